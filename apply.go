@@ -0,0 +1,549 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// The number of images being patched at the same time when neither the
+// manifest nor the command line say otherwise.
+const defaultConcurrency = 2
+
+// manifestEntry is an image to be patched as described in a manifest.
+type manifestEntry struct {
+	// The image to be patched and the name of the new image, which can be a
+	// template as accepted by the patch command.
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+
+	// The flags of the patch command.
+	Bugzilla              string `yaml:"bugzilla"`
+	CVE                   string `yaml:"cve"`
+	Date                  string `yaml:"date"`
+	Category              string `yaml:"category"`
+	Severity              string `yaml:"severity"`
+	NoRecommends          bool   `yaml:"no-recommends"`
+	AutoAgreeWithLicenses bool   `yaml:"auto-agree-with-licenses"`
+
+	// The author and the commit message of the new image. They default to
+	// the ones given at the top level of the manifest.
+	Author  string `yaml:"author"`
+	Message string `yaml:"message"`
+}
+
+// manifest describes a set of images to be patched by the apply command. For
+// example:
+//
+//	concurrency: 2
+//	author: Jane Doe <jane@example.com>
+//	images:
+//	  - source: opensuse:13.2
+//	    target: "{{.Repo}}:{{.Tag}}-patched"
+//	    category: security
+//	    no-recommends: true
+type manifest struct {
+	// The maximum number of images being patched at the same time.
+	Concurrency int `yaml:"concurrency"`
+
+	// The default author and commit message of the new images.
+	Author  string `yaml:"author"`
+	Message string `yaml:"message"`
+
+	Images []manifestEntry `yaml:"images"`
+}
+
+// readManifest reads and validates the manifest stored in the given path.
+func readManifest(path string) (*manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the manifest: %v", err)
+	}
+
+	m := &manifest{}
+	if err = yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Could not parse the manifest: %v", err)
+	}
+	if len(m.Images) == 0 {
+		return nil, fmt.Errorf("The manifest does not contain any image")
+	}
+	if m.Concurrency < 0 {
+		return nil, fmt.Errorf("The concurrency of the manifest cannot be negative")
+	}
+	for i, e := range m.Images {
+		if e.Source == "" || e.Target == "" {
+			return nil, fmt.Errorf("The image #%d of the manifest needs both a source and a target", i+1)
+		}
+	}
+	return m, nil
+}
+
+// manifestFlags are the flags of the patch command that can be given for each
+// image of a manifest.
+var manifestFlags = []cli.Flag{
+	cli.StringFlag{Name: "bugzilla"},
+	cli.StringFlag{Name: "cve"},
+	cli.StringFlag{Name: "date"},
+	cli.StringFlag{Name: "g, category"},
+	cli.StringFlag{Name: "severity"},
+	cli.BoolFlag{Name: "l, auto-agree-with-licenses"},
+	cli.BoolFlag{Name: "no-recommends"},
+	cli.StringFlag{Name: "author"},
+	cli.StringFlag{Name: "message"},
+}
+
+// args returns the command line arguments of the patch command that are
+// equivalent to this entry, flags included.
+func (e *manifestEntry) args() []string {
+	args := []string{"--author=" + e.Author, "--message=" + e.Message}
+
+	strs := []struct{ name, value string }{
+		{"--bugzilla", e.Bugzilla}, {"--cve", e.CVE}, {"--date", e.Date},
+		{"-g", e.Category}, {"--severity", e.Severity},
+	}
+	for _, s := range strs {
+		if s.value != "" {
+			args = append(args, s.name+"="+s.value)
+		}
+	}
+	if e.AutoAgreeWithLicenses {
+		args = append(args, "-l")
+	}
+	if e.NoRecommends {
+		args = append(args, "--no-recommends")
+	}
+	return append(args, e.Source, e.Target)
+}
+
+// context returns the context of a patch command invoked with the flags of
+// this entry. The given context is the one of the apply command.
+func (e *manifestEntry) context(parent *cli.Context) (*cli.Context, error) {
+	set := flag.NewFlagSet("patch", flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	for _, f := range manifestFlags {
+		f.Apply(set)
+	}
+	if err := set.Parse(e.args()); err != nil {
+		return nil, fmt.Errorf("Invalid flags for %s: %v", e.Source, err)
+	}
+
+	ctx := cli.NewContext(parent.App, set, parent)
+	ctx.Command = cli.Command{Name: "patch", Flags: manifestFlags}
+	return ctx, nil
+}
+
+// applyResult is the outcome of an entry of the manifest.
+type applyResult struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+
+	// The ID of the new image, if any.
+	ID string `json:"id,omitempty"`
+
+	// Either "patched", "tagged" (the image has been patched on behalf of
+	// another entry with the same source image and flags), "skipped" (there
+	// was nothing to be done) or "failed".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// applySummary is the summary of the apply command.
+type applySummary struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []applyResult `json:"results"`
+}
+
+// applyGroup contains the entries of the manifest that resolve to the same
+// source image and that share the same flags. They are patched only once.
+type applyGroup struct {
+	// The ID of the source image.
+	ID string
+
+	// The positions of the entries inside of the manifest.
+	entries []int
+}
+
+// groupEntries groups the entries of the given manifest by the ID of their
+// source image and by their flags. Entries whose source image cannot be found
+// are reported in the returned results.
+func groupEntries(m *manifest, results []applyResult) []*applyGroup {
+	groups := []*applyGroup{}
+	index := make(map[string]*applyGroup)
+
+	for i, e := range m.Images {
+		id, err := getImageID(e.Source)
+		if err != nil {
+			results[i].Status, results[i].Error = "failed", err.Error()
+			continue
+		}
+
+		// The key contains everything but the target.
+		key := e
+		key.Source, key.Target = id, ""
+		k := fmt.Sprintf("%#v", key)
+		if g, ok := index[k]; ok {
+			g.entries = append(g.entries, i)
+		} else {
+			g = &applyGroup{ID: id, entries: []int{i}}
+			index[k] = g
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// applyGroupEntries patches the source image of the given group and tags the
+// resulting image for each of its entries.
+func applyGroupEntries(g *applyGroup, m *manifest, ctx *cli.Context, results []applyResult) {
+	fail := func(entries []int, err error) {
+		for _, i := range entries {
+			results[i].Status, results[i].Error = "failed", err.Error()
+		}
+	}
+
+	first := m.Images[g.entries[0]]
+	pctx, err := first.context(ctx)
+	if err != nil {
+		fail(g.entries, err)
+		return
+	}
+	if err = checkSeveritySupport(g.ID, pctx); err != nil {
+		fail(g.entries, err)
+		return
+	}
+	targets := []string{}
+	for _, i := range g.entries {
+		targets = append(targets, m.Images[i].Target)
+	}
+	prov, err := inspectSource(first.Source, "patch", pctx, true)
+	if err != nil {
+		fail(g.entries, err)
+		return
+	}
+	id, name, err := commitFromSource(first.Source, first.Target, updatePatchCommand("patch", pctx), prov, pctx)
+	if err != nil {
+		fail(g.entries, err)
+		return
+	}
+	results[g.entries[0]] = applyResult{Source: first.Source, Target: name, ID: id, Status: "patched"}
+
+	names := map[string]bool{name: true}
+	for _, i := range g.entries[1:] {
+		e := m.Images[i]
+		if err = tagForEntry(g.ID, id, e, prov, names, &results[i]); err != nil {
+			fail([]int{i}, err)
+		}
+	}
+}
+
+// tagForEntry tags the image with the given id, which has been created out of
+// the image with the srcID ID, with the target of the given entry. The names
+// map contains the names already given to the new image, so entries asking
+// for the same name again are not tagged twice.
+func tagForEntry(srcID, id string, e manifestEntry, prov *provenance, names map[string]bool, result *applyResult) error {
+	// The name of the source image may be different among the entries.
+	p := *prov
+	if repo, tag, err := parseImageName(e.Source); err == nil {
+		p.Source = repo + ":" + tag
+	}
+
+	repo, tag, err := targetImageName(e.Target, &p)
+	if err != nil {
+		return err
+	}
+	if names[repo+":"+tag] {
+		*result = applyResult{Source: e.Source, Target: repo + ":" + tag, ID: id, Status: "tagged"}
+		return nil
+	}
+	if err = preventImageOverwrite(repo, tag); err != nil {
+		return err
+	}
+	if err = tagImage(id, repo, tag, false); err != nil {
+		return fmt.Errorf("Could not tag the new image as %s:%s: %v", repo, tag, err)
+	}
+	logAndPrintf("%s:%s successfully created\n", repo, tag)
+
+	names[repo+":"+tag] = true
+
+	cache := getCacheFile()
+	cache.recordUpdate(srcID, id, repo+":"+tag)
+
+	*result = applyResult{Source: e.Source, Target: repo + ":" + tag, ID: id, Status: "tagged"}
+	return nil
+}
+
+// applyManifest patches all the images of the given manifest, with at most
+// the given number of them being patched at the same time. It returns the
+// result of each entry of the manifest.
+func applyManifest(m *manifest, concurrency int, ctx *cli.Context) []applyResult {
+	results := make([]applyResult, len(m.Images))
+	for i, e := range m.Images {
+		results[i] = applyResult{Source: e.Source, Target: e.Target}
+	}
+
+	runGroups(groupEntries(m, results), concurrency, func(g *applyGroup) {
+		applyGroupEntries(g, m, ctx, results)
+	})
+	return results
+}
+
+// runGroups calls f for each of the given groups, with at most the given
+// number of calls running at the same time. Meanwhile, the output of the
+// builders is prefixed with the name of the image they work on.
+func runGroups(groups []*applyGroup, concurrency int, f func(*applyGroup)) {
+	if concurrency > 1 && len(groups) > 1 {
+		setPrefixedOutput(true)
+		defer setPrefixedOutput(false)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, concurrency)
+	for _, g := range groups {
+		wg.Add(1)
+		sem <- true
+		go func(g *applyGroup) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(g)
+		}(g)
+	}
+	wg.Wait()
+}
+
+// prefixedOutput tells whether several images are being patched at the same
+// time. In this case, every line printed by the builders is prefixed with the
+// name of the image it belongs to, so their output can be told apart.
+var prefixedOutput struct {
+	sync.Mutex
+	enabled bool
+}
+
+// setPrefixedOutput sets whether the output of the builders is prefixed.
+func setPrefixedOutput(enabled bool) {
+	prefixedOutput.Lock()
+	defer prefixedOutput.Unlock()
+
+	prefixedOutput.enabled = enabled
+}
+
+// builderOutput returns the writer to be used for the output of a builder
+// working on img, and a function to be called once the builder is done.
+func builderOutput(img string) (io.Writer, func()) {
+	prefixedOutput.Lock()
+	enabled := prefixedOutput.enabled
+	prefixedOutput.Unlock()
+
+	// Questions cannot be answered if they don't show up as they are.
+	if !enabled || interactiveMode() {
+		return os.Stdout, func() {}
+	}
+	w := &prefixWriter{w: os.Stdout, prefix: img + " | "}
+	return w, w.flush
+}
+
+// prefixWriter writes whole lines into w, each of them prefixed with the given
+// prefix. Every line is written at once, so the lines of different writers are
+// not mixed up.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+
+	// The current line, until it's complete.
+	line []byte
+}
+
+// Write implements the io.Writer interface.
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.line = append(p.line, b...)
+			break
+		}
+		p.line = append(p.line, b[:i+1]...)
+		if err := p.writeLine(); err != nil {
+			return n - len(b), err
+		}
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+// writeLine writes the current line, prefixed, into w.
+func (p *prefixWriter) writeLine() error {
+	prefixedOutput.Lock()
+	defer prefixedOutput.Unlock()
+
+	_, err := p.w.Write(append([]byte(p.prefix), p.line...))
+	p.line = p.line[:0]
+	return err
+}
+
+// flush writes the last line, if it was not complete.
+func (p *prefixWriter) flush() {
+	if len(p.line) == 0 {
+		return
+	}
+	p.line = append(p.line, '\n')
+	if err := p.writeLine(); err != nil {
+		log.Print(err)
+	}
+}
+
+// summarize returns the summary of the given results.
+func summarize(results []applyResult) applySummary {
+	summary := applySummary{Total: len(results), Results: results}
+	for _, r := range results {
+		if r.Status == "failed" {
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+	}
+	return summary
+}
+
+// printResults prints a table with the given results.
+func printResults(results []applyResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tTARGET\tIMAGE ID\tSTATUS\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Source, r.Target, shortImageID(r.ID), r.Status, r.Error)
+	}
+	_ = w.Flush()
+}
+
+// writeSummary writes the given summary in JSON format to the given path, or
+// to the standard output if the path is "-".
+func writeSummary(summary applySummary, path string) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// applyManifestFile patches the images listed in the manifest stored in the
+// given path, and returns the result of each of them.
+func applyManifestFile(path string, ctx *cli.Context) ([]applyResult, error) {
+	m, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.Images {
+		e := &m.Images[i]
+		if e.Author == "" {
+			e.Author = m.Author
+		}
+		if e.Author == "" {
+			e.Author = defaultCommitAuthor()
+		}
+		if e.Message == "" {
+			e.Message = m.Message
+		}
+		if e.Message == "" {
+			e.Message = "[zypper-docker] patch"
+		}
+	}
+
+	concurrency := ctx.Int("concurrency")
+	if concurrency <= 0 {
+		concurrency = m.Concurrency
+	}
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	return applyManifest(m, concurrency, ctx), nil
+}
+
+// applyPlanFile applies the plan stored in the given path, and returns the
+// result of each of its images.
+func applyPlanFile(path string, ctx *cli.Context) ([]applyResult, error) {
+	p, err := readPlan(path)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := ctx.Int("concurrency")
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	return applyPlan(p, concurrency, ctx), nil
+}
+
+// zypper-docker apply [flags]
+func applyCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 0 {
+		logAndFatalf("Wrong invocation: expected 0 arguments, %d given.\n", len(ctx.Args()))
+		return
+	}
+	file, planFile := ctx.String("file"), ctx.String("plan")
+	if (file == "") == (planFile == "") {
+		logAndFatalf("Wrong invocation: either a manifest (-f) or a plan (--plan) has to be given.\n")
+		return
+	}
+
+	var results []applyResult
+	var err error
+	if file != "" {
+		results, err = applyManifestFile(file, ctx)
+	} else {
+		results, err = applyPlanFile(planFile, ctx)
+	}
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+
+	for _, r := range results {
+		if r.Status == "failed" {
+			log.Printf("Could not patch %s into %s: %s", r.Source, r.Target, r.Error)
+		}
+	}
+	printResults(results)
+	summary := summarize(results)
+	if path := ctx.String("summary"); path != "" {
+		if err = writeSummary(summary, path); err != nil {
+			logAndPrintf("Could not write the summary: %v.\n", err)
+			exitWithCode(1)
+			return
+		}
+	}
+	if summary.Failed > 0 {
+		exitWithCode(1)
+	}
+}
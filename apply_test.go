@@ -0,0 +1,283 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+// writeManifest writes the given contents into a temporary file. It returns
+// its path and a function that removes it.
+func writeManifest(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "zypper-docker-manifest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	path := filepath.Join(dir, "patches.yaml")
+	if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Could not write the manifest: %v", err)
+	}
+	return path, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		contents, err string
+	}{
+		{"images: [", "Could not parse the manifest"},
+		{"author: me", "The manifest does not contain any image"},
+		{"concurrency: -1\nimages:\n  - source: a\n    target: b", "cannot be negative"},
+		{"images:\n  - source: a\n  - source: b\n    target: c", "The image #1 of the manifest needs both a source and a target"},
+	}
+
+	for _, test := range tests {
+		path, cleanup := writeManifest(t, test.contents)
+		_, err := readManifest(path)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error '%s', got: %v", test.err, err)
+		}
+	}
+
+	if _, err := readManifest("/does/not/exist"); err == nil {
+		t.Fatal("It should fail on missing files")
+	}
+
+	path, cleanup := writeManifest(t, `
+concurrency: 3
+author: me
+images:
+  - source: opensuse:13.2
+    target: "{{.Repo}}:{{.Tag}}-patched"
+    category: security
+    no-recommends: true
+`)
+	defer cleanup()
+	m, err := readManifest(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Concurrency != 3 || m.Author != "me" || len(m.Images) != 1 {
+		t.Fatalf("Wrong manifest: %+v", m)
+	}
+	e := m.Images[0]
+	if e.Source != "opensuse:13.2" || e.Target != "{{.Repo}}:{{.Tag}}-patched" ||
+		e.Category != "security" || !e.NoRecommends || e.AutoAgreeWithLicenses {
+		t.Fatalf("Wrong entry: %+v", e)
+	}
+}
+
+func TestManifestEntryContext(t *testing.T) {
+	e := manifestEntry{
+		Source:                "opensuse:13.2",
+		Target:                "new:1.0",
+		CVE:                   "CVE-2016-1234",
+		Category:              "security",
+		AutoAgreeWithLicenses: true,
+		Author:                "me",
+		Message:               "msg",
+	}
+	ctx, err := e.context(testContext([]string{}, false))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cmd := updatePatchSubcommand("-n patch", ctx)
+	if cmd != "-n patch --cve=CVE-2016-1234 -g security -l" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+	if ctx.String("author") != "me" || ctx.String("message") != "msg" {
+		t.Fatalf("Wrong author or message: %s, %s", ctx.String("author"), ctx.String("message"))
+	}
+	if args := ctx.Args(); len(args) != 2 || args[0] != "opensuse:13.2" || args[1] != "new:1.0" {
+		t.Fatalf("Wrong arguments: %v", args)
+	}
+}
+
+func TestApplyCommand(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	path, cleanup := writeManifest(t, `
+concurrency: 1
+images:
+  - source: opensuse:latest
+    target: new:1.0
+  - source: unknown:1.0
+    target: new:2.0
+  - source: opensuse:tag
+    target: "{{.Repo}}:{{.Tag}}-patched"
+  - source: opensuse:13.2
+    target: opensuse:latest
+`)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-summary")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	summaryPath := filepath.Join(dir, "summary.json")
+
+	setupTestExitStatus()
+	mc := &mockClient{}
+	safeClient.client = mc
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	captured := capture.All(func() { applyCmd(commandContext("apply", "--file", path, "--summary", summaryPath)) })
+
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %d", lastCode)
+	}
+	stdout := string(captured.Stdout)
+	for _, line := range []string{"new:1.0 successfully created", "opensuse:tag-patched successfully created"} {
+		if !strings.Contains(stdout, line) {
+			t.Fatalf("Expected '%s' in stdout: %s", line, stdout)
+		}
+	}
+	if n := strings.Count(mc.lastCommit.Comment, "[zypper-docker] patch"); n != 1 {
+		t.Fatalf("Wrong commit message: %s", mc.lastCommit.Comment)
+	}
+	if err = compareStringSlices(mc.tags, []string{"fake image ID=opensuse:tag-patched"}); err != nil {
+		t.Fatalf("The duplicated source should have been tagged: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(summaryPath)
+	if err != nil {
+		t.Fatalf("Could not read the summary: %v", err)
+	}
+	var summary applySummary
+	if err = json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Could not decode the summary: %v", err)
+	}
+	if summary.Total != 4 || summary.Succeeded != 2 || summary.Failed != 2 {
+		t.Fatalf("Wrong summary: %+v", summary)
+	}
+	expected := []string{"patched", "failed", "tagged", "failed"}
+	for i, r := range summary.Results {
+		if r.Status != expected[i] {
+			t.Fatalf("Expected %s for %s, got %s (%s)", expected[i], r.Source, r.Status, r.Error)
+		}
+	}
+	if summary.Results[1].Error != "Cannot find image unknown:1.0" {
+		t.Fatalf("Wrong error: %s", summary.Results[1].Error)
+	}
+	if !strings.Contains(summary.Results[3].Error, "Cannot overwrite an existing image") {
+		t.Fatalf("Wrong error: %s", summary.Results[3].Error)
+	}
+	if summary.Results[2].Target != "opensuse:tag-patched" || summary.Results[2].ID != "fake image ID" {
+		t.Fatalf("Wrong result: %+v", summary.Results[2])
+	}
+
+	cache := getCacheFile()
+	if record := cache.imageRecord("fake image ID"); record == nil || record.Source != "1" ||
+		compareStringSlices(record.Names, []string{"new:1.0", "opensuse:tag-patched"}) != nil {
+		t.Fatalf("Wrong cache record: %+v", record)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := bytes.NewBuffer([]byte{})
+	w := &prefixWriter{w: out, prefix: "opensuse:13.2 | "}
+	for _, s := range []string{"Refreshing", " repositories\nInstalling", "\n\nDone"} {
+		if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Unexpected write (%d): %v", n, err)
+		}
+	}
+	w.flush()
+	expected := "opensuse:13.2 | Refreshing repositories\nopensuse:13.2 | Installing\nopensuse:13.2 | \nopensuse:13.2 | Done\n"
+	if out.String() != expected {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+}
+
+func TestApplyConcurrentOutput(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	path, cleanup := writeManifest(t, `images:
+- source: opensuse:13.2
+  target: new:1.0
+- source: ubuntu:latest
+  target: new:2.0
+`)
+	defer cleanup()
+	m, err := readManifest(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	safeClient.client = &mockClient{logOutput: "zypper output"}
+	var results []applyResult
+	captured := capture.All(func() { results = applyManifest(m, 2, testContext([]string{}, false)) })
+	for _, r := range results {
+		if r.Status != "patched" {
+			t.Fatalf("Wrong result: %+v", r)
+		}
+	}
+	stdout := string(captured.Stdout)
+	if !strings.Contains(stdout, "opensuse:13.2 | zypper output\n") || !strings.Contains(stdout, "ubuntu:latest | zypper output\n") {
+		t.Fatalf("The output should have been prefixed: %s", stdout)
+	}
+
+	// Images patched one at a time do not need it.
+	safeClient.client = &mockClient{logOutput: "zypper output"}
+	captured = capture.All(func() { results = applyManifest(m, 1, testContext([]string{}, false)) })
+	if strings.Contains(string(captured.Stdout), " | ") {
+		t.Fatalf("The output should not have been prefixed: %s", captured.Stdout)
+	}
+}
+
+func TestApplySeverityNotSupported(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	path, cleanup := writeManifest(t, `images:
+- source: opensuse:13.2
+  target: new:1.0
+  severity: important
+- source: opensuse:latest
+  target: new:2.0
+`)
+	defer cleanup()
+	m, err := readManifest(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	safeClient.client = &mockClient{zypperBadVersion: true}
+	var results []applyResult
+	capture.All(func() { results = applyManifest(m, 1, testContext([]string{}, false)) })
+	if r := results[0]; r.Status != "failed" || r.Error != errSeverityUnsupported.Error() {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	if r := results[1]; r.Status != "patched" {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+}
+
+func TestApplyCommandWrongInvocation(t *testing.T) {
+	setupTestExitStatus()
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { applyCmd(commandContext("apply")) })
+	if lastCode != 1 || !strings.Contains(buffer.String(), "either a manifest (-f) or a plan (--plan) has to be given") {
+		t.Fatalf("Wrong result (%d): %s", lastCode, buffer.String())
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/engine-api/types"
+)
+
+// The repository holding the temporary images of the patch-archive command.
+const archiveRepository = "zypper-docker-archive"
+
+// renameArchiveImage copies the given archive, as produced by `docker save`,
+// into w while naming its only image as ref. It returns the name that the
+// image had in the given archive, which is empty if it had none.
+func renameArchiveImage(r io.Reader, w io.Writer, ref string) (string, error) {
+	repo, tag, err := parseImageName(ref)
+	if err != nil {
+		return "", err
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	name, found := "", false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("could not read the archive: %v", err)
+		}
+
+		var data []byte
+		switch strings.TrimPrefix(hdr.Name, "./") {
+		case "manifest.json":
+			if name, data, err = renameManifest(tr, ref); err != nil {
+				return "", err
+			}
+			found = true
+		case "repositories":
+			// The legacy format: {"repo": {"tag": "id"}}.
+			repos := make(map[string]map[string]string)
+			if err = json.NewDecoder(tr).Decode(&repos); err != nil {
+				return "", fmt.Errorf("could not read the repositories of the archive: %v", err)
+			}
+			id := ""
+			for _, tags := range repos {
+				for _, v := range tags {
+					id = v
+				}
+			}
+			if data, err = json.Marshal(map[string]map[string]string{repo: {tag: id}}); err != nil {
+				return "", err
+			}
+		}
+
+		if data != nil {
+			hdr.Size = int64(len(data))
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+		if data != nil {
+			_, err = tw.Write(data)
+		} else {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !found {
+		return "", fmt.Errorf("unsupported archive: it has no manifest.json file")
+	}
+	return name, tw.Close()
+}
+
+// renameManifest returns the first name of the image of the given manifest,
+// and the manifest itself with the image renamed as ref.
+func renameManifest(r io.Reader, ref string) (string, []byte, error) {
+	// Unknown fields have to be kept.
+	var manifests []map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&manifests); err != nil {
+		return "", nil, fmt.Errorf("could not read the manifest of the archive: %v", err)
+	}
+	if len(manifests) != 1 {
+		return "", nil, fmt.Errorf("the archive has to contain exactly one image, it has %d", len(manifests))
+	}
+
+	name := ""
+	if raw, ok := manifests[0]["RepoTags"]; ok {
+		var tags []string
+		if err := json.Unmarshal(raw, &tags); err == nil && len(tags) > 0 {
+			name = tags[0]
+		}
+	}
+	tags, err := json.Marshal([]string{ref})
+	if err != nil {
+		return "", nil, err
+	}
+	manifests[0]["RepoTags"] = tags
+	data, err := json.Marshal(manifests)
+	return name, data, err
+}
+
+// archiveSession keeps track of the temporary images used to patch an
+// archive, so they can be removed once done.
+type archiveSession struct {
+	// The temporary references of the loaded image and of the patched one.
+	in, out string
+
+	once sync.Once
+}
+
+// newArchiveSession returns a session with unique temporary references.
+func newArchiveSession() *archiveSession {
+	id := time.Now().UnixNano()
+	return &archiveSession{
+		in:  fmt.Sprintf("%s:%d-in", archiveRepository, id),
+		out: fmt.Sprintf("%s:%d-out", archiveRepository, id),
+	}
+}
+
+// load loads the archive stored in the given path as the temporary input
+// image. It returns the name of the image in the archive.
+func (s *archiveSession) load(path string) (string, error) {
+	client := getDockerClient()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	type result struct {
+		name string
+		err  error
+	}
+	done := make(chan result, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		name, err := renameArchiveImage(file, pw, s.in)
+		_ = pw.CloseWithError(err)
+		done <- result{name, err}
+	}()
+	resp, err := client.ImageLoad(pr)
+	_ = pr.Close()
+	res := <-done
+	if err == nil && res.err != nil {
+		_ = resp.Body.Close()
+		err = res.err
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not load %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.JSON {
+		err = jsonmessage.DisplayJSONMessagesStream(resp.Body, ioutil.Discard, 0, false, nil)
+	} else {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not load %s: %v", path, err)
+	}
+	return res.name, nil
+}
+
+// save saves the temporary output image, named as ref, into the given path.
+// The archive is written into a temporary file next to it, which then replaces
+// it, so the given path is never left with a partial archive.
+func (s *archiveSession) save(path, ref string) error {
+	client := getDockerClient()
+
+	body, err := client.ImageSave([]string{s.out})
+	if err != nil {
+		return fmt.Errorf("could not save the new image: %v", err)
+	}
+	defer body.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("could not save the new image: %v", err)
+	}
+	onExit(func() { _ = os.Remove(tmp.Name()) })
+	_, err = renameArchiveImage(body, tmp, ref)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not save the new image: %v", err)
+	}
+	return nil
+}
+
+// cleanup removes the temporary images, and the containers that might still
+// be based on them if the command has been interrupted. It's safe to call it
+// more than once.
+func (s *archiveSession) cleanup() {
+	s.once.Do(func() {
+		client := getDockerClient()
+
+		if containers, err := client.ContainerList(types.ContainerListOptions{All: true}); err == nil {
+			for _, c := range containers {
+				if c.Image == s.in || c.Image == s.out {
+					removeContainer(c.ID)
+				}
+			}
+		}
+		// The images might not have been created at all, so errors are
+		// ignored.
+		for _, ref := range []string{s.out, s.in} {
+			_ = untagImage(ref)
+		}
+	})
+}
+
+// parseRef returns the repository and the tag of the given reference, which
+// is known to be valid.
+func parseRef(ref string) (string, string) {
+	repo, tag, _ := parseImageName(ref)
+	return repo, tag
+}
+
+// patchArchive patches the only image of the archive stored in the in path,
+// and saves the new image into the out path. The images are only loaded into
+// the daemon under temporary references.
+func patchArchive(in, out string, ctx *cli.Context) (string, error) {
+	s := newArchiveSession()
+	onExit(s.cleanup)
+	defer s.cleanup()
+
+	// Nothing is left behind on Ctrl-C.
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-killChannel:
+			exitWithCode(1)
+		case <-done:
+		}
+	}()
+
+	name, err := s.load(in)
+	if err != nil {
+		return "", err
+	}
+	target := ctx.String("target")
+	if target == "" {
+		if name == "" {
+			return "", fmt.Errorf("the image of %s has no name, so the --target flag has to be given", in)
+		}
+		target = name
+	}
+
+	prov, err := inspectSource(s.in, "patch", ctx, true)
+	if err != nil {
+		return "", err
+	}
+	if name != "" {
+		prov.Source = name
+	} else if isTemplate(target) {
+		return "", fmt.Errorf("the image of %s has no name, so the --target flag cannot be a template", in)
+	}
+	cmd, err := patchCommand("patch", prov, ctx)
+	if err != nil {
+		return "", err
+	}
+	repo, tag, err := targetImageName(target, prov)
+	if err != nil {
+		return "", err
+	}
+
+	comment, err := renderMessage(ctx.String("message"), repo+":"+tag, prov)
+	if err != nil {
+		return "", err
+	}
+	build, err := newImageBuilder(ctx)
+	if err != nil {
+		return "", err
+	}
+	outRepo, outTag := parseRef(s.out)
+	if _, err = build(s.in, outRepo, outTag, cmd, comment,
+		ctx.String("author"), prov); err != nil {
+		return "", fmt.Errorf("Could not commit to the new image: %v", err)
+	}
+
+	if err = s.save(out, repo+":"+tag); err != nil {
+		return "", err
+	}
+	return repo + ":" + tag, nil
+}
+
+// zypper-docker patch-archive [flags] <in.tar> <out.tar>
+func patchArchiveCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 2 {
+		logAndFatalf("Wrong invocation: expected 2 arguments, %d given.\n", len(ctx.Args()))
+		return
+	}
+	if err := checkPatchSelection(ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	in, out := ctx.Args()[0], ctx.Args()[1]
+
+	name, err := patchArchive(in, out, ctx)
+	if err != nil {
+		logAndFatalf("Could not patch %s: %v.\n", in, err)
+		return
+	}
+	logAndPrintf("%s saved to %s\n", name, out)
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+// manifestTags returns the RepoTags of the only image of the given archive.
+func manifestTags(t *testing.T, data []byte) []string {
+	var manifests []savedManifest
+	files := readArchive(t, data)
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifests); err != nil || len(manifests) != 1 {
+		t.Fatalf("Wrong manifest (%v): %s", err, files["manifest.json"])
+	}
+	return manifests[0].RepoTags
+}
+
+// setupArchive writes the given archive into a temporary directory. It returns
+// the directory and a function that removes it.
+func setupArchive(t *testing.T, data []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "zypper-docker-archive")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "in.tar"), data, 0644); err != nil {
+		t.Fatalf("Could not write the archive: %v", err)
+	}
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestRenameArchiveImage(t *testing.T) {
+	data := newArchive(t, map[string]string{
+		"manifest.json": `[{"Config":"cfg.json","RepoTags":["opensuse:13.2"],"Layers":[],"Extra":1}]`,
+		"repositories":  `{"opensuse":{"13.2":"abc"}}`,
+		"cfg.json":      "{}",
+	})
+
+	buf := bytes.NewBuffer([]byte{})
+	name, err := renameArchiveImage(bytes.NewReader(data), buf, "new:1.0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if name != "opensuse:13.2" {
+		t.Fatalf("Wrong name: %s", name)
+	}
+	files := readArchive(t, buf.Bytes())
+	if !strings.Contains(files["manifest.json"], `"RepoTags":["new:1.0"]`) ||
+		!strings.Contains(files["manifest.json"], `"Extra":1`) {
+		t.Fatalf("Wrong manifest: %s", files["manifest.json"])
+	}
+	if files["repositories"] != `{"new":{"1.0":"abc"}}` || files["cfg.json"] != "{}" {
+		t.Fatalf("Wrong archive: %v", files)
+	}
+
+	tests := []struct {
+		files map[string]string
+		err   string
+	}{
+		{map[string]string{"cfg.json": "{}"}, "no manifest.json file"},
+		{map[string]string{"manifest.json": "[{},{}]"}, "exactly one image, it has 2"},
+		{map[string]string{"manifest.json": "{"}, "could not read the manifest"},
+	}
+	for _, test := range tests {
+		_, err = renameArchiveImage(bytes.NewReader(newArchive(t, test.files)), ioutil.Discard, "new:1.0")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected '%s', got: %v", test.err, err)
+		}
+	}
+}
+
+func TestPatchArchive(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	dir, cleanup := setupArchive(t, savedImage(t))
+	defer cleanup()
+
+	mc := &mockClient{savedImage: savedImage(t)}
+	safeClient.client = mc
+	out := filepath.Join(dir, "out.tar")
+	setupTestExitStatus()
+	captured := capture.All(func() {
+		patchArchiveCmd(commandContext("patch-archive", "--author", "me", "--message", "msg", filepath.Join(dir, "in.tar"), out))
+	})
+	if lastCode != 0 {
+		t.Fatalf("Unexpected failure: %s", captured.Stdout)
+	}
+	if !strings.Contains(string(captured.Stdout), "opensuse:13.2 saved to "+out) {
+		t.Fatalf("Wrong output: %s", captured.Stdout)
+	}
+
+	tags := manifestTags(t, mc.loadedImage)
+	if len(tags) != 1 || !strings.HasPrefix(tags[0], archiveRepository+":") {
+		t.Fatalf("The image should have been loaded under a temporary name: %v", tags)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("The new archive should have been written: %v", err)
+	}
+	if err = compareStringSlices(manifestTags(t, data), []string{"opensuse:13.2"}); err != nil {
+		t.Fatalf("Wrong name for the new image: %v", err)
+	}
+	if info, err := os.Stat(out); err != nil {
+		t.Fatalf("Could not stat the new archive: %v", err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Fatalf("Wrong permissions for the new archive: %v", info.Mode())
+	}
+
+	in := tags[0]
+	expected := []string{strings.TrimSuffix(in, "-in") + "-out", in}
+	if err = compareStringSlices(mc.removedImages, expected); err != nil {
+		t.Fatalf("The temporary images should have been removed: %v", err)
+	}
+	// The images they have been built on should be removed as well.
+	if err = compareStringSlices(mc.prunedImages, expected); err != nil {
+		t.Fatalf("The untagged parents should have been removed: %v", err)
+	}
+	if !strings.Contains(mc.lastCommit.Comment, "msg") || mc.lastCommit.Author != "me" {
+		t.Fatalf("Wrong commit: %+v", mc.lastCommit)
+	}
+}
+
+func TestPatchArchiveWithTarget(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	dir, cleanup := setupArchive(t, savedImage(t))
+	defer cleanup()
+
+	safeClient.client = &mockClient{savedImage: savedImage(t)}
+	out := filepath.Join(dir, "out.tar")
+	var (
+		name string
+		err  error
+	)
+	capture.All(func() {
+		name, err = patchArchive(filepath.Join(dir, "in.tar"), out, commandContext("patch-archive", "--target", "{{.Repo}}:{{.Tag}}-patched"))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if name != "opensuse:13.2-patched" {
+		t.Fatalf("Wrong name: %s", name)
+	}
+	data, _ := ioutil.ReadFile(out)
+	if err = compareStringSlices(manifestTags(t, data), []string{name}); err != nil {
+		t.Fatalf("Wrong name for the new image: %v", err)
+	}
+}
+
+func TestPatchArchiveFailures(t *testing.T) {
+	unnamed := newArchive(t, map[string]string{"manifest.json": `[{"Config":"cfg.json","Layers":[]}]`})
+	multiple := newArchive(t, map[string]string{"manifest.json": `[{"RepoTags":["a:1"]},{"RepoTags":["b:1"]}]`})
+
+	tests := []struct {
+		in     []byte
+		target string
+		mc     *mockClient
+		err    string
+	}{
+		{multiple, "", &mockClient{}, "exactly one image, it has 2"},
+		{savedImage(t), "", &mockClient{loadFail: true}, "Load failed"},
+		{unnamed, "", &mockClient{}, "the --target flag has to be given"},
+		{unnamed, "{{.Tag}}", &mockClient{}, "the --target flag cannot be a template"},
+		{savedImage(t), "", &mockClient{}, "could not save the new image: Save failed"},
+		{savedImage(t), "", &mockClient{inspectFail: true}, "inspect fail"},
+	}
+
+	for _, test := range tests {
+		dir, cleanup := setupArchive(t, test.in)
+		safeClient.client = test.mc
+		out := filepath.Join(dir, "out.tar")
+		var err error
+		capture.All(func() {
+			_, err = patchArchive(filepath.Join(dir, "in.tar"), out, commandContext("patch-archive", "--target", test.target))
+		})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected '%s', got: %v", test.err, err)
+		}
+		if _, err = os.Stat(out); !os.IsNotExist(err) {
+			t.Fatalf("The new archive should not have been written: %v", err)
+		}
+		if len(test.mc.removedImages) != 2 {
+			t.Fatalf("The temporary images should have been removed: %v", test.mc.removedImages)
+		}
+		cleanup()
+	}
+}
+
+func TestPatchArchiveSaveFailure(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	dir, cleanup := setupArchive(t, savedImage(t))
+	defer cleanup()
+	out := filepath.Join(dir, "out.tar")
+	if err := ioutil.WriteFile(out, []byte("previous"), 0644); err != nil {
+		t.Fatalf("Could not write the previous archive: %v", err)
+	}
+
+	// The image is loaded fine, but the saved archive is broken.
+	mc := &mockClient{savedImage: savedImage(t)}
+	safeClient.client = mc
+	var err error
+	capture.All(func() {
+		s := newArchiveSession()
+		defer s.cleanup()
+		if _, err = s.load(filepath.Join(dir, "in.tar")); err == nil {
+			mc.savedImage = []byte("garbage")
+			err = s.save(out, "opensuse:13.2")
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "could not save the new image") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The previous archive is kept, and nothing else is left behind.
+	if data, _ := ioutil.ReadFile(out); string(data) != "previous" {
+		t.Fatalf("The previous archive should have been kept: %s", data)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("Temporary files have been left behind: %v", files)
+	}
+}
+
+func TestPatchArchiveWrongInvocation(t *testing.T) {
+	setupTestExitStatus()
+	capture.All(func() { patchArchiveCmd(commandContext("patch-archive", "in.tar")) })
+	if lastCode != 1 {
+		t.Fatalf("Expected to have failed with 1, got: %d", lastCode)
+	}
+}
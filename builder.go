@@ -0,0 +1,254 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+	"github.com/docker/engine-api/types"
+)
+
+// The ways in which new images can be created.
+const (
+	// A helper container runs the zypper commands and it's then committed.
+	commitBuilder = "commit"
+
+	// A Dockerfile running the zypper commands is built by the daemon.
+	dockerfileBuilder = "dockerfile"
+)
+
+// imageBuilder runs the given zypper commands on img and stores the result
+// into repo:tag, with the given commit message and author, and labeled after
+// the given provenance (which might be nil). It returns the ID of the new
+// image.
+type imageBuilder func(img, repo, tag, cmd, comment, author string, prov *provenance) (string, error)
+
+// newImageBuilder returns the builder selected with the `--builder` flag.
+func newImageBuilder(ctx *cli.Context) (imageBuilder, error) {
+	path := ctx.String("dockerfile")
+	switch builder := ctx.String("builder"); builder {
+	case "", commitBuilder:
+		if path != "" {
+			return nil, fmt.Errorf("The --dockerfile flag can only be used with --builder=%s", dockerfileBuilder)
+		}
+		if helperImage() != "" {
+			return runCommandWithHelper, nil
+		}
+		return runCommandAndCommitToImage, nil
+	case dockerfileBuilder:
+		if helperImage() != "" {
+			return nil, fmt.Errorf("The --helper-image flag cannot be used with --builder=%s", dockerfileBuilder)
+		}
+		if ctx.Bool("interactive") {
+			return nil, fmt.Errorf("The --interactive flag cannot be used with --builder=%s", dockerfileBuilder)
+		}
+		return func(img, repo, tag, cmd, comment, author string, prov *provenance) (string, error) {
+			return buildDockerfileImage(img, repo, tag, cmd, comment, author, prov, path)
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown builder '%s', it has to be either '%s' or '%s'",
+			builder, commitBuilder, dockerfileBuilder)
+	}
+}
+
+// tolerantCommand returns the given shell command, but making it fail only on
+// the exit codes of zypper that are severe. This way, the Dockerfile builder
+// accepts the same results as the commit one.
+func tolerantCommand(cmd string) string {
+	codes := []string{}
+	for code := zypperExitInfUpdateNeeded; code <= zypperExitOnSignal; code++ {
+		if !isZypperExitCodeSevere(code) {
+			codes = append(codes, strconv.Itoa(code))
+		}
+	}
+	return fmt.Sprintf("%s || { status=$?; case $status in %s) ;; *) exit $status ;; esac; }",
+		cmd, strings.Join(codes, "|"))
+}
+
+// quoteDockerfileValue returns the given value as a double-quoted string that
+// can be used in Dockerfile instructions such as LABEL.
+func quoteDockerfileValue(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", " ")
+	return `"` + r.Replace(value) + `"`
+}
+
+// generateDockerfile returns a Dockerfile that runs the given zypper commands
+// on top of img. The user is the one the source image runs as, which has to
+// be restored after running zypper as root. Builds cannot set the comment of
+// the history of the new image, so the given one is kept as a label instead.
+func generateDockerfile(img, user, cmd, comment, author string, labels map[string]string) (string, error) {
+	buf := bytes.NewBuffer([]byte{})
+
+	if comment = strings.TrimSpace(comment); comment != "" {
+		for _, line := range strings.Split(comment, "\n") {
+			fmt.Fprintf(buf, "# %s\n", line)
+		}
+		labels = mergeLabels(labels, map[string]string{messageLabel: comment})
+	}
+	fmt.Fprintf(buf, "FROM %s\n", img)
+	if author != "" {
+		fmt.Fprintf(buf, "MAINTAINER %s\n", author)
+	}
+
+	buf.WriteString(labelInstruction(labels))
+
+	// The exec form does not depend on the SHELL of the source image.
+	run, err := json.Marshal([]string{"/bin/sh", "-c", tolerantCommand(cmd)})
+	if err != nil {
+		return "", err
+	}
+	root := user == "" || user == "root" || user == rootUser || strings.HasPrefix(user, "0:")
+	if !root {
+		fmt.Fprintf(buf, "USER %s\n", rootUser)
+	}
+	fmt.Fprintf(buf, "RUN %s\n", run)
+	if !root {
+		fmt.Fprintf(buf, "USER %s\n", user)
+	}
+	return buf.String(), nil
+}
+
+// labelInstruction returns the LABEL instruction that sets the given labels,
+// or an empty string if there are none.
+func labelInstruction(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+quoteDockerfileValue(labels[k]))
+	}
+	return fmt.Sprintf("LABEL %s\n", strings.Join(pairs, " \\\n      "))
+}
+
+// buildContext returns a build context containing only the given Dockerfile.
+func buildContext(dockerfile string) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer([]byte{})
+	tw := tar.NewWriter(buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "Dockerfile",
+		Mode:     0644,
+		Size:     int64(len(dockerfile)),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write([]byte(dockerfile))
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	return buf, err
+}
+
+// buildDockerfileImage behaves like runCommandAndCommitToImage, but the new
+// image is built by the daemon from a generated Dockerfile. If path is not
+// empty, the Dockerfile is also written there. The labels listing the patches
+// applied by zypper can only be known once it has run, so they are set by
+// building a second image on top of the first one. The first image is then
+// left untagged, and it's removed by the daemon along with the new one (see
+// `untagImage`).
+func buildDockerfileImage(img, repo, tag, cmd, comment, author string, prov *provenance, path string) (string, error) {
+	client := getDockerClient()
+
+	info, raw, err := client.ImageInspectWithRaw(img, false)
+	if err != nil {
+		return "", fmt.Errorf("could not inspect image '%s': %v", img, err)
+	}
+	// ONBUILD triggers would be run, and then lost, by the build.
+	parent, err := decodeImageConfig(info, raw)
+	if err != nil {
+		return "", err
+	}
+	if len(parent.OnBuild) > 0 {
+		return "", fmt.Errorf("the image '%s' has ONBUILD triggers, which cannot be kept by the %s builder",
+			img, dockerfileBuilder)
+	}
+
+	user := ""
+	if info.Config != nil {
+		user = info.Config.User
+	}
+	dockerfile, err := generateDockerfile(img, user, cmd, comment, author, prov.labels())
+	if err != nil {
+		return "", err
+	}
+	if path != "" {
+		if err = ioutil.WriteFile(path, []byte(dockerfile), 0644); err != nil {
+			return "", fmt.Errorf("could not write the Dockerfile: %v", err)
+		}
+		logAndPrintf("Dockerfile written to %s\n", path)
+	}
+
+	out, done := builderOutput(img)
+	defer done()
+	scanner := newPatchScanner(out)
+	id, err := buildImage(dockerfile, repo+":"+tag, scanner)
+	if err != nil {
+		return "", err
+	}
+	if applied := prov.appliedLabels(scanner.patches); len(applied) > 0 {
+		return buildImage(fmt.Sprintf("FROM %s\n%s", id, labelInstruction(applied)), repo+":"+tag, out)
+	}
+	return id, nil
+}
+
+// buildImage builds the given Dockerfile into the image with the given name,
+// showing the output of the build on out. It returns the ID of the new image.
+func buildImage(dockerfile, name string, out io.Writer) (string, error) {
+	client := getDockerClient()
+
+	buildCtx, err := buildContext(dockerfile)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.ImageBuild(types.ImageBuildOptions{
+		Tags:        []string{name},
+		Remove:      true,
+		ForceRemove: true,
+		Context:     buildCtx,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not build the new image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	fd, isTerminal := term.GetFdInfo(os.Stdout)
+	if err = jsonmessage.DisplayJSONMessagesStream(resp.Body, out, fd, isTerminal, nil); err != nil {
+		return "", fmt.Errorf("could not build the new image: %v", err)
+	}
+
+	info, _, err := client.ImageInspectWithRaw(name, false)
+	if err != nil {
+		return "", fmt.Errorf("could not inspect the new image: %v", err)
+	}
+	return info.ID, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+func TestTolerantCommand(t *testing.T) {
+	cmd := tolerantCommand("zypper ref")
+	expected := "zypper ref || { status=$?; case $status in 100|101|102|103|105) ;; *) exit $status ;; esac; }"
+	if cmd != expected {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
+
+func TestGenerateDockerfile(t *testing.T) {
+	labels := map[string]string{"b": `say "$HOME"`, "a": "1"}
+	dockerfile, err := generateDockerfile("opensuse:13.2", "nobody", "zypper ref", "first\nsecond", "me", labels)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `# first
+# second
+FROM opensuse:13.2
+MAINTAINER me
+LABEL a="1" \
+      b="say \"\$HOME\"" \
+      com.suse.zypper-docker.message="first second"
+USER 0:0
+RUN ["/bin/sh","-c","` + strings.Replace(tolerantCommand("zypper ref"), `"`, `\"`, -1) + `"]
+USER nobody
+`
+	if dockerfile != expected {
+		t.Fatalf("Wrong Dockerfile:\n%s", dockerfile)
+	}
+
+	// Images running as root do not need to switch users.
+	for _, user := range []string{"", "root", "0:0"} {
+		dockerfile, _ = generateDockerfile("opensuse:13.2", user, "zypper ref", "", "", nil)
+		if strings.Contains(dockerfile, "USER") || strings.Contains(dockerfile, "#") ||
+			strings.Contains(dockerfile, "LABEL") || strings.Contains(dockerfile, "MAINTAINER") {
+			t.Fatalf("Wrong Dockerfile for '%s':\n%s", user, dockerfile)
+		}
+	}
+}
+
+func TestNewImageBuilder(t *testing.T) {
+	tests := []struct {
+		builder, dockerfile, err string
+	}{
+		{"", "", ""},
+		{"commit", "", ""},
+		{"dockerfile", "Dockerfile", ""},
+		{"commit", "Dockerfile", "The --dockerfile flag can only be used with --builder=dockerfile"},
+		{"kaniko", "", "Unknown builder 'kaniko'"},
+	}
+
+	for _, test := range tests {
+		build, err := newImageBuilder(commandContext("patch", "--builder", test.builder, "--dockerfile", test.dockerfile))
+		if test.err == "" {
+			if err != nil || build == nil {
+				t.Fatalf("Unexpected error for %s: %v", test.builder, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected '%s', got: %v", test.err, err)
+		}
+	}
+}
+
+func TestBuildDockerfileImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-builder")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "Dockerfile")
+
+	mc := &mockClient{}
+	safeClient.client = mc
+	var id string
+	capture.All(func() {
+		id, err = buildDockerfileImage("opensuse:13.2", "new", "1.0", "zypper ref", "msg", "me", nil, path)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "built image ID" {
+		t.Fatalf("Wrong ID: %s", id)
+	}
+	if err = compareStringSlices(mc.builtTags, []string{"new:1.0"}); err != nil {
+		t.Fatalf("Wrong tags: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("The Dockerfile should have been written: %v", err)
+	}
+	if string(data) != mc.builtDockerfile || !strings.Contains(mc.builtDockerfile, "FROM opensuse:13.2\n") {
+		t.Fatalf("Wrong Dockerfile:\n%s", data)
+	}
+}
+
+func TestBuildDockerfileImageFailures(t *testing.T) {
+	tests := []struct {
+		mc  *mockClient
+		err string
+	}{
+		{&mockClient{buildFail: true}, "could not build the new image: Build failed"},
+		{&mockClient{buildError: true}, "could not build the new image: zypper failed"},
+		{&mockClient{rawInspect: `{"Config":{"OnBuild":["RUN make"]}}`}, "has ONBUILD triggers"},
+		{&mockClient{inspectFail: true}, "could not inspect image"},
+	}
+
+	for _, test := range tests {
+		safeClient.client = test.mc
+		var err error
+		capture.All(func() {
+			_, err = buildDockerfileImage("opensuse:13.2", "new", "1.0", "zypper ref", "msg", "me", nil, "")
+		})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected '%s', got: %v", test.err, err)
+		}
+	}
+}
+
+func TestUpdatePatchImageWithDockerfileBuilder(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	mc := &mockClient{}
+	safeClient.client = mc
+	var (
+		id, name string
+		err      error
+	)
+	captured := capture.All(func() {
+		id, name, err = updatePatchImage("patch", "opensuse:13.2", "new:1.0", commandContext("patch", "--builder", "dockerfile"))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "built image ID" || name != "new:1.0" {
+		t.Fatalf("Wrong image: %s, %s", id, name)
+	}
+	if !strings.Contains(string(captured.Stdout), "new:1.0 successfully created") {
+		t.Fatalf("Wrong output: %s", captured.Stdout)
+	}
+	if !strings.Contains(mc.builtDockerfile, "zypper -n patch") || !strings.Contains(mc.builtDockerfile, "com.suse.zypper-docker.command=\"patch\"") {
+		t.Fatalf("Wrong Dockerfile:\n%s", mc.builtDockerfile)
+	}
+	if record := getCacheFile().imageRecord("built image ID"); record == nil || record.Source != "2" {
+		t.Fatalf("Wrong cache record: %+v", record)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/coreos/etcd/pkg/fileutil"
 )
@@ -42,10 +43,43 @@ type cachedData struct {
 	// upgraded or patched using zypper-docker
 	Outdated []string `json:"outdated"`
 
+	// Contains the images that have been created by zypper-docker, indexed
+	// by their ID.
+	Images map[string]*imageRecord `json:"images,omitempty"`
+
+	// Contains all the IDs of the images created by zypper-docker that have
+	// been rolled back.
+	Broken []string `json:"broken,omitempty"`
+
 	// Whether this data comes from a valid file or not.
 	Valid bool `json:"-"`
 }
 
+// imageRecord contains what zypper-docker knows about an image that it has
+// created.
+type imageRecord struct {
+	// The ID of the image from which this one has been derived.
+	Source string `json:"source"`
+
+	// The names under which this image has been created.
+	Names []string `json:"names,omitempty"`
+
+	// When this image has been created, as a UNIX timestamp.
+	Created int64 `json:"created,omitempty"`
+
+	// The number of layers that zypper-docker has added on top of the
+	// original base of this image, if they have been squashed.
+	Layers int `json:"layers,omitempty"`
+
+	// Whether this image has been created by moving its source onto a
+	// patched base, instead of adding layers on top of it.
+	Rebased bool `json:"rebased,omitempty"`
+
+	// The digests of this image in the registries it has been pushed to,
+	// indexed by the pushed reference (e.g. "registry.example.com/app:1.0").
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
 // Checks whether the given Id exists or not. It returns two booleans:
 //  - Whether it exists or not.
 //  - If it exists, whether it is a SUSE image or not.
@@ -62,16 +96,67 @@ func (cd *cachedData) isImageOutdated(id string) bool {
 	return arrayIncludeString(cd.Outdated, id)
 }
 
+// Returns whether the given ID matches an image that has been rolled back via
+// zypper-docker rollback.
+func (cd *cachedData) isImageBroken(id string) bool {
+	return arrayIncludeString(cd.Broken, id)
+}
+
+// Returns the record of the image with the given ID if it has been created by
+// zypper-docker, nil otherwise.
+func (cd *cachedData) imageRecord(id string) *imageRecord {
+	if cd.Images == nil {
+		return nil
+	}
+	return cd.Images[id]
+}
+
+// createdImage returns the ID under which the record of the given image is
+// kept, along with the record itself. The image is looked up by its ID, with
+// or without the "sha256:" prefix, and then by the names it has been created
+// with, since an image might have been tagged under other names than the one
+// it was recorded with. It returns an empty string and nil if zypper-docker
+// has not created the image.
+func (cd *cachedData) createdImage(id, name string) (string, *imageRecord) {
+	if record := cd.imageRecord(id); record != nil {
+		return id, record
+	}
+	for key, record := range cd.Images {
+		if strings.TrimPrefix(key, "sha256:") == strings.TrimPrefix(id, "sha256:") {
+			return key, record
+		}
+	}
+
+	res := ""
+	for key, record := range cd.Images {
+		if !arrayIncludeString(record.Names, name) || cd.isImageBroken(key) {
+			continue
+		}
+		if res == "" || record.Created > cd.Images[res].Created {
+			res = key
+		}
+	}
+	if res == "" {
+		return "", nil
+	}
+	return res, cd.Images[res]
+}
+
 // Returns whether the given ID matches an image that is based on SUSE.
+//
+// The cache tells which images have zypper. With a helper image, the ones
+// without it might still be patched, and the result of the check does not
+// tell whether they have zypper, so it's not cached.
 func (cd *cachedData) isSUSE(id string) bool {
+	helper := helperImage() != ""
 	if cd.Valid {
-		if exists, suse := cd.idExists(id); exists {
+		if exists, suse := cd.idExists(id); exists && (suse || !helper) {
 			return suse
 		}
 	}
 
-	suse := checkCommandInImage(id, "zypper")
-	if cd.Valid {
+	suse := checkCommandInImage(id, suseCheckCommand())
+	if cd.Valid && !helper {
 		if suse {
 			cd.Suse = append(cd.Suse, id)
 		} else {
@@ -111,9 +196,18 @@ func (cd *cachedData) flush() {
 	cd.Suse = append(cd.Suse, oldCache.Suse...)
 	cd.Other = append(cd.Other, oldCache.Other...)
 	cd.Outdated = append(cd.Outdated, oldCache.Outdated...)
+	cd.Broken = append(cd.Broken, oldCache.Broken...)
 	cd.Suse = removeDuplicates(cd.Suse)
 	cd.Other = removeDuplicates(cd.Other)
 	cd.Outdated = removeDuplicates(cd.Outdated)
+	if len(cd.Broken) > 0 {
+		cd.Broken = removeDuplicates(cd.Broken)
+	}
+	for id, record := range oldCache.Images {
+		if cd.imageRecord(id) == nil {
+			cd.setImageRecord(id, record)
+		}
+	}
 
 	// Clear file content.
 	file.Seek(0, 0)
@@ -131,22 +225,134 @@ func (cd *cachedData) reset() {
 
 // Update the Cachefile after an update.
 // The ID of the outdated image will be added to outdated Images and
-// the ID of the new image will be added to the SUSE Images.
-func (cd *cachedData) updateCacheAfterUpdate(outdatedImg, updatedImgID string) error {
+// the ID of the new image will be added to the SUSE Images. The given names
+// are the ones under which the new image has been created.
+func (cd *cachedData) updateCacheAfterUpdate(outdatedImg, updatedImgID string, names ...string) error {
 	outdatedImgID, err := getImageID(outdatedImg)
 	if err != nil {
 		return err
 	}
+	cd.recordUpdate(outdatedImgID, updatedImgID, names...)
+	return nil
+}
+
+// recordUpdate acts like updateCacheAfterUpdate but it takes the ID of the
+// outdated image instead of its name.
+func (cd *cachedData) recordUpdate(outdatedImgID, updatedImgID string, names ...string) {
 	if !arrayIncludeString(cd.Outdated, outdatedImgID) {
 		cd.Outdated = append(cd.Outdated, outdatedImgID)
-		cd.flush()
 	}
-	if !arrayIncludeString(cd.Suse, updatedImgID) {
+	// With a helper image, the new image only has zypper if the outdated one
+	// had it.
+	if !arrayIncludeString(cd.Suse, updatedImgID) &&
+		(helperImage() == "" || arrayIncludeString(cd.Suse, outdatedImgID)) {
 		cd.Suse = append(cd.Suse, updatedImgID)
+	}
+
+	record := cd.imageRecord(updatedImgID)
+	if record == nil {
+		record = &imageRecord{Source: outdatedImgID, Created: time.Now().Unix()}
+		cd.setImageRecord(updatedImgID, record)
+	}
+	record.Names = removeDuplicates(append(record.Names, names...))
+	cd.flush()
+}
+
+// setImageRecord stores the given record for the image with the given ID.
+func (cd *cachedData) setImageRecord(id string, record *imageRecord) {
+	if cd.Images == nil {
+		cd.Images = make(map[string]*imageRecord)
+	}
+	cd.Images[id] = record
+}
+
+// replacementOf returns the ID of the image that should replace the image
+// with the given ID. That is, the most recent image that zypper-docker has
+// derived from it which has not been rolled back. If this image has been
+// updated in turn, then its replacement is returned instead. It returns an
+// empty string if there is no replacement.
+func (cd *cachedData) replacementOf(id string) string {
+	seen := map[string]bool{id: true}
+	res := ""
+	for {
+		next := ""
+		var created int64
+		for newID, record := range cd.Images {
+			if record.Source != id || cd.isImageBroken(newID) || seen[newID] {
+				continue
+			}
+			if next == "" || record.Created > created || (record.Created == created && newID < next) {
+				next, created = newID, record.Created
+			}
+		}
+		if next == "" {
+			return res
+		}
+		seen[next] = true
+		res, id = next, next
+	}
+}
+
+// recordPush records that the image with the given ID has been pushed as ref,
+// where it got the given digest.
+func (cd *cachedData) recordPush(id, ref, digest string) {
+	record := cd.imageRecord(id)
+	if record == nil {
+		record = &imageRecord{}
+		cd.setImageRecord(id, record)
+	}
+	if record.Digests == nil {
+		record.Digests = make(map[string]string)
+	}
+	record.Digests[ref] = digest
+	cd.flush()
+}
+
+// recordSquash records that the layers added by zypper-docker to the image
+// with the given ID have been squashed into a single one.
+func (cd *cachedData) recordSquash(id string) {
+	if record := cd.imageRecord(id); record != nil {
+		record.Layers = 1
 		cd.flush()
 	}
+}
 
-	return nil
+// recordRebase records that the image with the given ID has been rebased
+// onto a patched base, producing the image with the new ID.
+func (cd *cachedData) recordRebase(id, newID string, names ...string) {
+	cd.recordUpdate(id, newID, names...)
+	cd.imageRecord(newID).Rebased = true
+	cd.flush()
+}
+
+// zypperLayers returns the number of layers that zypper-docker has added on
+// top of the original base of the image with the given ID. That is, one for
+// each generation of images created by zypper-docker, unless some of them have
+// been squashed. Rebased images have no such layers, so the count stops there.
+func (cd *cachedData) zypperLayers(id string) int {
+	n := 0
+	seen := make(map[string]bool)
+	for record := cd.imageRecord(id); record != nil && !seen[id]; record = cd.imageRecord(id) {
+		if record.Layers > 0 {
+			return n + record.Layers
+		}
+		if record.Rebased {
+			return n
+		}
+		seen[id] = true
+		id = record.Source
+		n++
+	}
+	return n
+}
+
+// markBroken marks the image with the given ID as broken, so the "ps" command
+// can report the containers still running it.
+func (cd *cachedData) markBroken(id string) {
+	if !arrayIncludeString(cd.Broken, id) {
+		cd.Broken = append(cd.Broken, id)
+		cd.flush()
+	}
 }
 
 func (cd *cachedData) readCache(r io.Reader) *cachedData {
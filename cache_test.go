@@ -282,3 +282,141 @@ func TestReadCacheFail(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", expected, got)
 	}
 }
+
+func TestIsSUSEWithHelper(t *testing.T) {
+	exported := map[string]string{}
+	for name, content := range originalRootfs {
+		exported["/"+name] = content
+	}
+	mc := &mockClient{copies: map[string][]byte{"/": newArchive(t, exported)}}
+	safeClient.client = mc
+	cache := &cachedData{Valid: true, Suse: []string{"1"}, Other: []string{"2"}}
+
+	// Without a helper, the cache is enough.
+	if cache.isSUSE("2") || !cache.isSUSE("1") || len(mc.started) != 0 {
+		t.Fatalf("The cache should have been used: %v", mc.started)
+	}
+
+	// Images without zypper are checked again with a helper, and the result
+	// is not cached.
+	currentContext = globalCommandContext([]string{"--helper-image", "helper:1"}, "patch")
+	defer func() { currentContext = nil }()
+	if !cache.isSUSE("2") || !cache.isSUSE("1") || len(mc.started) != 1 {
+		t.Fatalf("Only the image without zypper should have been checked: %v", mc.started)
+	}
+	if !cache.isSUSE("3") || len(mc.started) != 2 {
+		t.Fatalf("The image should have been checked: %v", mc.started)
+	}
+	if compareStringSlices(cache.Suse, []string{"1"}) != nil || compareStringSlices(cache.Other, []string{"2"}) != nil {
+		t.Fatalf("The results should not have been cached: %+v", cache)
+	}
+
+	// Images patched with a helper only have zypper if their source had it.
+	cache.recordUpdate("2", "4")
+	cache.recordUpdate("1", "5")
+	if compareStringSlices(cache.Suse, []string{"1", "5"}) != nil {
+		t.Fatalf("Wrong SUSE images: %v", cache.Suse)
+	}
+}
+
+func TestRecordUpdate(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	cache := getCacheFile()
+	cache.recordUpdate("1", "2", "opensuse:patched")
+	cache.recordUpdate("1", "2", "opensuse:patched", "opensuse:other")
+	cache.markBroken("2")
+
+	// Another instance of the cache should see the same data.
+	cache = getCacheFile()
+	if !cache.isImageOutdated("1") {
+		t.Fatal("The source image should be outdated")
+	}
+	if !cache.isImageBroken("2") {
+		t.Fatal("The new image should be broken")
+	}
+	record := cache.imageRecord("2")
+	if record == nil || record.Source != "1" {
+		t.Fatalf("Wrong record: %v", record)
+	}
+	if err := compareStringSlices(record.Names, []string{"opensuse:patched", "opensuse:other"}); err != nil {
+		t.Fatalf("Wrong names: %v", err)
+	}
+	if cache.imageRecord("1") != nil {
+		t.Fatal("The source image was not created by zypper-docker")
+	}
+
+	// Flushing a cache that doesn't know about this record keeps it.
+	cd := &cachedData{Valid: true, Path: cache.Path}
+	cd.flush()
+	if getCacheFile().imageRecord("2") == nil {
+		t.Fatal("The record should have been kept")
+	}
+}
+
+func TestCreatedImage(t *testing.T) {
+	cd := &cachedData{}
+	cd.setImageRecord("sha256:1", &imageRecord{Names: []string{"app:1"}, Created: 1})
+	cd.setImageRecord("2", &imageRecord{Names: []string{"app:1", "app:2"}, Created: 2})
+
+	tests := []struct{ id, name, expected string }{
+		{"sha256:1", "unknown:1", "sha256:1"},
+		{"1", "unknown:1", "sha256:1"},
+		{"sha256:2", "app:1", "2"},
+		{"3", "app:1", "2"},
+		{"3", "app:2", "2"},
+		{"3", "unknown:1", ""},
+	}
+	for _, test := range tests {
+		id, record := cd.createdImage(test.id, test.name)
+		if id != test.expected || (id == "") != (record == nil) {
+			t.Fatalf("Expected '%s' for %s (%s), got '%s' (%v)", test.expected, test.id, test.name, id, record)
+		}
+	}
+}
+
+func TestReplacementOf(t *testing.T) {
+	cd := &cachedData{}
+	cd.setImageRecord("5", &imageRecord{Source: "2", Created: 1})
+	cd.setImageRecord("6", &imageRecord{Source: "2", Created: 2})
+	cd.setImageRecord("7", &imageRecord{Source: "6", Created: 3})
+
+	if id := cd.replacementOf("2"); id != "7" {
+		t.Fatalf("Expected 7, got %s", id)
+	}
+	if id := cd.replacementOf("7"); id != "" {
+		t.Fatalf("There should be no replacement, got %s", id)
+	}
+
+	cd.Broken = []string{"7"}
+	if id := cd.replacementOf("2"); id != "6" {
+		t.Fatalf("Expected 6, got %s", id)
+	}
+	cd.Broken = []string{"6", "7"}
+	if id := cd.replacementOf("2"); id != "5" {
+		t.Fatalf("Expected 5, got %s", id)
+	}
+}
+
+func TestZypperLayers(t *testing.T) {
+	cd := &cachedData{}
+	cd.setImageRecord("5", &imageRecord{Source: "2"})
+	cd.setImageRecord("6", &imageRecord{Source: "5"})
+	cd.setImageRecord("7", &imageRecord{Source: "6", Layers: 1})
+	cd.setImageRecord("8", &imageRecord{Source: "7"})
+	cd.setImageRecord("9", &imageRecord{Source: "3", Rebased: true})
+	cd.setImageRecord("10", &imageRecord{Source: "9"})
+
+	tests := map[string]int{"2": 0, "5": 1, "6": 2, "7": 1, "8": 2, "9": 0, "10": 1}
+	for id, expected := range tests {
+		if n := cd.zypperLayers(id); n != expected {
+			t.Fatalf("Expected %d layers for %s, got %d", expected, id, n)
+		}
+	}
+
+	// Loops are not followed forever.
+	cd.setImageRecord("2", &imageRecord{Source: "6"})
+	if n := cd.zypperLayers("6"); n != 3 {
+		t.Fatalf("Expected 3 layers, got %d", n)
+	}
+}
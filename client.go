@@ -23,6 +23,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
@@ -56,16 +57,32 @@ func (de dockerError) Error() string {
 type DockerClient interface {
 	ContainerCommit(options types.ContainerCommitOptions) (types.ContainerCommitResponse, error)
 	ContainerCreate(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (types.ContainerCreateResponse, error)
+	ContainerInspect(containerID string) (types.ContainerJSON, error)
+	ContainerInspectWithRaw(containerID string, getSize bool) (types.ContainerJSON, []byte, error)
 	ContainerKill(containerID, signal string) error
 	ContainerList(options types.ContainerListOptions) ([]types.Container, error)
 	ContainerLogs(options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerAttach(options types.ContainerAttachOptions) (types.HijackedResponse, error)
 	ContainerRemove(options types.ContainerRemoveOptions) error
+	ContainerRename(containerID, newContainerName string) error
 	ContainerResize(options types.ResizeOptions) error
 	ContainerStart(id string) error
+	ContainerStop(containerID string, timeout int) error
 	ContainerWait(containerID string) (int, error)
+	CopyFromContainer(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error)
+	CopyToContainer(options types.CopyToContainerOptions) error
 
+	ImageBuild(options types.ImageBuildOptions) (types.ImageBuildResponse, error)
+	ImageHistory(imageID string) ([]types.ImageHistory, error)
 	ImageInspectWithRaw(imageID string, getSize bool) (types.ImageInspect, []byte, error)
 	ImageList(options types.ImageListOptions) ([]types.Image, error)
+	ImageLoad(input io.Reader) (types.ImageLoadResponse, error)
+	ImagePush(options types.ImagePushOptions, privilegeFunc client.RequestPrivilegeFunc) (io.ReadCloser, error)
+	ImageRemove(options types.ImageRemoveOptions) ([]types.ImageDelete, error)
+	ImageSave(imageIDs []string) (io.ReadCloser, error)
+	ImageTag(options types.ImageTagOptions) error
+
+	NetworkConnect(networkID, containerID string, config *network.EndpointSettings) error
 }
 
 // The timeout in which the container is allowed to run a command as given
@@ -89,7 +106,14 @@ func getDockerClient() DockerClient {
 		return safeClient.client
 	}
 
-	if dc, err := client.NewEnvClient(); err != nil {
+	if currentContext != nil && currentContext.GlobalString("oci") != "" {
+		if oc, err := newOCIClient(currentContext.GlobalString("oci")); err != nil {
+			log.Printf("Could not get an OCI client: %v", err)
+		} else {
+			safeClient.client = oc
+			return oc
+		}
+	} else if dc, err := client.NewEnvClient(); err != nil {
 		log.Printf("Could not get a docker client: %v", err)
 	} else {
 		safeClient.client = dc
@@ -127,7 +151,7 @@ func humanizeCommandError(cmd, image string, err error) {
 // The given image string is just the ID of said image.
 // It returns true if the command was successful, false otherwise.
 func checkCommandInImage(img, cmd string) bool {
-	containerID, err := startContainer(img, []string{cmd}, false, nil)
+	containerID, err := startContainer(img, []string{cmd}, false, nil, nil)
 
 	defer removeContainer(containerID)
 
@@ -172,12 +196,20 @@ func runStreamedCommand(img, cmd string, getError bool) error {
 
 // Run the given command in a container based on the given image. The given
 // image string is just the ID of said image.
-// The STDOUT and STDERR of the container can be streamed by providing a
-// destination in `dst`.
+// The STDOUT of the container can be streamed by providing a destination in
+// `dst`, in which case its STDERR goes to the one of zypper-docker.
 // It returns the ID of the container spawned from the image.
 // Note well: the container is NOT deleted when the given command terminates.
 func runCommandInContainer(img string, cmd []string, dst io.Writer) (string, error) {
-	return startContainer(img, cmd, true, dst)
+	return startContainer(img, cmd, true, dst, os.Stderr)
+}
+
+// Behaves like `runCommandInContainer`, but the STDERR of the container goes
+// to `errDst`. This is needed when the error messages of a command have to be
+// parsed.
+// Note well: the container is NOT deleted when the given command terminates.
+func captureCommandInContainer(img string, cmd []string, dst, errDst io.Writer) (string, error) {
+	return startContainer(img, cmd, true, dst, errDst)
 }
 
 // Start a container from the specified image and then runs the given command
@@ -185,7 +217,7 @@ func runCommandInContainer(img string, cmd []string, dst io.Writer) (string, err
 // When `wait` is set to true the function will wait untill the container exits,
 // otherwise it will timeout raising an error.
 // The STDOUT and STDERR of the container can be streamed by providing a
-// destination in `dst`.
+// destination in `dst` and `errDst`. With a TTY, both streams go to `dst`.
 // Note well: the container is NOT deleted when the given command terminates.
 // This is again up to the caller.
 //
@@ -193,8 +225,8 @@ func runCommandInContainer(img string, cmd []string, dst io.Writer) (string, err
 // returned can be of type dockerError. This only happens when the container
 // has run normally (no signals, no timeout), but the exit code is not 0. Read
 // the documentation on the `dockerError` command on why we do this.
-func startContainer(img string, cmd []string, wait bool, dst io.Writer) (string, error) {
-	id, err := createContainer(img, cmd)
+func startContainer(img string, cmd []string, wait bool, dst, errDst io.Writer) (string, error) {
+	id, err := createContainer(img, cmd, false)
 	if err != nil {
 		log.Println(err)
 		return "", err
@@ -206,7 +238,11 @@ func startContainer(img string, cmd []string, wait bool, dst io.Writer) (string,
 		// want to add noise to the log.
 		return id, err
 	}
-	resizeTty(id)
+	tty := stdoutIsTerminal()
+	if tty {
+		stop := followTtySize(id)
+		defer stop()
+	}
 
 	sc := make(chan bool)
 
@@ -228,7 +264,14 @@ func startContainer(img string, cmd []string, wait bool, dst io.Writer) (string,
 			}
 		}()
 		go func() {
-			if _, err := io.Copy(dst, rc); err != nil {
+			var err error
+			if tty {
+				_, err = io.Copy(dst, rc)
+			} else {
+				// Without a TTY both streams are multiplexed by the daemon.
+				_, err = stdcopy.StdCopy(dst, errDst, rc)
+			}
+			if err != nil {
 				log.Print(err)
 			}
 			sc <- true
@@ -243,19 +286,59 @@ func startContainer(img string, cmd []string, wait bool, dst io.Writer) (string,
 		}
 	}()
 
+	if dst == nil {
+		sc = nil
+	}
+	return id, waitContainer(id, timeout, sc)
+}
+
+// liveContainers contains the IDs of the containers created by zypper-docker
+// that have not been removed yet.
+var liveContainers struct {
+	sync.Mutex
+	ids []string
+}
+
+// removeLiveContainers kills and removes the containers created by
+// zypper-docker that are still around. It's run before exiting, since only
+// one of the containers running at the same time is killed by
+// `waitContainer` when the user interrupts zypper-docker.
+func removeLiveContainers() {
+	liveContainers.Lock()
+	ids := liveContainers.ids
+	liveContainers.ids = nil
+	liveContainers.Unlock()
+
+	client := getDockerClient()
+	for _, id := range ids {
+		// The container might not be running: it's removed anyway.
+		_ = client.ContainerKill(id, "KILL")
+		removeContainer(id)
+	}
+}
+
+// Waits until the given container exits, the timeout is triggered or the
+// user interrupts zypper-docker. In the latter case, the container is killed
+// and the program exits. Once the container has exited, the given output
+// channel, if any, is waited for too, so no output is lost.
+//
+// The error returned can be of type dockerError, as explained in the
+// documentation of the `startContainer` function.
+func waitContainer(id string, timeout <-chan int, output <-chan bool) error {
 	select {
 	case res := <-containerWait(id):
-		if dst != nil {
-			<-sc
+		if output != nil {
+			<-output
 		}
 		if res.err != nil {
-			return id, res.err
+			return res.err
 		} else if res.exitCode != 0 {
-			return id, dockerError{res}
+			return dockerError{res}
 		}
 	case <-timeout:
-		return id, fmt.Errorf("Timed out when waiting for a container")
+		return fmt.Errorf("Timed out when waiting for a container")
 	case <-killChannel:
+		client := getDockerClient()
 		if err := client.ContainerKill(id, "KILL"); err != nil {
 			fmt.Println("Error while killing running container:", err)
 		} else {
@@ -263,8 +346,7 @@ func startContainer(img string, cmd []string, wait bool, dst io.Writer) (string,
 		}
 		exitWithCode(1)
 	}
-
-	return id, nil
+	return nil
 }
 
 // waitResult encapsulates the result of the client.ContainerWait function.
@@ -300,9 +382,29 @@ func getHostConfig() *container.HostConfig {
 // container.
 // It returns the ID of the spawned container when successful, nil otherwise.
 // The error is set accordingly when it's not possible to create the container.
+// When `stdin` is set to true, the standard input of the container is kept
+// open, so it can be attached to the one of the user.
 // Note well: the container is not running at this time, it must be started via
 // the `startContainer` function.
-func createContainer(img string, cmd []string) (string, error) {
+func createContainer(img string, cmd []string, stdin bool) (string, error) {
+	var id string
+	var err error
+	if helperImage() != "" {
+		id, err = createHelperContainer(img, cmd, stdin)
+	} else {
+		id, err = createZypperContainer(img, cmd, stdin)
+	}
+	if id != "" {
+		liveContainers.Lock()
+		liveContainers.ids = append(liveContainers.ids, id)
+		liveContainers.Unlock()
+	}
+	return id, err
+}
+
+// createZypperContainer behaves like `createContainer`, but the container is
+// always based on the given image.
+func createZypperContainer(img string, cmd []string, stdin bool) (string, error) {
 	client := getDockerClient()
 
 	// First of all we create a container in which we will run the command.
@@ -310,13 +412,17 @@ func createContainer(img string, cmd []string) (string, error) {
 		Image:        img,
 		Cmd:          strslice.New(cmd...),
 		Entrypoint:   strslice.New("/bin/sh", "-c"),
+		AttachStdin:  stdin,
 		AttachStdout: true,
 		AttachStderr: true,
+		OpenStdin:    stdin,
+		StdinOnce:    stdin,
 		// We need to run as root in order to run zypper commands.
 		User: rootUser,
 		// required to avoid garbage when cmd overwrites the terminal
-		// like "zypper ref" does
-		Tty: true,
+		// like "zypper ref" does. Without a terminal zypper does not
+		// overwrite anything, so stdout and stderr are kept apart.
+		Tty: stdoutIsTerminal(),
 	}
 	resp, err := client.ContainerCreate(config, getHostConfig(), nil, "")
 	if err != nil {
@@ -332,6 +438,15 @@ func createContainer(img string, cmd []string) (string, error) {
 // Safely remove the given container. It will deal with the error by logging
 // it.
 func removeContainer(id string) {
+	liveContainers.Lock()
+	for i, c := range liveContainers.ids {
+		if c == id {
+			liveContainers.ids = append(liveContainers.ids[:i], liveContainers.ids[i+1:]...)
+			break
+		}
+	}
+	liveContainers.Unlock()
+
 	client := getDockerClient()
 
 	err := client.ContainerRemove(types.ContainerRemoveOptions{
@@ -346,17 +461,23 @@ func removeContainer(id string) {
 
 // commitContainerToImage commits the container with the given containerID
 // that is based on the given img into a new image. The given repo should also
-// contain the namespace. Returns the id of the created image.
-func commitContainerToImage(img, containerID, repo, tag, comment, author string) (string, error) {
+// contain the namespace. The given labels are added to the ones inherited from
+// img. Returns the id of the created image.
+func commitContainerToImage(img, containerID, repo, tag, comment, author string, labels map[string]string) (string, error) {
 	client := getDockerClient()
 
 	// First of all, we inspect the parent image and fetch the values for the
 	// entrypoint and the cmd. We do this to preserve them on the committed
 	// image. See issue: https://github.com/SUSE/zypper-docker/issues/75.
-	info, _, err := client.ImageInspectWithRaw(img, false)
+	info, raw, err := client.ImageInspectWithRaw(img, false)
 	if err != nil {
 		return "", fmt.Errorf("could not inspect image '%s': %v", img, err)
 	}
+	parent, err := decodeImageConfig(info, raw)
+	if err != nil {
+		return "", err
+	}
+	parent.Labels = mergeLabels(parent.Labels, labels)
 
 	user := info.Config.User
 	if user == "" {
@@ -370,8 +491,17 @@ func commitContainerToImage(img, containerID, repo, tag, comment, author string)
 		"ENTRYPOINT " + joinAsArray(info.Config.Entrypoint.Slice(), false),
 		"CMD " + joinAsArray(info.Config.Cmd.Slice(), true),
 	}
+	healthcheck, err := healthcheckInstruction(parent.Healthcheck)
+	if err != nil {
+		return "", fmt.Errorf("could not preserve the healthcheck of '%s': %v", img, err)
+	}
+	if healthcheck != "" {
+		changes = append(changes, healthcheck)
+	}
 
-	// And we commit into the new image.
+	// And we commit into the new image. The rest of the configuration of the
+	// parent image is passed explicitly, so it doesn't depend on what the
+	// daemon carries over from the helper container.
 	resp, err := client.ContainerCommit(types.ContainerCommitOptions{
 		ContainerID:    containerID,
 		RepositoryName: repo,
@@ -379,19 +509,32 @@ func commitContainerToImage(img, containerID, repo, tag, comment, author string)
 		Comment:        comment,
 		Author:         author,
 		Changes:        changes,
-		Config:         &container.Config{},
+		Config:         commitConfig(parent),
 	})
-	return resp.ID, err
+	if err != nil {
+		return "", err
+	}
+
+	// Finally, make sure that nothing has been lost along the way. Otherwise
+	// the new image is removed, since it's not safe to use it.
+	if err = verifyImageConfig(parent, resp.ID); err != nil {
+		if rerr := untagImage(resp.ID); rerr != nil {
+			log.Printf("Could not remove the new image %s: %v", resp.ID, rerr)
+		}
+		return "", err
+	}
+	return resp.ID, nil
 }
 
 // Spawns a container from the specified image, runs the specified command inside
 // of it and commits the results to a new image.
-// The name of the new image is specified via target_repo and target_tag.
-// The container is always deleted.
+// The name of the new image is specified via target_repo and target_tag, and
+// it's labeled after the given provenance, including the patches that the
+// command has applied (see `appliedLabels`). The container is always deleted.
 // If something goes wrong an error message is returned.
 // Returns the ID of the new image on success.
-func runCommandAndCommitToImage(img, targetRepo, targetTag, cmd, comment, author string) (string, error) {
-	containerID, err := runCommandInContainer(img, []string{cmd}, os.Stdout)
+func runCommandAndCommitToImage(img, targetRepo, targetTag, cmd, comment, author string, prov *provenance) (string, error) {
+	containerID, applied, err := runBuilderCommand(img, cmd)
 	if err != nil {
 		switch err.(type) {
 		case dockerError:
@@ -404,7 +547,8 @@ func runCommandAndCommitToImage(img, targetRepo, targetTag, cmd, comment, author
 		}
 	}
 
-	imageID, err := commitContainerToImage(img, containerID, targetRepo, targetTag, comment, author)
+	labels := mergeLabels(prov.labels(), prov.appliedLabels(applied))
+	imageID, err := commitContainerToImage(img, containerID, targetRepo, targetTag, comment, author, labels)
 
 	// always remove the container
 	removeContainer(containerID)
@@ -412,40 +556,29 @@ func runCommandAndCommitToImage(img, targetRepo, targetTag, cmd, comment, author
 	return imageID, err
 }
 
-// Looks for the specified running container and makes sure it's running either
-// SUSE or openSUSE.
-func checkContainerRunning(id string) (types.Container, error) {
+// Looks for the specified container and makes sure it's running either SUSE
+// or openSUSE. The given id can be the full ID of the container, its name (with
+// or without the leading slash) or any prefix of its ID, as long as the prefix
+// is not ambiguous. Stopped containers are only taken into account if
+// `stopped` is set to true.
+func checkContainer(id string, stopped bool) (types.Container, error) {
 	client := getDockerClient()
 	var container types.Container
 
-	containers, err := client.ContainerList(types.ContainerListOptions{})
+	containers, err := client.ContainerList(types.ContainerListOptions{All: stopped})
 	if err != nil {
+		if stopped {
+			return container, fmt.Errorf("Error while fetching containers: %v", err)
+		}
 		return container, fmt.Errorf("Error while fetching running containers: %v", err)
 	}
 
-	found := false
-	for _, c := range containers {
-		if id == c.ID {
-			container = c
-			found = true
-			break
-		}
-		// look also for the short version of the container ID
-		if len(id) >= 12 && strings.Index(c.ID, id) == 0 {
-			container = c
-			found = true
-			break
-		}
-		// for some reason the daemon has all the names prefixed by "/"
-		if arrayIncludeString(c.Names, "/"+id) {
-			container = c
-			found = true
-			break
+	container, err = lookupContainer(containers, id)
+	if err != nil {
+		if _, ok := err.(containerNotFoundError); ok && !stopped {
+			err = fmt.Errorf("%v (use --stopped to include stopped containers)", err)
 		}
-	}
-
-	if !found {
-		return container, fmt.Errorf("Cannot find running container: %s", id)
+		return container, err
 	}
 
 	cache := getCacheFile()
@@ -457,3 +590,57 @@ func checkContainerRunning(id string) (types.Container, error) {
 
 	return container, nil
 }
+
+// containerNotFoundError is the error returned by `lookupContainer` when no
+// container matches the given id.
+type containerNotFoundError string
+
+func (id containerNotFoundError) Error() string {
+	return fmt.Sprintf("Cannot find container: %s", string(id))
+}
+
+// lookupContainer picks the container identified by id from the given list. It
+// follows the same precedence as the docker client: a full ID match comes
+// first, then an exact name match and, finally, a unique prefix of the ID.
+// Whenever the given prefix matches more than one container, the returned
+// error lists all the candidates.
+func lookupContainer(containers []types.Container, id string) (types.Container, error) {
+	if id == "" {
+		return types.Container{}, fmt.Errorf("No container specified")
+	}
+
+	for _, c := range containers {
+		if id == c.ID {
+			return c, nil
+		}
+	}
+
+	// For some reason the daemon has all the names prefixed by "/".
+	name := "/" + strings.TrimPrefix(id, "/")
+	for _, c := range containers {
+		if arrayIncludeString(c.Names, name) {
+			return c, nil
+		}
+	}
+
+	candidates := []types.Container{}
+	for _, c := range containers {
+		if strings.HasPrefix(c.ID, id) {
+			candidates = append(candidates, c)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return types.Container{}, containerNotFoundError(id)
+	case 1:
+		return candidates[0], nil
+	}
+
+	list := []string{}
+	for _, c := range candidates {
+		list = append(list, fmt.Sprintf("%s %v [%s]", c.ID, c.Names, c.Image))
+	}
+	return types.Container{}, fmt.Errorf("The prefix '%s' is ambiguous, candidates are:\n  - %s",
+		id, strings.Join(list, "\n  - "))
+}
@@ -76,7 +76,7 @@ func TestCreateContainerWarnings(t *testing.T) {
 
 	buffer := bytes.NewBuffer([]byte{})
 	log.SetOutput(buffer)
-	if _, err := createContainer("image", []string{"such", "command", "wow"}); err != nil {
+	if _, err := createContainer("image", []string{"such", "command", "wow"}, false); err != nil {
 		t.Fatalf("We've got the error %v", err)
 	}
 
@@ -108,6 +108,53 @@ func TestRunCommandInContainerContainerLogsFailure(t *testing.T) {
 	testReaderData(t, buffer, []string{"Fake log failure"})
 }
 
+func TestRunCommandInContainerWithoutTty(t *testing.T) {
+	mc := &mockClient{stderrOutput: "Warning: something happened\n"}
+	safeClient.client = mc
+
+	var err error
+	resp := capture.All(func() {
+		_, err = runCommandInContainer("opensuse", []string{"foo"}, os.Stdout)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mc.tty {
+		t.Fatal("The output is not a terminal, so the container should not have a TTY")
+	}
+	if string(resp.Stdout) != "streaming buffer initialized\n" {
+		t.Fatalf("Wrong stdout: %s", resp.Stdout)
+	}
+	if string(resp.Stderr) != "Warning: something happened\n" {
+		t.Fatalf("Wrong stderr: %s", resp.Stderr)
+	}
+
+	// Output that is going to be parsed only gets stdout.
+	buffer := bytes.NewBuffer([]byte{})
+	resp = capture.All(func() {
+		_, err = runCommandInContainer("opensuse", []string{"foo"}, buffer)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buffer.String() != "streaming buffer initialized\n" {
+		t.Fatalf("Wrong output: %s", buffer.String())
+	}
+	if string(resp.Stderr) != "Warning: something happened\n" {
+		t.Fatalf("Wrong stderr: %s", resp.Stderr)
+	}
+
+	// Unless stderr is explicitly captured as well.
+	buffer.Reset()
+	stderr := bytes.NewBuffer([]byte{})
+	if _, err = captureCommandInContainer("opensuse", []string{"foo"}, buffer, stderr); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buffer.String() != "streaming buffer initialized\n" || stderr.String() != "Warning: something happened\n" {
+		t.Fatalf("Wrong output: %s / %s", buffer.String(), stderr.String())
+	}
+}
+
 func TestRunCommandInContainerStreaming(t *testing.T) {
 	safeClient.client = &mockClient{}
 
@@ -241,6 +288,33 @@ func TestHandleSignalWhileContainerRunsEvenWhenKillContainerFails(t *testing.T)
 	}
 }
 
+func TestRemoveLiveContainers(t *testing.T) {
+	liveContainers.ids = nil
+	mc := &mockClient{}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	for _, img := range []string{"opensuse:13.2", "opensuse:latest", "opensuse:tag"} {
+		if _, err := createContainer(img, []string{"zypper ref"}, false); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	removeContainer("zypper-docker-private-opensuse:latest")
+
+	// The containers still around are removed, even if they cannot be
+	// killed because they are not running.
+	mc.removedContainers, mc.killFail = nil, true
+	removeLiveContainers()
+	expected := []string{"zypper-docker-private-opensuse:13.2", "zypper-docker-private-opensuse:tag"}
+	if err := compareStringSlices(mc.removedContainers, expected); err != nil {
+		t.Fatalf("Wrong removed containers: %v", err)
+	}
+	if len(liveContainers.ids) != 0 {
+		t.Fatalf("No container should be left: %v", liveContainers.ids)
+	}
+}
+
 func TestRunCommandAndCommitToImageSuccess(t *testing.T) {
 	safeClient.client = &mockClient{}
 	var err error
@@ -252,7 +326,8 @@ func TestRunCommandAndCommitToImageSuccess(t *testing.T) {
 			"new_tag",
 			"touch foo",
 			"comment",
-			"author")
+			"author",
+			nil)
 	})
 
 	if err != nil {
@@ -271,7 +346,8 @@ func TestRunCommandAndCommitToImageRunFailure(t *testing.T) {
 			"new_tag",
 			"touch foo",
 			"comment",
-			"author")
+			"author",
+			nil)
 	})
 
 	if err == nil {
@@ -293,7 +369,8 @@ func TestRunCommandAndCommitToImageCommitFailure(t *testing.T) {
 			"new_tag",
 			"touch foo",
 			"comment",
-			"author")
+			"author",
+			nil)
 	})
 
 	if err == nil {
@@ -304,52 +381,58 @@ func TestRunCommandAndCommitToImageCommitFailure(t *testing.T) {
 	}
 }
 
-func TestCheckContainerRunningListContainersFailure(t *testing.T) {
+func TestCheckContainerListContainersFailure(t *testing.T) {
 	safeClient.client = &mockClient{listFail: true}
 
-	_, err := checkContainerRunning("1")
+	_, err := checkContainer("1", false)
 
 	if err == nil {
 		t.Fatal("Was supposed to have an error")
 	}
 
-	if !strings.Contains(err.Error(), "Fake failure while listing containers") {
+	if !strings.Contains(err.Error(), "Error while fetching running containers: Fake failure while listing containers") {
 		t.Fatal("Unexpected error message")
 	}
+
+	// With stopped containers, the message does not talk about running ones.
+	_, err = checkContainer("1", true)
+	if err == nil || !strings.HasPrefix(err.Error(), "Error while fetching containers: ") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 }
 
-func TestCheckContainerRunningNoRunningContainer(t *testing.T) {
+func TestCheckContainerNoRunningContainer(t *testing.T) {
 	safeClient.client = &mockClient{listEmpty: true}
 
-	_, err := checkContainerRunning("35ae93c88cf8")
+	_, err := checkContainer("35ae93c88cf8", false)
 
 	if err == nil {
 		t.Fatal("Was supposed to have an error")
 	}
 
-	if !strings.Contains(err.Error(), "Cannot find running container") {
+	if !strings.Contains(err.Error(), "Cannot find container") {
 		t.Fatal("Unexpected error message")
 	}
 }
 
-func TestCheckContainerRunningWrongContainer(t *testing.T) {
+func TestCheckContainerWrongContainer(t *testing.T) {
 	safeClient.client = &mockClient{}
 
-	_, err := checkContainerRunning("not running")
+	_, err := checkContainer("not running", false)
 
 	if err == nil {
 		t.Fatal("Was supposed to have an error")
 	}
 
-	if !strings.Contains(err.Error(), "Cannot find running container") {
+	if !strings.Contains(err.Error(), "Cannot find container") {
 		t.Fatal("Unexpected error message")
 	}
 }
 
-func TestCheckContainerRunningNotSUSESystem(t *testing.T) {
+func TestCheckContainerNotSUSESystem(t *testing.T) {
 	safeClient.client = &mockClient{startFail: true}
 
-	_, err := checkContainerRunning("not_suse")
+	_, err := checkContainer("not_suse", false)
 
 	if err == nil {
 		t.Fatal("Was supposed to have an error")
@@ -360,10 +443,10 @@ func TestCheckContainerRunningNotSUSESystem(t *testing.T) {
 	}
 }
 
-func TestCheckContainerRunningByNameSuccess(t *testing.T) {
+func TestCheckContainerByNameSuccess(t *testing.T) {
 	safeClient.client = &mockClient{}
 
-	container, err := checkContainerRunning("suse")
+	container, err := checkContainer("suse", false)
 
 	if err != nil {
 		t.Fatal("Wasn't supposed to have an error")
@@ -374,10 +457,10 @@ func TestCheckContainerRunningByNameSuccess(t *testing.T) {
 	}
 }
 
-func TestCheckContainerRunningByFullIDSuccess(t *testing.T) {
+func TestCheckContainerByFullIDSuccess(t *testing.T) {
 	safeClient.client = &mockClient{}
 
-	container, err := checkContainerRunning("35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01")
+	container, err := checkContainer("35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01", false)
 
 	if err != nil {
 		t.Fatal("Wasn't supposed to have an error")
@@ -388,10 +471,10 @@ func TestCheckContainerRunningByFullIDSuccess(t *testing.T) {
 	}
 }
 
-func TestCheckContainerRunningByShortIDSuccess(t *testing.T) {
+func TestCheckContainerByShortIDSuccess(t *testing.T) {
 	safeClient.client = &mockClient{}
 
-	container, err := checkContainerRunning("35ae93c88cf8")
+	container, err := checkContainer("35ae93c88cf8", false)
 
 	if err != nil {
 		t.Fatal("Wasn't supposed to have an error")
@@ -402,6 +485,81 @@ func TestCheckContainerRunningByShortIDSuccess(t *testing.T) {
 	}
 }
 
+func TestCheckContainerByAnyPrefixSuccess(t *testing.T) {
+	safeClient.client = &mockClient{}
+
+	container, err := checkContainer("35a", false)
+
+	if err != nil {
+		t.Fatalf("Wasn't supposed to have an error: %v", err)
+	}
+
+	if container.ID != "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01" {
+		t.Fatal("Wrong container found")
+	}
+}
+
+func TestCheckContainerByNameWithSlashSuccess(t *testing.T) {
+	safeClient.client = &mockClient{}
+
+	container, err := checkContainer("/suse", false)
+
+	if err != nil {
+		t.Fatalf("Wasn't supposed to have an error: %v", err)
+	}
+
+	if container.ID != "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01" {
+		t.Fatal("Wrong container found")
+	}
+}
+
+func TestCheckContainerStopped(t *testing.T) {
+	safeClient.client = &mockClient{}
+
+	_, err := checkContainer("stopped_suse", false)
+	if err == nil {
+		t.Fatal("Was supposed to have an error")
+	}
+	if !strings.Contains(err.Error(), "use --stopped to include stopped containers") {
+		t.Fatalf("Unexpected error message: %v", err)
+	}
+
+	container, err := checkContainer("stopped_suse", true)
+	if err != nil {
+		t.Fatalf("Wasn't supposed to have an error: %v", err)
+	}
+	if container.ID != "35ae93c88cf8aa0000000000000000000000000000000000000000000000ff" {
+		t.Fatal("Wrong container found")
+	}
+}
+
+func TestCheckContainerAmbiguousPrefix(t *testing.T) {
+	safeClient.client = &mockClient{}
+
+	_, err := checkContainer("35ae93c88cf8", true)
+	if err == nil {
+		t.Fatal("Was supposed to have an error")
+	}
+
+	msg := err.Error()
+	if !strings.Contains(msg, "The prefix '35ae93c88cf8' is ambiguous") {
+		t.Fatalf("Unexpected error message: %v", msg)
+	}
+	if !strings.Contains(msg, "[/suse]") || !strings.Contains(msg, "[/stopped_suse]") {
+		t.Fatalf("All the candidates should be listed: %v", msg)
+	}
+
+	// The hint about stopped containers is only given when nothing matches.
+	safeClient.client = &mockClient{listAmbiguous: true}
+	_, err = checkContainer("35ae93c88cf8ab", false)
+	if err == nil {
+		t.Fatal("Was supposed to have an error")
+	}
+	if strings.Contains(err.Error(), "use --stopped") {
+		t.Fatalf("Unexpected hint: %v", err)
+	}
+}
+
 func TestHostConfig(t *testing.T) {
 	hc := getHostConfig()
 	if len(hc.ExtraHosts) != 0 {
@@ -0,0 +1,340 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/go-units"
+)
+
+// solvable represents a package or a patch as described by zypper when
+// printing the summary of a transaction in XML format.
+type solvable struct {
+	Type       string `xml:"type,attr"`
+	Name       string `xml:"name,attr"`
+	Edition    string `xml:"edition,attr"`
+	Arch       string `xml:"arch,attr"`
+	EditionOld string `xml:"edition-old,attr"`
+	Summary    string `xml:"summary,attr"`
+	Repository string `xml:"repository,attr"`
+}
+
+// installSummary is the `<install-summary>` element that zypper prints when
+// running with the `--xmlout` global flag.
+type installSummary struct {
+	DownloadSize   int64      `xml:"download-size,attr"`
+	SpaceUsageDiff int64      `xml:"space-usage-diff,attr"`
+	Install        []solvable `xml:"to-install>solvable"`
+	Upgrade        []solvable `xml:"to-upgrade>solvable"`
+	Downgrade      []solvable `xml:"to-downgrade>solvable"`
+	Reinstall      []solvable `xml:"to-reinstall>solvable"`
+	Remove         []solvable `xml:"to-remove>solvable"`
+}
+
+// zypperMessage is a `<message>` element as printed by zypper.
+type zypperMessage struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// zypperPrompt is a `<prompt>` element as printed by zypper.
+type zypperPrompt struct {
+	ID   string `xml:"id,attr"`
+	Text string `xml:"text"`
+}
+
+// zypperStream is the root element of the XML output of zypper.
+type zypperStream struct {
+	Messages []zypperMessage `xml:"message"`
+	Prompts  []zypperPrompt  `xml:"prompt"`
+	Summary  *installSummary `xml:"install-summary"`
+}
+
+// transaction contains everything that zypper would do when running either
+// the `patch` or the `update` command.
+type transaction struct {
+	// The packages to be installed, upgraded, etc. grouped by the kind of
+	// operation (e.g. "upgraded").
+	Packages map[string][]solvable
+
+	// The patches to be applied.
+	Patches []solvable
+
+	// The size of the packages to be downloaded.
+	DownloadSize int64
+
+	// The difference in disk usage once the transaction has been committed.
+	SpaceUsageDiff int64
+
+	// Descriptions of the licenses that have to be accepted.
+	Licenses []string
+
+	// Problems reported by the solver.
+	Problems []string
+}
+
+// empty returns true if this transaction would not change anything.
+func (t *transaction) empty() bool {
+	if len(t.Patches) > 0 {
+		return false
+	}
+	for _, pkgs := range t.Packages {
+		if len(pkgs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// extractXMLStream returns the last XML stream as printed by zypper in the
+// given output. This is needed because the output might contain the plain
+// text output of other zypper commands, like `zypper ref`.
+func extractXMLStream(output string) (string, error) {
+	start := strings.LastIndex(output, "<stream>")
+	end := strings.LastIndex(output, "</stream>")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("zypper did not produce any XML output")
+	}
+	return output[start : end+len("</stream>")], nil
+}
+
+// parseTransaction parses the XML output of a zypper command that has been
+// run with the `--dry-run` flag.
+func parseTransaction(output string) (*transaction, error) {
+	str, err := extractXMLStream(output)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := zypperStream{}
+	if err := xml.Unmarshal([]byte(str), &stream); err != nil {
+		return nil, fmt.Errorf("could not parse the output of zypper: %v", err)
+	}
+
+	t := &transaction{Packages: make(map[string][]solvable)}
+	if s := stream.Summary; s != nil {
+		t.DownloadSize = s.DownloadSize
+		t.SpaceUsageDiff = s.SpaceUsageDiff
+
+		groups := []struct {
+			name      string
+			solvables []solvable
+		}{
+			{"installed", s.Install},
+			{"upgraded", s.Upgrade},
+			{"downgraded", s.Downgrade},
+			{"reinstalled", s.Reinstall},
+			{"removed", s.Remove},
+		}
+		for _, group := range groups {
+			for _, sv := range group.solvables {
+				if sv.Type == "patch" {
+					t.Patches = append(t.Patches, sv)
+				} else {
+					t.Packages[group.name] = append(t.Packages[group.name], sv)
+				}
+			}
+		}
+	}
+
+	for _, msg := range stream.Messages {
+		text := strings.TrimSpace(msg.Text)
+		if strings.Contains(text, "license agreement") {
+			t.Licenses = append(t.Licenses, text)
+		} else if msg.Type == "error" || strings.HasPrefix(text, "Problem:") {
+			t.Problems = append(t.Problems, text)
+		}
+	}
+	for _, prompt := range stream.Prompts {
+		text := strings.TrimSpace(prompt.Text)
+		if strings.Contains(strings.ToLower(text), "license") {
+			t.Licenses = append(t.Licenses, text)
+		}
+	}
+	return t, nil
+}
+
+// printTransaction prints in a human readable way the given transaction.
+func printTransaction(t *transaction) {
+	if t.empty() && len(t.Problems) == 0 {
+		fmt.Println("Nothing to do.")
+		return
+	}
+
+	if len(t.Patches) > 0 {
+		fmt.Printf("The following %d patches would be installed:\n", len(t.Patches))
+		for _, p := range t.Patches {
+			fmt.Printf("  - %s\n", p.Name)
+		}
+	}
+
+	for _, kind := range []string{"installed", "upgraded", "downgraded", "reinstalled", "removed"} {
+		pkgs := t.Packages[kind]
+		if len(pkgs) == 0 {
+			continue
+		}
+		fmt.Printf("The following %d packages would be %s:\n", len(pkgs), kind)
+		for _, p := range pkgs {
+			if p.EditionOld != "" {
+				fmt.Printf("  - %s %s -> %s (%s)\n", p.Name, p.EditionOld, p.Edition, p.Arch)
+			} else {
+				fmt.Printf("  - %s %s (%s)\n", p.Name, p.Edition, p.Arch)
+			}
+		}
+	}
+
+	if !t.empty() {
+		diff := units.BytesSize(float64(t.SpaceUsageDiff))
+		if t.SpaceUsageDiff >= 0 {
+			diff = "+" + diff
+		}
+		fmt.Printf("Overall download size: %s. Space usage difference: %s.\n",
+			units.BytesSize(float64(t.DownloadSize)), diff)
+	}
+
+	if len(t.Licenses) > 0 {
+		fmt.Println("The following licenses would have to be accepted:")
+		for _, l := range t.Licenses {
+			fmt.Printf("  - %s\n", l)
+		}
+	}
+
+	if len(t.Problems) > 0 {
+		fmt.Println("The solver reported the following problems:")
+		for _, p := range t.Problems {
+			fmt.Printf("  - %s\n", p)
+		}
+	}
+}
+
+// resolveTransaction runs the given zypper command in a throwaway container
+// based on the given image and returns the transaction that zypper would
+// perform. The given command is expected to print its results in XML format
+// and to not commit anything (i.e. it has been given the `--dry-run` flag).
+func resolveTransaction(img, cmd string) (*transaction, error) {
+	t, _, err := resolveRecordedTransaction(img, cmd)
+	return t, err
+}
+
+// resolveRecordedTransaction behaves like `resolveTransaction`, but it also
+// returns the records printed by the given command (see `recordCommand`).
+func resolveRecordedTransaction(img, cmd string) (*transaction, map[string]string, error) {
+	buf := bytes.NewBuffer([]byte{})
+	rec := newRecorder(buf)
+	id, err := runCommandInContainer(img, []string{cmd}, rec)
+	rec.flush()
+	removeContainer(id)
+
+	// Some errors (e.g. solver problems) are reported by zypper with an exit
+	// code different than 0, so try to parse the output anyways.
+	t, perr := parseTransaction(buf.String())
+	if perr != nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, perr
+	}
+	if err != nil && len(t.Problems) == 0 {
+		if de, ok := err.(dockerError); !ok || isZypperExitCodeSevere(de.exitCode) {
+			return nil, nil, err
+		}
+	}
+	return t, rec.records, nil
+}
+
+// dryRunCmd shows what the given update/patch command would do on the image
+// given as the first argument. Nothing is committed and the cache is left
+// untouched. It exits with zypperExitInfUpdateNeeded if the image would change,
+// and with 0 if there is nothing to be done.
+func dryRunCmd(zypperCmd string, ctx *cli.Context) {
+	if n := len(ctx.Args()); n != 1 && n != 2 {
+		logAndFatalf("Wrong invocation: expected 1 or 2 arguments, %d given.\n", n)
+		return
+	}
+	dryRunImage(zypperCmd, ctx.Args()[0], ctx)
+}
+
+// dryRunCommand returns the zypper commands that resolve the transaction of
+// the given zypper command (either "up" or "patch") on the img image without
+// applying it. The patches given with the `--patch` flag, and the ones
+// excluded with the `--exclude-patch` and the `--exclude-cve` flags, are
+// taken into account as in `patchCommand`.
+func dryRunCommand(zypperCmd, img string, ctx *cli.Context) (string, error) {
+	names := ctx.StringSlice("patch")
+	excluded := len(ctx.StringSlice("exclude-patch")) > 0 || len(ctx.StringSlice("exclude-cve")) > 0
+	sub := updatePatchSubcommand("--xmlout -n "+zypperCmd+" --dry-run", ctx)
+	if zypperCmd != "patch" || (len(names) == 0 && !excluded) {
+		return formatZypperCommand("ref", sub), nil
+	}
+
+	prov, err := inspectSource(img, zypperCmd, ctx, true)
+	if err != nil {
+		return "", err
+	}
+	locks, err := excludedPatches(prov, ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(names) > 0 {
+		if _, err = namedPatches(prov, names, locks); err != nil {
+			return "", err
+		}
+		sub = installSubcommand("--xmlout -n install --dry-run", names, ctx)
+	}
+
+	// The container is thrown away afterwards, so the locks do not have to
+	// be removed.
+	cmds := []string{"ref"}
+	if len(locks) > 0 {
+		cmds = append(cmds, addlockSubcommand(locks))
+	}
+	return formatZypperCommand(append(cmds, sub)...), nil
+}
+
+// dryRunImage shows what the given zypper command (either "up" or "patch")
+// would do on the img image. The exit code follows the conventions of
+// `dryRunCmd`.
+func dryRunImage(zypperCmd, img string, ctx *cli.Context) {
+	if err := checkSeveritySupport(img, ctx); err != nil {
+		logAndFatalf("%v\n", err)
+		return
+	}
+	cmd, err := dryRunCommand(zypperCmd, img, ctx)
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	t, err := resolveTransaction(img, cmd)
+	if err != nil {
+		logAndFatalf("Could not resolve the transaction: %v.\n", err)
+		return
+	}
+
+	printTransaction(t)
+	if len(t.Problems) > 0 {
+		log.Printf("The solver reported %d problems", len(t.Problems))
+		exitWithCode(1)
+	} else if !t.empty() {
+		exitWithCode(zypperExitInfUpdateNeeded)
+	} else {
+		exitWithCode(zypperExitOK)
+	}
+}
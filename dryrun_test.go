@@ -0,0 +1,199 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+const dryRunOutput = `Retrieving repository 'openSUSE-13.2-Update' metadata [done]
+All repositories have been refreshed.
+<?xml version='1.0'?>
+<stream>
+<message type="info">Loading repository data...</message>
+<install-summary download-size="1048576" space-usage-diff="2097152" packages-to-change="2">
+<to-upgrade>
+<solvable type="package" name="bash" edition="4.2-75.1" arch="x86_64" edition-old="4.2-68.1" arch-old="x86_64" summary="The GNU Bourne-Again Shell"/>
+<solvable type="package" name="openssl" edition="1.0.1k-2.24.1" arch="x86_64" edition-old="1.0.1k-2.1" arch-old="x86_64" summary="Secure Sockets and Transport Layer Security"/>
+</to-upgrade>
+<to-install>
+<solvable type="patch" name="openSUSE-2015-345" edition="1" arch="noarch" summary="Security update for openssl"/>
+</to-install>
+</install-summary>
+</stream>
+`
+
+const dryRunProblemsOutput = `<?xml version='1.0'?>
+<stream>
+<message type="error">Problem: nothing provides libfoo.so.1 needed by foo-1.0-1.x86_64</message>
+<message type="info">In order to install 'foo' (foo-1.0-1), you must agree to terms of the following license agreement:</message>
+</stream>
+`
+
+func TestParseTransaction(t *testing.T) {
+	tr, err := parseTransaction(dryRunOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if tr.empty() {
+		t.Fatal("The transaction should not be empty")
+	}
+	if len(tr.Patches) != 1 || tr.Patches[0].Name != "openSUSE-2015-345" {
+		t.Fatalf("Wrong patches: %v", tr.Patches)
+	}
+	if len(tr.Packages["upgraded"]) != 2 {
+		t.Fatalf("Wrong packages: %v", tr.Packages)
+	}
+	if tr.Packages["upgraded"][0].EditionOld != "4.2-68.1" {
+		t.Fatalf("Wrong old edition: %v", tr.Packages["upgraded"][0])
+	}
+	if tr.DownloadSize != 1048576 || tr.SpaceUsageDiff != 2097152 {
+		t.Fatalf("Wrong sizes: %v %v", tr.DownloadSize, tr.SpaceUsageDiff)
+	}
+	if len(tr.Problems) != 0 || len(tr.Licenses) != 0 {
+		t.Fatal("There should be neither problems nor licenses")
+	}
+}
+
+func TestParseTransactionProblemsAndLicenses(t *testing.T) {
+	tr, err := parseTransaction(dryRunProblemsOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !tr.empty() {
+		t.Fatal("The transaction should be empty")
+	}
+	if len(tr.Problems) != 1 || !strings.Contains(tr.Problems[0], "nothing provides libfoo.so.1") {
+		t.Fatalf("Wrong problems: %v", tr.Problems)
+	}
+	if len(tr.Licenses) != 1 || !strings.Contains(tr.Licenses[0], "'foo'") {
+		t.Fatalf("Wrong licenses: %v", tr.Licenses)
+	}
+}
+
+func TestParseTransactionNoXML(t *testing.T) {
+	if _, err := parseTransaction("Unknown option '--xmlout'"); err == nil {
+		t.Fatal("It should've failed")
+	}
+	if _, err := parseTransaction("<stream><message></stream>"); err == nil {
+		t.Fatal("It should've failed")
+	}
+}
+
+func TestDryRunCommand(t *testing.T) {
+	cases := []struct {
+		desc   string
+		client *mockClient
+		args   []string
+		code   int
+		stdout string
+	}{
+		{"Wrong invocation", &mockClient{}, []string{}, 1, "expected 1 or 2 arguments, 0 given"},
+		{"Nothing to do", &mockClient{logOutput: "<stream></stream>"}, []string{"opensuse:13.2"}, 0, "Nothing to do."},
+		{"Changes", &mockClient{logOutput: dryRunOutput}, []string{"opensuse:13.2", "new:1.0.0"}, 100, "bash 4.2-68.1 -> 4.2-75.1 (x86_64)"},
+		{"Problems", &mockClient{logOutput: dryRunProblemsOutput, commandFail: true, commandExit: 4}, []string{"opensuse:13.2"}, 1, "The solver reported the following problems"},
+		{"Start fails", &mockClient{startFail: true}, []string{"opensuse:13.2"}, 1, "Could not resolve the transaction: Start failed."},
+	}
+
+	for _, test := range cases {
+		setupTestExitStatus()
+		safeClient.client = test.client
+
+		buffer := bytes.NewBuffer([]byte{})
+		log.SetOutput(buffer)
+		captured := capture.All(func() { patchCmd(testContextWithFlags(append([]string{"--dry-run"}, test.args...), "dry-run")) })
+
+		if lastCode != test.code {
+			t.Fatalf("[%s] Expected to have exited with code %v, %v was received.",
+				test.desc, test.code, lastCode)
+		}
+		if !strings.Contains(string(captured.Stdout), test.stdout) {
+			t.Fatalf("[%s] Wrong stdout.\nExpecting:\n%s\n===\nReceived:\n%s\n",
+				test.desc, test.stdout, string(captured.Stdout))
+		}
+		if test.code == 0 || test.code == 100 {
+			cmd := test.client.lastCmd[0]
+			if !strings.Contains(cmd, "zypper --xmlout -n patch --dry-run") {
+				t.Fatalf("[%s] Wrong command: %s", test.desc, cmd)
+			}
+			if strings.Contains(cmd, "clean") {
+				t.Fatalf("[%s] The dry run should not clean anything: %s", test.desc, cmd)
+			}
+		}
+	}
+}
+
+func TestDryRunSeverityNotSupported(t *testing.T) {
+	setupTestExitStatus()
+	mc := &mockClient{logOutput: dryRunOutput, zypperBadVersion: true}
+	safeClient.client = mc
+	log.SetOutput(bytes.NewBuffer([]byte{}))
+
+	ctx := commandContext("patch", "--dry-run", "--severity", "important", "opensuse:13.2")
+	captured := capture.All(func() { patchCmd(ctx) })
+	if lastCode != 1 {
+		t.Fatalf("Expected exit code 1, got %d", lastCode)
+	}
+	if !strings.Contains(string(captured.Stdout), errSeverityUnsupported.Error()) {
+		t.Fatalf("Wrong output: %s", captured.Stdout)
+	}
+	if len(mc.lastCmd) != 1 || mc.lastCmd[0] != "zypper lp --severity" {
+		t.Fatalf("The dry run should not have been started: %v", mc.lastCmd)
+	}
+
+	mc.zypperBadVersion, mc.zypperGoodVersion = false, true
+	lastCode = 0
+	capture.All(func() { patchCmd(ctx) })
+	if lastCode != zypperExitInfUpdateNeeded || !strings.Contains(mc.lastCmd[0], "--dry-run --severity important") {
+		t.Fatalf("Unexpected dry run (%d): %v", lastCode, mc.lastCmd)
+	}
+}
+
+func TestDryRunPatchSelection(t *testing.T) {
+	setupTestExitStatus()
+	// The patches needed by the image are listed to check the ones given
+	// with --patch, and the same output is then taken as the transaction.
+	mc := &mockClient{logOutput: patchListOutput}
+	safeClient.client = mc
+	log.SetOutput(bytes.NewBuffer([]byte{}))
+
+	ctx := commandContext("patch", "--dry-run", "--patch", "openSUSE-2016-100", "--exclude-patch", "openSUSE-2015-1",
+		"opensuse:13.2")
+	captured := capture.All(func() { patchCmd(ctx) })
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, captured.Stdout)
+	}
+	cmd := mc.lastCmd[0]
+	if !strings.Contains(cmd, "zypper addlock -t patch 'openSUSE-2015-1' && ") ||
+		!strings.HasSuffix(cmd, "zypper --xmlout -n install --dry-run -- 'patch:openSUSE-2016-100'") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	// Without --patch, the exclusions are applied to the patch command.
+	ctx = commandContext("patch", "--dry-run", "--exclude-patch", "openSUSE-2015-1", "opensuse:13.2")
+	capture.All(func() { patchCmd(ctx) })
+	cmd = mc.lastCmd[0]
+	if !strings.Contains(cmd, "zypper addlock -t patch 'openSUSE-2015-1' && ") ||
+		!strings.HasSuffix(cmd, "zypper --xmlout -n patch --dry-run") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
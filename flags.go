@@ -48,6 +48,50 @@ func defaultCommitAuthor() string {
 	return current.Username
 }
 
+// containerFlags returns the given flags of either the update or the patch
+// command plus the ones of their variants acting on containers.
+func containerFlags(flags []cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "stopped",
+			Usage: "Also look for the container among the stopped ones.",
+		},
+		cli.BoolFlag{
+			Name:  "recreate",
+			Usage: "Recreate the container on top of the new image.",
+		},
+	}, flags...)
+}
+
+// repositoryFlags returns the given flags of the patch command plus the ones
+// used to patch all the tags of a repository.
+func repositoryFlags(flags []cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "repository",
+			Value: "",
+			Usage: "Patch all the local tags of this repository instead of a single image.",
+		},
+		cli.StringFlag{
+			Name:  "tag-template",
+			Value: "",
+			Usage: "Template for the tag of each new image when using --repository (e.g. '{{.Tag}}-patched').",
+		},
+	}, flags...)
+}
+
+// withoutFlags returns the given flags except for the ones with the given
+// names.
+func withoutFlags(flags []cli.Flag, names ...string) []cli.Flag {
+	result := []cli.Flag{}
+	for _, flag := range flags {
+		if !arrayIncludeString(names, flag.GetName()) {
+			result = append(result, flag)
+		}
+	}
+	return result
+}
+
 // It returns an application with all the flags and subcommands already in
 // place.
 func newApp() *cli.App {
@@ -83,6 +127,191 @@ func newApp() *cli.App {
 			Name:  "add-host",
 			Usage: "Add a custom host-to-IP mapping (host:ip)",
 		},
+		cli.StringFlag{
+			Name:  "oci",
+			Value: "",
+			Usage: "Work on the OCI image layout stored in this directory instead of the Docker daemon",
+		},
+		cli.StringFlag{
+			Name:  "helper-image",
+			Value: "",
+			Usage: "Run zypper from this image on the file system of the target images, which then need neither a shell nor zypper",
+		},
+	}
+
+	updateFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  "skip-interactive",
+			Usage: "Skip interactive patches, that is, those that need a reboot, contain a message, or update a package whose license needs to be confirmed.",
+		},
+		cli.BoolFlag{
+			Name:  "with-interactive",
+			Usage: "Avoid skipping of interactive patches when in non-interactive mode.",
+		},
+		cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "Attach the standard input to zypper, so licenses and patch messages can be read and accepted.",
+		},
+		cli.BoolFlag{
+			Name:  "l, auto-agree-with-licenses",
+			Usage: "Automatically say yes to third party license confirmation prompt. By using this option, you choose to agree with licenses of all third-party software this command will install.",
+		},
+		cli.BoolFlag{
+			Name:  "no-recommends",
+			Usage: "By default, zypper installs also packages recommended by the requested ones. This option causes the recommended packages to be ignored and only the required ones to be installed.",
+		},
+		cli.BoolFlag{
+			Name:  "replacefiles",
+			Usage: "Install the packages even if they replace files from other, already installed, packages. Default is to treat file conflicts as an error.",
+		},
+		cli.StringFlag{
+			Name:  "author",
+			Value: defaultCommitAuthor(),
+			Usage: "Commit author to associate with the new layer (e.g., \"John Doe <john.doe@example.com>\")",
+		},
+		cli.StringFlag{
+			Name:  "message",
+			Value: "[zypper-docker] update",
+			Usage: "Commit message to associated with the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Allow <new-image> to exist already. The image holding it is kept under the <tag>-pre-zypper-<timestamp> tag.",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Show what would be done without creating the new image. The exit code is 100 if the image would change, 0 otherwise.",
+		},
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "Push the new image to its registry once it has been created.",
+		},
+		cli.BoolFlag{
+			Name:  "squash",
+			Usage: "Merge the layers added by zypper-docker on top of the original base image into a single one.",
+		},
+		cli.StringFlag{
+			Name:  "builder",
+			Value: "commit",
+			Usage: "How the new image is created: either by committing a helper container (commit) or by building a generated Dockerfile (dockerfile).",
+		},
+		cli.StringFlag{
+			Name:  "dockerfile",
+			Value: "",
+			Usage: "Write the generated Dockerfile to this path. Only with --builder=dockerfile.",
+		},
+	}
+	patchFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "bugzilla",
+			Value: "",
+			Usage: "Install available needed patches for all Bugzilla issues, or issues whose number matches the given string (--bugzilla=#).",
+		},
+		cli.StringFlag{
+			Name:  "cve",
+			Value: "",
+			Usage: "Install available needed patches for all CVE issues, or issues whose number matches the given string (--cve=#).",
+		},
+		cli.StringFlag{
+			Name:  "date",
+			Value: "",
+			Usage: "Install patches issued up to, but not including, the specified date (YYYY-MM-DD).",
+		},
+		cli.StringFlag{
+			Name:  "g, category",
+			Value: "",
+			Usage: "Install only patches with this category.",
+		},
+		cli.StringFlag{
+			Name:  "severity",
+			Value: "",
+			Usage: "Install only patches with this severity.",
+		},
+		cli.StringFlag{
+			Name:  "min-severity",
+			Value: "",
+			Usage: "Install only patches with this severity or a higher one (low, moderate, important or critical).",
+		},
+		cli.BoolFlag{
+			Name:  "security",
+			Usage: "Install only security patches. Shortcut for --category security.",
+		},
+		cli.BoolFlag{
+			Name:  "skip-interactive",
+			Usage: "Skip interactive patches, that is, those that need a reboot, contain a message, or update a package whose license needs to be confirmed.",
+		},
+		cli.BoolFlag{
+			Name:  "with-interactive",
+			Usage: "Avoid skipping of interactive patches when in non-interactive mode.",
+		},
+		cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "Attach the standard input to zypper, so licenses and patch messages can be read and accepted.",
+		},
+		cli.BoolFlag{
+			Name:  "select",
+			Usage: "Pick the patches to install from the list of the needed ones in a terminal UI.",
+		},
+		cli.StringSliceFlag{
+			Name:  "patch",
+			Usage: "Install exactly this patch, which can be given multiple times. It cannot be combined with the flags filtering patches.",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude-patch",
+			Usage: "Do not install this patch, even if it matches the other filters. It can be given multiple times.",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude-cve",
+			Usage: "Do not install the patches fixing this CVE, even if they match the other filters. It can be given multiple times.",
+		},
+		cli.BoolFlag{
+			Name:  "l, auto-agree-with-licenses",
+			Usage: "Automatically say yes to third party license confirmation prompt. By using this option, you choose to agree with licenses of all third-party software this command will install.",
+		},
+		cli.BoolFlag{
+			Name:  "no-recommends",
+			Usage: "By default, zypper installs also packages recommended by the requested ones. This option causes the recommended packages to be ignored and only the required ones to be installed.",
+		},
+		cli.BoolFlag{
+			Name:  "replacefiles",
+			Usage: "Install the packages even if they replace files from other, already installed, packages. Default is to treat file conflicts as an error.",
+		},
+		cli.StringFlag{
+			Name:  "author",
+			Value: defaultCommitAuthor(),
+			Usage: "Commit author to associate with the new layer (e.g., \"John Doe <john.doe@example.com>\")",
+		},
+		cli.StringFlag{
+			Name:  "message",
+			Value: "[zypper-docker] patch",
+			Usage: "Commit message to associated with the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Allow <new-image> to exist already. The image holding it is kept under the <tag>-pre-zypper-<timestamp> tag.",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Show what would be done without creating the new image. The exit code is 100 if the image would change, 0 otherwise.",
+		},
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "Push the new image to its registry once it has been created.",
+		},
+		cli.BoolFlag{
+			Name:  "squash",
+			Usage: "Merge the layers added by zypper-docker on top of the original base image into a single one.",
+		},
+		cli.StringFlag{
+			Name:  "builder",
+			Value: "commit",
+			Usage: "How the new image is created: either by committing a helper container (commit) or by building a generated Dockerfile (dockerfile).",
+		},
+		cli.StringFlag{
+			Name:  "dockerfile",
+			Value: "",
+			Usage: "Write the generated Dockerfile to this path. Only with --builder=dockerfile.",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -108,8 +337,14 @@ If the tag has not been provided, then "latest" is the one that will be used.`,
 			Action:  getCmd("list-updates-container", listUpdatesContainerCmd),
 			ArgsUsage: `<container-id>
 
-Where <container-id> is either the container ID or the name of the container
-to be used.`,
+Where <container-id> is either the container ID, any unambiguous prefix of it,
+or the name of the container to be used.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "stopped",
+					Usage: "Also look for the container among the stopped ones.",
+				},
+			},
 		},
 		{
 			Name:    "update",
@@ -119,36 +354,33 @@ to be used.`,
 			ArgsUsage: `<image> <new-image>
 
 Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to
-update. Since zypper-docker does not overwrite images, <new-image> is the name
-of the image that will be created on this operation. This new image will be the
+update. Unless --overwrite is given, zypper-docker does not overwrite images:
+<new-image> is the name of the image that will be created on this operation. This new image will be the
 same as the old one plus the applied updates.
 
 If the tag has not been provided on either <image> or <new-image>, then
-"latest" is the one that will be used.`,
-			Flags: []cli.Flag{
-				cli.BoolFlag{
-					Name:  "l, auto-agree-with-licenses",
-					Usage: "Automatically say yes to third party license confirmation prompt. By using this option, you choose to agree with licenses of all third-party software this command will install.",
-				},
-				cli.BoolFlag{
-					Name:  "no-recommends",
-					Usage: "By default, zypper installs also packages recommended by the requested ones. This option causes the recommended packages to be ignored and only the required ones to be installed.",
-				},
-				cli.BoolFlag{
-					Name:  "replacefiles",
-					Usage: "Install the packages even if they replace files from other, already installed, packages. Default is to treat file conflicts as an error.",
-				},
-				cli.StringFlag{
-					Name:  "author",
-					Value: defaultCommitAuthor(),
-					Usage: "Commit author to associate with the new layer (e.g., \"John Doe <john.doe@example.com>\")",
-				},
-				cli.StringFlag{
-					Name:  "message",
-					Value: "[zypper-docker] update",
-					Usage: "Commit message to associated with the new layer",
-				},
-			},
+"latest" is the one that will be used. The <new-image> argument can be omitted
+when passing the --dry-run flag.
+
+The <new-image> argument can also be a Go template with access to the source
+repository, tag and short ID (e.g. '{{.Repo}}:{{.Tag}}-p{{.Date "20060102"}}'),
+to the number of patches to be applied (.Patches) and to their highest
+severity (.Severity).`,
+			Flags: updateFlags,
+		},
+		{
+			Name:    "update-container",
+			Aliases: []string{"upc"},
+			Usage:   "Install the available updates on the image of the given container",
+			Action:  getCmd("update-container", updateContainerCmd),
+			ArgsUsage: `<container-id> <new-image>
+
+Where <container-id> is either the container ID, any unambiguous prefix of it,
+or the name of the container whose image is to be updated. The <new-image>
+argument behaves as in the update command. With --recreate, the container is
+then recreated on top of <new-image>, keeping its name, configuration,
+networks, volumes and restart policy.`,
+			Flags: containerFlags(updateFlags),
 		},
 		{
 			Name:    "list-patches",
@@ -190,6 +422,15 @@ If the tag has not been provided, then "latest" is the one that will be used.`,
 					Value: "",
 					Usage: "List only patches with this severity.",
 				},
+				cli.StringFlag{
+					Name:  "min-severity",
+					Value: "",
+					Usage: "List only patches with this severity or a higher one (low, moderate, important or critical).",
+				},
+				cli.BoolFlag{
+					Name:  "security",
+					Usage: "List only security patches. Shortcut for --category security.",
+				},
 			},
 		},
 		{
@@ -199,9 +440,13 @@ If the tag has not been provided, then "latest" is the one that will be used.`,
 			Action:  listPatchesContainerCmd,
 			ArgsUsage: `<container-id>
 
-Where <container-id> is either the container ID or the name of the container
-to be used.`,
+Where <container-id> is either the container ID, any unambiguous prefix of it,
+or the name of the container to be used.`,
 			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "stopped",
+					Usage: "Also look for the container among the stopped ones.",
+				},
 				cli.StringFlag{
 					Name:  "b, bugzilla",
 					Value: "",
@@ -227,53 +472,227 @@ to be used.`,
 					Value: "",
 					Usage: "List only patches with this category.",
 				},
+				cli.StringFlag{
+					Name:  "severity",
+					Value: "",
+					Usage: "List only patches with this severity.",
+				},
+				cli.StringFlag{
+					Name:  "min-severity",
+					Value: "",
+					Usage: "List only patches with this severity or a higher one (low, moderate, important or critical).",
+				},
+				cli.BoolFlag{
+					Name:  "security",
+					Usage: "List only security patches. Shortcut for --category security.",
+				},
 			},
 		},
 		{
 			Name:   "patch",
 			Usage:  "Install the available patches",
 			Action: getCmd("patch", patchCmd),
-			ArgsUsage: `<image> <new-image>
+			ArgsUsage: `<image> <new-image> | --repository <repository> --tag-template <template>
 
 Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to
-patch. Since zypper-docker does not overwrite images, <new-image> is the name
-of the image that will be created on this operation. This new image will be the
+patch. Unless --overwrite is given, zypper-docker does not overwrite images:
+<new-image> is the name of the image that will be created on this operation. This new image will be the
 same as the old one plus the applied patches.
 
 If the tag has not been provided on either <image> or <new-image>, then
-"latest" is the one that will be used.`,
+"latest" is the one that will be used. The <new-image> argument can be omitted
+when passing the --dry-run flag.
+
+The <new-image> argument can also be a Go template with access to the source
+repository, tag and short ID (e.g. '{{.Repo}}:{{.Tag}}-p{{.Date "20060102"}}'),
+to the number of patches to be applied (.Patches) and to their highest
+severity (.Severity).
+
+With --repository, all the local tags of the given repository are patched
+instead. Each image is patched only once, and the result is tagged for each of
+its tags with the tag given by --tag-template (e.g. '{{.Tag}}-patched').`,
+			Flags: repositoryFlags(patchFlags),
+		},
+		{
+			Name:    "patch-container",
+			Aliases: []string{"pc"},
+			Usage:   "Install the available patches on the image of the given container",
+			Action:  getCmd("patch-container", patchContainerCmd),
+			ArgsUsage: `<container-id> <new-image>
+
+Where <container-id> is either the container ID, any unambiguous prefix of it,
+or the name of the container whose image is to be patched. The <new-image>
+argument behaves as in the patch command. With --recreate, the container is
+then recreated on top of <new-image>, keeping its name, configuration,
+networks, volumes and restart policy.`,
+			Flags: containerFlags(patchFlags),
+		},
+		{
+			Name:   "patch-archive",
+			Usage:  "Install the available patches on an image saved with \"docker save\"",
+			Action: getCmd("patch-archive", patchArchiveCmd),
+			ArgsUsage: `<in.tar> <out.tar>
+
+Where <in.tar> is an archive holding a single image, as produced by "docker
+save". The image is loaded into the daemon under a temporary name, patched,
+and the new image is saved into <out.tar>. The temporary images and containers
+are always removed afterwards, even if the command is interrupted. The new
+image is named after the original one, unless --target is given.`,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "target",
+					Value: "",
+					Usage: "Name of the patched image inside <out.tar>, which can be a template as in the patch command.",
+				},
+			}, withoutFlags(patchFlags, "overwrite", "dry-run", "push", "squash")...),
+		},
+		{
+			Name:   "rebase",
+			Usage:  "Move an image built on top of an outdated base onto the patched one",
+			Action: getCmd("rebase", rebaseCmd),
+			ArgsUsage: `<app-image> <new-image>
+
+Where <app-image> is an image built on top of an outdated base image, and
+<new-image> is the name of the image to be created. The layers of the old base
+are replaced by the ones of the image given with --onto, and the layers of
+<app-image> are kept on top of them. The old base is found among the images
+that the --onto image has been derived from by zypper-docker, unless --from is
+given. The files updated by the new base that the layers of <app-image>
+override or remove are listed afterwards.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "onto",
+					Value: "",
+					Usage: "The patched base image.",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Value: "",
+					Usage: "The base image that <app-image> has been built on.",
+				},
+			},
+		},
+		{
+			Name:    "patch-check",
+			Aliases: []string{"pchk"},
+			Usage:   "Check for patches",
+			Action:  getCmd("patch-check", patchCheckCmd),
+			ArgsUsage: `<image>
+
+Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to use.
+If the tag has not been provided, then "latest" is the one that will be used.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "severity",
+					Value: "",
+					Usage: "Check only patches with this severity.",
+				},
+				cli.StringFlag{
+					Name:  "min-severity",
+					Value: "",
+					Usage: "Check only patches with this severity or a higher one (low, moderate, important or critical).",
+				},
+				cli.BoolFlag{
+					Name:  "security",
+					Usage: "Check only security patches. Shortcut for --category security.",
+				},
+			},
+		},
+		{
+			Name:    "patch-check-container",
+			Aliases: []string{"pchkc"},
+			Usage:   "Check for patches available for the given container",
+			Action:  getCmd("patch-check-container", patchCheckContainerCmd),
+			ArgsUsage: `<container-id>
+
+Where <container-id> is either the container ID, any unambiguous prefix of it,
+or the name of the container to be used.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "stopped",
+					Usage: "Also look for the container among the stopped ones.",
+				},
+				cli.StringFlag{
+					Name:  "severity",
+					Value: "",
+					Usage: "Check only patches with this severity.",
+				},
+				cli.StringFlag{
+					Name:  "min-severity",
+					Value: "",
+					Usage: "Check only patches with this severity or a higher one (low, moderate, important or critical).",
+				},
+				cli.BoolFlag{
+					Name:  "security",
+					Usage: "Check only security patches. Shortcut for --category security.",
+				},
+			},
+		},
+		{
+			Name:   "plan",
+			Usage:  "Write the exact transactions that would patch the given images",
+			Action: getCmd("plan", planCmd),
+			ArgsUsage: `<image>...
+
+Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to
+patch. The resulting plan contains the patches and the exact versions of the
+packages that would be installed and removed in each image, and it can be
+applied later on with "apply --plan".`,
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target",
+					Usage: "The name of the new image, or a template for the names of the new images (e.g. '{{.Repo}}:{{.Tag}}-patched').",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Value: "plan.yaml",
+					Usage: "The file where the plan is written (\"-\" for the standard output).",
+				},
 				cli.StringFlag{
 					Name:  "bugzilla",
 					Value: "",
-					Usage: "Install available needed patches for all Bugzilla issues, or issues whose number matches the given string (--bugzilla=#).",
+					Usage: "Plan available needed patches for all Bugzilla issues, or issues whose number matches the given string (--bugzilla=#).",
 				},
 				cli.StringFlag{
 					Name:  "cve",
 					Value: "",
-					Usage: "Install available needed patches for all CVE issues, or issues whose number matches the given string (--cve=#).",
+					Usage: "Plan available needed patches for all CVE issues, or issues whose number matches the given string (--cve=#).",
 				},
 				cli.StringFlag{
 					Name:  "date",
 					Value: "",
-					Usage: "Install patches issued up to, but not including, the specified date (YYYY-MM-DD).",
+					Usage: "Plan patches issued up to, but not including, the specified date (YYYY-MM-DD).",
 				},
 				cli.StringFlag{
 					Name:  "g, category",
 					Value: "",
-					Usage: "Install only patches with this category.",
+					Usage: "Plan only patches with this category.",
+				},
+				cli.StringFlag{
+					Name:  "severity",
+					Value: "",
+					Usage: "Plan only patches with this severity.",
+				},
+				cli.StringFlag{
+					Name:  "min-severity",
+					Value: "",
+					Usage: "Plan only patches with this severity or a higher one (low, moderate, important or critical).",
+				},
+				cli.BoolFlag{
+					Name:  "security",
+					Usage: "Plan only security patches. Shortcut for --category security.",
 				},
 				cli.BoolFlag{
 					Name:  "l, auto-agree-with-licenses",
-					Usage: "Automatically say yes to third party license confirmation prompt. By using this option, you choose to agree with licenses of all third-party software this command will install.",
+					Usage: "Automatically say yes to third party license confirmation prompt, both when planning and when applying the plan.",
 				},
 				cli.BoolFlag{
 					Name:  "no-recommends",
-					Usage: "By default, zypper installs also packages recommended by the requested ones. This option causes the recommended packages to be ignored and only the required ones to be installed.",
+					Usage: "Do not plan the installation of packages recommended by the required ones.",
 				},
 				cli.BoolFlag{
 					Name:  "replacefiles",
-					Usage: "Install the packages even if they replace files from other, already installed, packages. Default is to treat file conflicts as an error.",
+					Usage: "Install the packages even if they replace files from other, already installed, packages.",
 				},
 				cli.StringFlag{
 					Name:  "author",
@@ -288,24 +707,87 @@ If the tag has not been provided on either <image> or <new-image>, then
 			},
 		},
 		{
-			Name:    "patch-check",
-			Aliases: []string{"pchk"},
-			Usage:   "Check for patches",
-			Action:  getCmd("patch-check", patchCheckCmd),
+			Name:   "apply",
+			Usage:  "Patch all the images listed in a manifest or a plan file",
+			Action: getCmd("apply", applyCmd),
+			ArgsUsage: `
+
+The manifest is a YAML file listing the images to be patched. Each image has a
+source, a target (which can be a template as accepted by the patch command)
+and, optionally, the bugzilla, cve, date, category, severity, no-recommends,
+auto-agree-with-licenses, author and message settings. The author and the
+message can also be given at the top level of the manifest. Sources resolving
+to the same image with the same settings are patched only once.
+
+Alternatively, a plan file as written by the plan command can be given with
+--plan. In this case, exactly the packages listed in the plan are installed,
+and an image is not patched if the repositories can no longer satisfy its
+plan.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "f, file",
+					Usage: "The manifest file listing the images to be patched.",
+				},
+				cli.StringFlag{
+					Name:  "plan",
+					Usage: "The plan file, as written by the plan command, to be applied.",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "Maximum number of images being patched at the same time. It overrides the one given in the manifest, which defaults to 2.",
+				},
+				cli.StringFlag{
+					Name:  "summary",
+					Usage: "Write a JSON summary of the results to the given file (\"-\" for the standard output).",
+				},
+			},
+		},
+		{
+			Name:   "rollback",
+			Usage:  "Restore an image to the one it was derived from",
+			Action: getCmd("rollback", rollbackCmd),
 			ArgsUsage: `<image>
 
-Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to use.
-If the tag has not been provided, then "latest" is the one that will be used.`,
+Where <image> is the name of an image created by either the update or the patch
+commands. Afterwards, <image> will point to the image it was derived from. The
+image being rolled back is flagged as broken, so the "ps" command can report
+the containers that are still using it.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "recreate",
+					Usage: "Recreate the containers based on <image> so they use the restored image.",
+				},
+			},
 		},
 		{
-			Name:    "patch-check-container",
-			Aliases: []string{"pchkc"},
-			Usage:   "Check for patches available for the given container",
-			Action:  getCmd("patch-check-container", patchCheckContainerCmd),
-			ArgsUsage: `<container-id>
+			Name:   "push",
+			Usage:  "Push an image created by zypper-docker to its registry",
+			Action: getCmd("push", pushCmd),
+			ArgsUsage: `<image>
+
+Where <image> is the name of an image created by either the update or the patch
+commands. The credentials are taken from the docker config file, as written by
+"docker login".`,
+		},
+		{
+			Name:   "replace",
+			Usage:  "Replace outdated containers with ones based on the updated images",
+			Action: getCmd("replace", replaceCmd),
+			ArgsUsage: `[<container-id>...]
 
-Where <container-id> is either the container ID or the name of the container
-to be used.`,
+Where <container-id> is either the container ID, any unambiguous prefix of it,
+or the name of a running container to be replaced. If no container is given,
+all the running containers based on images updated by zypper-docker are
+replaced. The new containers keep the name, the configuration, the networks,
+the volumes and the restart policy of the old ones. If a new container does
+not become healthy in time, the old one is restored.`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "timeout",
+					Value: 60,
+					Usage: "Seconds to wait for each new container to become healthy.",
+				},
+			},
 		},
 		{
 			Name:      "ps",
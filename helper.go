@@ -0,0 +1,568 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/strslice"
+)
+
+// The directory of the helper container in which the file system of the target
+// image is extracted. The archive of the original file system is kept next to
+// it, in helperRoot + ".tar".
+const helperRoot = "/zypper-docker-root"
+
+// helperSetup is the shell code run by the helper container before the zypper
+// commands. It extracts the file system of the target image, and it defines a
+// zypper function that runs the zypper of the helper on it. The caches of
+// zypper stay in the helper, and the repositories of the helper are used if
+// the target image does not define any.
+const helperSetup = `mkdir -p "$ZYPPER_DOCKER_ROOT" &&
+tar -xpf "$ZYPPER_DOCKER_ROOT.tar" --numeric-owner -C "$ZYPPER_DOCKER_ROOT" || exit 1
+zypper() {
+	if ls "$ZYPPER_DOCKER_ROOT"/etc/zypp/repos.d/*.repo >/dev/null 2>&1; then
+		command zypper --root "$ZYPPER_DOCKER_ROOT" --cache-dir /var/cache/zypp "$@"
+	else
+		command zypper --root "$ZYPPER_DOCKER_ROOT" --cache-dir /var/cache/zypp --reposd-dir /etc/zypp/repos.d "$@"
+	fi
+}
+`
+
+// helperImage returns the image given with the `--helper-image` flag, or an
+// empty string if zypper has to be run inside of the target images.
+func helperImage() string {
+	if currentContext == nil {
+		return ""
+	}
+	return currentContext.GlobalString("helper-image")
+}
+
+// suseCheckCommand returns the command that succeeds on the images that can be
+// patched by zypper-docker.
+func suseCheckCommand() string {
+	if helperImage() == "" {
+		return "zypper"
+	}
+	// The target only needs an RPM database, zypper comes from the helper.
+	return `rpm --root "$ZYPPER_DOCKER_ROOT" -qa | grep -q .`
+}
+
+// rootfsName returns the path, relative to the root, of the entry of an
+// archive of a root file system with the given name, once the given prefix
+// directory has been removed from it. It returns an empty string for the root
+// itself and for entries outside of the prefix.
+func rootfsName(name, prefix string) string {
+	p := path.Clean("/" + name)
+	if prefix != "" {
+		pre := path.Clean("/" + prefix)
+		if !strings.HasPrefix(p, pre+"/") {
+			return ""
+		}
+		p = strings.TrimPrefix(p, pre)
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// normalizeRootfs copies the given archive of a root file system into w, with
+// the names of its entries relative to the root.
+func normalizeRootfs(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Name = rootfsName(hdr.Name, ""); hdr.Name == "" {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		} else if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rootfsName(hdr.Linkname, "")
+		}
+		if err = tw.WriteHeader(hdr); err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// entryMetadata returns the part of the fingerprint of the given entry of an
+// archive that does not depend on its contents.
+func entryMetadata(hdr *tar.Header) string {
+	typeflag := hdr.Typeflag
+	if typeflag == tar.TypeRegA {
+		typeflag = tar.TypeReg
+	}
+	return fmt.Sprintf("%c %o %d:%d %d %d %s", typeflag, hdr.Mode, hdr.Uid, hdr.Gid,
+		hdr.Size, hdr.ModTime.Unix(), hdr.Linkname)
+}
+
+// fingerprint returns a string that changes whenever the given entry of an
+// archive changes, given the checksum of its contents.
+func fingerprint(hdr *tar.Header, sum []byte) string {
+	return fmt.Sprintf("%s %x", entryMetadata(hdr), sum)
+}
+
+// rootfsFingerprints returns the fingerprint of each entry of the given
+// archive of a root file system, indexed by the name returned by
+// `rootfsName`.
+func rootfsFingerprints(r io.Reader, prefix string) (map[string]string, error) {
+	res := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := rootfsName(hdr.Name, prefix)
+		if name == "" {
+			continue
+		}
+		hash := sha256.New()
+		if _, err = io.Copy(hash, tr); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rootfsName(hdr.Linkname, prefix)
+		}
+		res[name] = fingerprint(hdr, hash.Sum(nil))
+	}
+}
+
+// diffRootfs writes into w a layer with the changes between the root file
+// system described by the old fingerprints and the one of the given archive.
+// The prefix is removed from the names of the entries of the archive.
+//
+// Entries whose metadata has changed are copied right away. Otherwise, their
+// contents have to be checked as well, so they are kept in a temporary file
+// until it's known whether they have changed. This way, files are never held
+// in memory.
+func diffRootfs(old map[string]string, r io.Reader, prefix string, w io.Writer) error {
+	// The entries of the new root file system, and whether they are
+	// directories.
+	seen := make(map[string]bool)
+
+	spool, err := ioutil.TempFile("", "zypper-docker-diff")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := rootfsName(hdr.Name, prefix)
+		if name == "" {
+			continue
+		}
+		seen[name] = hdr.Typeflag == tar.TypeDir
+
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rootfsName(hdr.Linkname, prefix)
+		}
+		var data io.Reader = tr
+		if fp, ok := old[name]; ok && strings.HasPrefix(fp, entryMetadata(hdr)+" ") {
+			sum, err := spoolEntry(spool, tr)
+			if err != nil {
+				return err
+			}
+			if fp == fingerprint(hdr, sum) {
+				continue
+			}
+			data = spool
+		}
+
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err == nil {
+			_, err = io.Copy(tw, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Whiteouts for the removed entries. Removing a directory is enough to
+	// remove its contents.
+	removed := []string{}
+	for name := range old {
+		if _, ok := seen[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	gone := make(map[string]bool)
+	for _, name := range removed {
+		gone[name] = true
+		skip := false
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if isDir, ok := seen[dir]; gone[dir] || (ok && !isDir) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+
+		dir, base := path.Split(name)
+		err := tw.WriteHeader(&tar.Header{
+			Name:     dir + archive.WhiteoutPrefix + base,
+			Mode:     0644,
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// spoolEntry replaces the contents of the given file with the ones read from
+// r, and rewinds it so they can be read back. It returns their checksum.
+func spoolEntry(f *os.File, r io.Reader) ([]byte, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), r); err != nil {
+		return nil, err
+	}
+	_, err := f.Seek(0, 0)
+	return hash.Sum(nil), err
+}
+
+// exportRootfs writes into w the root file system of the given image, with
+// the names of its entries relative to the root.
+func exportRootfs(img string, w io.Writer) error {
+	client := getDockerClient()
+
+	// The container is never started, so its command does not matter.
+	resp, err := client.ContainerCreate(&container.Config{
+		Image:      img,
+		Entrypoint: strslice.New("/bin/sh"),
+	}, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer removeContainer(resp.ID)
+
+	body, _, err := client.CopyFromContainer(resp.ID, "/")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return normalizeRootfs(body, w)
+}
+
+// createHelperContainer behaves like `createContainer`, but the container is
+// based on the helper image and the given commands run on a copy of the file
+// system of the target image.
+func createHelperContainer(img string, cmd []string, stdin bool) (string, error) {
+	client := getDockerClient()
+
+	rootfs, err := ioutil.TempFile("", "zypper-docker-rootfs")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = rootfs.Close()
+		_ = os.Remove(rootfs.Name())
+	}()
+	if err = exportRootfs(img, rootfs); err != nil {
+		return "", fmt.Errorf("could not export the file system of '%s': %v", img, err)
+	}
+	info, err := rootfs.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	script := make([]string, len(cmd))
+	for i, c := range cmd {
+		script[i] = helperSetup + c
+	}
+	resp, err := client.ContainerCreate(&container.Config{
+		Image:        helperImage(),
+		Cmd:          strslice.New(script...),
+		Entrypoint:   strslice.New("/bin/sh", "-c"),
+		Env:          []string{"ZYPPER_DOCKER_ROOT=" + helperRoot},
+		AttachStdin:  stdin,
+		AttachStdout: true,
+		AttachStderr: true,
+		OpenStdin:    stdin,
+		StdinOnce:    stdin,
+		User:         rootUser,
+		Tty:          stdoutIsTerminal(),
+	}, getHostConfig(), nil, "")
+	if err != nil {
+		return "", err
+	}
+	for _, warning := range resp.Warnings {
+		log.Print(warning)
+	}
+
+	// The daemon would make root the owner of every copied file, so the file
+	// system is copied as a single archive which is then extracted by the
+	// helper itself.
+	if _, err = rootfs.Seek(0, 0); err == nil {
+		pr, pw := io.Pipe()
+		go func() {
+			tw := tar.NewWriter(pw)
+			err := tw.WriteHeader(&tar.Header{
+				Name:     strings.TrimPrefix(helperRoot, "/") + ".tar",
+				Mode:     0600,
+				Size:     info.Size(),
+				ModTime:  time.Now(),
+				Typeflag: tar.TypeReg,
+			})
+			if err == nil {
+				_, err = io.Copy(tw, rootfs)
+			}
+			if err == nil {
+				err = tw.Close()
+			}
+			_ = pw.CloseWithError(err)
+		}()
+		err = client.CopyToContainer(types.CopyToContainerOptions{
+			ContainerID: resp.ID,
+			Path:        "/",
+			Content:     pr,
+		})
+		_ = pr.Close()
+	}
+	if err != nil {
+		removeContainer(resp.ID)
+		return "", fmt.Errorf("could not copy the file system of '%s' into the helper: %v", img, err)
+	}
+	return resp.ID, nil
+}
+
+// commitHelperConfig returns the given configuration of an image with a new
+// layer on top of it, with the given diff ID. The new layer is described by
+// the rest of the arguments, as in `commitContainerToImage`.
+func commitHelperConfig(data []byte, diffID, cmd, comment, author string, labels map[string]string) ([]byte, error) {
+	config := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	runConfig := make(map[string]json.RawMessage)
+	if raw, ok := config["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &runConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	var rootfs imageRootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("could not read the layers of the image: %v", err)
+	}
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+
+	var history []imageHistory
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("could not read the history of the image: %v", err)
+		}
+	}
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	if len(history) > 0 {
+		history = append(history, imageHistory{
+			Created:   created,
+			CreatedBy: "/bin/sh -c " + cmd,
+			Author:    author,
+			Comment:   comment,
+		})
+	}
+
+	var parentLabels map[string]string
+	if raw, ok := runConfig["Labels"]; ok {
+		if err := json.Unmarshal(raw, &parentLabels); err != nil {
+			return nil, fmt.Errorf("could not read the labels of the image: %v", err)
+		}
+	}
+
+	values := map[string]interface{}{
+		"created": created,
+		"author":  author,
+		"rootfs":  rootfs,
+		"history": history,
+	}
+	if len(history) == 0 {
+		delete(values, "history")
+	}
+	for key, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		config[key] = raw
+	}
+
+	var err error
+	if runConfig["Labels"], err = json.Marshal(mergeLabels(parentLabels, labels)); err != nil {
+		return nil, err
+	}
+	if config["config"], err = json.Marshal(runConfig); err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+// commitHelperContainer stores the changes done by the given helper container
+// on the file system of img into the image repo:tag. Only the file system of
+// img is taken into account, so nothing from the helper image ends up in the
+// new one. It returns the ID of the new image.
+func commitHelperContainer(img, containerID, repo, tag, cmd, comment, author string, labels map[string]string) (string, error) {
+	client := getDockerClient()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-helper")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// The original file system, as copied into the helper.
+	body, _, err := client.CopyFromContainer(containerID, helperRoot+".tar")
+	if err != nil {
+		return "", fmt.Errorf("could not read the original file system: %v", err)
+	}
+	tr := tar.NewReader(body)
+	var old map[string]string
+	if _, err = tr.Next(); err == nil {
+		old, err = rootfsFingerprints(tr, "")
+	}
+	_ = body.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not read the original file system: %v", err)
+	}
+
+	// The changes done by zypper.
+	body, _, err = client.CopyFromContainer(containerID, helperRoot)
+	if err != nil {
+		return "", fmt.Errorf("could not read the patched file system: %v", err)
+	}
+	layer, err := os.Create(filepath.Join(dir, "layer.tar"))
+	if err != nil {
+		_ = body.Close()
+		return "", err
+	}
+	hash := sha256.New()
+	err = diffRootfs(old, body, path.Base(helperRoot), io.MultiWriter(layer, hash))
+	_ = body.Close()
+	if cerr := layer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read the patched file system: %v", err)
+	}
+
+	// The new image is the original one plus the new layer.
+	m, err := saveImage(img, filepath.Join(dir, "image"))
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "image", filepath.Clean(m.Config)))
+	if err != nil {
+		return "", fmt.Errorf("could not read the configuration of the image: %v", err)
+	}
+	data, err = commitHelperConfig(data, "sha256:"+hex.EncodeToString(hash.Sum(nil)), cmd, comment, author, labels)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	config := hex.EncodeToString(sum[:]) + ".json"
+	if err = ioutil.WriteFile(filepath.Join(dir, config), data, 0644); err != nil {
+		return "", err
+	}
+
+	layers := []string{}
+	for _, l := range m.Layers {
+		layers = append(layers, filepath.Join("image", filepath.Clean(l)))
+	}
+	m = savedManifest{
+		Config:   config,
+		RepoTags: []string{repo + ":" + tag},
+		Layers:   append(layers, "layer.tar"),
+	}
+	if err = loadArchive(dir, m); err != nil {
+		return "", fmt.Errorf("could not load the new image: %v", err)
+	}
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// runCommandWithHelper behaves like `runCommandAndCommitToImage`, but zypper
+// is run by the helper image.
+func runCommandWithHelper(img, repo, tag, cmd, comment, author string, prov *provenance) (string, error) {
+	containerID, applied, err := runBuilderCommand(img, cmd)
+	if err != nil {
+		if de, ok := err.(dockerError); !ok || isZypperExitCodeSevere(de.exitCode) {
+			if containerID != "" {
+				removeContainer(containerID)
+			}
+			return "", err
+		}
+	}
+
+	labels := mergeLabels(prov.labels(), prov.appliedLabels(applied))
+	imageID, err := commitHelperContainer(img, containerID, repo, tag, cmd, comment, author, labels)
+
+	// always remove the container
+	removeContainer(containerID)
+
+	return imageID, err
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+// The root file system of the target image, before and after being patched.
+var (
+	originalRootfs = map[string]string{
+		"etc/":                     "",
+		"etc/os-release":           "SLE 15",
+		"usr/":                     "",
+		"usr/lib/":                 "",
+		"usr/lib/libssl.so":        "ssl 1",
+		"usr/share/":               "",
+		"usr/share/doc/":           "",
+		"usr/share/doc/ssl/":       "",
+		"usr/share/doc/ssl/README": "ssl",
+		"var/":                     "",
+		"var/lib/":                 "",
+		"var/lib/rpm/":             "",
+		"var/lib/rpm/Packages":     "db 1",
+	}
+	patchedRootfs = map[string]string{
+		"zypper-docker-root/":                      "",
+		"zypper-docker-root/etc/":                  "",
+		"zypper-docker-root/etc/os-release":        "SLE 15",
+		"zypper-docker-root/usr/":                  "",
+		"zypper-docker-root/usr/lib/":              "",
+		"zypper-docker-root/usr/lib/libssl.so":     "ssl 2",
+		"zypper-docker-root/usr/lib/libssl.so.3":   "ssl 3",
+		"zypper-docker-root/usr/share/":            "",
+		"zypper-docker-root/usr/share/doc/":        "",
+		"zypper-docker-root/var/":                  "",
+		"zypper-docker-root/var/lib/":              "",
+		"zypper-docker-root/var/lib/rpm/":          "",
+		"zypper-docker-root/var/lib/rpm/Packages":  "db 2",
+		"zypper-docker-root/var/cache/":            "",
+		"zypper-docker-root/var/cache/zypp/":       "",
+		"zypper-docker-root/var/cache/zypp/cookie": "cookie",
+	}
+)
+
+func TestRootfsName(t *testing.T) {
+	tests := []struct{ name, prefix, expected string }{
+		{"./etc/os-release", "", "etc/os-release"},
+		{"/etc/", "", "etc"},
+		{"/", "", ""},
+		{"zypper-docker-root/etc/", "zypper-docker-root", "etc"},
+		{"zypper-docker-root", "zypper-docker-root", ""},
+		{"other/etc", "zypper-docker-root", ""},
+	}
+	for _, test := range tests {
+		if name := rootfsName(test.name, test.prefix); name != test.expected {
+			t.Fatalf("Expected '%s' for %s, got '%s'", test.expected, test.name, name)
+		}
+	}
+}
+
+func TestDiffRootfs(t *testing.T) {
+	old, err := rootfsFingerprints(bytes.NewReader(newArchive(t, originalRootfs)), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err = diffRootfs(old, bytes.NewReader(newArchive(t, patchedRootfs)), "zypper-docker-root", buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	layer := readArchive(t, buf.Bytes())
+	expected := map[string]string{
+		"usr/lib/libssl.so":     "ssl 2",
+		"usr/lib/libssl.so.3":   "ssl 3",
+		"var/lib/rpm/Packages":  "db 2",
+		"var/cache/":            "",
+		"var/cache/zypp/":       "",
+		"var/cache/zypp/cookie": "cookie",
+		"usr/share/doc/.wh.ssl": "",
+	}
+	if len(layer) != len(expected) {
+		t.Fatalf("Wrong layer: %v", layer)
+	}
+	for name, content := range expected {
+		if c, ok := layer[name]; !ok || c != content {
+			t.Fatalf("Wrong layer, expected %s: %v", name, layer)
+		}
+	}
+}
+
+func TestPatchWithHelper(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	// The daemon would export the file system with absolute names.
+	exported := map[string]string{"/": ""}
+	for name, content := range originalRootfs {
+		exported["/"+name] = content
+	}
+	mc := &mockClient{
+		savedImage: savedImage(t),
+		copies: map[string][]byte{
+			"/": newArchive(t, exported),
+			"/zypper-docker-root.tar": newArchive(t, map[string]string{
+				"zypper-docker-root.tar": string(newArchive(t, originalRootfs)),
+			}),
+			"/zypper-docker-root": newArchive(t, patchedRootfs),
+		},
+	}
+	safeClient.client = mc
+	ctx := globalCommandContext([]string{"--helper-image", "helper:1"}, "patch", "--author", "me", "--message", "msg")
+	currentContext = ctx
+	defer func() { currentContext = nil }()
+
+	var (
+		id  string
+		err error
+	)
+	capture.All(func() { id, _, err = updatePatchImage("patch", "opensuse:13.2", "new:1.0", ctx) })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(id, "sha256:") || mc.lastCommit.ContainerID != "" {
+		t.Fatalf("The image should have been loaded instead of committed: %s", id)
+	}
+
+	// zypper runs in the helper, on the file system of the target.
+	for _, c := range mc.copiedTo {
+		if c != "zypper-docker-private-helper:1:/" {
+			t.Fatalf("The file system should have been copied into the helper: %v", mc.copiedTo)
+		}
+	}
+	if !strings.Contains(mc.lastCmd[0], `command zypper --root "$ZYPPER_DOCKER_ROOT"`) ||
+		!strings.Contains(mc.lastCmd[0], "zypper --non-interactive -n patch") {
+		t.Fatalf("Wrong command: %s", mc.lastCmd[0])
+	}
+	copied := readArchive(t, []byte(readArchive(t, mc.copiedContent)["zypper-docker-root.tar"]))
+	if len(copied) != len(originalRootfs) || copied["etc/os-release"] != "SLE 15" {
+		t.Fatalf("Wrong file system copied into the helper: %v", copied)
+	}
+
+	// The new image is the original one plus the changes done by zypper.
+	files := readArchive(t, mc.loadedImage)
+	var manifests []savedManifest
+	if err = json.Unmarshal([]byte(files["manifest.json"]), &manifests); err != nil || len(manifests) != 1 {
+		t.Fatalf("Wrong manifest (%v): %s", err, files["manifest.json"])
+	}
+	m := manifests[0]
+	expected := []string{"image/1/layer.tar", "image/2/layer.tar", "image/3/layer.tar", "layer.tar"}
+	if compareStringSlices(m.RepoTags, []string{"new:1.0"}) != nil || compareStringSlices(m.Layers, expected) != nil {
+		t.Fatalf("Wrong manifest: %+v", m)
+	}
+	if layer := readArchive(t, []byte(files["layer.tar"])); layer["usr/lib/libssl.so"] != "ssl 2" {
+		t.Fatalf("Wrong layer: %v", layer)
+	}
+
+	config := struct {
+		Author  string         `json:"author"`
+		RootFS  imageRootFS    `json:"rootfs"`
+		History []imageHistory `json:"history"`
+		Config  imageConfig    `json:"config"`
+	}{}
+	if err = json.Unmarshal([]byte(files[m.Config]), &config); err != nil {
+		t.Fatalf("Wrong configuration (%v): %s", err, files[m.Config])
+	}
+	if len(config.RootFS.DiffIDs) != 4 || len(config.History) != 4 || config.Author != "me" {
+		t.Fatalf("Wrong configuration: %s", files[m.Config])
+	}
+	if h := config.History[3]; h.Comment != "msg" || !strings.HasPrefix(h.CreatedBy, "/bin/sh -c zypper") {
+		t.Fatalf("Wrong history: %+v", h)
+	}
+	if config.Config.Labels[labelPrefix+"command"] != "patch" {
+		t.Fatalf("Wrong labels: %v", config.Config.Labels)
+	}
+
+	if record := getCacheFile().imageRecord(id); record == nil {
+		t.Fatal("The new image should have been recorded")
+	}
+}
+
+func TestHelperWithDockerfileBuilder(t *testing.T) {
+	ctx := globalCommandContext([]string{"--helper-image", "helper:1"}, "patch", "--builder", "dockerfile")
+	currentContext = ctx
+	defer func() { currentContext = nil }()
+
+	if _, err := newImageBuilder(ctx); err == nil || !strings.Contains(err.Error(), "cannot be used with --builder=dockerfile") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cmd := suseCheckCommand(); !strings.HasPrefix(cmd, "rpm --root") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
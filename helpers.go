@@ -48,7 +48,16 @@ func globalFlags() string {
 		return ""
 	}
 
-	res := "--non-interactive "
+	return "--non-interactive " + gpgFlags()
+}
+
+// Returns a string containing the global flags about GPG checks being used.
+func gpgFlags() string {
+	if currentContext == nil {
+		return ""
+	}
+
+	res := ""
 	flags := []string{"no-gpg-checks", "gpg-auto-import-keys"}
 
 	for _, v := range flags {
@@ -70,6 +79,17 @@ func formatZypperCommand(cmds ...string) string {
 	return strings.Join(cmds, " && ")
 }
 
+// Behaves like `formatZypperCommand`, but zypper is allowed to ask questions
+// to the user. Only meant for the commands run in interactive mode.
+func formatInteractiveZypperCommand(cmds ...string) string {
+	flags := gpgFlags()
+
+	for k, v := range cmds {
+		cmds[k] = "zypper " + flags + v
+	}
+	return strings.Join(cmds, " && ")
+}
+
 func arrayIncludeString(arr []string, s string) bool {
 	for _, i := range arr {
 		if i == s {
@@ -200,10 +220,10 @@ func preventImageOverwrite(repo, tag string) error {
 	imageExists, err := checkImageExists(repo, tag)
 
 	if err != nil {
-		return fmt.Errorf("Cannot proceed safely: %v.", err)
+		return fmt.Errorf("Cannot proceed safely: %v", err)
 	}
 	if imageExists {
-		return fmt.Errorf("Cannot overwrite an existing image. Please use a different repository/tag.")
+		return fmt.Errorf("Cannot overwrite an existing image. Please use a different repository/tag")
 	}
 	return nil
 }
@@ -242,66 +262,291 @@ type commandFunc func(string, *cli.Context)
 
 // commandInContainer executes the given commandFunc for the image in which the
 // given container is based on. The container ID is extracted from the first
-// argument as given in ctx.
+// argument as given in ctx. Stopped containers are only considered when the
+// `--stopped` flag has been given.
 func commandInContainer(f commandFunc, ctx *cli.Context) {
 	containerID := ctx.Args().First()
 
-	if container, err := checkContainerRunning(containerID); err != nil {
+	if container, err := checkContainer(containerID, ctx.Bool("stopped")); err != nil {
 		logAndFatalf("%v.\n", err)
 	} else {
 		f(container.Image, ctx)
 	}
 }
 
+// updatePatchBoolFlags contains the names of the boolean flags of both the
+// update and the patch commands.
+var updatePatchBoolFlags = []string{"l", "auto-agree-with-licenses",
+	"no-recommends", "replacefiles", "skip-interactive", "with-interactive"}
+
+// updatePatchIgnoredFlags contains the names of the flags of both the update
+// and the patch commands that must not be forwarded to zypper.
+var updatePatchIgnoredFlags = []string{"author", "message", "dry-run", "overwrite", "push",
+	"stopped", "recreate", "target", "output", "repository", "tag-template", "squash",
+	"builder", "dockerfile", "interactive", "select", "patch", "exclude-patch", "exclude-cve",
+	"min-severity", "security"}
+
+// updatePatchSubcommand returns the given zypper subcommand (e.g. "-n patch")
+// with all the flags given to the update/patch command that have to be
+// forwarded to zypper.
+func updatePatchSubcommand(subcmd string, ctx *cli.Context) string {
+	return cmdWithFlags(subcmd, ctx, updatePatchBoolFlags, updatePatchIgnoredFlags) + severityFilterArgs(ctx)
+}
+
 // updatePatchCmd executes an update/patch command depending on the argument
 // zypperCmd.
 func updatePatchCmd(zypperCmd string, ctx *cli.Context) {
+	if err := checkPatchSelection(ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	if ctx.String("repository") != "" {
+		if ctx.Bool("interactive") {
+			logAndFatalf("The --interactive flag cannot be used with --repository.\n")
+			return
+		}
+		updatePatchRepositoryCmd(zypperCmd, ctx)
+		return
+	}
+	if ctx.Bool("dry-run") {
+		dryRunCmd(zypperCmd, ctx)
+		return
+	}
+
 	if len(ctx.Args()) != 2 {
 		logAndFatalf("Wrong invocation: expected 2 arguments, %d given.\n", len(ctx.Args()))
 		return
 	}
+	if _, _, err := updatePatchImage(zypperCmd, ctx.Args()[0], ctx.Args()[1], ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+	}
+}
+
+// updatePatchContainerCmd executes an update/patch command, depending on the
+// argument zypperCmd, on the image of the container given as the first
+// argument. With the `--recreate` flag, the container is then recreated on top
+// of the new image.
+func updatePatchContainerCmd(zypperCmd string, ctx *cli.Context) {
+	if err := checkPatchSelection(ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	dryRun := ctx.Bool("dry-run")
+	if n := len(ctx.Args()); n != 2 && (!dryRun || n != 1) {
+		logAndFatalf("Wrong invocation: expected 2 arguments, %d given.\n", n)
+		return
+	}
+
+	containerID := ctx.Args().First()
+	container, err := checkContainer(containerID, ctx.Bool("stopped"))
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	// The image is patched by its ID, since its name might refer to another
+	// image by now.
+	if dryRun {
+		dryRunImage(zypperCmd, container.ImageID, ctx)
+		return
+	}
 
-	img := ctx.Args()[0]
-	repo, tag, err := parseImageName(ctx.Args()[1])
+	_, name, err := updatePatchContainerImage(zypperCmd, container, ctx.Args()[1], ctx)
 	if err != nil {
-		logAndFatalf("%v\n", err)
+		logAndFatalf("%v.\n", err)
+		return
+	} else if !ctx.Bool("recreate") {
 		return
 	}
-	if err = preventImageOverwrite(repo, tag); err != nil {
-		logAndFatalf("%v\n", err)
+	newID, err := recreateContainer(container.ID, name)
+	if err != nil {
+		logAndFatalf("Could not recreate container %s: %v.\n", containerID, err)
 		return
 	}
+	logAndPrintf("Container %s recreated as %s\n", containerID, newID)
+}
 
-	comment := ctx.String("message")
+// updatePatchImage runs the given zypper command (either "up" or "patch") on
+// the img image, and commits the result into the image defined by target. It
+// returns the ID and the name of the new image.
+func updatePatchImage(zypperCmd, img, target string, ctx *cli.Context) (string, string, error) {
+	prov, err := inspectSource(img, zypperCmd, ctx, true)
+	if err != nil {
+		return "", "", err
+	}
+	cmd, err := patchCommand(zypperCmd, prov, ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return commitFromSource(img, target, cmd, prov, ctx)
+}
+
+// updatePatchContainerImage behaves like `updatePatchImage`, but it patches
+// the image that the given container is based on. The name of this image is
+// only used to render the name of the new image and its provenance.
+func updatePatchContainerImage(zypperCmd string, container types.Container, target string, ctx *cli.Context) (string, string, error) {
+	prov, err := inspectNamedSource(container.ImageID, container.Image, zypperCmd, ctx, true)
+	if err != nil {
+		return "", "", err
+	}
+	cmd, err := patchCommand(zypperCmd, prov, ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return commitFromSource(container.ImageID, target, cmd, prov, ctx)
+}
+
+// updatePatchCommand returns the zypper commands to be run in order to apply
+// the given update/patch command.
+func updatePatchCommand(zypperCmd string, ctx *cli.Context) string {
+	return zypperTransaction(updatePatchTransaction(zypperCmd, ctx), nil, ctx.Bool("interactive"))
+}
+
+// updatePatchTransaction returns the zypper subcommand that applies the given
+// update/patch command, which is non-interactive unless the `--interactive`
+// flag has been given.
+func updatePatchTransaction(zypperCmd string, ctx *cli.Context) string {
+	if ctx.Bool("interactive") {
+		return updatePatchSubcommand(zypperCmd, ctx)
+	}
+	return updatePatchSubcommand(fmt.Sprintf("-n %v", zypperCmd), ctx)
+}
+
+// The file where zypper keeps the locks of the image being patched, and the one
+// where it's backed up while zypper-docker adds its own locks. In helper mode
+// the image is mounted at $ZYPPER_DOCKER_ROOT, which is unset otherwise.
+const (
+	locksFile   = `"$ZYPPER_DOCKER_ROOT/etc/zypp/locks"`
+	locksBackup = `"$ZYPPER_DOCKER_ROOT/etc/zypp/locks.zypper-docker"`
+)
+
+// zypperTransaction returns the zypper commands that refresh the repositories,
+// run the given subcommand and then clean the caches. The given patches are
+// locked while the subcommand runs, and the locks file of the image is
+// restored afterwards, so these locks do not end up in the new image while the
+// ones the image already had are kept. With interactive set to true, zypper is
+// allowed to ask questions to the user.
+func zypperTransaction(sub string, locks []string, interactive bool) string {
+	format := formatZypperCommand
+	if interactive {
+		format = formatInteractiveZypperCommand
+	}
+	if len(locks) == 0 {
+		return format("ref", sub, "clean -a")
+	}
+
+	cmd := format("ref") + " && { [ ! -e " + locksFile + " ] || cp -p " + locksFile + " " + locksBackup + "; }" +
+		" && " + format(addlockSubcommand(locks))
+	unlock := "if [ -e " + locksBackup + " ]; then mv -f " + locksBackup + " " + locksFile +
+		"; else rm -f " + locksFile + "; fi || exit 1; "
+	// The exit code of the subcommand is kept, since some of them are not
+	// errors (see isZypperExitCodeSevere).
+	return cmd + " && { " + format(sub) + "; status=$?; " + unlock +
+		"[ $status -ne 0 ] || " + format("clean -a") + "; exit $status; }"
+}
+
+// addlockSubcommand returns the zypper subcommand that locks the given
+// patches.
+func addlockSubcommand(locks []string) string {
+	sub := "addlock -t patch"
+	for _, l := range locks {
+		sub += " " + shellQuote(l)
+	}
+	return sub
+}
+
+// shellQuote quotes the given string so it's taken as a single word by the
+// shell.
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+// commitFromSource runs the given zypper commands on the img image, whose
+// provenance has already been returned by the `inspectSource` function, and
+// commits the result into the image defined by target. The img image can also
+// be given by its ID. It returns the ID and the name of the new image.
+func commitFromSource(img, target, cmd string, prov *provenance, ctx *cli.Context) (string, string, error) {
+	repo, tag, err := targetImageName(target, prov)
+	if err != nil {
+		return "", "", err
+	}
+	// When overwriting, the source image might be the one holding the target
+	// tag. In this case, its ID has to be fetched before it's too late.
+	var srcID string
+	overwrite := ctx.Bool("overwrite")
+	if img == prov.SourceID {
+		srcID = img
+	} else if overwrite {
+		if srcID, err = getImageID(img); err != nil {
+			return "", "", fmt.Errorf("Could not find the ID of %s: %v", img, err)
+		}
+	}
+	if !overwrite {
+		if err = preventImageOverwrite(repo, tag); err != nil {
+			return "", "", err
+		}
+	}
+
+	comment, err := renderMessage(ctx.String("message"), repo+":"+tag, prov)
+	if err != nil {
+		return "", "", err
+	}
 	author := ctx.String("author")
 
-	boolFlags := []string{"l", "auto-agree-with-licenses", "no-recommends",
-		"replacefiles"}
-	toIgnore := []string{"author", "message"}
-
-	cmd := formatZypperCommand("ref", fmt.Sprintf("-n %v", zypperCmd), "clean -a")
-	cmd = cmdWithFlags(cmd, ctx, boolFlags, toIgnore)
-	newImgID, err := runCommandAndCommitToImage(
-		img,
-		repo,
-		tag,
-		cmd,
-		comment,
-		author)
+	build, err := newImageBuilder(ctx)
 	if err != nil {
-		logAndFatalf("Could not commit to the new image: %v.\n", err)
-		return
+		return "", "", err
+	}
+	var newImgID, backup string
+	if overwrite {
+		newImgID, backup, err = runCommandAndOverwriteImage(build, img, repo, tag, cmd, comment, author, prov)
+	} else {
+		newImgID, err = build(img, repo, tag, cmd, comment, author, prov)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Could not commit to the new image: %v", err)
 	}
 
 	logAndPrintf("%s:%s successfully created\n", repo, tag)
+	if backup != "" {
+		logAndPrintf("The previous %s:%s image has been kept as %s\n", repo, tag, backup)
+	}
 
 	cache := getCacheFile()
-	if err := cache.updateCacheAfterUpdate(img, newImgID); err != nil {
+	var squashErr error
+	squashed := false
+	if ctx.Bool("squash") {
+		// One layer for the new image, plus the ones from the previous
+		// generations.
+		n := 1 + cache.zypperLayers(prov.SourceID)
+		if n > 1 {
+			var id string
+			if id, squashErr = squashImage(newImgID, repo, tag, n); squashErr == nil {
+				logAndPrintf("%s:%s squashed: %d layers merged into one\n", repo, tag, n)
+				newImgID, squashed = id, true
+			}
+		}
+	}
+
+	if srcID != "" {
+		cache.recordUpdate(srcID, newImgID, repo+":"+tag)
+	} else if err := cache.updateCacheAfterUpdate(img, newImgID, repo+":"+tag); err != nil {
+		// The new image is fine, so it's kept all the same.
 		log.Println("Cannot add image details to zypper-docker cache")
 		log.Println("This will break the \"zypper-docker ps\" feature")
 		log.Println(err)
-		exitWithCode(1)
 	}
+	if squashed {
+		cache.recordSquash(newImgID)
+	} else if squashErr != nil {
+		return "", "", fmt.Errorf("Could not squash %s:%s, which has been kept as it is: %v", repo, tag, squashErr)
+	}
+
+	if ctx.Bool("push") {
+		if err = pushAndRecord(newImgID, repo, tag); err != nil {
+			return "", "", err
+		}
+	}
+	return newImgID, repo + ":" + tag, nil
 }
 
 // joinAsArray joins the given array of commands so it's compatible to what is
@@ -325,7 +570,8 @@ func joinAsArray(cmds []string, emptyArray bool) string {
 // supports the `--severity` flag in the specified image.
 func supportsSeverityFlag(image string) (bool, error) {
 	buf := bytes.NewBuffer([]byte{})
-	id, err := runCommandInContainer(image, []string{"zypper lp --severity"}, buf)
+	// zypper complains about the flag on stderr.
+	id, err := captureCommandInContainer(image, []string{"zypper lp --severity"}, buf, buf)
 	defer removeContainer(id)
 
 	if strings.Contains(buf.String(), "Missing argument for --severity") {
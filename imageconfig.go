@@ -0,0 +1,288 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// healthConfig is the healthcheck of an image, as given by the Docker daemon.
+type healthConfig struct {
+	Test        []string      `json:",omitempty"`
+	Interval    time.Duration `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	StartPeriod time.Duration `json:",omitempty"`
+	Retries     int           `json:",omitempty"`
+}
+
+// imageConfig contains the settings of an image that have to be preserved
+// when committing a new image on top of it. Some of them (e.g. the healthcheck
+// or the shell) are not available in the engine-api types, so this is decoded
+// from the raw JSON returned by the daemon.
+type imageConfig struct {
+	Env          []string
+	WorkingDir   string
+	ExposedPorts map[string]struct{}
+	Volumes      map[string]struct{}
+	Labels       map[string]string
+	OnBuild      []string
+	StopSignal   string
+	Healthcheck  *healthConfig
+	Shell        []string
+}
+
+// inspectImageConfig returns the configuration of the given image.
+func inspectImageConfig(img string) (imageConfig, error) {
+	client := getDockerClient()
+
+	info, raw, err := client.ImageInspectWithRaw(img, false)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("could not inspect image '%s': %v", img, err)
+	}
+	return decodeImageConfig(info, raw)
+}
+
+// decodeImageConfig returns the configuration contained in the given raw
+// output of an image inspection. If the raw output is not available, the given
+// info is used instead.
+func decodeImageConfig(info types.ImageInspect, raw []byte) (imageConfig, error) {
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(info); err != nil {
+			return imageConfig{}, err
+		}
+	}
+
+	data := struct{ Config *imageConfig }{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return imageConfig{}, fmt.Errorf("could not decode the image configuration: %v", err)
+	}
+	if data.Config == nil {
+		return imageConfig{}, nil
+	}
+	return *data.Config, nil
+}
+
+// commitConfig returns the configuration to be given when committing a new
+// image on top of an image with the given configuration. The healthcheck
+// cannot be passed this way, so it has to be given as a change instead (see
+// the `healthcheckInstruction` function). The shell can be given neither way,
+// and it's inherited by the daemon from the helper container.
+func commitConfig(cfg imageConfig) *container.Config {
+	ports := make(map[nat.Port]struct{})
+	for port := range cfg.ExposedPorts {
+		ports[nat.Port(port)] = struct{}{}
+	}
+
+	return &container.Config{
+		Env:          cfg.Env,
+		WorkingDir:   cfg.WorkingDir,
+		ExposedPorts: ports,
+		Volumes:      cfg.Volumes,
+		Labels:       cfg.Labels,
+		OnBuild:      cfg.OnBuild,
+		StopSignal:   cfg.StopSignal,
+	}
+}
+
+// mergeLabels returns a new map containing the given labels plus the extra
+// ones, which take precedence.
+func mergeLabels(labels, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return labels
+	}
+	res := make(map[string]string)
+	for k, v := range labels {
+		res[k] = v
+	}
+	for k, v := range extra {
+		res[k] = v
+	}
+	return res
+}
+
+// healthcheckInstruction returns the Dockerfile instruction that sets the
+// given healthcheck. It returns an empty string if there's nothing to set.
+func healthcheckInstruction(hc *healthConfig) (string, error) {
+	if hc == nil || len(hc.Test) == 0 {
+		return "", nil
+	}
+
+	switch hc.Test[0] {
+	case "NONE":
+		return "HEALTHCHECK NONE", nil
+	case "CMD", "CMD-SHELL":
+	default:
+		return "", fmt.Errorf("unknown healthcheck type '%s'", hc.Test[0])
+	}
+
+	instr := "HEALTHCHECK"
+	durations := []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"interval", hc.Interval},
+		{"timeout", hc.Timeout},
+		{"start-period", hc.StartPeriod},
+	}
+	for _, d := range durations {
+		if d.value != 0 {
+			instr += fmt.Sprintf(" --%s=%s", d.flag, d.value)
+		}
+	}
+	if hc.Retries != 0 {
+		instr += fmt.Sprintf(" --retries=%d", hc.Retries)
+	}
+
+	if hc.Test[0] == "CMD-SHELL" {
+		return instr + " CMD " + strings.Join(hc.Test[1:], " "), nil
+	}
+	args, err := json.Marshal(hc.Test[1:])
+	if err != nil {
+		return "", err
+	}
+	return instr + " CMD " + string(args), nil
+}
+
+// sortedStrings returns a sorted copy of the given strings.
+func sortedStrings(strs []string) []string {
+	res := append([]string{}, strs...)
+	sort.Strings(res)
+	return res
+}
+
+// setKeys returns the sorted keys of the given set.
+func setKeys(set map[string]struct{}) []string {
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// equalStrings returns true if both slices contain the same strings in the
+// same order. Nil and empty slices are considered equal.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalLabels returns true if both maps contain the same labels. Nil and
+// empty maps are considered equal.
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// equalHealthchecks returns true if both healthchecks are the same. A nil
+// healthcheck is the same as an empty one.
+func equalHealthchecks(a, b *healthConfig) bool {
+	if a == nil {
+		a = &healthConfig{}
+	}
+	if b == nil {
+		b = &healthConfig{}
+	}
+	return equalStrings(a.Test, b.Test) && a.Interval == b.Interval &&
+		a.Timeout == b.Timeout && a.StartPeriod == b.StartPeriod && a.Retries == b.Retries
+}
+
+// configDifferences returns a description of each setting that is not the
+// same on both configurations.
+func configDifferences(expected, actual imageConfig) []string {
+	diffs := []string{}
+	add := func(name string, exp, act interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%s is %v instead of %v", name, act, exp))
+	}
+
+	if !equalStrings(sortedStrings(expected.Env), sortedStrings(actual.Env)) {
+		add("ENV", expected.Env, actual.Env)
+	}
+	if expected.WorkingDir != actual.WorkingDir {
+		add("WORKDIR", fmt.Sprintf("'%s'", expected.WorkingDir), fmt.Sprintf("'%s'", actual.WorkingDir))
+	}
+	if exp, act := setKeys(expected.ExposedPorts), setKeys(actual.ExposedPorts); !equalStrings(exp, act) {
+		add("EXPOSE", exp, act)
+	}
+	if exp, act := setKeys(expected.Volumes), setKeys(actual.Volumes); !equalStrings(exp, act) {
+		add("VOLUME", exp, act)
+	}
+	if !equalLabels(expected.Labels, actual.Labels) {
+		add("LABEL", expected.Labels, actual.Labels)
+	}
+	if !equalStrings(expected.OnBuild, actual.OnBuild) {
+		add("ONBUILD", expected.OnBuild, actual.OnBuild)
+	}
+	if expected.StopSignal != actual.StopSignal {
+		add("STOPSIGNAL", fmt.Sprintf("'%s'", expected.StopSignal), fmt.Sprintf("'%s'", actual.StopSignal))
+	}
+	if !equalHealthchecks(expected.Healthcheck, actual.Healthcheck) {
+		add("HEALTHCHECK", healthcheckString(expected.Healthcheck), healthcheckString(actual.Healthcheck))
+	}
+	if !equalStrings(expected.Shell, actual.Shell) {
+		add("SHELL", expected.Shell, actual.Shell)
+	}
+	return diffs
+}
+
+// healthcheckString returns a human readable representation of the given
+// healthcheck.
+func healthcheckString(hc *healthConfig) string {
+	if hc == nil || reflect.DeepEqual(*hc, healthConfig{}) {
+		return "unset"
+	}
+	if instr, err := healthcheckInstruction(hc); err == nil {
+		return "'" + strings.TrimPrefix(instr, "HEALTHCHECK ") + "'"
+	}
+	return fmt.Sprintf("%v", *hc)
+}
+
+// verifyImageConfig checks that the image with the given id has the given
+// configuration, which is the one of the image it has been derived from.
+func verifyImageConfig(expected imageConfig, id string) error {
+	actual, err := inspectImageConfig(id)
+	if err != nil {
+		return err
+	}
+	if diffs := configDifferences(expected, actual); len(diffs) > 0 {
+		return fmt.Errorf("the configuration of the parent image has not been preserved: %s",
+			strings.Join(diffs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+)
+
+const rawImageInspect = `{
+  "Id": "sha256:4f3a2b1c0d9e",
+  "Config": {
+    "Env": ["PATH=/usr/bin:/bin", "LANG=en_US.UTF-8"],
+    "WorkingDir": "/srv",
+    "ExposedPorts": {"80/tcp": {}},
+    "Volumes": {"/data": {}},
+    "Labels": {"vendor": "SUSE"},
+    "OnBuild": ["RUN zypper ref"],
+    "StopSignal": "SIGQUIT",
+    "Healthcheck": {
+      "Test": ["CMD", "curl", "-f", "http://localhost/"],
+      "Interval": 30000000000,
+      "Retries": 3
+    },
+    "Shell": ["/bin/bash", "-c"]
+  }
+}`
+
+func TestDecodeImageConfig(t *testing.T) {
+	cfg, err := decodeImageConfig(types.ImageInspect{}, []byte(rawImageInspect))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(cfg.Env) != 2 || cfg.WorkingDir != "/srv" || cfg.StopSignal != "SIGQUIT" {
+		t.Fatalf("Wrong config: %v", cfg)
+	}
+	if _, ok := cfg.ExposedPorts["80/tcp"]; !ok {
+		t.Fatalf("Wrong exposed ports: %v", cfg.ExposedPorts)
+	}
+	if cfg.Healthcheck == nil || cfg.Healthcheck.Interval != 30*time.Second {
+		t.Fatalf("Wrong healthcheck: %v", cfg.Healthcheck)
+	}
+	if !equalStrings(cfg.Shell, []string{"/bin/bash", "-c"}) {
+		t.Fatalf("Wrong shell: %v", cfg.Shell)
+	}
+
+	if _, err = decodeImageConfig(types.ImageInspect{}, []byte("{")); err == nil {
+		t.Fatal("It should've failed")
+	}
+}
+
+func TestCommitConfig(t *testing.T) {
+	cfg, _ := decodeImageConfig(types.ImageInspect{}, []byte(rawImageInspect))
+	config := commitConfig(cfg)
+
+	if config.WorkingDir != "/srv" || config.StopSignal != "SIGQUIT" || len(config.OnBuild) != 1 {
+		t.Fatalf("Wrong config: %v", config)
+	}
+	if _, ok := config.ExposedPorts["80/tcp"]; !ok {
+		t.Fatalf("Wrong exposed ports: %v", config.ExposedPorts)
+	}
+	if config.Labels["vendor"] != "SUSE" {
+		t.Fatalf("Wrong labels: %v", config.Labels)
+	}
+}
+
+func TestHealthcheckInstruction(t *testing.T) {
+	tests := []struct {
+		hc    *healthConfig
+		instr string
+	}{
+		{nil, ""},
+		{&healthConfig{}, ""},
+		{&healthConfig{Test: []string{"NONE"}}, "HEALTHCHECK NONE"},
+		{&healthConfig{Test: []string{"CMD-SHELL", "curl -f http://localhost/"}, Timeout: 5 * time.Second},
+			"HEALTHCHECK --timeout=5s CMD curl -f http://localhost/"},
+		{&healthConfig{Test: []string{"CMD", "curl", "-f"}, Interval: time.Minute, Retries: 3},
+			`HEALTHCHECK --interval=1m0s --retries=3 CMD ["curl","-f"]`},
+	}
+	for _, test := range tests {
+		instr, err := healthcheckInstruction(test.hc)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if instr != test.instr {
+			t.Fatalf("Expected '%s', got '%s'", test.instr, instr)
+		}
+	}
+
+	if _, err := healthcheckInstruction(&healthConfig{Test: []string{"WHATEVER"}}); err == nil {
+		t.Fatal("It should've failed")
+	}
+}
+
+func TestConfigDifferences(t *testing.T) {
+	expected, _ := decodeImageConfig(types.ImageInspect{}, []byte(rawImageInspect))
+	actual, _ := decodeImageConfig(types.ImageInspect{}, []byte(rawImageInspect))
+
+	// The order of the environment does not matter.
+	actual.Env = []string{"LANG=en_US.UTF-8", "PATH=/usr/bin:/bin"}
+	if diffs := configDifferences(expected, actual); len(diffs) != 0 {
+		t.Fatalf("There should be no differences: %v", diffs)
+	}
+
+	actual.Shell = nil
+	actual.Healthcheck = nil
+	actual.Labels = map[string]string{}
+	diffs := configDifferences(expected, actual)
+	if len(diffs) != 3 {
+		t.Fatalf("Expected 3 differences, got: %v", diffs)
+	}
+	for i, name := range []string{"LABEL", "HEALTHCHECK is unset", "SHELL"} {
+		if !strings.HasPrefix(diffs[i], name) {
+			t.Fatalf("Expected '%s', got '%s'", name, diffs[i])
+		}
+	}
+}
+
+func TestCommitPreservesConfig(t *testing.T) {
+	setupTestExitStatus()
+	mock := &mockClient{rawInspect: rawImageInspect}
+	safeClient.client = mock
+
+	if _, err := commitContainerToImage("opensuse:13.2", "1", "new", "1.0", "", "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	changes := strings.Join(mock.lastCommit.Changes, "\n")
+	if !strings.Contains(changes, `HEALTHCHECK --interval=30s --retries=3 CMD ["curl","-f","http://localhost/"]`) {
+		t.Fatalf("The healthcheck has not been preserved: %v", mock.lastCommit.Changes)
+	}
+	if mock.lastCommit.Config.WorkingDir != "/srv" {
+		t.Fatalf("The config has not been preserved: %v", mock.lastCommit.Config)
+	}
+}
+
+func TestCommitConfigMismatch(t *testing.T) {
+	setupTestExitStatus()
+	mock := &mockClient{configMismatch: true}
+	safeClient.client = mock
+
+	_, err := commitContainerToImage("opensuse:13.2", "1", "new", "1.0", "", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "ENV is [LANG=C] instead of []") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if len(mock.removedImages) != 1 || mock.removedImages[0] != "fake image ID" {
+		t.Fatalf("The new image should've been removed: %v", mock.removedImages)
+	}
+}
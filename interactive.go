@@ -0,0 +1,128 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/docker/pkg/term"
+	"github.com/docker/engine-api/types"
+)
+
+// Returns true if the `--interactive` flag has been given to the current
+// command. In this mode, the zypper command that changes the image is
+// attached to the standard input of the user, so licenses and patch messages
+// can be read and accepted.
+func interactiveMode() bool {
+	return currentContext != nil && currentContext.Bool("interactive")
+}
+
+// Runs the given command of an image builder in a container based on the
+// given image, streaming its output to the standard output. In interactive
+// mode, the standard input is attached to the container too. It returns the
+// ID of the container and the patches that zypper said it was going to
+// install (see `patchScanner`).
+// Note well: the container is NOT deleted when the given command terminates.
+func runBuilderCommand(img, cmd string) (string, []string, error) {
+	out, done := builderOutput(img)
+	defer done()
+	scanner := newPatchScanner(out)
+
+	var id string
+	var err error
+	if interactiveMode() {
+		id, err = runInteractiveCommandInContainer(img, []string{cmd}, scanner)
+	} else {
+		id, err = runCommandInContainer(img, []string{cmd}, scanner)
+	}
+	return id, scanner.patches, err
+}
+
+// Behaves like `runCommandInContainer`, but the container is attached to the
+// standard input and error of zypper-docker, and its output goes to dst. If
+// both the standard input and output are terminals, the terminal is set in raw
+// mode until the command exits, as `docker run -it` does.
+// Note well: the container is NOT deleted when the given command terminates.
+func runInteractiveCommandInContainer(img string, cmd []string, dst io.Writer) (string, error) {
+	id, err := createContainer(img, cmd, true)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	// The container has to be attached before starting it, otherwise the
+	// first prompts could be lost.
+	client := getDockerClient()
+	resp, err := client.ContainerAttach(types.ContainerAttachOptions{
+		ContainerID: id,
+		Stream:      true,
+		Stdin:       true,
+		Stdout:      true,
+		Stderr:      true,
+	})
+	if err != nil {
+		return id, err
+	}
+	defer resp.Close()
+
+	tty := stdoutIsTerminal()
+	if fd, isTerminal := term.GetFdInfo(os.Stdin); tty && isTerminal {
+		if state, err := term.SetRawTerminal(fd); err != nil {
+			log.Printf("Could not set the terminal in raw mode: %v", err)
+		} else {
+			defer func() {
+				if err := term.RestoreTerminal(fd, state); err != nil {
+					log.Print(err)
+				}
+			}()
+		}
+	}
+
+	if err = client.ContainerStart(id); err != nil {
+		return id, err
+	}
+	if tty {
+		stop := followTtySize(id)
+		defer stop()
+	}
+
+	go func() {
+		if _, err := io.Copy(resp.Conn, os.Stdin); err != nil {
+			log.Print(err)
+		}
+		if err := resp.CloseWrite(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	output := make(chan bool)
+	go func() {
+		var err error
+		if tty {
+			_, err = io.Copy(dst, resp.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(dst, os.Stderr, resp.Reader)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		output <- true
+	}()
+
+	return id, waitContainer(id, nil, output)
+}
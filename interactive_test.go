@@ -0,0 +1,95 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+func TestUpdatePatchCommandInteractiveFlags(t *testing.T) {
+	ctx := commandContext("patch", "--skip-interactive")
+	currentContext = ctx
+	defer func() { currentContext = nil }()
+
+	expected := "zypper --non-interactive ref && zypper --non-interactive -n patch --skip-interactive && zypper --non-interactive clean -a"
+	if cmd := updatePatchCommand("patch", ctx); cmd != expected {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	ctx = commandContext("patch", "--interactive", "--with-interactive")
+	currentContext = ctx
+	expected = "zypper ref && zypper patch --with-interactive && zypper clean -a"
+	if cmd := updatePatchCommand("patch", ctx); cmd != expected {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
+
+func TestPatchInteractive(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	mc := &mockClient{}
+	safeClient.client = mc
+	ctx := commandContext("patch", "--interactive")
+	currentContext = ctx
+	defer func() { currentContext = nil }()
+
+	var err error
+	captured := capture.All(func() { _, _, err = updatePatchImage("patch", "opensuse:13.2", "new:1.0", ctx) })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !mc.openStdin || len(mc.attached) != 1 || !mc.attached[0].Stdin || !mc.attached[0].Stream {
+		t.Fatalf("The standard input should have been attached: %+v", mc.attached)
+	}
+	if mc.lastCmd[0] != "zypper ref && zypper patch && zypper clean -a" {
+		t.Fatalf("Wrong command: %s", mc.lastCmd[0])
+	}
+	if !strings.Contains(string(captured.Stdout), "Do you agree with the terms of the license?") {
+		t.Fatalf("The output of zypper should have been shown: %s", captured.Stdout)
+	}
+	if mc.lastCommit.ContainerID != "zypper-docker-private-opensuse:13.2" {
+		t.Fatalf("Wrong commit: %+v", mc.lastCommit)
+	}
+
+	// The container is not started if it cannot be attached. Only the one
+	// listing the patches of the image, which is not attached, is started.
+	mc = &mockClient{attachFail: true}
+	safeClient.client = mc
+	capture.All(func() { _, _, err = updatePatchImage("patch", "opensuse:13.2", "new:1.1", ctx) })
+	if err == nil || !strings.Contains(err.Error(), "Attach failed") || len(mc.started) != 1 {
+		t.Fatalf("Unexpected error (%v), started: %v", err, mc.started)
+	}
+}
+
+func TestInteractiveWrongInvocation(t *testing.T) {
+	ctx := commandContext("patch", "--interactive", "--builder", "dockerfile")
+	if _, err := newImageBuilder(ctx); err == nil || err.Error() != "The --interactive flag cannot be used with --builder=dockerfile" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	setupTestExitStatus()
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { updatePatchCmd("patch", commandContext("patch", "--interactive", "--repository", "opensuse")) })
+	if lastCode != 1 || !strings.Contains(buffer.String(), "cannot be used with --repository") {
+		t.Fatalf("Unexpected failure (%d): %s", lastCode, buffer.String())
+	}
+}
@@ -15,13 +15,22 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
 	"github.com/docker/engine-api/types/network"
@@ -38,6 +47,7 @@ type mockClient struct {
 	commandExit        int
 	listFail           bool
 	listEmpty          bool
+	listAmbiguous      bool
 	listReturnOneImage bool
 	logFail            bool
 	lastCmd            []string
@@ -47,6 +57,50 @@ type mockClient struct {
 	zypperBadVersion   bool
 	zypperGoodVersion  bool
 	suppressLog        bool
+	logOutput          string
+	transactionOutput  string
+	tagFail            bool
+	tagFailOnForce     bool
+	removeImageFail    bool
+	tags               []string
+	removedImages      []string
+	prunedImages       []string
+	inspectContFail    bool
+	renameFail         bool
+	stopFail           bool
+	connectFail        bool
+	renamed            []string
+	started            []string
+	connected          []string
+	rawInspect         string
+	configMismatch     bool
+	lastCommit         types.ContainerCommitOptions
+	pushFail           bool
+	pushNoDigest       bool
+	pushed             []types.ImagePushOptions
+	health             string
+	exited             bool
+	removedContainers  []string
+	savedImage         []byte
+	loadFail           bool
+	loadedImage        []byte
+	buildFail          bool
+	buildError         bool
+	builtDockerfile    string
+	builtDockerfiles   []string
+	builtTags          []string
+	buildOutput        string
+	rawInspects        map[string]string
+	histories          map[string][]types.ImageHistory
+	savedImages        map[string][]byte
+	copies             map[string][]byte
+	copiedTo           []string
+	copiedContent      []byte
+	tty                bool
+	stderrOutput       string
+	openStdin          bool
+	attachFail         bool
+	attached           []types.ContainerAttachOptions
 }
 
 func (mc *mockClient) ImageList(options types.ImageListOptions) ([]types.Image, error) {
@@ -135,6 +189,8 @@ func (mc *mockClient) ContainerCreate(config *container.Config, hostConfig *cont
 	}
 
 	mc.lastCmd = config.Cmd.Slice()
+	mc.tty = config.Tty
+	mc.openStdin = config.OpenStdin
 
 	return types.ContainerCreateResponse{ID: name, Warnings: warnings}, nil
 }
@@ -147,6 +203,7 @@ func (mc *mockClient) ContainerStart(id string) error {
 		// Ubuntu doesn't have zypper: fail.
 		return errors.New("Start failed")
 	}
+	mc.started = append(mc.started, id)
 	return nil
 }
 
@@ -154,6 +211,7 @@ func (mc *mockClient) ContainerRemove(options types.ContainerRemoveOptions) erro
 	if mc.removeFail {
 		return errors.New("Remove failed")
 	}
+	mc.removedContainers = append(mc.removedContainers, options.ContainerID)
 	if !mc.suppressLog {
 		log.Printf("Removed container %v", options.ContainerID)
 	}
@@ -182,16 +240,53 @@ func (mc *mockClient) ContainerLogs(options types.ContainerLogsOptions) (io.Read
 		return nil, fmt.Errorf("Fake log failure")
 	}
 	cb := &closingBuffer{bytes.NewBuffer([]byte{})}
-	if mc.zypperBadVersion {
-		_, err = cb.WriteString("Unknown option '--severity'\n")
+	var stdout, stderr io.Writer = cb, cb
+	if !mc.tty {
+		stdout = stdcopy.NewStdWriter(cb, stdcopy.Stdout)
+		stderr = stdcopy.NewStdWriter(cb, stdcopy.Stderr)
+	}
+	// The check of the --severity flag (see supportsSeverityFlag) gets its
+	// own answer, so it can be mixed with the output of other commands.
+	probe := len(mc.lastCmd) > 0 && strings.HasSuffix(mc.lastCmd[0], "zypper lp --severity")
+	if probe && mc.zypperBadVersion {
+		_, err = io.WriteString(stderr, "Unknown option '--severity'\n")
+	} else if probe && mc.zypperGoodVersion {
+		_, err = io.WriteString(stderr, "Missing argument for --severity\n")
+	} else if mc.transactionOutput != "" && len(mc.lastCmd) > 0 && !strings.Contains(mc.lastCmd[0], recordBegin+repositoriesRecord) {
+		_, err = io.WriteString(stdout, mc.transactionOutput)
+	} else if mc.logOutput != "" {
+		_, err = io.WriteString(stdout, mc.logOutput)
+	} else if mc.zypperBadVersion {
+		_, err = io.WriteString(stderr, "Unknown option '--severity'\n")
 	} else if mc.zypperGoodVersion {
-		_, err = cb.WriteString("Missing argument for --severity\n")
+		_, err = io.WriteString(stderr, "Missing argument for --severity\n")
 	} else {
-		_, err = cb.WriteString("streaming buffer initialized\n")
+		_, err = io.WriteString(stdout, "streaming buffer initialized\n")
+	}
+	if err == nil && mc.stderrOutput != "" {
+		_, err = io.WriteString(stderr, mc.stderrOutput)
 	}
 	return cb, err
 }
 
+func (mc *mockClient) ContainerAttach(options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	if mc.attachFail {
+		return types.HijackedResponse{}, errors.New("Attach failed")
+	}
+	mc.attached = append(mc.attached, options)
+
+	conn, server := net.Pipe()
+	go func() {
+		var w io.Writer = server
+		if !mc.tty {
+			w = stdcopy.NewStdWriter(server, stdcopy.Stdout)
+		}
+		_, _ = io.WriteString(w, "Do you agree with the terms of the license? [yes/no] (no): ")
+		_ = server.Close()
+	}()
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(conn)}, nil
+}
+
 func (mc *mockClient) ContainerKill(id, signal string) error {
 	if mc.killFail {
 		return fmt.Errorf("Fake failure while killing container")
@@ -203,6 +298,7 @@ func (mc *mockClient) ContainerCommit(options types.ContainerCommitOptions) (typ
 	if mc.commitFail {
 		return types.ContainerCommitResponse{ID: ""}, fmt.Errorf("Fake failure while committing container")
 	}
+	mc.lastCommit = options
 	return types.ContainerCommitResponse{ID: "fake image ID"}, nil
 }
 
@@ -216,11 +312,12 @@ func (mc *mockClient) ContainerList(options types.ContainerListOptions) ([]types
 		return []types.Container{}, nil
 	}
 
-	return []types.Container{
+	containers := []types.Container{
 		types.Container{
-			ID:    "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01",
-			Names: []string{"/suse"},
-			Image: "opensuse:13.2",
+			ID:      "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01",
+			Names:   []string{"/suse"},
+			Image:   "opensuse:13.2",
+			ImageID: "2",
 		},
 		types.Container{
 			ID:    "2",
@@ -237,7 +334,28 @@ func (mc *mockClient) ContainerList(options types.ContainerListOptions) ([]types
 			Names: []string{"/unknown_image"},
 			Image: "foo",
 		},
-	}, nil
+	}
+
+	if mc.listAmbiguous {
+		containers = append(containers, types.Container{
+			ID:      "35ae93c88cf8ab0000000000000000000000000000000000000000000000ee",
+			Names:   []string{"/other_suse"},
+			Image:   "opensuse:13.2",
+			ImageID: "2",
+		})
+	}
+
+	// Stopped containers are only returned when explicitly asked.
+	if options.All {
+		containers = append(containers, types.Container{
+			ID:      "35ae93c88cf8aa0000000000000000000000000000000000000000000000ff",
+			Names:   []string{"/stopped_suse"},
+			Image:   "opensuse:13.2",
+			ImageID: "2",
+			State:   "exited",
+		})
+	}
+	return containers, nil
 }
 
 func (mc *mockClient) ContainerResize(options types.ResizeOptions) error {
@@ -245,9 +363,220 @@ func (mc *mockClient) ContainerResize(options types.ResizeOptions) error {
 	return nil
 }
 
+func (mc *mockClient) ImageBuild(options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	if mc.buildFail {
+		return types.ImageBuildResponse{}, errors.New("Build failed")
+	}
+
+	tr := tar.NewReader(options.Context)
+	if _, err := tr.Next(); err != nil {
+		return types.ImageBuildResponse{}, err
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return types.ImageBuildResponse{}, err
+	}
+	mc.builtDockerfile = string(data)
+	mc.builtDockerfiles = append(mc.builtDockerfiles, mc.builtDockerfile)
+	mc.builtTags = options.Tags
+
+	stream := "{\"stream\":\"Successfully built 1234\\n\"}\n"
+	if mc.buildOutput != "" && strings.Contains(mc.builtDockerfile, "RUN ") {
+		out, _ := json.Marshal(map[string]string{"stream": mc.buildOutput})
+		stream = string(out) + "\n" + stream
+	}
+	if mc.buildError {
+		stream = "{\"errorDetail\":{\"message\":\"zypper failed\"},\"error\":\"zypper failed\"}\n"
+	}
+	return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(stream))}, nil
+}
+
 func (mc *mockClient) ImageInspectWithRaw(imageID string, getSize bool) (types.ImageInspect, []byte, error) {
 	if mc.inspectFail {
 		return types.ImageInspect{}, []byte{}, errors.New("inspect fail")
 	}
-	return types.ImageInspect{Config: &container.Config{Image: "1"}}, []byte{}, nil
+	if len(mc.builtTags) > 0 && imageID == mc.builtTags[0] {
+		return types.ImageInspect{ID: "built image ID", Config: &container.Config{Image: "1"}}, []byte{}, nil
+	}
+	if raw, ok := mc.rawInspects[imageID]; ok {
+		info := types.ImageInspect{}
+		err := json.Unmarshal([]byte(raw), &info)
+		return info, []byte(raw), err
+	}
+	if mc.configMismatch && imageID == "fake image ID" {
+		return types.ImageInspect{Config: &container.Config{Image: "1", Env: []string{"LANG=C"}}}, []byte{}, nil
+	}
+
+	// The committed image has the same config as its parent, plus the labels
+	// given when committing it.
+	raw := []byte(mc.rawInspect)
+	if imageID == "fake image ID" && mc.lastCommit.Config != nil {
+		data := struct {
+			Config map[string]interface{}
+		}{}
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &data); err != nil {
+				return types.ImageInspect{}, nil, err
+			}
+		}
+		if data.Config == nil {
+			data.Config = make(map[string]interface{})
+		}
+		data.Config["Labels"] = mc.lastCommit.Config.Labels
+		raw, _ = json.Marshal(data)
+	}
+
+	// The images listed by ImageList can be inspected by their ID.
+	id := ""
+	if _, err := strconv.Atoi(imageID); err == nil {
+		id = imageID
+	}
+	return types.ImageInspect{ID: id, Config: &container.Config{Image: "1"}}, raw, nil
+}
+
+func (mc *mockClient) ImagePush(options types.ImagePushOptions, privilegeFunc client.RequestPrivilegeFunc) (io.ReadCloser, error) {
+	if mc.pushFail {
+		return nil, errors.New("Push failed")
+	}
+	mc.pushed = append(mc.pushed, options)
+
+	cb := &closingBuffer{bytes.NewBuffer([]byte{})}
+	cb.WriteString(`{"status":"The push refers to a repository [` + options.ImageID + `]"}` + "\n")
+	if !mc.pushNoDigest {
+		cb.WriteString(`{"status":"` + options.Tag + `: digest: sha256:1234 size: 528"}` + "\n")
+		cb.WriteString(`{"progressDetail":{},"aux":{"Tag":"` + options.Tag + `","Digest":"sha256:1234","Size":528}}` + "\n")
+	}
+	return cb, nil
+}
+
+func (mc *mockClient) ImageRemove(options types.ImageRemoveOptions) ([]types.ImageDelete, error) {
+	if mc.removeImageFail {
+		return nil, errors.New("Image remove failed")
+	}
+	mc.removedImages = append(mc.removedImages, options.ImageID)
+	if options.PruneChildren {
+		mc.prunedImages = append(mc.prunedImages, options.ImageID)
+	}
+	return []types.ImageDelete{types.ImageDelete{Untagged: options.ImageID}}, nil
+}
+
+func (mc *mockClient) ImageHistory(imageID string) ([]types.ImageHistory, error) {
+	if history, ok := mc.histories[imageID]; ok {
+		return history, nil
+	}
+	return nil, fmt.Errorf("No such image: %s", imageID)
+}
+
+func (mc *mockClient) CopyFromContainer(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	if data, ok := mc.copies[srcPath]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), types.ContainerPathStat{}, nil
+	}
+	return nil, types.ContainerPathStat{}, fmt.Errorf("Could not find the file %s in container %s", srcPath, containerID)
+}
+
+func (mc *mockClient) CopyToContainer(options types.CopyToContainerOptions) error {
+	data, err := ioutil.ReadAll(options.Content)
+	if err != nil {
+		return err
+	}
+	mc.copiedTo = append(mc.copiedTo, options.ContainerID+":"+options.Path)
+	mc.copiedContent = data
+	return nil
+}
+
+func (mc *mockClient) ImageSave(imageIDs []string) (io.ReadCloser, error) {
+	if data, ok := mc.savedImages[imageIDs[0]]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	if mc.savedImage == nil {
+		return nil, errors.New("Save failed")
+	}
+	return ioutil.NopCloser(bytes.NewReader(mc.savedImage)), nil
+}
+
+func (mc *mockClient) ImageLoad(input io.Reader) (types.ImageLoadResponse, error) {
+	if mc.loadFail {
+		return types.ImageLoadResponse{}, errors.New("Load failed")
+	}
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+	mc.loadedImage = data
+	body := ioutil.NopCloser(strings.NewReader("{\"stream\":\"Loaded image\"}\n"))
+	return types.ImageLoadResponse{Body: body, JSON: true}, nil
+}
+
+func (mc *mockClient) ImageTag(options types.ImageTagOptions) error {
+	if mc.tagFail || (options.Force && mc.tagFailOnForce) {
+		return errors.New("Tag failed")
+	}
+	mc.tags = append(mc.tags, fmt.Sprintf("%s=%s:%s", options.ImageID, options.RepositoryName, options.Tag))
+	return nil
+}
+
+func (mc *mockClient) ContainerInspect(containerID string) (types.ContainerJSON, error) {
+	if mc.inspectContFail {
+		return types.ContainerJSON{}, errors.New("Container inspect failed")
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    containerID,
+			Name:  "/name-" + containerID,
+			State: &types.ContainerState{Running: true},
+			HostConfig: &container.HostConfig{
+				NetworkMode:   "default",
+				Binds:         []string{"/srv:/srv"},
+				RestartPolicy: container.RestartPolicy{Name: "always"},
+			},
+		},
+		Mounts: []types.MountPoint{
+			types.MountPoint{Source: "/srv", Destination: "/srv", RW: true},
+			types.MountPoint{Name: "data", Destination: "/data", RW: true},
+		},
+		Config: &container.Config{Image: "opensuse:13.2"},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"bridge":  &network.EndpointSettings{IPAddress: "172.17.0.2"},
+				"backend": &network.EndpointSettings{Aliases: []string{"db"}, IPAddress: "172.18.0.2"},
+			},
+		},
+	}, nil
+}
+
+func (mc *mockClient) ContainerInspectWithRaw(containerID string, getSize bool) (types.ContainerJSON, []byte, error) {
+	info, err := mc.ContainerInspect(containerID)
+	if err != nil {
+		return info, nil, err
+	}
+
+	state := map[string]interface{}{"Running": !mc.exited}
+	if mc.health != "" {
+		state["Health"] = map[string]string{"Status": mc.health}
+	}
+	raw, err := json.Marshal(map[string]interface{}{"Id": containerID, "State": state})
+	return info, raw, err
+}
+
+func (mc *mockClient) ContainerRename(containerID, newContainerName string) error {
+	if mc.renameFail {
+		return errors.New("Rename failed")
+	}
+	mc.renamed = append(mc.renamed, containerID+"="+newContainerName)
+	return nil
+}
+
+func (mc *mockClient) ContainerStop(containerID string, timeout int) error {
+	if mc.stopFail {
+		return errors.New("Stop failed")
+	}
+	return nil
+}
+
+func (mc *mockClient) NetworkConnect(networkID, containerID string, config *network.EndpointSettings) error {
+	if mc.connectFail {
+		return errors.New("Connect failed")
+	}
+	mc.connected = append(mc.connected, networkID+"="+containerID)
+	return nil
 }
@@ -0,0 +1,139 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// imageNameData contains the data that can be accessed by the templates that
+// define the name of new images. For example:
+//
+//	{{.Repo}}:{{.Tag}}-p{{.Date "20060102"}}
+type imageNameData struct {
+	// The repository and the tag of the source image. They are empty if the
+	// source image is only known by its ID.
+	Repo string
+	Tag  string
+
+	// The short ID of the source image (e.g. "4f3a2b1c0d9e").
+	ID string
+
+	// The number of patches to be applied.
+	Patches int
+
+	// The highest severity of the patches to be applied (e.g. "important").
+	// It is empty if none of them has a known severity.
+	Severity string
+
+	now time.Time
+}
+
+// Date returns the current date formatted with the given layout, as defined
+// by the `time` package (e.g. "20060102").
+func (d imageNameData) Date(layout string) string {
+	return d.now.Format(layout)
+}
+
+// isTemplate returns true if the given argument (e.g. the name of an image)
+// has to be interpreted as a template.
+func isTemplate(arg string) bool {
+	return strings.Contains(arg, "{{")
+}
+
+// shortImageID returns the short representation of the given image ID.
+func shortImageID(id string) string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// isImageID returns true if the given name of the source image is just the
+// given ID of the image, either in full (e.g. "sha256:4f3a...") or shortened
+// (e.g. "4f3a2b1c0d9e"). This happens with containers based on images that
+// have no name.
+func isImageID(name, id string) bool {
+	if name == id || strings.HasPrefix(name, "sha256:") {
+		return true
+	}
+	id = strings.TrimPrefix(id, "sha256:")
+	return len(name) >= 12 && strings.HasPrefix(id, name)
+}
+
+// renderImageName executes the given template with the given data, and
+// returns the repository and the tag of the resulting image name.
+func renderImageName(tmpl string, data imageNameData) (string, string, error) {
+	t, err := template.New("name").Parse(tmpl)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid template for the new image: %v", err)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err = t.Execute(buf, data); err != nil {
+		return "", "", fmt.Errorf("Could not execute the template for the new image: %v", err)
+	}
+
+	name := buf.String()
+	repo, tag, err := parseImageName(name)
+	if err != nil {
+		return "", "", fmt.Errorf("The template produced an invalid image name (%s): %v", name, err)
+	}
+	return repo, tag, nil
+}
+
+// imageNameFromTemplate returns the repository and the tag of the image that
+// will be created from the source image described by the given provenance, as
+// defined by the given template.
+func imageNameFromTemplate(tmpl string, p *provenance) (string, string, error) {
+	data := imageNameData{ID: shortImageID(p.SourceID), now: time.Now()}
+	if isImageID(p.Source, p.SourceID) {
+		if strings.Contains(tmpl, ".Repo") || strings.Contains(tmpl, ".Tag") {
+			return "", "", fmt.Errorf("The source image %s has no name, so the template of the new image cannot use {{.Repo}} or {{.Tag}}",
+				shortImageID(p.Source))
+		}
+	} else {
+		var err error
+		if data.Repo, data.Tag, err = parseImageName(p.Source); err != nil {
+			return "", "", err
+		}
+	}
+
+	if strings.Contains(tmpl, ".Patches") || strings.Contains(tmpl, ".Severity") {
+		if p.patchesErr != nil {
+			return "", "", fmt.Errorf("Could not fetch the patches to be applied: %v", p.patchesErr)
+		}
+		data.Patches = len(p.Patches)
+		data.Severity = p.Severity()
+	}
+	return renderImageName(tmpl, data)
+}
+
+// targetImageName returns the repository and the tag of the image given by
+// target, which might be a template, for the source image described by the
+// given provenance.
+func targetImageName(target string, p *provenance) (string, string, error) {
+	if isTemplate(target) {
+		return imageNameFromTemplate(target, p)
+	}
+	return parseImageName(target)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderImageName(t *testing.T) {
+	data := imageNameData{
+		Repo:     "opensuse",
+		Tag:      "13.2",
+		ID:       shortImageID("sha256:4f3a2b1c0d9e8f7a6b5c"),
+		Patches:  3,
+		Severity: "important",
+		now:      time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct{ tmpl, repo, tag string }{
+		{`{{.Repo}}:{{.Tag}}-p{{.Date "20060102"}}`, "opensuse", "13.2-p20160301"},
+		{`{{.Repo}}-patched:{{.Tag}}`, "opensuse-patched", "13.2"},
+		{`{{.Repo}}:{{.ID}}-{{.Patches}}-{{.Severity}}`, "opensuse", "4f3a2b1c0d9e-3-important"},
+	}
+	for _, test := range tests {
+		repo, tag, err := renderImageName(test.tmpl, data)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.tmpl, err)
+		}
+		if repo != test.repo || tag != test.tag {
+			t.Fatalf("Expected %s:%s, got %s:%s", test.repo, test.tag, repo, tag)
+		}
+	}
+}
+
+func TestRenderImageNameFail(t *testing.T) {
+	errs := map[string]string{
+		"{{.Repo":            "Invalid template for the new image",
+		"{{.Unknown}}":       "Could not execute the template for the new image",
+		"{{.Repo}}:$$":       "The template produced an invalid image name (opensuse:$$)",
+		"{{.Repo}}:{{.Tag}}": "",
+	}
+	for tmpl, msg := range errs {
+		_, _, err := renderImageName(tmpl, imageNameData{Repo: "opensuse", Tag: "13.2"})
+		if msg == "" {
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("Expected error '%s' for %s, got: %v", msg, tmpl, err)
+		}
+	}
+}
+
+func TestImageNameFromTemplate(t *testing.T) {
+	id := "sha256:4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a"
+	tests := []struct{ source, tmpl, repo, tag, err string }{
+		{"opensuse:13.2", "{{.Repo}}:{{.Tag}}-{{.ID}}", "opensuse", "13.2-4f3a2b1c0d9e", ""},
+		{id, "patched:{{.ID}}", "patched", "4f3a2b1c0d9e", ""},
+		{"4f3a2b1c0d9e", "patched:{{.ID}}", "patched", "4f3a2b1c0d9e", ""},
+		{id, "{{.Repo}}:patched", "", "", "The source image 4f3a2b1c0d9e has no name"},
+		{"4f3a2b1c0d9e", "patched:{{.Tag}}", "", "", "The source image 4f3a2b1c0d9e has no name"},
+	}
+	for _, test := range tests {
+		repo, tag, err := imageNameFromTemplate(test.tmpl, &provenance{Source: test.source, SourceID: id})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error '%s' for %s, got: %v", test.err, test.source, err)
+			}
+		} else if err != nil || repo != test.repo || tag != test.tag {
+			t.Fatalf("Expected %s:%s for %s, got %s:%s (%v)", test.repo, test.tag, test.source, repo, tag, err)
+		}
+	}
+}
+
+func TestPatchCommandTemplate(t *testing.T) {
+	cases := testCases{
+		{"Template with patches", &mockClient{listReturnOneImage: true, logOutput: patchListOutput}, 0, []string{"opensuse:13.2", "{{.Repo}}-p{{.Patches}}:{{.Severity}}"}, true, "opensuse-p2:important successfully created", ""},
+		{"Template collision", &mockClient{}, 1, []string{"opensuse:13.2", "{{.Repo}}:{{.Tag}}"}, true, "Cannot overwrite an existing image. Please use a different repository/tag.", ""},
+		{"Cannot inspect the source image", &mockClient{inspectFail: true}, 1, []string{"opensuse:42.1", "{{.Repo}}:new"}, true, "could not inspect image 'opensuse:42.1': inspect fail", ""},
+		{"Patches cannot be listed", &mockClient{listReturnOneImage: true}, 1, []string{"opensuse:13.2", "{{.Repo}}:{{.Patches}}"}, true, "Could not fetch the patches to be applied: zypper did not produce any XML output", ""},
+	}
+	cases.run(t, patchCmd, "zypper -n patch", "")
+}
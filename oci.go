@@ -0,0 +1,1034 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/network"
+)
+
+// The media types and annotations of OCI image layouts used by the OCI
+// backend. Manifests in the Docker format are also accepted.
+const (
+	ociLayoutVersion        = "1.0.0"
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	ociLayerMediaType       = "application/vnd.oci.image.layer.v1.tar+gzip"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerLayerMediaType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	ociRefNameAnnotation    = "org.opencontainers.image.ref.name"
+)
+
+// errOCIUnsupported is returned by the operations that cannot be performed
+// without a Docker daemon.
+var errOCIUnsupported = errors.New("this operation is not supported by the OCI backend")
+
+// ociDigest matches the valid digests of blobs.
+var ociDigest = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+// ociDescriptor points to a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    json.RawMessage   `json:"platform,omitempty"`
+}
+
+// name returns the name of the image pointed by this descriptor, or an empty
+// string if it has none.
+func (d ociDescriptor) name() string {
+	name := d.Annotations[ociRefNameAnnotation]
+	if name == "" {
+		return ""
+	}
+	repo, tag, err := parseImageName(name)
+	if err != nil {
+		return ""
+	}
+	return repo + ":" + tag
+}
+
+// ociIndex is the index.json file of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is the manifest of an image.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociImage is an image stored in an OCI image layout.
+type ociImage struct {
+	// The descriptor of its manifest in the index, and the manifest itself.
+	desc     ociDescriptor
+	manifest ociManifest
+
+	// The names of the image. The ID is the digest of its configuration, as
+	// it happens with the Docker daemon.
+	names []string
+	id    string
+}
+
+// ociContainer is the root filesystem in which the OCI backend runs the
+// given command. Two copies of the image are unpacked, so the changes done
+// by the command can be committed as a new layer.
+type ociContainer struct {
+	id      string
+	image   string
+	created time.Time
+	parent  *ociImage
+
+	dir, lower, rootfs string
+	args, env          []string
+
+	log            *ociLog
+	stdout, stderr io.Writer
+	cmd            *exec.Cmd
+	done           chan bool
+	exitCode       int
+}
+
+// state returns the state of the container, as reported by the daemon. The
+// lock of the client has to be held.
+func (ctr *ociContainer) state() string {
+	if ctr.cmd == nil {
+		return "created"
+	}
+	select {
+	case <-ctr.done:
+		return "exited"
+	default:
+		return "running"
+	}
+}
+
+// ociClient implements the DockerClient interface on top of an OCI image
+// layout stored in a local directory, so images can be patched without a
+// Docker daemon. The containers are only known by this client, and zypper is
+// run inside of them through `sandboxCommand`.
+type ociClient struct {
+	sync.Mutex
+
+	dir        string
+	containers map[string]*ociContainer
+}
+
+// newOCIClient returns a client for the OCI image layout stored in dir.
+func newOCIClient(dir string) (*ociClient, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %v", dir, err)
+	}
+	layout := struct {
+		Version string `json:"imageLayoutVersion"`
+	}{}
+	if err = json.Unmarshal(data, &layout); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %v", dir, err)
+	}
+	if layout.Version != ociLayoutVersion {
+		return nil, fmt.Errorf("unsupported version of the OCI image layout: %s", layout.Version)
+	}
+	return &ociClient{dir: dir, containers: make(map[string]*ociContainer)}, nil
+}
+
+// blobPath returns the path of the blob with the given digest.
+func (c *ociClient) blobPath(digest string) (string, error) {
+	if !ociDigest.MatchString(digest) {
+		return "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+	parts := strings.SplitN(digest, ":", 2)
+	return filepath.Join(c.dir, "blobs", parts[0], parts[1]), nil
+}
+
+// readBlob returns the contents of the blob with the given digest.
+func (c *ociClient) readBlob(digest string) ([]byte, error) {
+	path, err := c.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// writeBlob stores the given data as a blob. It returns its descriptor.
+func (c *ociClient) writeBlob(mediaType string, data []byte) (ociDescriptor, error) {
+	sum := sha256.Sum256(data)
+	desc := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+	}
+	path, _ := c.blobPath(desc.Digest)
+	if _, err := os.Stat(path); err == nil {
+		return desc, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return desc, err
+	}
+	return desc, writeFileAtomically(path, data)
+}
+
+// writeFileAtomically writes the given data into path, making sure that the
+// file is never left half-written.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readIndex returns the index of the layout.
+func (c *ociClient) readIndex() (ociIndex, error) {
+	var index ociIndex
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, "index.json"))
+	if err != nil {
+		return index, err
+	}
+	if err = json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("could not decode the index of the OCI image layout: %v", err)
+	}
+	return index, nil
+}
+
+// writeIndex replaces the index of the layout.
+func (c *ociClient) writeIndex(index ociIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(c.dir, "index.json"), data)
+}
+
+// images returns the images listed in the index of the layout. Nested indexes
+// (e.g. multi-platform images) are not supported, so they are ignored.
+func (c *ociClient) images() ([]*ociImage, error) {
+	index, err := c.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []*ociImage{}
+	byManifest := make(map[string]*ociImage)
+	for _, desc := range index.Manifests {
+		if desc.MediaType != ociManifestMediaType && desc.MediaType != dockerManifestMediaType {
+			continue
+		}
+		img, ok := byManifest[desc.Digest]
+		if !ok {
+			data, err := c.readBlob(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("could not read manifest %s: %v", desc.Digest, err)
+			}
+			img = &ociImage{desc: desc}
+			if err = json.Unmarshal(data, &img.manifest); err != nil {
+				return nil, fmt.Errorf("could not decode manifest %s: %v", desc.Digest, err)
+			}
+			img.id = img.manifest.Config.Digest
+			byManifest[desc.Digest] = img
+			images = append(images, img)
+		}
+		if name := desc.name(); name != "" && !arrayIncludeString(img.names, name) {
+			img.names = append(img.names, name)
+		}
+	}
+	return images, nil
+}
+
+// lookupImage returns the image with the given reference, which can be either
+// its name, its ID or a prefix of the ID.
+func (c *ociClient) lookupImage(ref string) (*ociImage, error) {
+	images, err := c.images()
+	if err != nil {
+		return nil, err
+	}
+
+	if repo, tag, err := parseImageName(ref); err == nil {
+		name := repo + ":" + tag
+		for _, img := range images {
+			if arrayIncludeString(img.names, name) {
+				return img, nil
+			}
+		}
+	}
+	for _, img := range images {
+		if img.id == ref || strings.HasPrefix(img.id, "sha256:"+ref) ||
+			(strings.HasPrefix(ref, "sha256:") && strings.HasPrefix(img.id, ref)) {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("No such image: %s", ref)
+}
+
+// ociConfig contains the fields of the configuration of an image that are
+// needed to inspect it.
+type ociConfig struct {
+	Created      string          `json:"created"`
+	Author       string          `json:"author"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       json.RawMessage `json:"config"`
+}
+
+// ImageInspectWithRaw returns the image with the given reference. The raw
+// output contains the configuration as stored in the layout.
+func (c *ociClient) ImageInspectWithRaw(imageID string, getSize bool) (types.ImageInspect, []byte, error) {
+	img, err := c.lookupImage(imageID)
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	data, err := c.readBlob(img.id)
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	var cfg ociConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return types.ImageInspect{}, nil, fmt.Errorf("could not decode the configuration of %s: %v", imageID, err)
+	}
+
+	size := int64(0)
+	for _, layer := range img.manifest.Layers {
+		size += layer.Size
+	}
+	raw, err := json.Marshal(struct {
+		ID           string `json:"Id"`
+		RepoTags     []string
+		Created      string
+		Author       string
+		Architecture string
+		Os           string
+		Size         int64
+		Config       json.RawMessage
+	}{img.id, img.names, cfg.Created, cfg.Author, cfg.Architecture, cfg.OS, size, cfg.Config})
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+
+	var info types.ImageInspect
+	if err = json.Unmarshal(raw, &info); err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	if info.Config == nil {
+		info.Config = &container.Config{}
+	}
+	return info, raw, nil
+}
+
+// ImageList returns the images of the layout. Only the repository given in
+// MatchName is taken into account, if any.
+func (c *ociClient) ImageList(options types.ImageListOptions) ([]types.Image, error) {
+	images, err := c.images()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []types.Image{}
+	for _, img := range images {
+		if options.MatchName != "" {
+			found := false
+			for _, name := range img.names {
+				repo, _, _ := parseImageName(name)
+				found = found || repo == options.MatchName || name == options.MatchName
+			}
+			if !found {
+				continue
+			}
+		}
+		info, _, err := c.ImageInspectWithRaw(img.id, false)
+		if err != nil {
+			return nil, err
+		}
+		created, _ := time.Parse(time.RFC3339Nano, info.Created)
+		list = append(list, types.Image{
+			ID:          img.id,
+			RepoTags:    img.names,
+			Created:     created.Unix(),
+			Size:        info.Size,
+			VirtualSize: info.Size,
+			Labels:      info.Config.Labels,
+		})
+	}
+	return list, nil
+}
+
+// setName makes the given name point to the manifest described by desc. The
+// lock of the client has to be held.
+func (c *ociClient) setName(desc ociDescriptor, name string) error {
+	index, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+	manifests := []ociDescriptor{}
+	for _, d := range index.Manifests {
+		if d.name() != name {
+			manifests = append(manifests, d)
+		}
+	}
+
+	desc.Annotations = map[string]string{ociRefNameAnnotation: name}
+	index.Manifests = append(manifests, desc)
+	return c.writeIndex(index)
+}
+
+// ImageHistory returns the history of the given image, from the most recent
+// entry to the oldest one, as stored in its configuration.
+func (c *ociClient) ImageHistory(imageID string) ([]types.ImageHistory, error) {
+	img, err := c.lookupImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.readBlob(img.id)
+	if err != nil {
+		return nil, err
+	}
+	cfg := struct {
+		History []imageHistory `json:"history"`
+	}{}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("could not decode the configuration of %s: %v", imageID, err)
+	}
+
+	history := []types.ImageHistory{}
+	for i := len(cfg.History) - 1; i >= 0; i-- {
+		h := cfg.History[i]
+		created, _ := time.Parse(time.RFC3339Nano, h.Created)
+		entry := types.ImageHistory{ID: "<missing>", Created: created.Unix(), CreatedBy: h.CreatedBy, Comment: h.Comment}
+		if i == len(cfg.History)-1 {
+			entry.ID, entry.Tags = img.id, img.names
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+// ImageTag gives a new name to an image of the layout.
+func (c *ociClient) ImageTag(options types.ImageTagOptions) error {
+	c.Lock()
+	defer c.Unlock()
+
+	img, err := c.lookupImage(options.ImageID)
+	if err != nil {
+		return err
+	}
+	return c.setName(img.desc, options.RepositoryName+":"+options.Tag)
+}
+
+// ImageRemove removes the given name from the layout. If an ID is given
+// instead, all the names of the image are removed. The blobs are kept, since
+// other images might still be using them.
+func (c *ociClient) ImageRemove(options types.ImageRemoveOptions) ([]types.ImageDelete, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	img, err := c.lookupImage(options.ImageID)
+	if err != nil {
+		return nil, err
+	}
+	names, byName := img.names, false
+	if repo, tag, err := parseImageName(options.ImageID); err == nil && arrayIncludeString(names, repo+":"+tag) {
+		names, byName = []string{repo + ":" + tag}, true
+	} else if len(names) > 1 && !options.Force {
+		return nil, fmt.Errorf("conflict: unable to delete %s (must be forced) - image is referenced in multiple repositories", options.ImageID)
+	}
+
+	index, err := c.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifests := []ociDescriptor{}
+	for _, d := range index.Manifests {
+		removed := d.Digest == img.desc.Digest && (!byName || arrayIncludeString(names, d.name()))
+		if !removed {
+			manifests = append(manifests, d)
+		}
+	}
+	index.Manifests = manifests
+	if err = c.writeIndex(index); err != nil {
+		return nil, err
+	}
+
+	deleted := []types.ImageDelete{}
+	for _, name := range names {
+		deleted = append(deleted, types.ImageDelete{Untagged: name})
+	}
+	return deleted, nil
+}
+
+// unpackImage applies the layers of the given image into dir.
+func (c *ociClient) unpackImage(img *ociImage, dir string) error {
+	for _, layer := range img.manifest.Layers {
+		path, err := c.blobPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = archive.ApplyLayer(dir, file)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("could not unpack layer %s: %v", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// container returns the container with the given ID and its state.
+func (c *ociClient) container(id string) (*ociContainer, string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if ctr, ok := c.containers[id]; ok {
+		return ctr, ctr.state(), nil
+	}
+	return nil, "", fmt.Errorf("No such container: %s", id)
+}
+
+// ContainerCreate unpacks the given image into a temporary directory, where
+// the given command will be run.
+func (c *ociClient) ContainerCreate(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (types.ContainerCreateResponse, error) {
+	resp := types.ContainerCreateResponse{}
+
+	img, err := c.lookupImage(config.Image)
+	if err != nil {
+		return resp, err
+	}
+	info, _, err := c.ImageInspectWithRaw(img.id, false)
+	if err != nil {
+		return resp, err
+	}
+	dir, err := ioutil.TempDir("", "zypper-docker-oci-")
+	if err != nil {
+		return resp, err
+	}
+
+	ctr := &ociContainer{
+		id:      stringid.GenerateRandomID(),
+		image:   config.Image,
+		created: time.Now(),
+		parent:  img,
+		dir:     dir,
+		lower:   filepath.Join(dir, "lower"),
+		rootfs:  filepath.Join(dir, "rootfs"),
+		args:    append(config.Entrypoint.Slice(), config.Cmd.Slice()...),
+		env:     append(info.Config.Env, config.Env...),
+		log:     newOCILog(),
+		done:    make(chan bool),
+	}
+	// As with the daemon, both streams are multiplexed unless there's a TTY.
+	ctr.stdout, ctr.stderr = ctr.log, ctr.log
+	if !config.Tty {
+		ctr.stdout = stdcopy.NewStdWriter(ctr.log, stdcopy.Stdout)
+		ctr.stderr = stdcopy.NewStdWriter(ctr.log, stdcopy.Stderr)
+	}
+	for _, d := range []string{ctr.lower, ctr.rootfs} {
+		if err = os.Mkdir(d, 0755); err == nil {
+			err = c.unpackImage(img, d)
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return resp, err
+		}
+	}
+
+	if hostConfig != nil && len(hostConfig.ExtraHosts) > 0 {
+		resp.Warnings = append(resp.Warnings, "The custom host-to-IP mappings are ignored by the OCI backend")
+	}
+	c.Lock()
+	c.containers[ctr.id] = ctr
+	c.Unlock()
+	resp.ID = ctr.id
+	return resp, nil
+}
+
+// ContainerStart runs the command of the given container in a sandbox.
+func (c *ociClient) ContainerStart(id string) error {
+	ctr, state, err := c.container(id)
+	if err != nil {
+		return err
+	}
+	if state != "created" {
+		return fmt.Errorf("container %s has already been started", id)
+	}
+
+	cmd, err := sandboxCommand(ctr.rootfs, ctr.args, ctr.env)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = ctr.stdout, ctr.stderr
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	c.Lock()
+	ctr.cmd = cmd
+	c.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			ctr.exitCode = 1
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				ctr.exitCode = status.ExitStatus()
+			}
+		} else if err != nil {
+			ctr.exitCode = 1
+			fmt.Fprintln(ctr.stderr, err)
+		}
+		_ = ctr.log.Close()
+		close(ctr.done)
+	}()
+	return nil
+}
+
+// ContainerWait waits for the command of the given container to finish and
+// returns its exit code.
+func (c *ociClient) ContainerWait(containerID string) (int, error) {
+	ctr, state, err := c.container(containerID)
+	if err != nil {
+		return -1, err
+	}
+	if state == "created" {
+		return -1, fmt.Errorf("container %s has not been started", containerID)
+	}
+	<-ctr.done
+	return ctr.exitCode, nil
+}
+
+// ContainerLogs returns the output of the given container, which is followed
+// until the container exits.
+func (c *ociClient) ContainerLogs(options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	ctr, _, err := c.container(options.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	return ctr.log.reader(), nil
+}
+
+// ContainerKill kills the command of the given container.
+func (c *ociClient) ContainerKill(containerID, signal string) error {
+	ctr, state, err := c.container(containerID)
+	if err != nil {
+		return err
+	}
+	if state != "running" {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	return ctr.cmd.Process.Kill()
+}
+
+// ContainerStop behaves like ContainerKill, since the sandbox has no init
+// process to forward signals to.
+func (c *ociClient) ContainerStop(containerID string, timeout int) error {
+	return c.ContainerKill(containerID, "KILL")
+}
+
+// ContainerRemove removes the root filesystem of the given container.
+func (c *ociClient) ContainerRemove(options types.ContainerRemoveOptions) error {
+	ctr, state, err := c.container(options.ContainerID)
+	if err != nil {
+		return err
+	}
+	if state == "running" {
+		if !options.Force {
+			return fmt.Errorf("container %s is running", options.ContainerID)
+		}
+		_ = ctr.cmd.Process.Kill()
+		<-ctr.done
+	}
+
+	c.Lock()
+	delete(c.containers, ctr.id)
+	c.Unlock()
+	return os.RemoveAll(ctr.dir)
+}
+
+// ContainerList returns the containers created by this client.
+func (c *ociClient) ContainerList(options types.ContainerListOptions) ([]types.Container, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	list := []types.Container{}
+	for _, ctr := range c.containers {
+		state := ctr.state()
+		if state != "running" && !options.All {
+			continue
+		}
+		list = append(list, types.Container{
+			ID:      ctr.id,
+			Names:   []string{"/" + ctr.id[:12]},
+			Image:   ctr.image,
+			ImageID: ctr.parent.id,
+			Command: strings.Join(ctr.args, " "),
+			Created: ctr.created.Unix(),
+			State:   state,
+		})
+	}
+	return list, nil
+}
+
+// ContainerCommit stores the changes done in the given container as a new
+// layer on top of its image. The configuration of the new image is the one of
+// the parent image with the values given in options.Config, which makes
+// options.Changes unneeded: they only restore what has been overridden in the
+// helper container.
+func (c *ociClient) ContainerCommit(options types.ContainerCommitOptions) (types.ContainerCommitResponse, error) {
+	resp := types.ContainerCommitResponse{}
+
+	ctr, state, err := c.container(options.ContainerID)
+	if err != nil {
+		return resp, err
+	}
+	if state == "running" {
+		return resp, fmt.Errorf("container %s is still running", options.ContainerID)
+	}
+
+	layer, diffID, err := c.writeLayer(ctr)
+	if err != nil {
+		return resp, fmt.Errorf("could not write the new layer: %v", err)
+	}
+	if ctr.parent.desc.MediaType == dockerManifestMediaType {
+		layer.MediaType = dockerLayerMediaType
+	}
+
+	parent, err := c.readBlob(ctr.parent.id)
+	if err != nil {
+		return resp, err
+	}
+	data, err := commitOCIConfig(parent, options, diffID, strings.Join(ctr.args, " "))
+	if err != nil {
+		return resp, err
+	}
+	config, err := c.writeBlob(ctr.parent.manifest.Config.MediaType, data)
+	if err != nil {
+		return resp, err
+	}
+
+	manifest := ctr.parent.manifest
+	manifest.Config = config
+	manifest.Layers = append(append([]ociDescriptor{}, manifest.Layers...), layer)
+	if data, err = json.Marshal(manifest); err != nil {
+		return resp, err
+	}
+	desc, err := c.writeBlob(ctr.parent.desc.MediaType, data)
+	if err != nil {
+		return resp, err
+	}
+	desc.Platform = ctr.parent.desc.Platform
+
+	c.Lock()
+	defer c.Unlock()
+	if err = c.setName(desc, options.RepositoryName+":"+options.Tag); err != nil {
+		return resp, err
+	}
+	resp.ID = config.Digest
+	return resp, nil
+}
+
+// writeLayer stores the changes done in the given container as a compressed
+// layer. It returns its descriptor and its uncompressed digest.
+func (c *ociClient) writeLayer(ctr *ociContainer) (ociDescriptor, string, error) {
+	desc := ociDescriptor{MediaType: ociLayerMediaType}
+
+	changes, err := archive.ChangesDirs(ctr.rootfs, ctr.lower)
+	if err != nil {
+		return desc, "", err
+	}
+	layer, err := archive.ExportChanges(ctr.rootfs, changes, nil, nil)
+	if err != nil {
+		return desc, "", err
+	}
+	defer layer.Close()
+
+	dir := filepath.Join(c.dir, "blobs", "sha256")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return desc, "", err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return desc, "", err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	compressed, uncompressed := sha256.New(), sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, compressed))
+	if _, err = io.Copy(io.MultiWriter(gz, uncompressed), layer); err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err != nil {
+		return desc, "", err
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return desc, "", err
+	}
+	desc.Digest = "sha256:" + hex.EncodeToString(compressed.Sum(nil))
+	desc.Size = info.Size()
+	path, _ := c.blobPath(desc.Digest)
+	if err = os.Chmod(tmp.Name(), 0644); err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return desc, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), err
+}
+
+// commitOCIConfig returns the configuration of the image committed on top of
+// the one with the given configuration. Unknown fields are kept as they are.
+func commitOCIConfig(parent []byte, options types.ContainerCommitOptions, diffID, createdBy string) ([]byte, error) {
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(parent, &cfg); err != nil {
+		return nil, fmt.Errorf("could not decode the configuration of the parent image: %v", err)
+	}
+	runCfg := make(map[string]json.RawMessage)
+	if raw, ok := cfg["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &runCfg); err != nil {
+			return nil, fmt.Errorf("could not decode the configuration of the parent image: %v", err)
+		}
+	}
+	var rootfs imageRootFS
+	var history []imageHistory
+	if raw, ok := cfg["rootfs"]; ok {
+		if err := json.Unmarshal(raw, &rootfs); err != nil {
+			return nil, fmt.Errorf("could not decode the layers of the parent image: %v", err)
+		}
+	}
+	if raw, ok := cfg["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("could not decode the history of the parent image: %v", err)
+		}
+	}
+
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	rootfs.Type = "layers"
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+	history = append(history, imageHistory{
+		Created:   created,
+		CreatedBy: createdBy,
+		Author:    options.Author,
+		Comment:   options.Comment,
+	})
+
+	values := map[string]interface{}{"created": created, "rootfs": rootfs, "history": history}
+	if options.Author != "" {
+		values["author"] = options.Author
+	}
+	if c := options.Config; c != nil {
+		overrides := map[string]interface{}{
+			"Env":          c.Env,
+			"WorkingDir":   c.WorkingDir,
+			"ExposedPorts": c.ExposedPorts,
+			"Volumes":      c.Volumes,
+			"Labels":       c.Labels,
+			"OnBuild":      c.OnBuild,
+			"StopSignal":   c.StopSignal,
+		}
+		for key, value := range overrides {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			if s := string(data); s != "null" && s != `""` && s != "{}" && s != "[]" {
+				runCfg[key] = data
+			}
+		}
+		values["config"] = runCfg
+	}
+
+	for key, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		cfg[key] = data
+	}
+	return json.Marshal(cfg)
+}
+
+// ContainerResize does nothing, since the output of the sandbox is not
+// attached to a terminal.
+func (c *ociClient) ContainerResize(options types.ResizeOptions) error {
+	return nil
+}
+
+// ContainerAttach is not supported by the OCI backend.
+func (c *ociClient) ContainerAttach(options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	return types.HijackedResponse{}, errOCIUnsupported
+}
+
+// ContainerInspect is not supported by the OCI backend.
+func (c *ociClient) ContainerInspect(containerID string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{}, errOCIUnsupported
+}
+
+// ContainerInspectWithRaw is not supported by the OCI backend.
+func (c *ociClient) ContainerInspectWithRaw(containerID string, getSize bool) (types.ContainerJSON, []byte, error) {
+	return types.ContainerJSON{}, nil, errOCIUnsupported
+}
+
+// ContainerRename is not supported by the OCI backend.
+func (c *ociClient) ContainerRename(containerID, newContainerName string) error {
+	return errOCIUnsupported
+}
+
+// CopyFromContainer is not supported by the OCI backend.
+func (c *ociClient) CopyFromContainer(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	return nil, types.ContainerPathStat{}, errOCIUnsupported
+}
+
+// CopyToContainer is not supported by the OCI backend.
+func (c *ociClient) CopyToContainer(options types.CopyToContainerOptions) error {
+	return errOCIUnsupported
+}
+
+// ImageBuild is not supported by the OCI backend.
+func (c *ociClient) ImageBuild(options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	return types.ImageBuildResponse{}, errOCIUnsupported
+}
+
+// ImageLoad is not supported by the OCI backend.
+func (c *ociClient) ImageLoad(input io.Reader) (types.ImageLoadResponse, error) {
+	return types.ImageLoadResponse{}, errOCIUnsupported
+}
+
+// ImagePush is not supported by the OCI backend.
+func (c *ociClient) ImagePush(options types.ImagePushOptions, privilegeFunc client.RequestPrivilegeFunc) (io.ReadCloser, error) {
+	return nil, errOCIUnsupported
+}
+
+// ImageSave is not supported by the OCI backend.
+func (c *ociClient) ImageSave(imageIDs []string) (io.ReadCloser, error) {
+	return nil, errOCIUnsupported
+}
+
+// NetworkConnect is not supported by the OCI backend.
+func (c *ociClient) NetworkConnect(networkID, containerID string, config *network.EndpointSettings) error {
+	return errOCIUnsupported
+}
+
+// ociLog holds the output of a container, which can be followed by any number
+// of readers until it's closed.
+type ociLog struct {
+	sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	closed bool
+}
+
+func newOCILog() *ociLog {
+	l := &ociLog{}
+	l.cond = sync.NewCond(&l.Mutex)
+	return l
+}
+
+func (l *ociLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.data = append(l.data, p...)
+	l.cond.Broadcast()
+	return len(p), nil
+}
+
+func (l *ociLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.closed = true
+	l.cond.Broadcast()
+	return nil
+}
+
+// reader returns a reader of the whole log, which blocks until there's more
+// output or the log is closed.
+func (l *ociLog) reader() io.ReadCloser {
+	return &ociLogReader{log: l}
+}
+
+type ociLogReader struct {
+	log    *ociLog
+	offset int
+	closed bool
+}
+
+func (r *ociLogReader) Read(p []byte) (int, error) {
+	l := r.log
+	l.Lock()
+	defer l.Unlock()
+
+	for r.offset >= len(l.data) && !l.closed && !r.closed {
+		l.cond.Wait()
+	}
+	if r.offset >= len(l.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, l.data[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+func (r *ociLogReader) Close() error {
+	r.log.Lock()
+	defer r.log.Unlock()
+
+	r.closed = true
+	r.log.cond.Broadcast()
+	return nil
+}
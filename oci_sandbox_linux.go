@@ -0,0 +1,222 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/reexec"
+)
+
+// The name under which zypper-docker re-executes itself to set up the sandbox
+// of the OCI backend.
+const sandboxInit = "zypper-docker-sandbox"
+
+func init() {
+	reexec.Register(sandboxInit, runSandbox)
+}
+
+// The user and group IDs of the sandbox are mapped to the same IDs on the
+// host, so the ownership of the files of the image is kept as it is.
+const sandboxIDs = math.MaxInt32
+
+// sandboxCommand returns the command that runs args inside of rootfs. It runs
+// in its own user, mount, PID, UTS and IPC namespaces, but it shares the
+// network of the host so zypper can reach its repositories. Since it has its
+// own user namespace, the capabilities of root inside of the sandbox do not
+// apply to the host.
+func sandboxCommand(rootfs string, args, env []string) (*exec.Cmd, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+	cmd := reexec.Command(append([]string{sandboxInit, rootfs}, args...)...)
+	cmd.Env = env
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+		syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: sandboxIDs}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: sandboxIDs}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+	return cmd, nil
+}
+
+// runSandbox is run by the process started by `sandboxCommand`: it sets up
+// the root filesystem and then it executes the given command inside of it.
+func runSandbox() {
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <rootfs> <command>...\n", sandboxInit)
+		os.Exit(125)
+	}
+	rootfs, args := os.Args[1], os.Args[2:]
+
+	if err := setupSandbox(rootfs); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up the sandbox: %v\n", err)
+		os.Exit(125)
+	}
+	path, err := exec.LookPath(args[0])
+	if err == nil {
+		err = syscall.Exec(path, args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "Could not execute %s: %v\n", args[0], err)
+	os.Exit(127)
+}
+
+// The devices of the host that are available inside of the sandbox.
+var sandboxDevices = []string{"null", "zero", "random", "urandom", "tty"}
+
+// setupSandbox mounts what zypper needs inside of rootfs, and makes it the
+// root directory. Nothing is created inside of rootfs, so the mount points
+// that it lacks are skipped.
+func setupSandbox(rootfs string) error {
+	// The mounts are gone with the mount namespace, as long as they are not
+	// propagated to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("could not make the mounts private: %v", err)
+	}
+	// pivot_root needs the new root to be a mount point.
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not mount the root filesystem: %v", err)
+	}
+
+	if dev, ok := sandboxMountPoint(rootfs, "dev", true); ok {
+		if err := setupDevices(dev); err != nil {
+			return err
+		}
+	}
+	if proc, ok := sandboxMountPoint(rootfs, "proc", true); ok {
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV)
+		if err := syscall.Mount("proc", proc, "proc", flags, ""); err != nil {
+			return fmt.Errorf("could not mount proc: %v", err)
+		}
+	}
+	if resolv, ok := sandboxMountPoint(rootfs, "etc/resolv.conf", false); ok {
+		if err := syscall.Mount("/etc/resolv.conf", resolv, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("could not mount etc/resolv.conf: %v", err)
+		}
+	}
+
+	// The previous root is detached, so nothing from the host can be reached
+	// from the sandbox, not even by escaping a chroot.
+	if err := os.Chdir(rootfs); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("could not change the root directory: %v", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("could not detach the previous root directory: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+// setupDevices mounts a minimal /dev on the given directory: a tmpfs with the
+// devices from sandboxDevices, which are bind mounted from the host.
+func setupDevices(dev string) error {
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_STRICTATIME)
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", flags, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("could not mount dev: %v", err)
+	}
+	for _, name := range sandboxDevices {
+		target := filepath.Join(dev, name)
+		if err := ioutil.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount("/dev/"+name, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("could not mount /dev/%s: %v", name, err)
+		}
+	}
+	links := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sandboxMountPoint returns the path of the given mount point inside of
+// rootfs, and whether it exists and it's a directory (or a regular file if
+// dir is false).
+func sandboxMountPoint(rootfs, name string, dir bool) (string, bool) {
+	target, err := resolveInRoot(rootfs, name)
+	if err != nil {
+		return "", false
+	}
+	info, err := os.Lstat(target)
+	if err != nil || info.IsDir() != dir || (!dir && !info.Mode().IsRegular()) {
+		return "", false
+	}
+	return target, true
+}
+
+// resolveInRoot returns the path of name inside of root, following the
+// symbolic links of its components as if root was the root directory, so
+// neither the links nor ".." can go above it. The components that do not
+// exist are kept as they are.
+func resolveInRoot(root, name string) (string, error) {
+	resolved, rest := "", name
+	for links := 0; rest != ""; {
+		var part string
+		if i := strings.IndexByte(rest, '/'); i < 0 {
+			part, rest = rest, ""
+		} else {
+			part, rest = rest[:i], rest[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = filepath.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		rest = target + "/" + rest
+	}
+	return filepath.Join(root, resolved), nil
+}
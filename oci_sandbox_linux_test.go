@@ -0,0 +1,72 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "zypper-docker-rootfs")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(root) }()
+
+	if err = os.MkdirAll(filepath.Join(root, "usr", "etc"), 0755); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	links := map[string]string{
+		"etc":      "usr/etc",
+		"abs":      "/usr/etc",
+		"up":       "../../..",
+		"usr/back": "..",
+		"c":        ".",
+		"a":        "c/..",
+		"loop":     "loop",
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatalf("Could not create link: %v", err)
+		}
+	}
+
+	paths := map[string]string{
+		"etc/resolv.conf":            "usr/etc/resolv.conf",
+		"abs/resolv.conf":            "usr/etc/resolv.conf",
+		"up/etc/resolv.conf":         "usr/etc/resolv.conf",
+		"../../etc":                  "usr/etc",
+		"usr/back/usr/back/etc":      "usr/etc",
+		"a/etc":                      "usr/etc",
+		"a/../../proc":               "proc",
+		"missing/../etc/resolv.conf": "usr/etc/resolv.conf",
+	}
+	for name, expected := range paths {
+		resolved, err := resolveInRoot(root, name)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", name, err)
+		}
+		if resolved != filepath.Join(root, expected) {
+			t.Fatalf("Expected %s for %s, got %s", expected, name, resolved)
+		}
+	}
+
+	if _, err = resolveInRoot(root, "loop/etc"); err == nil {
+		t.Fatal("It should have failed")
+	}
+}
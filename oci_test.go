@@ -0,0 +1,263 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/strslice"
+)
+
+// setupOCILayout creates an OCI image layout containing the opensuse:13.2
+// image. It returns the client of the layout and a function that removes it.
+func setupOCILayout(t *testing.T) (*ociClient, func()) {
+	dir, err := ioutil.TempDir("", "zypper-docker-oci-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	c := &ociClient{dir: dir, containers: make(map[string]*ociContainer)}
+
+	layer, err := c.writeBlob(ociLayerMediaType, newArchive(t, map[string]string{
+		"etc/":           "",
+		"etc/os-release": "openSUSE 13.2",
+		"etc/motd":       "hello",
+		"usr/":           "",
+	}))
+	if err != nil {
+		t.Fatalf("Could not write layer: %v", err)
+	}
+	config, err := c.writeBlob("application/vnd.oci.image.config.v1+json", []byte(`{"architecture":"amd64","os":"linux",`+
+		`"created":"2016-03-01T10:00:00Z","config":{"Env":["PATH=/usr/bin"],"Cmd":["/bin/bash"],"Labels":{"a":"1"}},`+
+		`"rootfs":{"type":"layers","diff_ids":["sha256:base"]},"history":[{"created_by":"base"}],"unknown":true}`))
+	if err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	data, _ := json.Marshal(ociManifest{SchemaVersion: 2, Config: config, Layers: []ociDescriptor{layer}})
+	manifest, err := c.writeBlob(ociManifestMediaType, data)
+	if err != nil {
+		t.Fatalf("Could not write manifest: %v", err)
+	}
+	manifest.Annotations = map[string]string{ociRefNameAnnotation: "opensuse:13.2"}
+	if err = c.writeIndex(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{manifest}}); err != nil {
+		t.Fatalf("Could not write index: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatalf("Could not write layout: %v", err)
+	}
+	return c, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestNewOCIClient(t *testing.T) {
+	c, cleanup := setupOCILayout(t)
+	defer cleanup()
+
+	if _, err := newOCIClient(c.dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := newOCIClient(filepath.Join(c.dir, "blobs")); err == nil || !strings.Contains(err.Error(), "is not an OCI image layout") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_ = ioutil.WriteFile(filepath.Join(c.dir, "oci-layout"), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0644)
+	if _, err := newOCIClient(c.dir); err == nil || !strings.Contains(err.Error(), "unsupported version") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestOCIImages(t *testing.T) {
+	c, cleanup := setupOCILayout(t)
+	defer cleanup()
+
+	images, err := c.ImageList(types.ImageListOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(images) != 1 || compareStringSlices(images[0].RepoTags, []string{"opensuse:13.2"}) != nil ||
+		images[0].Labels["a"] != "1" || images[0].Created == 0 {
+		t.Fatalf("Wrong images: %+v", images)
+	}
+	id := images[0].ID
+	if images, _ = c.ImageList(types.ImageListOptions{MatchName: "ubuntu"}); len(images) != 0 {
+		t.Fatalf("Wrong images: %+v", images)
+	}
+
+	for _, ref := range []string{"opensuse:13.2", id, strings.TrimPrefix(id, "sha256:")[:12]} {
+		info, raw, err := c.ImageInspectWithRaw(ref, false)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", ref, err)
+		}
+		if info.ID != id || info.Architecture != "amd64" || info.Config.Cmd.Slice()[0] != "/bin/bash" {
+			t.Fatalf("Wrong inspection for %s: %+v", ref, info)
+		}
+		if cfg, err := decodeImageConfig(info, raw); err != nil || cfg.Labels["a"] != "1" {
+			t.Fatalf("Wrong configuration (%v): %+v", err, cfg)
+		}
+	}
+	if _, _, err = c.ImageInspectWithRaw("opensuse:42.1", false); err == nil || !strings.Contains(err.Error(), "No such image") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestOCITagAndRemove(t *testing.T) {
+	c, cleanup := setupOCILayout(t)
+	defer cleanup()
+
+	if err := c.ImageTag(types.ImageTagOptions{ImageID: "opensuse:13.2", RepositoryName: "new", Tag: "1.0"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	images, _ := c.ImageList(types.ImageListOptions{})
+	if len(images) != 1 || compareStringSlices(images[0].RepoTags, []string{"opensuse:13.2", "new:1.0"}) != nil {
+		t.Fatalf("Wrong images: %+v", images)
+	}
+
+	if _, err := c.ImageRemove(types.ImageRemoveOptions{ImageID: images[0].ID}); err == nil || !strings.Contains(err.Error(), "must be forced") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	deleted, err := c.ImageRemove(types.ImageRemoveOptions{ImageID: "new:1.0"})
+	if err != nil || len(deleted) != 1 || deleted[0].Untagged != "new:1.0" {
+		t.Fatalf("Wrong removal (%v): %+v", err, deleted)
+	}
+	images, _ = c.ImageList(types.ImageListOptions{})
+	if len(images) != 1 || compareStringSlices(images[0].RepoTags, []string{"opensuse:13.2"}) != nil {
+		t.Fatalf("Wrong images: %+v", images)
+	}
+
+	if _, err = c.ImageRemove(types.ImageRemoveOptions{ImageID: images[0].ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if images, _ = c.ImageList(types.ImageListOptions{}); len(images) != 0 {
+		t.Fatalf("Wrong images: %+v", images)
+	}
+}
+
+func TestOCICommit(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Unpacking layers requires root privileges")
+	}
+	c, cleanup := setupOCILayout(t)
+	defer cleanup()
+
+	resp, err := c.ContainerCreate(&container.Config{
+		Image:      "opensuse:13.2",
+		Entrypoint: strslice.New("/bin/sh", "-c"),
+		Cmd:        strslice.New("zypper ref"),
+	}, &container.HostConfig{ExtraHosts: []string{"a:1.1.1.1"}}, nil, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(resp.Warnings) != 1 {
+		t.Fatalf("Expected a warning about the extra hosts: %v", resp.Warnings)
+	}
+	ctr := c.containers[resp.ID]
+	if data, err := ioutil.ReadFile(filepath.Join(ctr.rootfs, "etc", "os-release")); err != nil || string(data) != "openSUSE 13.2" {
+		t.Fatalf("The image has not been unpacked (%v): %s", err, data)
+	}
+	if list, _ := c.ContainerList(types.ContainerListOptions{All: true}); len(list) != 1 || list[0].State != "created" {
+		t.Fatalf("Wrong containers: %+v", list)
+	}
+
+	// What zypper would do.
+	_ = ioutil.WriteFile(filepath.Join(ctr.rootfs, "etc", "os-release"), []byte("openSUSE 13.2 patched"), 0644)
+	_ = os.Remove(filepath.Join(ctr.rootfs, "etc", "motd"))
+
+	commit, err := c.ContainerCommit(types.ContainerCommitOptions{
+		ContainerID:    resp.ID,
+		RepositoryName: "new",
+		Tag:            "1.0",
+		Comment:        "msg",
+		Author:         "me",
+		Config:         &container.Config{Labels: map[string]string{"a": "1", "b": "2"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, _, err := c.ImageInspectWithRaw("new:1.0", false)
+	if err != nil || info.ID != commit.ID {
+		t.Fatalf("Wrong image (%v): %+v", err, info)
+	}
+	if info.Author != "me" || info.Config.Labels["b"] != "2" || info.Config.Cmd.Slice()[0] != "/bin/bash" {
+		t.Fatalf("Wrong configuration: %+v", info.Config)
+	}
+
+	config, _ := c.readBlob(commit.ID)
+	data := struct {
+		RootFS  imageRootFS    `json:"rootfs"`
+		History []imageHistory `json:"history"`
+		Unknown bool           `json:"unknown"`
+	}{}
+	if err = json.Unmarshal(config, &data); err != nil || !data.Unknown {
+		t.Fatalf("Wrong configuration (%v): %s", err, config)
+	}
+	if len(data.RootFS.DiffIDs) != 2 || len(data.History) != 2 || data.History[1].Comment != "msg" ||
+		data.History[1].CreatedBy != "/bin/sh -c zypper ref" {
+		t.Fatalf("Wrong configuration: %s", config)
+	}
+
+	img, _ := c.lookupImage("new:1.0")
+	if len(img.manifest.Layers) != 2 {
+		t.Fatalf("Wrong layers: %+v", img.manifest.Layers)
+	}
+	blob, _ := c.readBlob(img.manifest.Layers[1].Digest)
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("The layer should be compressed: %v", err)
+	}
+	layer, _ := ioutil.ReadAll(gz)
+	files := readArchive(t, layer)
+	if files["etc/os-release"] != "openSUSE 13.2 patched" {
+		t.Fatalf("Wrong layer: %v", files)
+	}
+	if _, ok := files["etc/.wh.motd"]; !ok {
+		t.Fatalf("The removed file should have a whiteout: %v", files)
+	}
+
+	if err = c.ContainerRemove(types.ContainerRemoveOptions{ContainerID: resp.ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err = os.Stat(ctr.dir); !os.IsNotExist(err) {
+		t.Fatalf("The container should have been removed: %v", err)
+	}
+	if _, err = c.ContainerCommit(types.ContainerCommitOptions{ContainerID: resp.ID}); err == nil {
+		t.Fatal("The container should not exist anymore")
+	}
+}
+
+func TestOCILog(t *testing.T) {
+	l := newOCILog()
+	r := l.reader()
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+
+	_, _ = l.Write([]byte("Retrieving "))
+	_, _ = l.Write([]byte("repository"))
+	_ = l.Close()
+	if data := <-done; string(data) != "Retrieving repository" {
+		t.Fatalf("Wrong output: %s", data)
+	}
+	if data, _ := ioutil.ReadAll(l.reader()); string(data) != "Retrieving repository" {
+		t.Fatalf("Wrong output: %s", data)
+	}
+}
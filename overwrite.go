@@ -0,0 +1,97 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/engine-api/types"
+)
+
+// backupTag returns the tag under which the image currently holding the given
+// tag is kept when overwriting it.
+func backupTag(tag string, now time.Time) string {
+	return fmt.Sprintf("%s-pre-zypper-%s", tag, now.Format("20060102150405"))
+}
+
+// tagImage tags the image with the given ID as repo:tag. If force is set to
+// true, the tag is moved even if it's already held by another image.
+func tagImage(id, repo, tag string, force bool) error {
+	client := getDockerClient()
+
+	return client.ImageTag(types.ImageTagOptions{
+		ImageID:        id,
+		RepositoryName: repo,
+		Tag:            tag,
+		Force:          force,
+	})
+}
+
+// untagImage removes the given reference. The image itself is only removed
+// by the daemon if this was its last reference, and so are the untagged
+// images it was built on top of (e.g. the first of the two images built by
+// the Dockerfile builder), as with `docker rmi`.
+func untagImage(ref string) error {
+	client := getDockerClient()
+
+	_, err := client.ImageRemove(types.ImageRemoveOptions{ImageID: ref, PruneChildren: true})
+	return err
+}
+
+// runCommandAndOverwriteImage behaves like the given builder, but it allows
+// repo:tag to exist already. In this case, the image holding it is first
+// tagged as a backup (see the `backupTag` function), and then the new image is
+// committed to repo:tag. This operation is atomic: should anything go wrong,
+// repo:tag is restored to the previous image and the backup tag is dropped.
+//
+// It returns the ID of the new image and, if there was an image holding the
+// given tag, the reference of its backup.
+func runCommandAndOverwriteImage(build imageBuilder, img, repo, tag, cmd, comment, author string, prov *provenance) (string, string, error) {
+	exists, err := checkImageExists(repo, tag)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot proceed safely: %v", err)
+	}
+	if !exists {
+		id, err := build(img, repo, tag, cmd, comment, author, prov)
+		return id, "", err
+	}
+
+	oldID, err := getImageID(repo + ":" + tag)
+	if err != nil {
+		return "", "", err
+	}
+	bk := backupTag(tag, time.Now())
+	if err = tagImage(oldID, repo, bk, false); err != nil {
+		return "", "", fmt.Errorf("could not back up %s:%s as %s:%s: %v", repo, tag, repo, bk, err)
+	}
+	log.Printf("%s:%s has been backed up as %s:%s", repo, tag, repo, bk)
+
+	id, err := build(img, repo, tag, cmd, comment, author, prov)
+	if err == nil {
+		return id, repo + ":" + bk, nil
+	}
+
+	// Something went wrong, put everything back into place.
+	if rerr := tagImage(oldID, repo, tag, true); rerr != nil {
+		return "", "", fmt.Errorf("%v; moreover, %s:%s could not be restored (%v), "+
+			"the previous image is still available as %s:%s", err, repo, tag, rerr, repo, bk)
+	}
+	if rerr := untagImage(repo + ":" + bk); rerr != nil {
+		log.Printf("Could not remove the backup tag %s:%s: %v", repo, bk, rerr)
+	}
+	return "", "", err
+}
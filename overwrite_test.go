@@ -0,0 +1,170 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mssola/capture"
+)
+
+func TestBackupTag(t *testing.T) {
+	now := time.Date(2016, time.March, 4, 10, 11, 12, 0, time.UTC)
+	if tag := backupTag("leap", now); tag != "leap-pre-zypper-20160304101112" {
+		t.Fatalf("Wrong backup tag: %s", tag)
+	}
+}
+
+func TestRunCommandAndOverwriteImageNewTag(t *testing.T) {
+	mc := &mockClient{}
+	safeClient.client = mc
+
+	var id, backup string
+	var err error
+	capture.All(func() {
+		id, backup, err = runCommandAndOverwriteImage(runCommandAndCommitToImage, "opensuse:13.2", "new", "1.0.0", "cmd", "comment", "author", nil)
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "fake image ID" || backup != "" {
+		t.Fatalf("Wrong results: %s, %s", id, backup)
+	}
+	if len(mc.tags) != 0 {
+		t.Fatalf("Nothing should have been tagged: %v", mc.tags)
+	}
+}
+
+func TestRunCommandAndOverwriteImageExistingTag(t *testing.T) {
+	mc := &mockClient{}
+	safeClient.client = mc
+
+	var id, backup string
+	var err error
+	capture.All(func() {
+		id, backup, err = runCommandAndOverwriteImage(runCommandAndCommitToImage, "opensuse:13.2", "opensuse", "13.2", "cmd", "comment", "author", nil)
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "fake image ID" {
+		t.Fatalf("Wrong ID: %s", id)
+	}
+	if !strings.HasPrefix(backup, "opensuse:13.2-pre-zypper-") {
+		t.Fatalf("Wrong backup: %s", backup)
+	}
+	if len(mc.tags) != 1 || mc.tags[0] != "2="+backup {
+		t.Fatalf("The old image should have been backed up: %v", mc.tags)
+	}
+}
+
+func TestRunCommandAndOverwriteImageBackupFails(t *testing.T) {
+	mc := &mockClient{tagFail: true}
+	safeClient.client = mc
+
+	var err error
+	capture.All(func() {
+		_, _, err = runCommandAndOverwriteImage(runCommandAndCommitToImage, "opensuse:13.2", "opensuse", "13.2", "cmd", "comment", "author", nil)
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "could not back up opensuse:13.2") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if mc.lastCmd != nil {
+		t.Fatal("No container should have been created")
+	}
+}
+
+func TestRunCommandAndOverwriteImageRestore(t *testing.T) {
+	mc := &mockClient{commitFail: true}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+
+	var err error
+	capture.All(func() {
+		_, _, err = runCommandAndOverwriteImage(runCommandAndCommitToImage, "opensuse:13.2", "opensuse", "13.2", "cmd", "comment", "author", nil)
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "Fake failure while committing container") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if len(mc.tags) != 2 || mc.tags[1] != "2=opensuse:13.2" {
+		t.Fatalf("The old image should have been restored: %v", mc.tags)
+	}
+	if len(mc.removedImages) != 1 || !strings.HasPrefix(mc.removedImages[0], "opensuse:13.2-pre-zypper-") {
+		t.Fatalf("The backup tag should have been removed: %v", mc.removedImages)
+	}
+}
+
+func TestRunCommandAndOverwriteImageRestoreFails(t *testing.T) {
+	mc := &mockClient{commitFail: true, tagFailOnForce: true}
+	safeClient.client = mc
+
+	var err error
+	capture.All(func() {
+		_, _, err = runCommandAndOverwriteImage(runCommandAndCommitToImage, "opensuse:13.2", "opensuse", "13.2", "cmd", "comment", "author", nil)
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "the previous image is still available as opensuse:13.2-pre-zypper-") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if len(mc.removedImages) != 0 {
+		t.Fatalf("The backup tag should have been kept: %v", mc.removedImages)
+	}
+}
+
+func TestPatchCommandOverwrite(t *testing.T) {
+	setupTestExitStatus()
+	mc := &mockClient{listReturnOneImage: true}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	ctx := testContextWithFlags([]string{"--overwrite", "opensuse:13.2", "opensuse:13.2"}, "overwrite")
+	captured := capture.All(func() { patchCmd(ctx) })
+
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %v: %s", lastCode, buffer.String())
+	}
+	if !strings.Contains(string(captured.Stdout), "The previous opensuse:13.2 image has been kept as opensuse:13.2-pre-zypper-") {
+		t.Fatalf("Wrong stdout: %s", captured.Stdout)
+	}
+}
+
+func TestPatchCommandOverwriteUnknownSource(t *testing.T) {
+	setupTestExitStatus()
+	mc := &mockClient{listFail: true}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	ctx := testContextWithFlags([]string{"--overwrite", "opensuse:13.2", "opensuse:13.2"}, "overwrite")
+	capture.All(func() { patchCmd(ctx) })
+
+	if lastCode != 1 || !strings.Contains(buffer.String(), "Could not find the ID of opensuse:13.2: List Failed") {
+		t.Fatalf("Unexpected failure (%d): %s", lastCode, buffer.String())
+	}
+	if mc.lastCommit.ContainerID != "" {
+		t.Fatal("Nothing should have been committed")
+	}
+}
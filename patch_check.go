@@ -14,7 +14,11 @@
 
 package main
 
-import "github.com/codegangsta/cli"
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+)
 
 // zypper-docker patch-check [flags] <image>
 func patchCheckCmd(ctx *cli.Context) {
@@ -27,8 +31,15 @@ func patchCheckContainerCmd(ctx *cli.Context) {
 }
 
 // patchCheck calls the `zypper pchk` command for the given image and the given
-// arguments.
+// arguments. Since `zypper pchk` cannot filter patches, the patches are
+// listed instead if the --severity, --min-severity or --security flags have
+// been given.
 func patchCheck(image string, ctx *cli.Context) {
+	if ctx.String("severity") != "" || ctx.String("min-severity") != "" || ctx.Bool("security") {
+		filteredPatchCheck(image, ctx)
+		return
+	}
+
 	err := runStreamedCommand(image, "pchk", true)
 	if err == nil {
 		return
@@ -50,3 +61,42 @@ func patchCheck(image string, ctx *cli.Context) {
 	humanizeCommandError("zypper pchk", image, err)
 	exitWithCode(1)
 }
+
+// filteredPatchCheck checks whether the given image needs any of the patches
+// matching the filters from the given context. It exits with the same codes
+// as `zypper pchk`.
+func filteredPatchCheck(image string, ctx *cli.Context) {
+	if image == "" {
+		logAndFatalf("Error: no image name specified.\n")
+		return
+	}
+	if err := checkSeverityFlags(ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	if err := checkSeveritySupport(image, ctx); err != nil {
+		logAndFatalf("%v\n", err)
+		return
+	}
+
+	patches, err := pendingPatches(image, ctx)
+	if err != nil {
+		humanizeCommandError("zypper lp", image, err)
+		exitWithCode(1)
+		return
+	}
+
+	security := 0
+	for _, p := range patches {
+		if p.Category == "security" {
+			security++
+		}
+	}
+	fmt.Printf("%d patches needed (%d security patches)\n", len(patches), security)
+
+	if security > 0 {
+		exitWithCode(101)
+	} else if len(patches) > 0 {
+		exitWithCode(100)
+	}
+}
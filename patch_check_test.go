@@ -14,7 +14,14 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
 
 // PATCH-CHECK
 
@@ -33,6 +40,56 @@ func TestPatchCheckCommand(t *testing.T) {
 	cases.run(t, patchCheckCmd, "zypper pchk", "")
 }
 
+func TestPatchCheckWithFilters(t *testing.T) {
+	tests := []struct {
+		args   []string
+		output string
+		code   int
+		stdout string
+	}{
+		{[]string{"--security", "opensuse:13.2"}, patchListOutput, 101, "2 patches needed (1 security patches)"},
+		{[]string{"--min-severity", "moderate", "opensuse:13.2"},
+			strings.Replace(patchListOutput, `category="security"`, `category="recommended"`, -1),
+			100, "2 patches needed (0 security patches)"},
+		{[]string{"--severity", "critical", "opensuse:13.2"},
+			strings.Replace(patchListOutput, `status="needed"`, `status="applied"`, -1),
+			0, "0 patches needed (0 security patches)"},
+		{[]string{"--severity", "low", "opensuse:13.2"}, "", 1, ""},
+		{[]string{"--severity", "low", "--min-severity", "low", "opensuse:13.2"}, patchListOutput, 1, ""},
+	}
+	for _, test := range tests {
+		setupTestExitStatus()
+		mc := &mockClient{logOutput: test.output, zypperGoodVersion: true}
+		safeClient.client = mc
+		log.SetOutput(bytes.NewBuffer([]byte{}))
+
+		captured := capture.All(func() { patchCheckCmd(commandContext("patch-check", test.args...)) })
+		if lastCode != test.code {
+			t.Fatalf("Expected exit code %d for %v, got %d", test.code, test.args, lastCode)
+		}
+		if !strings.Contains(string(captured.Stdout), test.stdout) {
+			t.Fatalf("Wrong output for %v: %s", test.args, captured.Stdout)
+		}
+	}
+}
+
+func TestPatchCheckSeverityNotSupported(t *testing.T) {
+	setupTestExitStatus()
+	safeClient.client = &mockClient{logOutput: patchListOutput, zypperBadVersion: true}
+	log.SetOutput(bytes.NewBuffer([]byte{}))
+
+	for _, args := range [][]string{{"--severity", "low", "opensuse:13.2"}, {"--min-severity", "low", "opensuse:13.2"}} {
+		lastCode = 0
+		captured := capture.All(func() { patchCheckCmd(commandContext("patch-check", args...)) })
+		if lastCode != 1 {
+			t.Fatalf("Expected exit code 1 for %v, got %d", args, lastCode)
+		}
+		if !strings.Contains(string(captured.Stdout), "the --severity flag is only available for zypper versions >= 1.12.6") {
+			t.Fatalf("Wrong output for %v: %s", args, captured.Stdout)
+		}
+	}
+}
+
 // PATCH-CHECK-CONTAINER
 
 func TestPatchCheckContainerCommand(t *testing.T) {
@@ -14,12 +14,7 @@
 
 package main
 
-import (
-	"fmt"
-	"log"
-
-	"github.com/codegangsta/cli"
-)
+import "github.com/codegangsta/cli"
 
 // zypper-docker list-patches [flags] <image>
 func listPatchesCmd(ctx *cli.Context) {
@@ -41,27 +36,28 @@ func listPatches(image string, ctx *cli.Context) {
 		exitWithCode(1)
 	}
 
-	if severity := ctx.String("severity"); severity != "" {
-		if ok, err := supportsSeverityFlag(image); !ok {
-			if err == nil {
-				log.Println("the --severity flag is only available for zypper versions >= 1.12.6")
-				fmt.Println("the --severity flag is only available for zypper versions >= 1.12.6")
-			} else {
-				log.Println(err)
-				fmt.Println(err)
-			}
-			exitWithCode(1)
-		}
+	if err := checkSeverityFlags(ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	if err := checkSeveritySupport(image, ctx); err != nil {
+		logAndFatalf("%v\n", err)
+		return
 	}
 
 	// It's safe to ignore the returned error because we set to false the
 	// `getError` parameter of this function.
 	_ = runStreamedCommand(
 		image,
-		cmdWithFlags("lp", ctx, []string{}, []string{}), false)
+		cmdWithFlags("lp", ctx, []string{}, []string{"stopped", "min-severity", "security"})+severityFilterArgs(ctx), false)
 }
 
 // zypper-docker patch [flags] image
 func patchCmd(ctx *cli.Context) {
 	updatePatchCmd("patch", ctx)
 }
+
+// zypper-docker patch-container [flags] <container> <new-image>
+func patchContainerCmd(ctx *cli.Context) {
+	updatePatchContainerCmd("patch", ctx)
+}
@@ -14,7 +14,14 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
 
 // PATCH
 
@@ -25,13 +32,90 @@ func TestPatchCommand(t *testing.T) {
 		{"List Command fails", &mockClient{listFail: true}, 1, []string{"ori", "opensuse:13.2"}, true, "Cannot proceed safely: List Failed.", ""},
 		{"Overwrite detected", &mockClient{}, 1, []string{"ori", "opensuse:13.2"}, true, "Cannot overwrite an existing image. Please use a different repository/tag.", ""},
 		{"Start fail on commit", &mockClient{startFail: true}, 1, []string{"ori", "new:1.0.0"}, true, "Could not commit to the new image: Start failed.", ""},
-		{"Cannot update cache", &mockClient{}, 1, []string{"ori", "new:1.0.0"}, false, "Cannot add image details to zypper-docker cache", ""},
+		{"Cannot update cache", &mockClient{}, 0, []string{"ori", "new:1.0.0"}, false, "Cannot add image details to zypper-docker cache", ""},
 		{"Cannot inspect", &mockClient{inspectFail: true}, 1, []string{"opensuse:13.2", "new:1.0.0"}, true, "could not inspect image 'opensuse:13.2': inspect fail", ""},
 		{"Patch success", &mockClient{listReturnOneImage: true}, 0, []string{"opensuse:13.2", "new:1.0.0"}, true, "new:1.0.0 successfully created", ""},
 	}
 	cases.run(t, patchCmd, "zypper -n patch", "")
 }
 
+func TestPatchCommandCacheFailure(t *testing.T) {
+	setupTestExitStatus()
+	mc := &mockClient{}
+	safeClient.client = mc
+	log.SetOutput(bytes.NewBuffer([]byte{}))
+
+	capture.All(func() { patchCmd(testContext([]string{"ori", "new:1.0.0"}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %d", lastCode)
+	}
+	if len(mc.removedImages) != 0 {
+		t.Fatalf("The new image should have been kept: %v", mc.removedImages)
+	}
+}
+
+// PATCH CONTAINER
+
+func TestPatchContainerCommand(t *testing.T) {
+	cases := testCases{
+		{"Wrong number of arguments", &mockClient{}, 1, []string{"suse"}, true, "Wrong invocation: expected 2 arguments, 1 given.", ""},
+		{"List fails", &mockClient{listFail: true}, 1, []string{"suse", "new:1.0.0"}, true, "Error while fetching running containers: Fake failure while listing containers", ""},
+		{"Unknown container", &mockClient{}, 1, []string{"unknown", "new:1.0.0"}, true, "Cannot find container: unknown (use --stopped to include stopped containers).", ""},
+		{"Patch success", &mockClient{listReturnOneImage: true}, 0, []string{"suse", "new:1.0.0"}, true, "new:1.0.0 successfully created", ""},
+	}
+	cases.run(t, patchContainerCmd, "zypper -n patch", "")
+}
+
+func TestPatchContainerRecreate(t *testing.T) {
+	setupTestExitStatus()
+	mc := &mockClient{listReturnOneImage: true}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	args := []string{"--recreate", "suse", "new:1.0.0"}
+	captured := capture.All(func() { patchContainerCmd(testContextWithFlags(args, "recreate", "stopped")) })
+
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+	stdout := string(captured.Stdout)
+	if !strings.Contains(stdout, "new:1.0.0 successfully created") {
+		t.Fatalf("The image should have been created: %s", stdout)
+	}
+	if !strings.Contains(stdout, "Container suse recreated as zypper-docker-private-new:1.0.0") {
+		t.Fatalf("The container should have been recreated: %s", stdout)
+	}
+}
+
+func TestPatchContainerByImageID(t *testing.T) {
+	setupTestExitStatus()
+	defer setupTemporaryCache(t)()
+	mc := &mockClient{}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { patchContainerCmd(testContext([]string{"suse", "{{.Repo}}:{{.Tag}}-patched"}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+
+	// The image of the container is patched even if its name refers to
+	// another image, but its name is still used for the new image.
+	if mc.lastCommit.ContainerID != "zypper-docker-private-2" {
+		t.Fatalf("Wrong image patched: %+v", mc.lastCommit)
+	}
+	labels := mc.lastCommit.Config.Labels
+	if labels[labelPrefix+"source.id"] != "2" || labels[ociBasePrefix+"name"] != "opensuse:13.2" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	if record := getCacheFile().imageRecord("fake image ID"); record == nil || record.Source != "2" ||
+		compareStringSlices(record.Names, []string{"opensuse:13.2-patched"}) != nil {
+		t.Fatalf("Wrong cache record: %+v", record)
+	}
+}
+
 // LIST PATCHES
 
 func TestListPatchesCommand(t *testing.T) {
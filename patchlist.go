@@ -0,0 +1,233 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// patchFilterFlags contains the names of the flags that can be used to filter
+// the list of patches, both when listing and when installing them.
+var patchFilterFlags = []string{"bugzilla", "cve", "date", "issues", "g", "severity"}
+
+// severities contains the known severities of patches sorted by importance.
+var severities = []string{"low", "moderate", "important", "critical"}
+
+// severityRank returns the position of the given severity inside of the
+// `severities` array plus one. Unknown severities (e.g. "unspecified") have a
+// rank of 0.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// patchIssue is an issue (e.g. a CVE) fixed by a patch.
+type patchIssue struct {
+	Type string `xml:"type,attr"`
+	ID   string `xml:"id,attr"`
+}
+
+// checkSeverityFlags returns an error if the --severity, --min-severity and
+// --security flags have been given in a way that makes no sense.
+func checkSeverityFlags(ctx *cli.Context) error {
+	min := ctx.String("min-severity")
+	if min != "" {
+		if ctx.String("severity") != "" {
+			return errors.New("The --severity and the --min-severity flags cannot be used together")
+		}
+		if severityRank(min) == 0 {
+			return fmt.Errorf("Unknown severity '%s', it has to be one of: %s", min, strings.Join(severities, ", "))
+		}
+	}
+	if category := ctx.String("g"); ctx.Bool("security") && category != "" && category != "security" {
+		return errors.New("The --security flag cannot be used with another --category")
+	}
+	return nil
+}
+
+// errSeverityUnsupported is returned by checkSeveritySupport when the zypper
+// of the image does not know about the --severity flag.
+var errSeverityUnsupported = errors.New("the --severity flag is only available for zypper versions >= 1.12.6")
+
+// checkSeveritySupport returns an error if the --severity or the
+// --min-severity flags have been given, since both are forwarded to zypper as
+// --severity, but the zypper of the given image does not support it.
+func checkSeveritySupport(image string, ctx *cli.Context) error {
+	if ctx.String("severity") == "" && ctx.String("min-severity") == "" {
+		return nil
+	}
+	ok, err := supportsSeverityFlag(image)
+	if ok {
+		return nil
+	}
+	if err == nil {
+		return errSeverityUnsupported
+	}
+	return err
+}
+
+// severityFilterArgs returns the arguments of zypper that filter patches as
+// requested by the --min-severity and --security flags, which zypper does not
+// know about. The --min-severity flag is turned into a --severity flag for
+// each of the severities that are at least as high as the given one.
+func severityFilterArgs(ctx *cli.Context) string {
+	args := ""
+	if rank := severityRank(ctx.String("min-severity")); rank > 0 {
+		for _, s := range severities[rank-1:] {
+			args += " --severity " + s
+		}
+	}
+	if ctx.Bool("security") && ctx.String("g") == "" {
+		args += " -g security"
+	}
+	return args
+}
+
+// patchInfo contains the information of a patch as given by the
+// `zypper --xmlout list-patches` command.
+type patchInfo struct {
+	Kind        string       `xml:"kind,attr"`
+	Name        string       `xml:"name,attr"`
+	Edition     string       `xml:"edition,attr"`
+	Status      string       `xml:"status,attr"`
+	Category    string       `xml:"category,attr"`
+	Severity    string       `xml:"severity,attr"`
+	Interactive bool         `xml:"interactive,attr"`
+	Summary     string       `xml:"summary"`
+	Description string       `xml:"description"`
+	Issues      []patchIssue `xml:"issue-list>issue"`
+}
+
+// CVEs returns the IDs of the CVEs fixed by this patch.
+func (p patchInfo) CVEs() []string {
+	cves := []string{}
+	for _, issue := range p.Issues {
+		if issue.Type == "cve" {
+			cves = append(cves, issue.ID)
+		}
+	}
+	return cves
+}
+
+// patchList is the root element of the XML output of the
+// `zypper --xmlout list-patches` command.
+type patchList struct {
+	Updates []patchInfo `xml:"update-status>update-list>update"`
+}
+
+// parsePatchList parses the given output of the
+// `zypper --xmlout list-patches` command.
+func parsePatchList(output string) ([]patchInfo, error) {
+	str, err := extractXMLStream(output)
+	if err != nil {
+		return nil, err
+	}
+
+	list := patchList{}
+	if err := xml.Unmarshal([]byte(str), &list); err != nil {
+		return nil, fmt.Errorf("could not parse the output of zypper: %v", err)
+	}
+
+	patches := []patchInfo{}
+	for _, p := range list.Updates {
+		if p.Kind == "" || p.Kind == "patch" {
+			patches = append(patches, p)
+		}
+	}
+	return patches, nil
+}
+
+// highestSeverity returns the highest severity of the given patches. It
+// returns an empty string if none of the patches has a known severity.
+func highestSeverity(patches []patchInfo) string {
+	rank := 0
+	for _, p := range patches {
+		if r := severityRank(p.Severity); r > rank {
+			rank = r
+		}
+	}
+	if rank == 0 {
+		return ""
+	}
+	return severities[rank-1]
+}
+
+// patchFilterCommand returns the `zypper lp` command in XML mode with all the
+// filtering flags from the given context, if any.
+func patchFilterCommand(ctx *cli.Context) string {
+	if ctx == nil {
+		return "--xmlout lp"
+	}
+
+	toIgnore := []string{}
+	for _, name := range ctx.FlagNames() {
+		if !arrayIncludeString(patchFilterFlags, name) {
+			toIgnore = append(toIgnore, name)
+		}
+	}
+	return cmdWithFlags("--xmlout lp", ctx, []string{}, toIgnore) + severityFilterArgs(ctx)
+}
+
+// pendingPatches returns the patches that are needed by the given image. The
+// list is filtered with the flags given in the context, if any.
+func pendingPatches(img string, ctx *cli.Context) ([]patchInfo, error) {
+	output, err := runPatchListing(img, formatZypperCommand("ref", patchFilterCommand(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	return neededPatches(output)
+}
+
+// runPatchListing runs the given command, which is expected to list patches in
+// XML format, in a throwaway container based on the given image. It returns the
+// output of the command.
+func runPatchListing(img, cmd string) (string, error) {
+	buf := bytes.NewBuffer([]byte{})
+	id, err := runCommandInContainer(img, []string{cmd}, buf)
+	removeContainer(id)
+	if err != nil {
+		if de, ok := err.(dockerError); !ok || isZypperExitCodeSevere(de.exitCode) {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// neededPatches returns the patches from the given output of the
+// `zypper --xmlout list-patches` command that are needed.
+func neededPatches(output string) ([]patchInfo, error) {
+	patches, err := parsePatchList(output)
+	if err != nil {
+		return nil, err
+	}
+
+	needed := []patchInfo{}
+	for _, p := range patches {
+		if p.Status == "" || p.Status == "needed" {
+			needed = append(needed, p)
+		}
+	}
+	return needed, nil
+}
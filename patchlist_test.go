@@ -0,0 +1,148 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const patchListOutput = `Retrieving repository 'openSUSE-13.2-Update' metadata [done]
+All repositories have been refreshed.
+<?xml version='1.0'?>
+<stream>
+<message type="info">Loading repository data...</message>
+<update-status version="0.6">
+<update-list>
+<update kind="patch" name="openSUSE-2016-100" edition="1" arch="noarch" status="needed" category="security" severity="important" pkgmanager="false" restart="false" interactive="false">
+<summary>Security update for openssl</summary>
+<description>This update fixes several vulnerabilities.</description>
+<issue-list>
+<issue type="cve" id="CVE-2016-0701"/>
+<issue type="bugzilla" id="963410"/>
+</issue-list>
+</update>
+<update kind="patch" name="openSUSE-2016-101" edition="1" arch="noarch" status="needed" category="recommended" severity="moderate" pkgmanager="false" restart="true" interactive="true">
+<summary>Recommended update for bash</summary>
+<description>This update fixes a crash.</description>
+</update>
+<update kind="package" name="vim" edition="7.4-1.1" arch="x86_64"/>
+</update-list>
+</update-status>
+</stream>
+`
+
+func TestParsePatchList(t *testing.T) {
+	patches, err := parsePatchList(patchListOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("Expected 2 patches, got %d", len(patches))
+	}
+
+	p := patches[0]
+	if p.Name != "openSUSE-2016-100" || p.Category != "security" || p.Severity != "important" {
+		t.Fatalf("Wrong patch: %v", p)
+	}
+	if p.Summary != "Security update for openssl" {
+		t.Fatalf("Wrong summary: %s", p.Summary)
+	}
+	if cves := p.CVEs(); len(cves) != 1 || cves[0] != "CVE-2016-0701" {
+		t.Fatalf("Wrong CVEs: %v", cves)
+	}
+	if !patches[1].Interactive || patches[0].Interactive {
+		t.Fatal("Wrong interactive flags")
+	}
+}
+
+func TestParsePatchListFail(t *testing.T) {
+	if _, err := parsePatchList("Unknown option '--xmlout'"); err == nil {
+		t.Fatal("It should've failed")
+	}
+	_, err := parsePatchList("<stream><update-status></stream>")
+	if err == nil || !strings.Contains(err.Error(), "could not parse the output of zypper") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestHighestSeverity(t *testing.T) {
+	patches := []patchInfo{{Severity: "moderate"}, {Severity: "unspecified"}, {Severity: "critical"}}
+	if s := highestSeverity(patches); s != "critical" {
+		t.Fatalf("Expected critical, got %s", s)
+	}
+	if s := highestSeverity([]patchInfo{{Severity: "unspecified"}}); s != "" {
+		t.Fatalf("Expected an empty severity, got %s", s)
+	}
+}
+
+func TestPatchFilterCommand(t *testing.T) {
+	if cmd := patchFilterCommand(nil); cmd != "--xmlout lp" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
+
+func TestCheckSeverityFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--min-severity", "important", "--security", "-g", "security"}, ""},
+		{[]string{"--severity", "low", "--min-severity", "low"}, "The --severity and the --min-severity flags cannot be used together"},
+		{[]string{"--min-severity", "urgent"}, "Unknown severity 'urgent', it has to be one of: low, moderate, important, critical"},
+		{[]string{"--security", "-g", "recommended"}, "The --security flag cannot be used with another --category"},
+	}
+	for _, test := range tests {
+		err := checkSeverityFlags(commandContext("list-patches", test.args...))
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || err.Error() != test.err)) {
+			t.Fatalf("Expected '%s' for %v, got: %v", test.err, test.args, err)
+		}
+	}
+}
+
+func TestSeverityFilterArgs(t *testing.T) {
+	ctx := commandContext("list-patches", "--min-severity", "important", "--security")
+	if cmd := patchFilterCommand(ctx); cmd != "--xmlout lp --severity important --severity critical -g security" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	ctx = commandContext("list-patches", "--severity", "low", "--security", "-g", "security")
+	if cmd := patchFilterCommand(ctx); cmd != "--xmlout lp -g security --severity low" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	ctx = commandContext("patch", "--min-severity", "important", "--security")
+	if cmd := updatePatchSubcommand("-n patch", ctx); cmd != "-n patch --severity important --severity critical -g security" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
+
+func TestPendingPatches(t *testing.T) {
+	setupTestExitStatus()
+	safeClient.client = &mockClient{logOutput: patchListOutput}
+
+	patches, err := pendingPatches("opensuse:13.2", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("Expected 2 patches, got %d", len(patches))
+	}
+
+	safeClient.client = &mockClient{startFail: true}
+	if _, err = pendingPatches("opensuse:13.2", nil); err == nil {
+		t.Fatal("It should've failed")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// installFlags contains the names of the flags of the patch command that are
+// also understood by `zypper install`, and that are thus forwarded to it when
+// installing specific patches.
+var installFlags = []string{"l", "auto-agree-with-licenses", "no-recommends", "replacefiles"}
+
+// filterFlagNames contains all the names of the flags that filter the patches
+// to be installed.
+var filterFlagNames = []string{"bugzilla", "cve", "date", "g", "category", "severity",
+	"min-severity", "security"}
+
+// checkPatchSelection returns an error if the flags that choose the patches to
+// be installed have been given along with flags that they cannot be combined
+// with.
+func checkPatchSelection(ctx *cli.Context) error {
+	if err := checkSeverityFlags(ctx); err != nil {
+		return err
+	}
+
+	named := len(ctx.StringSlice("patch")) > 0
+
+	if ctx.Bool("select") {
+		if named {
+			return errors.New("The --patch flag cannot be used with --select")
+		}
+		if ctx.String("repository") != "" || ctx.Bool("dry-run") {
+			return errors.New("The --select flag cannot be used with --repository nor with --dry-run")
+		}
+	}
+	if named {
+		for _, name := range filterFlagNames {
+			if ctx.IsSet(name) {
+				return errors.New("The --patch flag cannot be used with the flags filtering patches")
+			}
+		}
+	}
+	return nil
+}
+
+// patchCommand returns the zypper commands to be run in order to apply the
+// given update/patch command on the image described by prov. For the patch
+// command, the patches to be installed can be chosen in different ways:
+//
+//   - With `--patch`, exactly the given patches are installed.
+//   - With `--select`, the user picks them among the ones needed by the image.
+//   - Otherwise, all the patches matching the filters are installed.
+//
+// In all cases, the patches given with `--exclude-patch`, and the ones fixing
+// the CVEs given with `--exclude-cve`, are locked during the transaction. The
+// patches of prov are updated to the ones that will be installed.
+func patchCommand(zypperCmd string, prov *provenance, ctx *cli.Context) (string, error) {
+	if err := checkSeveritySupport(prov.SourceID, ctx); err != nil {
+		return "", err
+	}
+	if zypperCmd != "patch" {
+		return updatePatchCommand(zypperCmd, ctx), nil
+	}
+
+	locks, err := excludedPatches(prov, ctx)
+	if err != nil {
+		return "", err
+	}
+	if prov.Patches != nil {
+		prov.Patches = withoutPatches(prov.Patches, locks)
+	}
+
+	var sub string
+	if names := ctx.StringSlice("patch"); len(names) > 0 {
+		if prov.Patches, err = namedPatches(prov, names, locks); err != nil {
+			return "", err
+		}
+		sub = installPatchesSubcommand(names, ctx)
+	} else if ctx.Bool("select") {
+		if prov.patchesErr != nil {
+			return "", fmt.Errorf("could not fetch the patches needed by %s: %v", prov.Source, prov.patchesErr)
+		}
+		if len(prov.Patches) == 0 {
+			return "", fmt.Errorf("%s does not need any patch", prov.Source)
+		}
+		if prov.Patches, err = selectPatchesInTerminal(prov.Patches); err != nil {
+			return "", err
+		}
+		names := []string{}
+		for _, p := range prov.Patches {
+			names = append(names, p.Name)
+		}
+		sub = installPatchesSubcommand(names, ctx)
+	} else {
+		sub = updatePatchTransaction(zypperCmd, ctx)
+	}
+	return zypperTransaction(sub, locks, ctx.Bool("interactive")), nil
+}
+
+// installPatchesSubcommand returns the zypper subcommand that installs
+// exactly the given patches.
+func installPatchesSubcommand(names []string, ctx *cli.Context) string {
+	sub := "-n install"
+	if ctx.Bool("interactive") {
+		sub = "install"
+	}
+	return installSubcommand(sub, names, ctx)
+}
+
+// installSubcommand behaves like `installPatchesSubcommand`, but the given
+// zypper subcommand is used instead of `install`, so the transaction can be
+// resolved with `--dry-run`.
+func installSubcommand(sub string, names []string, ctx *cli.Context) string {
+	toIgnore := []string{}
+	for _, name := range ctx.FlagNames() {
+		if !arrayIncludeString(installFlags, name) {
+			toIgnore = append(toIgnore, name)
+		}
+	}
+
+	sub = cmdWithFlags(sub, ctx, updatePatchBoolFlags, toIgnore) + " --"
+	for _, name := range names {
+		sub += " " + shellQuote("patch:"+name)
+	}
+	return sub
+}
+
+// namedPatches returns the patches needed by the image described by prov
+// that have been given with the `--patch` flag. It fails if any of them is
+// also excluded, or if the image does not need it. If the needed patches
+// could not be fetched, it returns nil.
+func namedPatches(prov *provenance, names, locks []string) ([]patchInfo, error) {
+	for _, name := range names {
+		if arrayIncludeString(locks, name) {
+			return nil, fmt.Errorf("the patch %s has been both requested and excluded", name)
+		}
+	}
+	if prov.patchesErr != nil {
+		return nil, nil
+	}
+
+	patches := []patchInfo{}
+	for _, name := range names {
+		found := false
+		for _, p := range prov.Patches {
+			if p.Name == name {
+				patches, found = append(patches, p), true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s does not need the patch %s", prov.Source, name)
+		}
+	}
+	return patches, nil
+}
+
+// excludedPatches returns the names of the patches given with the
+// `--exclude-patch` flag, plus the ones needed by the image described by prov
+// that fix any of the CVEs given with the `--exclude-cve` flag.
+func excludedPatches(prov *provenance, ctx *cli.Context) ([]string, error) {
+	locks := []string{}
+	for _, name := range ctx.StringSlice("exclude-patch") {
+		if !arrayIncludeString(locks, name) {
+			locks = append(locks, name)
+		}
+	}
+
+	cves := ctx.StringSlice("exclude-cve")
+	if len(cves) > 0 && prov.patchesErr != nil {
+		return nil, fmt.Errorf("could not find the patches fixing the excluded CVEs: %v", prov.patchesErr)
+	}
+	for _, cve := range cves {
+		found := false
+		for _, p := range prov.Patches {
+			for _, id := range p.CVEs() {
+				if sameCVE(id, cve) {
+					found = true
+					if !arrayIncludeString(locks, p.Name) {
+						locks = append(locks, p.Name)
+					}
+				}
+			}
+		}
+		if !found {
+			log.Printf("None of the patches needed by %s fixes %s", prov.Source, cve)
+		}
+	}
+	return locks, nil
+}
+
+// withoutPatches returns the given patches except the ones with the given
+// names.
+func withoutPatches(patches []patchInfo, names []string) []patchInfo {
+	res := []patchInfo{}
+	for _, p := range patches {
+		if !arrayIncludeString(names, p.Name) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// sameCVE returns true if both given IDs refer to the same CVE. The "CVE-"
+// prefix is optional and case insensitive.
+func sameCVE(a, b string) bool {
+	a, b = strings.ToUpper(a), strings.ToUpper(b)
+	return strings.TrimPrefix(a, "CVE-") == strings.TrimPrefix(b, "CVE-")
+}
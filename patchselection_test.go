@@ -0,0 +1,196 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+// patchListProvenance returns the provenance of an image needing the patches
+// of patchListOutput.
+func patchListProvenance(t *testing.T) *provenance {
+	patches, err := neededPatches(patchListOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return &provenance{Command: "patch", Source: "opensuse:13.2", Patches: patches}
+}
+
+func TestInstallPatchesSubcommand(t *testing.T) {
+	ctx := commandContext("patch", "-l", "-g", "security")
+	expected := "-n install -l -- 'patch:openSUSE-2016-100' 'patch:it'\\''s'"
+	if sub := installPatchesSubcommand([]string{"openSUSE-2016-100", "it's"}, ctx); sub != expected {
+		t.Fatalf("Wrong subcommand: %s", sub)
+	}
+
+	ctx = commandContext("patch", "--interactive")
+	if sub := installPatchesSubcommand([]string{"openSUSE-2016-100"}, ctx); sub != "install -- 'patch:openSUSE-2016-100'" {
+		t.Fatalf("Wrong subcommand: %s", sub)
+	}
+}
+
+func TestZypperTransaction(t *testing.T) {
+	if cmd := zypperTransaction("patch", nil, true); cmd != "zypper ref && zypper patch && zypper clean -a" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	cmd := zypperTransaction("-n patch", []string{"a", "b"}, false)
+	expected := "zypper ref && { [ ! -e \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks\" ] || " +
+		"cp -p \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks\" \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks.zypper-docker\"; } && " +
+		"zypper addlock -t patch 'a' 'b' && { zypper -n patch; status=$?; " +
+		"if [ -e \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks.zypper-docker\" ]; then " +
+		"mv -f \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks.zypper-docker\" \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks\"; " +
+		"else rm -f \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks\"; fi || exit 1; [ $status -ne 0 ] || zypper clean -a; exit $status; }"
+	if cmd != expected {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	// The locks that the image already had must be kept.
+	if strings.Contains(cmd, "removelock") {
+		t.Fatalf("The locks should be restored from the backup: %s", cmd)
+	}
+}
+
+func TestPatchCommandExclusions(t *testing.T) {
+	ctx := commandContext("patch", "--exclude-cve", "2016-0701", "--exclude-cve", "CVE-2000-1",
+		"--exclude-patch", "foo", "--exclude-patch", "foo")
+	prov := patchListProvenance(t)
+
+	cmd, err := patchCommand("patch", prov, ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(cmd, "zypper addlock -t patch 'foo' 'openSUSE-2016-100' && { ") ||
+		!strings.Contains(cmd, "{ zypper -n patch; status=$?;") ||
+		!strings.Contains(cmd, "else rm -f \"$ZYPPER_DOCKER_ROOT/etc/zypp/locks\"; fi || exit 1;") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+	if len(prov.Patches) != 1 || prov.Patches[0].Name != "openSUSE-2016-101" {
+		t.Fatalf("The excluded patches should not be recorded: %+v", prov.Patches)
+	}
+
+	// The CVEs cannot be excluded if the patches are unknown.
+	prov = &provenance{Source: "opensuse:13.2", patchesErr: errSelectionAborted}
+	if _, err = patchCommand("patch", prov, ctx); err == nil ||
+		!strings.Contains(err.Error(), "could not find the patches fixing the excluded CVEs") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Only the patch command knows about patches.
+	prov = patchListProvenance(t)
+	if cmd, _ = patchCommand("up", prov, ctx); strings.Contains(cmd, "addlock") || len(prov.Patches) != 2 {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
+
+func TestPatchCommandNamedPatches(t *testing.T) {
+	prov := patchListProvenance(t)
+	cmd, err := patchCommand("patch", prov, commandContext("patch", "--patch", "openSUSE-2016-101"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(cmd, "zypper ref && zypper -n install -- 'patch:openSUSE-2016-101' && zypper clean -a") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+	if len(prov.Patches) != 1 || prov.Patches[0].Name != "openSUSE-2016-101" {
+		t.Fatalf("Wrong patches: %+v", prov.Patches)
+	}
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--patch", "openSUSE-2016-1"}, "opensuse:13.2 does not need the patch openSUSE-2016-1"},
+		{[]string{"--patch", "openSUSE-2016-100", "--exclude-cve", "CVE-2016-0701"},
+			"the patch openSUSE-2016-100 has been both requested and excluded"},
+	}
+	for _, test := range tests {
+		if _, err = patchCommand("patch", patchListProvenance(t), commandContext("patch", test.args...)); err == nil ||
+			err.Error() != test.err {
+			t.Fatalf("Expected '%s', got: %v", test.err, err)
+		}
+	}
+}
+
+func TestPatchCommandSeverityNotSupported(t *testing.T) {
+	mc := &mockClient{zypperBadVersion: true, suppressLog: true}
+	safeClient.client = mc
+
+	for _, cmd := range []string{"patch", "up"} {
+		_, err := patchCommand(cmd, patchListProvenance(t), commandContext("patch", "--min-severity", "important"))
+		if err != errSeverityUnsupported {
+			t.Fatalf("Expected the --severity flag to be rejected for %s, got: %v", cmd, err)
+		}
+	}
+	if len(mc.lastCmd) == 0 || mc.lastCmd[0] != "zypper lp --severity" {
+		t.Fatalf("The zypper of the image should have been checked: %v", mc.lastCmd)
+	}
+
+	mc.zypperBadVersion = false
+	mc.zypperGoodVersion = true
+	if _, err := patchCommand("patch", patchListProvenance(t), commandContext("patch", "--min-severity", "important")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestCheckPatchSelection(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--patch", "a", "--exclude-patch", "b"}, ""},
+		{[]string{"--patch", "a", "--select"}, "The --patch flag cannot be used with --select"},
+		{[]string{"--patch", "a", "-g", "security"}, "The --patch flag cannot be used with the flags filtering patches"},
+		{[]string{"--patch", "a", "--security"}, "The --patch flag cannot be used with the flags filtering patches"},
+		{[]string{"--min-severity", "urgent"}, "Unknown severity 'urgent', it has to be one of: low, moderate, important, critical"},
+		{[]string{"--exclude-cve", "a", "--dry-run"}, ""},
+		{[]string{"--select", "--repository", "opensuse"}, "The --select flag cannot be used with --repository nor with --dry-run"},
+	}
+	for _, test := range tests {
+		err := checkPatchSelection(commandContext("patch", test.args...))
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || err.Error() != test.err)) {
+			t.Fatalf("Expected '%s' for %v, got: %v", test.err, test.args, err)
+		}
+	}
+}
+
+func TestPatchWithExclusions(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	mc := &mockClient{logOutput: patchListOutput, transactionOutput: installOutput("openSUSE-2016-101")}
+	safeClient.client = mc
+	ctx := commandContext("patch", "--exclude-cve", "CVE-2016-0701")
+	currentContext = ctx
+	defer func() { currentContext = nil }()
+
+	var (
+		id  string
+		err error
+	)
+	capture.All(func() { id, _, err = updatePatchImage("patch", "opensuse:13.2", "new:1.0", ctx) })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(mc.lastCmd[0], "zypper --non-interactive addlock -t patch 'openSUSE-2016-100'") {
+		t.Fatalf("Wrong command: %s", mc.lastCmd[0])
+	}
+	if id != "fake image ID" || !strings.Contains(mc.lastCommit.Config.Labels[labelPrefix+"patches"], "openSUSE-2016-101") ||
+		strings.Contains(mc.lastCommit.Config.Labels[labelPrefix+"patches"], "openSUSE-2016-100") {
+		t.Fatalf("Wrong commit: %+v", mc.lastCommit.Config.Labels)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// plannedImage is the transaction that has been planned for an image. Packages
+// are identified by their NEVRA (e.g. "bash-4.2-75.1.x86_64").
+type plannedImage struct {
+	// The image to be patched, its ID when the plan was made and the name of
+	// the new image (which might be a template).
+	Source   string `yaml:"source"`
+	SourceID string `yaml:"source-id"`
+	Target   string `yaml:"target"`
+
+	// The author and the commit message of the new image.
+	Author  string `yaml:"author,omitempty"`
+	Message string `yaml:"message,omitempty"`
+
+	// The flags given to zypper when making the plan.
+	Flags                 string `yaml:"flags,omitempty"`
+	AutoAgreeWithLicenses bool   `yaml:"auto-agree-with-licenses,omitempty"`
+	Replacefiles          bool   `yaml:"replacefiles,omitempty"`
+
+	// The patches being applied, the CVEs fixed by each of them, and the
+	// packages to be installed and removed in order to apply them.
+	Patches []string            `yaml:"patches,omitempty"`
+	CVEs    map[string][]string `yaml:"cves,omitempty"`
+	Install []string            `yaml:"install,omitempty"`
+	Remove  []string            `yaml:"remove,omitempty"`
+}
+
+// patches returns the patches being applied, as far as the plan knows them.
+func (pi *plannedImage) patches() []patchInfo {
+	patches := []patchInfo{}
+	for _, name := range pi.Patches {
+		p := patchInfo{Kind: "patch", Name: name}
+		for _, cve := range pi.CVEs[name] {
+			p.Issues = append(p.Issues, patchIssue{Type: "cve", ID: cve})
+		}
+		patches = append(patches, p)
+	}
+	return patches
+}
+
+// plan contains the transactions planned by the plan command.
+type plan struct {
+	Images []plannedImage `yaml:"images"`
+}
+
+// nevra returns the NEVRA of the given package.
+func nevra(sv solvable) string {
+	return fmt.Sprintf("%s-%s.%s", sv.Name, sv.Edition, sv.Arch)
+}
+
+// parseNEVRA returns the name, the edition and the architecture of the package
+// identified by the given NEVRA.
+func parseNEVRA(str string) (string, string, string, error) {
+	dot := strings.LastIndex(str, ".")
+	if dot > 0 {
+		nevr := str[:dot]
+		if rel := strings.LastIndex(nevr, "-"); rel > 0 {
+			if ver := strings.LastIndex(nevr[:rel], "-"); ver > 0 {
+				return nevr[:ver], nevr[ver+1:], str[dot+1:], nil
+			}
+		}
+	}
+	return "", "", "", fmt.Errorf("invalid package '%s'", str)
+}
+
+// plannedPackages returns the NEVRAs of the packages to be installed and the
+// ones to be removed by the given transaction.
+func plannedPackages(t *transaction) ([]string, []string) {
+	install, remove := []string{}, []string{}
+	for _, kind := range []string{"installed", "upgraded", "downgraded", "reinstalled"} {
+		for _, sv := range t.Packages[kind] {
+			install = append(install, nevra(sv))
+		}
+	}
+	for _, sv := range t.Packages["removed"] {
+		remove = append(remove, nevra(sv))
+	}
+	return sortedStrings(install), sortedStrings(remove)
+}
+
+// installCommand returns the zypper commands that install exactly the packages
+// of this plan. If dryRun is true, then the commands only print what would be
+// done in XML format.
+func (pi *plannedImage) installCommand(dryRun bool) (string, error) {
+	// Recommended packages have already been added to the plan if needed.
+	sub := "-n install --no-recommends"
+	if dryRun {
+		sub = "--xmlout " + sub + " --dry-run"
+	}
+	if pi.AutoAgreeWithLicenses {
+		sub += " -l"
+	}
+	if pi.Replacefiles {
+		sub += " --replacefiles"
+	}
+
+	sub += " --"
+	for _, pkg := range pi.Install {
+		name, edition, arch, err := parseNEVRA(pkg)
+		if err != nil {
+			return "", err
+		}
+		sub += fmt.Sprintf(" '%s.%s=%s'", name, arch, edition)
+	}
+	for _, pkg := range pi.Remove {
+		name, _, arch, err := parseNEVRA(pkg)
+		if err != nil {
+			return "", err
+		}
+		sub += fmt.Sprintf(" '!%s.%s'", name, arch)
+	}
+
+	if dryRun {
+		return formatZypperCommand("ref", sub), nil
+	}
+	return formatZypperCommand("ref", sub, "clean -a"), nil
+}
+
+// planDifferences returns a description of how the given transaction differs
+// from this plan.
+func (pi *plannedImage) planDifferences(t *transaction) []string {
+	diffs := []string{}
+	compare := func(planned, actual []string, verb string) {
+		for _, pkg := range planned {
+			if !arrayIncludeString(actual, pkg) {
+				diffs = append(diffs, fmt.Sprintf("%s would not be %s", pkg, verb))
+			}
+		}
+		for _, pkg := range actual {
+			if !arrayIncludeString(planned, pkg) {
+				diffs = append(diffs, fmt.Sprintf("%s would also be %s", pkg, verb))
+			}
+		}
+	}
+
+	install, remove := plannedPackages(t)
+	compare(pi.Install, install, "installed")
+	compare(pi.Remove, remove, "removed")
+	return diffs
+}
+
+// verify checks that the repositories can still satisfy this plan, and that
+// the source image has not changed since the plan was made.
+func (pi *plannedImage) verify() error {
+	id, err := getImageID(pi.Source)
+	if err != nil {
+		return err
+	}
+	if id != pi.SourceID {
+		return fmt.Errorf("the image %s has changed since the plan was made", pi.Source)
+	}
+
+	cmd, err := pi.installCommand(true)
+	if err != nil {
+		return err
+	}
+	t, err := resolveTransaction(pi.Source, cmd)
+	if err != nil {
+		return fmt.Errorf("the repositories can no longer satisfy the plan: %v", err)
+	}
+	if len(t.Problems) > 0 {
+		return fmt.Errorf("the repositories can no longer satisfy the plan: %s",
+			strings.Join(t.Problems, "; "))
+	}
+	if diffs := pi.planDifferences(t); len(diffs) > 0 {
+		return fmt.Errorf("the repositories can no longer satisfy the plan: %s",
+			strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// applyPlannedImage installs the packages planned for the given image into a
+// new image. It also returns the provenance of the new image, if any.
+func applyPlannedImage(pi plannedImage, ctx *cli.Context) (applyResult, *provenance) {
+	result := applyResult{Source: pi.Source, Target: pi.Target, Status: "failed"}
+	if len(pi.Install) == 0 && len(pi.Remove) == 0 {
+		result.Status = "skipped"
+		return result, nil
+	}
+
+	e := manifestEntry{Source: pi.Source, Target: pi.Target, Author: pi.Author, Message: pi.Message}
+	if e.Author == "" {
+		e.Author = defaultCommitAuthor()
+	}
+	if e.Message == "" {
+		e.Message = "[zypper-docker] patch"
+	}
+	pctx, err := e.context(ctx)
+	if err == nil {
+		err = pi.verify()
+	}
+	// The patches have been listed when making the plan.
+	var prov *provenance
+	if err == nil {
+		prov, err = inspectSource(pi.Source, "patch", pctx, false)
+	}
+	var cmd string
+	if err == nil {
+		prov.Flags, prov.Patches, prov.patchesErr = pi.Flags, pi.patches(), nil
+		prov.planned = true
+		cmd, err = pi.installCommand(false)
+	}
+	if err == nil {
+		result.ID, result.Target, err = commitFromSource(pi.Source, pi.Target, cmd, prov, pctx)
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.Status = "patched"
+	return result, prov
+}
+
+// groupPlannedImages groups the images of the given plan that have the same
+// source image and the same transaction. They are patched only once.
+func groupPlannedImages(p *plan) []*applyGroup {
+	groups := []*applyGroup{}
+	index := make(map[string]*applyGroup)
+
+	for i, pi := range p.Images {
+		// The key contains everything but the names of the images.
+		key := pi
+		key.Source, key.Target = "", ""
+		k := fmt.Sprintf("%#v", key)
+		if g, ok := index[k]; ok {
+			g.entries = append(g.entries, i)
+		} else {
+			g = &applyGroup{ID: pi.SourceID, entries: []int{i}}
+			index[k] = g
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// applyPlannedGroup applies the transaction of the given group once, and tags
+// the resulting image for each of its images.
+func applyPlannedGroup(g *applyGroup, p *plan, ctx *cli.Context, results []applyResult) {
+	first, prov := applyPlannedImage(p.Images[g.entries[0]], ctx)
+	results[g.entries[0]] = first
+
+	names := map[string]bool{first.Target: true}
+	for _, i := range g.entries[1:] {
+		pi := p.Images[i]
+		results[i] = applyResult{Source: pi.Source, Target: pi.Target, Status: first.Status, Error: first.Error}
+		if prov == nil {
+			continue
+		}
+
+		// Other references might have been moved since the plan was made.
+		id, err := getImageID(pi.Source)
+		if err == nil && id != pi.SourceID {
+			err = fmt.Errorf("the image %s has changed since the plan was made", pi.Source)
+		}
+		if err == nil {
+			e := manifestEntry{Source: pi.Source, Target: pi.Target}
+			err = tagForEntry(pi.SourceID, first.ID, e, prov, names, &results[i])
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = "failed", err.Error()
+		}
+	}
+}
+
+// applyPlan applies all the transactions of the given plan, with at most the
+// given number of them being applied at the same time.
+func applyPlan(p *plan, concurrency int, ctx *cli.Context) []applyResult {
+	results := make([]applyResult, len(p.Images))
+
+	runGroups(groupPlannedImages(p), concurrency, func(g *applyGroup) {
+		applyPlannedGroup(g, p, ctx, results)
+	})
+	return results
+}
+
+// readPlan reads the plan stored in the given path.
+func readPlan(path string) (*plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the plan: %v", err)
+	}
+
+	p := &plan{}
+	if err = yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Could not parse the plan: %v", err)
+	}
+	if len(p.Images) == 0 {
+		return nil, fmt.Errorf("The plan does not contain any image")
+	}
+	for i, pi := range p.Images {
+		if pi.Source == "" || pi.SourceID == "" || pi.Target == "" {
+			return nil, fmt.Errorf("The image #%d of the plan needs a source, its ID and a target", i+1)
+		}
+	}
+	return p, nil
+}
+
+// writePlan writes the given plan to the given path, or to the standard output
+// if the path is "-".
+func writePlan(p *plan, path string) error {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// planImage resolves the transaction of the patch command with the flags
+// given in the context for the given image, whose ID is also given.
+func planImage(img, id, target string, ctx *cli.Context) (plannedImage, error) {
+	if err := checkSeveritySupport(img, ctx); err != nil {
+		return plannedImage{}, err
+	}
+
+	// The needed patches are listed too, since the CVEs fixed by them are not
+	// shown by the dry run.
+	cmd := formatZypperCommand("ref", updatePatchSubcommand("--xmlout -n patch --dry-run", ctx)) +
+		"; status=$?; " + recordCommand(neededBeforeRecord, recordedPatchesCommand()) + "; exit $status"
+	t, records, err := resolveRecordedTransaction(img, cmd)
+	if err != nil {
+		return plannedImage{}, fmt.Errorf("could not resolve the transaction: %v", err)
+	}
+	if len(t.Problems) > 0 {
+		return plannedImage{}, fmt.Errorf("the solver reported problems: %s", strings.Join(t.Problems, "; "))
+	}
+
+	pi := plannedImage{
+		Source:                img,
+		SourceID:              id,
+		Target:                target,
+		Author:                ctx.String("author"),
+		Message:               ctx.String("message"),
+		Flags:                 strings.TrimSpace(updatePatchSubcommand("", ctx)),
+		AutoAgreeWithLicenses: ctx.Bool("l"),
+		Replacefiles:          ctx.Bool("replacefiles"),
+	}
+	for _, patch := range t.Patches {
+		pi.Patches = append(pi.Patches, patch.Name)
+	}
+	pi.Install, pi.Remove = plannedPackages(t)
+
+	listed, err := parsePatchList(records[neededBeforeRecord])
+	if err != nil {
+		log.Printf("Could not find out the CVEs fixed by the patches planned for %s: %v", img, err)
+		return pi, nil
+	}
+	for _, patch := range listed {
+		if cves := patch.CVEs(); len(cves) > 0 && arrayIncludeString(pi.Patches, patch.Name) {
+			if pi.CVEs == nil {
+				pi.CVEs = make(map[string][]string)
+			}
+			pi.CVEs[patch.Name] = cves
+		}
+	}
+	return pi, nil
+}
+
+// zypper-docker plan [flags] <image>...
+func planCmd(ctx *cli.Context) {
+	if len(ctx.Args()) == 0 {
+		logAndFatalf("Wrong invocation: expected at least 1 argument, 0 given.\n")
+		return
+	}
+	target := ctx.String("target")
+	if target == "" {
+		logAndFatalf("Wrong invocation: the name of the new images has to be given with the --target flag.\n")
+		return
+	}
+	images := removeDuplicates(ctx.Args())
+	if len(images) > 1 && !isTemplate(target) {
+		logAndFatalf("Wrong invocation: the --target flag has to be a template when planning for more than one image.\n")
+		return
+	}
+	if err := checkSeverityFlags(ctx); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+
+	// The transaction is resolved only once for each distinct image, even if
+	// it's given through many references.
+	p := &plan{}
+	planned := make(map[string]plannedImage)
+	failed := false
+	for _, img := range images {
+		id, err := getImageID(img)
+		pi, ok := planned[id]
+		if err == nil && !ok {
+			if pi, err = planImage(img, id, target, ctx); err == nil {
+				planned[id] = pi
+			}
+		}
+		pi.Source = img
+		if err != nil {
+			logAndPrintf("Could not plan the patches for %s: %v.\n", img, err)
+			failed = true
+			continue
+		}
+		logAndPrintf("%s: %d patches, %d packages to be installed and %d to be removed\n",
+			img, len(pi.Patches), len(pi.Install), len(pi.Remove))
+		p.Images = append(p.Images, pi)
+	}
+	if failed {
+		exitWithCode(1)
+		return
+	}
+
+	if err := writePlan(p, ctx.String("output")); err != nil {
+		logAndFatalf("Could not write the plan: %v.\n", err)
+	}
+}
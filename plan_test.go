@@ -0,0 +1,265 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/mssola/capture"
+)
+
+func TestParseNEVRA(t *testing.T) {
+	tests := []struct {
+		nevra, name, edition, arch string
+	}{
+		{"bash-4.2-75.1.x86_64", "bash", "4.2-75.1", "x86_64"},
+		{"libopenssl1_0_0-1.0.1k-2.24.1.x86_64", "libopenssl1_0_0", "1.0.1k-2.24.1", "x86_64"},
+		{"perl-Bootloader-0.4.89.1-1.1.noarch", "perl-Bootloader", "0.4.89.1-1.1", "noarch"},
+		{"foo", "", "", ""},
+		{"foo-1.x86_64", "", "", ""},
+	}
+
+	for _, test := range tests {
+		name, edition, arch, err := parseNEVRA(test.nevra)
+		if test.name == "" {
+			if err == nil {
+				t.Fatalf("%s should not be valid", test.nevra)
+			}
+			continue
+		}
+		if err != nil || name != test.name || edition != test.edition || arch != test.arch {
+			t.Fatalf("Wrong result for %s: %s, %s, %s (%v)", test.nevra, name, edition, arch, err)
+		}
+	}
+}
+
+func TestPlannedImageInstallCommand(t *testing.T) {
+	pi := plannedImage{
+		Install:               []string{"bash-4.2-75.1.x86_64"},
+		Remove:                []string{"foo-1.0-1.noarch"},
+		AutoAgreeWithLicenses: true,
+	}
+
+	cmd, err := pi.installCommand(true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "zypper ref && zypper --xmlout -n install --no-recommends --dry-run -l -- 'bash.x86_64=4.2-75.1' '!foo.noarch'"
+	if cmd != expected {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	cmd, err = pi.installCommand(false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(cmd, "&& zypper clean -a") || strings.Contains(cmd, "--dry-run") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+
+	pi.Install = []string{"wrong"}
+	if _, err = pi.installCommand(false); err == nil || err.Error() != "invalid package 'wrong'" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestPlanAndApply(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-plan")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "plan.yaml")
+
+	// Make the plan. The CVEs fixed by the patches are listed as well.
+	listing := strings.Replace(patchListOutput, "openSUSE-2016-100", "openSUSE-2015-345", -1)
+	setupTestExitStatus()
+	mc := &mockClient{logOutput: dryRunOutput,
+		transactionOutput: dryRunOutput + recordBegin + neededBeforeRecord + "\n" + listing + recordEnd + neededBeforeRecord + "\n"}
+	safeClient.client = mc
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	captured := capture.All(func() {
+		planCmd(commandContext("plan", "--output", path, "--target", "new:1.0", "--author", "me", "--message", "msg", "opensuse:13.2"))
+	})
+
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+	if !strings.Contains(string(captured.Stdout), "opensuse:13.2: 1 patches, 2 packages to be installed and 0 to be removed") {
+		t.Fatalf("Wrong stdout: %s", captured.Stdout)
+	}
+	p, err := readPlan(path)
+	if err != nil {
+		t.Fatalf("Could not read the plan: %v", err)
+	}
+	pi := p.Images[0]
+	if pi.Source != "opensuse:13.2" || pi.SourceID != "2" || pi.Target != "new:1.0" || pi.Author != "me" {
+		t.Fatalf("Wrong plan: %+v", pi)
+	}
+	if err = compareStringSlices(pi.Patches, []string{"openSUSE-2015-345"}); err != nil {
+		t.Fatalf("Wrong patches: %v", err)
+	}
+	if len(pi.CVEs) != 1 || compareStringSlices(pi.CVEs["openSUSE-2015-345"], []string{"CVE-2016-0701"}) != nil {
+		t.Fatalf("Wrong CVEs: %v", pi.CVEs)
+	}
+	expected := []string{"bash-4.2-75.1.x86_64", "openssl-1.0.1k-2.24.1.x86_64"}
+	if err = compareStringSlices(pi.Install, expected); err != nil {
+		t.Fatalf("Wrong packages: %v", err)
+	}
+
+	// Apply it.
+	setupTestExitStatus()
+	mc = &mockClient{logOutput: dryRunOutput}
+	safeClient.client = mc
+	results := applyPlan(p, 1, testContext([]string{}, false))
+	if len(results) != 1 || results[0].Status != "patched" || results[0].ID != "fake image ID" {
+		t.Fatalf("Wrong results: %+v", results)
+	}
+	if !strings.Contains(mc.lastCmd[0], "zypper -n install --no-recommends -- 'bash.x86_64=4.2-75.1' 'openssl.x86_64=1.0.1k-2.24.1'") {
+		t.Fatalf("Wrong command: %s", mc.lastCmd[0])
+	}
+	if mc.lastCommit.Comment != "msg" || mc.lastCommit.Author != "me" {
+		t.Fatalf("Wrong commit: %+v", mc.lastCommit)
+	}
+	// The labels come from the plan: only the plan is verified before
+	// applying it.
+	labels := mc.lastCommit.Config.Labels
+	if labels[labelPrefix+"patches"] != "openSUSE-2015-345" || labels[labelPrefix+"cves"] != "CVE-2016-0701" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	if len(mc.started) != 2 {
+		t.Fatalf("The plan should have been verified and applied: %v", mc.started)
+	}
+}
+
+func TestPlanAndApplyByImageID(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-plan")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "plan.yaml")
+
+	// Both opensuse:latest and opensuse:tag point to the same image.
+	setupTestExitStatus()
+	mc := &mockClient{logOutput: dryRunOutput}
+	safeClient.client = mc
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() {
+		planCmd(commandContext("plan", "--output", path, "--target", "{{.Repo}}:{{.Tag}}-patched", "opensuse:latest", "opensuse:tag", "opensuse:latest"))
+	})
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+	if len(mc.started) != 1 {
+		t.Fatalf("The transaction should have been resolved once: %v", mc.started)
+	}
+	p, err := readPlan(path)
+	if err != nil {
+		t.Fatalf("Could not read the plan: %v", err)
+	}
+	if len(p.Images) != 2 || p.Images[0].Source != "opensuse:latest" || p.Images[1].Source != "opensuse:tag" ||
+		p.Images[1].SourceID != "1" || len(p.Images[1].Install) != 2 {
+		t.Fatalf("Wrong plan: %+v", p.Images)
+	}
+
+	// The same image is asked twice under the same name.
+	p.Images = append(p.Images, p.Images[0])
+	mc = &mockClient{logOutput: dryRunOutput}
+	safeClient.client = mc
+	var results []applyResult
+	capture.All(func() { results = applyPlan(p, 2, testContext([]string{}, false)) })
+
+	expected := []string{"patched", "tagged", "tagged"}
+	for i, r := range results {
+		if r.Status != expected[i] || r.ID != "fake image ID" {
+			t.Fatalf("Wrong result for %s: %+v", r.Source, r)
+		}
+	}
+	// One container verifies the plan and the other one applies it.
+	if len(mc.started) != 2 {
+		t.Fatalf("The plan should have been verified and applied once: %v", mc.started)
+	}
+	if err = compareStringSlices(mc.tags, []string{"fake image ID=opensuse:tag-patched"}); err != nil {
+		t.Fatalf("The new image should have been tagged once: %v", err)
+	}
+	record := getCacheFile().imageRecord("fake image ID")
+	if record == nil || record.Source != "1" ||
+		compareStringSlices(record.Names, []string{"opensuse:latest-patched", "opensuse:tag-patched"}) != nil {
+		t.Fatalf("Wrong cache record: %+v", record)
+	}
+}
+
+func TestApplyPlanFailures(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	p := &plan{Images: []plannedImage{
+		{Source: "opensuse:13.2", SourceID: "1", Target: "new:1.0", Install: []string{"bash-4.2-75.1.x86_64"}},
+		{Source: "opensuse:13.2", SourceID: "2", Target: "new:1.0", Install: []string{"bash-4.2-75.1.x86_64"}},
+		{Source: "opensuse:13.2", SourceID: "2", Target: "new:1.0"},
+	}}
+	safeClient.client = &mockClient{logOutput: dryRunOutput}
+	captured := capture.All(func() {
+		results := applyPlan(p, 1, testContext([]string{}, false))
+
+		if results[0].Status != "failed" || results[0].Error != "the image opensuse:13.2 has changed since the plan was made" {
+			t.Fatalf("Wrong result: %+v", results[0])
+		}
+		expected := "the repositories can no longer satisfy the plan: openssl-1.0.1k-2.24.1.x86_64 would also be installed"
+		if results[1].Status != "failed" || results[1].Error != expected {
+			t.Fatalf("Wrong result: %+v", results[1])
+		}
+		if results[2].Status != "skipped" {
+			t.Fatalf("Wrong result: %+v", results[2])
+		}
+	})
+	if strings.Contains(string(captured.Stdout), "successfully created") {
+		t.Fatalf("No image should have been created: %s", captured.Stdout)
+	}
+}
+
+func TestPlanCommandWrongInvocation(t *testing.T) {
+	tests := []struct {
+		ctx *cli.Context
+		msg string
+	}{
+		{commandContext("plan", "--output", "-", "--target", "new:1.0"), "expected at least 1 argument, 0 given"},
+		{commandContext("plan", "--output", "-", "opensuse:13.2"), "has to be given with the --target flag"},
+		{commandContext("plan", "--output", "-", "--target", "new:1.0", "opensuse:13.2", "opensuse:latest"), "the --target flag has to be a template"},
+	}
+
+	for _, test := range tests {
+		setupTestExitStatus()
+		buffer := bytes.NewBuffer([]byte{})
+		log.SetOutput(buffer)
+		capture.All(func() { planCmd(test.ctx) })
+		if lastCode != 1 || !strings.Contains(buffer.String(), test.msg) {
+			t.Fatalf("Expected '%s', got (%d): %s", test.msg, lastCode, buffer.String())
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/codegangsta/cli"
+)
+
+// The prefix of the labels set by zypper-docker on the images it creates.
+const labelPrefix = "com.suse.zypper-docker."
+
+// messageLabel holds the commit message of the images built with
+// --builder=dockerfile, since their history has no comment.
+const messageLabel = labelPrefix + "message"
+
+// The prefix of the OCI annotations describing the base image.
+const ociBasePrefix = "org.opencontainers.image.base."
+
+// provenance describes how an image has been created by zypper-docker.
+type provenance struct {
+	// The command that has been used: "patch" or "up".
+	Command string
+
+	// The name, the ID and the digest (if any) of the source image.
+	Source       string
+	SourceID     string
+	SourceDigest string
+
+	// The flags that have been forwarded to zypper.
+	Flags string
+
+	// The patches that were needed by the source image and selected by the
+	// given filters before running zypper. It's nil if they have not been
+	// listed, in which case patchesErr contains the reason. The patches that
+	// are actually applied are taken from the output of zypper instead (see
+	// `appliedLabels`).
+	Patches    []patchInfo
+	patchesErr error
+
+	// A fingerprint of the metadata of the repositories in use.
+	Repositories string
+
+	// Whether the patches are exactly the ones being applied, as it happens
+	// when applying a plan. Then they are labeled as well.
+	planned bool
+}
+
+// CVEs returns the sorted IDs of the CVEs fixed by the patches.
+func (p *provenance) CVEs() []string {
+	cves := []string{}
+	for _, patch := range p.Patches {
+		cves = append(cves, patch.CVEs()...)
+	}
+	cves = removeDuplicates(cves)
+	sort.Strings(cves)
+	return cves
+}
+
+// Severity returns the highest severity of the patches.
+func (p *provenance) Severity() string {
+	return highestSeverity(p.Patches)
+}
+
+// labels returns the labels to be set on the new image. The patches applied
+// by zypper are labeled afterwards (see `appliedLabels`).
+func (p *provenance) labels() map[string]string {
+	if p == nil {
+		return nil
+	}
+	labels := map[string]string{
+		labelPrefix + "version":   version(),
+		labelPrefix + "command":   p.Command,
+		labelPrefix + "flags":     p.Flags,
+		labelPrefix + "source.id": p.SourceID,
+		ociBasePrefix + "name":    p.Source,
+	}
+	if p.SourceDigest != "" {
+		labels[labelPrefix+"source.digest"] = p.SourceDigest
+		labels[ociBasePrefix+"digest"] = p.SourceDigest
+	}
+	if p.Repositories != "" {
+		labels[labelPrefix+"repositories"] = p.Repositories
+	}
+	if p.planned {
+		labels = mergeLabels(labels, patchLabels(p.Patches))
+	}
+	return labels
+}
+
+// appliedLabels returns the labels listing the given patches, which zypper
+// said it was going to install (see `patchScanner`), and the CVEs fixed by
+// them as far as the listed patches tell. It returns nil if no patch was
+// applied. Only the patch command is labeled this way, and planned patches
+// are already labeled by `labels`.
+func (p *provenance) appliedLabels(applied []string) map[string]string {
+	if p == nil || p.Command != "patch" || p.planned || len(applied) == 0 {
+		return nil
+	}
+	patches := []patchInfo{}
+	for _, name := range applied {
+		patch := patchInfo{Name: name}
+		for _, listed := range p.Patches {
+			if listed.Name == name {
+				patch = listed
+				break
+			}
+		}
+		patches = append(patches, patch)
+	}
+	return patchLabels(patches)
+}
+
+// patchLabels returns the labels listing the given patches, which have been
+// applied on the new image, and the CVEs fixed by them.
+func patchLabels(patches []patchInfo) map[string]string {
+	p := &provenance{Patches: patches}
+	names := []string{}
+	for _, patch := range patches {
+		names = append(names, patch.Name)
+	}
+	return map[string]string{
+		labelPrefix + "patches": strings.Join(names, ","),
+		labelPrefix + "cves":    strings.Join(p.CVEs(), ","),
+	}
+}
+
+// repositoriesCommand returns the command that prints the metadata of the
+// repositories, which consists of the cookies that libzypp uses to detect
+// changes on the repositories.
+func repositoriesCommand() string {
+	return "cat /var/cache/zypp/solv/*/cookie 2>/dev/null || true"
+}
+
+// repositoriesFingerprint returns the fingerprint of the metadata of the
+// repositories as printed by the command returned by `repositoriesCommand`.
+// It returns an empty string if no metadata was found.
+func repositoriesFingerprint(output string) string {
+	metadata := strings.TrimSpace(output)
+	if metadata == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(metadata))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// sourceDigest returns the digest of the given repository from the given
+// list of repository digests (e.g. "opensuse@sha256:1234"). It returns an
+// empty string if the repository has not been pulled from a registry.
+func sourceDigest(repo string, digests []string) string {
+	for _, d := range digests {
+		if idx := strings.LastIndex(d, "@"); idx >= 0 && d[:idx] == repo {
+			return d[idx+1:]
+		}
+	}
+	return ""
+}
+
+// errPatchesNotListed is the reason given when the patches needed by a source
+// image have not been listed because they were already known.
+var errPatchesNotListed = errors.New("the patches have not been listed")
+
+// inspectSource returns the provenance of the image that the given
+// update/patch command is about to create from img. If list is true, the
+// patches needed by img are listed in a throwaway container, filtered with the
+// flags given in the context, and so is the metadata of its repositories.
+func inspectSource(img, zypperCmd string, ctx *cli.Context, list bool) (*provenance, error) {
+	return inspectNamedSource(img, img, zypperCmd, ctx, list)
+}
+
+// inspectNamedSource behaves like `inspectSource`, but img might be the ID of
+// the image, while name is the one recorded as its source.
+func inspectNamedSource(img, name, zypperCmd string, ctx *cli.Context, list bool) (*provenance, error) {
+	client := getDockerClient()
+
+	repo, tag, err := parseImageName(name)
+	if err != nil {
+		return nil, err
+	}
+	info, _, err := client.ImageInspectWithRaw(img, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect image '%s': %v", img, err)
+	}
+
+	p := &provenance{
+		Command:      zypperCmd,
+		Source:       repo + ":" + tag,
+		SourceID:     info.ID,
+		SourceDigest: sourceDigest(repo, info.RepoDigests),
+		Flags:        strings.TrimSpace(updatePatchSubcommand("", ctx)),
+	}
+
+	if !list {
+		p.patchesErr = errPatchesNotListed
+		return p, nil
+	}
+
+	filters := ctx
+	if zypperCmd != "patch" {
+		filters = nil
+	}
+	cmd := formatZypperCommand("ref", patchFilterCommand(filters)) + "; " +
+		recordCommand(repositoriesRecord, repositoriesCommand())
+	output, err := runPatchListing(img, cmd)
+	if err == nil {
+		var records map[string]string
+		output, records = splitRecords(output)
+		p.Repositories = repositoriesFingerprint(records[repositoriesRecord])
+		p.Patches, err = neededPatches(output)
+	}
+	if err != nil {
+		log.Printf("Could not fetch the patches needed by %s: %v", img, err)
+		p.Patches, p.patchesErr = nil, err
+	}
+	return p, nil
+}
+
+// messageData contains the data that can be accessed by the templates given
+// as the commit message of new images.
+type messageData struct {
+	// The command that has been used: "patch" or "up".
+	Command string
+
+	// The name of the source image and of the new one.
+	Source string
+	Image  string
+
+	// The patches to be applied, the CVEs fixed by them and their highest
+	// severity.
+	Patches  []patchInfo
+	CVEs     []string
+	Severity string
+}
+
+// renderMessage returns the commit message for the image being created, which
+// might be a template (see `messageData`).
+func renderMessage(msg, image string, p *provenance) (string, error) {
+	if !isTemplate(msg) {
+		return msg, nil
+	}
+	if p.patchesErr != nil {
+		for _, field := range []string{".Patches", ".CVEs", ".Severity"} {
+			if strings.Contains(msg, field) {
+				return "", fmt.Errorf("Could not fetch the patches to be applied: %v", p.patchesErr)
+			}
+		}
+	}
+
+	t, err := template.New("message").Parse(msg)
+	if err != nil {
+		return "", fmt.Errorf("Invalid template for the commit message: %v", err)
+	}
+
+	data := messageData{
+		Command:  p.Command,
+		Source:   p.Source,
+		Image:    image,
+		Patches:  p.Patches,
+		CVEs:     p.CVEs(),
+		Severity: p.Severity(),
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err = t.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("Could not execute the template for the commit message: %v", err)
+	}
+	return buf.String(), nil
+}
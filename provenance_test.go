@@ -0,0 +1,153 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/mssola/capture"
+)
+
+func testProvenance() *provenance {
+	patches, _ := parsePatchList(patchListOutput)
+	return &provenance{
+		Command:      "patch",
+		Source:       "opensuse:13.2",
+		SourceID:     "sha256:4f3a2b1c0d9e",
+		SourceDigest: "sha256:1234",
+		Flags:        "--cve CVE-2016-0701",
+		Patches:      patches,
+	}
+}
+
+func TestProvenanceLabels(t *testing.T) {
+	labels := testProvenance().labels()
+
+	expected := map[string]string{
+		"com.suse.zypper-docker.version":       version(),
+		"com.suse.zypper-docker.command":       "patch",
+		"com.suse.zypper-docker.flags":         "--cve CVE-2016-0701",
+		"com.suse.zypper-docker.source.id":     "sha256:4f3a2b1c0d9e",
+		"com.suse.zypper-docker.source.digest": "sha256:1234",
+		"org.opencontainers.image.base.name":   "opensuse:13.2",
+		"org.opencontainers.image.base.digest": "sha256:1234",
+	}
+	if !equalLabels(labels, expected) {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+
+	// The patches and the repositories are recorded by the transaction, and
+	// unknown digests are not recorded.
+	p := &provenance{Command: "up", Source: "opensuse:13.2", patchesErr: errors.New("fail")}
+	labels = p.labels()
+	for _, name := range []string{"patches", "cves", "source.digest", "repositories"} {
+		if _, ok := labels[labelPrefix+name]; ok {
+			t.Fatalf("The %s label should not be there", name)
+		}
+	}
+}
+
+func TestRepositoriesFingerprint(t *testing.T) {
+	if f := repositoriesFingerprint("\r\n"); f != "" {
+		t.Fatalf("Unexpected fingerprint: %s", f)
+	}
+
+	f1 := repositoriesFingerprint("abc\n")
+	f2 := repositoriesFingerprint("abc")
+	f3 := repositoriesFingerprint("abd")
+	if !strings.HasPrefix(f1, "sha256:") || f1 != f2 || f1 == f3 {
+		t.Fatalf("Wrong fingerprints: %s %s %s", f1, f2, f3)
+	}
+}
+
+func TestSourceDigest(t *testing.T) {
+	digests := []string{"suse/sles12@sha256:5678", "opensuse@sha256:1234"}
+	if d := sourceDigest("opensuse", digests); d != "sha256:1234" {
+		t.Fatalf("Wrong digest: %s", d)
+	}
+	if d := sourceDigest("suse", digests); d != "" {
+		t.Fatalf("Wrong digest: %s", d)
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	p := testProvenance()
+
+	msg, err := renderMessage("[zypper-docker] patch", "new:1.0", p)
+	if err != nil || msg != "[zypper-docker] patch" {
+		t.Fatalf("Wrong message: %s (%v)", msg, err)
+	}
+
+	tmpl := "{{.Command}} {{.Source}} -> {{.Image}} ({{.Severity}}):{{range .Patches}} {{.Name}}{{end}}; {{join .CVEs}}"
+	if _, err = renderMessage(tmpl, "new:1.0", p); err == nil {
+		t.Fatal("It should've failed")
+	}
+
+	tmpl = "{{.Command}} {{.Source}} -> {{.Image}} ({{.Severity}}):{{range .Patches}} {{.Name}}{{end}}; {{.CVEs}}"
+	msg, err = renderMessage(tmpl, "new:1.0", p)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "patch opensuse:13.2 -> new:1.0 (important): openSUSE-2016-100 openSUSE-2016-101; [CVE-2016-0701]"
+	if msg != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, msg)
+	}
+
+	p.patchesErr = errors.New("fail")
+	if _, err = renderMessage("{{.Image}}", "new:1.0", p); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err = renderMessage("{{.CVEs}}", "new:1.0", p); err == nil {
+		t.Fatal("It should've failed")
+	}
+}
+
+func TestPatchCommandProvenance(t *testing.T) {
+	setupTestExitStatus()
+	defer setupTemporaryCache(t)()
+	mock := &mockClient{listReturnOneImage: true, logOutput: patchListOutput,
+		transactionOutput: installOutput("openSUSE-2016-100", "openSUSE-2016-101")}
+	safeClient.client = mock
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("message", "Applied:{{range .Patches}} {{.Name}}{{end}}", "doc")
+	if err := set.Parse([]string{"opensuse:13.2", "new:1.0"}); err != nil {
+		t.Fatalf("Cannot parse cli options: %v", err)
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { patchCmd(cli.NewContext(nil, set, nil)) })
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+
+	if msg := mock.lastCommit.Comment; msg != "Applied: openSUSE-2016-100 openSUSE-2016-101" {
+		t.Fatalf("Wrong commit message: %s", msg)
+	}
+	labels := mock.lastCommit.Config.Labels
+	if labels[labelPrefix+"command"] != "patch" || labels[labelPrefix+"cves"] != "CVE-2016-0701" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	if labels[ociBasePrefix+"name"] != "opensuse:13.2" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+}
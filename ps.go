@@ -34,6 +34,7 @@ func psCmd(ctx *cli.Context) {
 	cache := getCacheFile()
 
 	matches := []types.Container{}
+	broken := []types.Container{}
 	notSuse := []types.Container{}
 	unknown := []types.Container{}
 
@@ -47,7 +48,7 @@ func psCmd(ctx *cli.Context) {
 		case <-killChannel:
 			return
 		default:
-			imageID, err := getImageID(container.Image)
+			imageID, err := containerImageID(container)
 			if err != nil {
 				log.Printf("Cannot analyze container %s [%s]: %s", container.ID, container.Image, err)
 				unknown = append(unknown, container)
@@ -56,6 +57,8 @@ func psCmd(ctx *cli.Context) {
 
 			if exists, suse := cache.idExists(imageID); exists && !suse {
 				notSuse = append(notSuse, container)
+			} else if cache.isImageBroken(imageID) {
+				broken = append(broken, container)
 			} else if cache.isImageOutdated(imageID) {
 				matches = append(matches, container)
 			} else {
@@ -70,12 +73,24 @@ func psCmd(ctx *cli.Context) {
 			fmt.Printf("  - %s [%s]\n", container.ID, container.Image)
 		}
 		fmt.Println("It is recommended to stop the container and start a new instance based on the new image created with zypper-docker")
+		fmt.Println("This can be done with the \"replace\" command")
 	}
 
-	if len(notSuse) > 0 {
+	if len(broken) > 0 {
 		if len(matches) > 0 {
 			fmt.Printf("\n")
 		}
+		fmt.Println("Running containers whose images have been rolled back:")
+		for _, container := range broken {
+			fmt.Printf("  - %s [%s]\n", container.ID, container.Image)
+		}
+		fmt.Println("It is recommended to stop the container and start a new instance based on the restored image")
+	}
+
+	if len(notSuse) > 0 {
+		if len(matches) > 0 || len(broken) > 0 {
+			fmt.Printf("\n")
+		}
 		fmt.Println("The following containers have been ignored because are known to be based on non-SUSE systems:")
 
 		for _, container := range notSuse {
@@ -84,7 +99,7 @@ func psCmd(ctx *cli.Context) {
 	}
 
 	if len(unknown) > 0 {
-		if len(matches) > 0 || len(notSuse) > 0 {
+		if len(matches) > 0 || len(broken) > 0 || len(notSuse) > 0 {
 			fmt.Printf("\n")
 		}
 		fmt.Println("The following containers have an unknown state:")
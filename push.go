@@ -0,0 +1,162 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/cliconfig"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+	"github.com/docker/engine-api/types"
+)
+
+// The key used by the docker config file for the credentials of the Docker
+// Hub.
+const defaultIndexServer = "https://index.docker.io/v1/"
+
+// The hostnames under which the Docker Hub can be explicitly referred to.
+var dockerHubHostnames = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+
+// registryHostname returns the hostname of the registry of the given
+// repository, or an empty string if it belongs to the Docker Hub.
+func registryHostname(repo string) string {
+	idx := strings.Index(repo, "/")
+	if idx < 0 {
+		return ""
+	}
+	host := repo[:idx]
+	if arrayIncludeString(dockerHubHostnames, host) {
+		return ""
+	}
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return ""
+}
+
+// registryAuth returns the encoded credentials for the registry of the given
+// repository, as stored in the docker config file. It returns an empty string
+// if there are no credentials for it.
+func registryAuth(repo string) (string, error) {
+	config, err := cliconfig.Load(cliconfig.ConfigDir())
+	if err != nil {
+		return "", fmt.Errorf("could not load the docker config file: %v", err)
+	}
+
+	host := registryHostname(repo)
+	keys := []string{defaultIndexServer}
+	if host != "" {
+		keys = []string{host, "https://" + host, "http://" + host}
+	}
+
+	for _, key := range keys {
+		if auth, ok := config.AuthConfigs[key]; ok {
+			buf, err := json.Marshal(auth)
+			if err != nil {
+				return "", err
+			}
+			return base64.URLEncoding.EncodeToString(buf), nil
+		}
+	}
+	return "", nil
+}
+
+// pushImage pushes repo:tag to its registry, while streaming the progress to
+// the standard output. It returns the digest of the pushed image.
+func pushImage(repo, tag string) (string, error) {
+	client := getDockerClient()
+
+	auth, err := registryAuth(repo)
+	if err != nil {
+		return "", err
+	}
+	body, err := client.ImagePush(types.ImagePushOptions{
+		ImageID:      repo,
+		Tag:          tag,
+		RegistryAuth: auth,
+	}, func() (string, error) {
+		return "", fmt.Errorf("authentication required, use `docker login` first")
+	})
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	// The digest of the pushed image is given as out-of-band data.
+	var digest string
+	aux := func(msg *json.RawMessage) {
+		var result struct{ Digest string }
+		if err := json.Unmarshal(*msg, &result); err == nil && result.Digest != "" {
+			digest = result.Digest
+		}
+	}
+	fd, isTerminal := term.GetFdInfo(os.Stdout)
+	if err = jsonmessage.DisplayJSONMessagesStream(body, os.Stdout, fd, isTerminal, aux); err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return "", fmt.Errorf("the registry did not report the digest of the image")
+	}
+	return digest, nil
+}
+
+// pushAndRecord pushes the image with the given ID, known as repo:tag, and
+// records the resulting digest in the cache.
+func pushAndRecord(id, repo, tag string) error {
+	digest, err := pushImage(repo, tag)
+	if err != nil {
+		return fmt.Errorf("Could not push %s:%s: %v", repo, tag, err)
+	}
+	logAndPrintf("%s:%s pushed with digest %s\n", repo, tag, digest)
+
+	cache := getCacheFile()
+	cache.recordPush(id, repo+":"+tag, digest)
+	return nil
+}
+
+// zypper-docker push [flags] <image>
+func pushCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		logAndFatalf("Wrong invocation: expected 1 argument, %d given.\n", len(ctx.Args()))
+		return
+	}
+
+	img := ctx.Args().First()
+	repo, tag, err := parseImageName(img)
+	if err != nil {
+		logAndFatalf("%v\n", err)
+		return
+	}
+	id, err := getImageID(img)
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+
+	cache := getCacheFile()
+	if id, _ = cache.createdImage(id, repo+":"+tag); id == "" {
+		logAndFatalf("The image %s has not been created by zypper-docker.\n", img)
+		return
+	}
+	if err = pushAndRecord(id, repo, tag); err != nil {
+		logAndFatalf("%v.\n", err)
+	}
+}
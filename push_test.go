@@ -0,0 +1,237 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/cliconfig"
+	"github.com/docker/engine-api/types"
+	"github.com/mssola/capture"
+)
+
+// setupDockerConfig points the docker config directory to a temporary one
+// containing the given config file. It returns a function that restores
+// everything.
+func setupDockerConfig(t *testing.T, contents string) func() {
+	old := cliconfig.ConfigDir()
+	dir, err := ioutil.TempDir("", "zypper-docker-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	if contents != "" {
+		err = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(contents), 0600)
+		if err != nil {
+			t.Fatalf("Could not write the config file: %v", err)
+		}
+	}
+	cliconfig.SetConfigDir(dir)
+
+	return func() {
+		cliconfig.SetConfigDir(old)
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestRegistryHostname(t *testing.T) {
+	hosts := map[string]string{
+		"opensuse":                    "",
+		"suse/sles12":                 "",
+		"localhost/app":               "localhost",
+		"localhost:5000/app":          "localhost:5000",
+		"registry.example.com/a/b":    "registry.example.com",
+		"registry.example.com:443/ab": "registry.example.com:443",
+		"docker.io/library/opensuse":  "",
+		"index.docker.io/suse/sles12": "",
+	}
+	for repo, host := range hosts {
+		if h := registryHostname(repo); h != host {
+			t.Fatalf("Expected '%s' for %s, got '%s'", host, repo, h)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	creds := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	defer setupDockerConfig(t, `{"auths": {
+		"localhost:5000": {"auth": "`+creds+`"},
+		"https://index.docker.io/v1/": {"auth": "`+creds+`"}
+	}}`)()
+
+	for _, repo := range []string{"localhost:5000/app", "suse/sles12", "docker.io/library/opensuse"} {
+		auth, err := registryAuth(repo)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		decoded, err := base64.URLEncoding.DecodeString(auth)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		config := types.AuthConfig{}
+		if err = json.Unmarshal(decoded, &config); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if config.Username != "user" || config.Password != "secret" {
+			t.Fatalf("Wrong credentials for %s: %v", repo, config)
+		}
+	}
+
+	auth, err := registryAuth("registry.example.com/app")
+	if err != nil || auth != "" {
+		t.Fatalf("There should be no credentials: %s (%v)", auth, err)
+	}
+}
+
+func TestPushCommand(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	defer setupDockerConfig(t, "")()
+
+	cases := testCases{
+		{"Wrong number of arguments", &mockClient{}, 1, []string{}, true, "Wrong invocation: expected 1 argument, 0 given.", ""},
+		{"Unknown image", &mockClient{}, 1, []string{"new:1.0.0"}, true, "Cannot find image new:1.0.0.", ""},
+		{"Not created by zypper-docker", &mockClient{}, 1, []string{"opensuse:13.2"}, true, "The image opensuse:13.2 has not been created by zypper-docker.", ""},
+	}
+	cases.run(t, pushCmd, "", "")
+
+	getCacheFile().recordUpdate("1", "2", "opensuse:13.2")
+	cases = testCases{
+		{"Push fails", &mockClient{pushFail: true}, 1, []string{"opensuse:13.2"}, true, "Could not push opensuse:13.2: Push failed.", ""},
+		{"No digest", &mockClient{pushNoDigest: true}, 1, []string{"opensuse:13.2"}, true, "Could not push opensuse:13.2: the registry did not report the digest of the image.", ""},
+		{"Push success", &mockClient{}, 0, []string{"opensuse:13.2"}, true, "opensuse:13.2 pushed with digest sha256:1234", ""},
+	}
+	cases.run(t, pushCmd, "", "")
+
+	record := getCacheFile().imageRecord("2")
+	if record == nil || record.Digests["opensuse:13.2"] != "sha256:1234" {
+		t.Fatalf("The digest has not been recorded: %v", record)
+	}
+}
+
+func TestPushCommandByName(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	defer setupDockerConfig(t, "")()
+
+	// The image is found by name when it was recorded under another ID.
+	getCacheFile().recordUpdate("1", "sha256:5", "opensuse:13.2")
+	cases := testCases{
+		{"Push by name", &mockClient{}, 0, []string{"opensuse:13.2"}, true, "opensuse:13.2 pushed with digest sha256:1234", ""},
+	}
+	cases.run(t, pushCmd, "", "")
+
+	record := getCacheFile().imageRecord("sha256:5")
+	if record == nil || record.Digests["opensuse:13.2"] != "sha256:1234" {
+		t.Fatalf("The digest has not been recorded: %v", record)
+	}
+}
+
+func TestPatchCommandPush(t *testing.T) {
+	setupTestExitStatus()
+	defer setupTemporaryCache(t)()
+	defer setupDockerConfig(t, "")()
+	mock := &mockClient{listReturnOneImage: true}
+	safeClient.client = mock
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() {
+		patchCmd(testContextWithFlags([]string{"--push", "opensuse:13.2", "localhost:5000/new:1.0"}, "push"))
+	})
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+
+	if len(mock.pushed) != 1 || mock.pushed[0].ImageID != "localhost:5000/new" || mock.pushed[0].Tag != "1.0" {
+		t.Fatalf("Wrong pushes: %v", mock.pushed)
+	}
+	record := getCacheFile().imageRecord("fake image ID")
+	if record == nil || record.Digests["localhost:5000/new:1.0"] != "sha256:1234" {
+		t.Fatalf("The digest has not been recorded: %v", record)
+	}
+}
+
+// TestPushRegistry pushes an image to a real registry. It needs a docker
+// daemon with the busybox:latest image, and a registry:2 container (e.g.
+// `docker run -d -p 5000:5000 registry:2`) whose address is given by the
+// ZYPPER_DOCKER_TEST_REGISTRY environment variable. It is skipped otherwise.
+func TestPushRegistry(t *testing.T) {
+	registry := os.Getenv("ZYPPER_DOCKER_TEST_REGISTRY")
+	if registry == "" {
+		t.Skip("ZYPPER_DOCKER_TEST_REGISTRY is not set")
+	}
+
+	setupTestExitStatus()
+	defer setupTemporaryCache(t)()
+	defer setupDockerConfig(t, "")()
+	old := safeClient.client
+	safeClient.client = nil
+	defer func() { safeClient.client = old }()
+
+	repo := registry + "/zypper-docker-push-test"
+	tag := fmt.Sprintf("%d", time.Now().UnixNano())
+	img := repo + ":" + tag
+	id, err := getImageID("busybox:latest")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = getDockerClient().ImageTag(types.ImageTagOptions{ImageID: id, RepositoryName: repo, Tag: tag})
+	if err != nil {
+		t.Fatalf("Could not tag the image: %v", err)
+	}
+	defer func() {
+		if err := untagImage(img); err != nil {
+			t.Logf("Could not remove %s: %v", img, err)
+		}
+	}()
+	getCacheFile().recordUpdate(id, id, img)
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { pushCmd(commandContext("push", img)) })
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+
+	record := getCacheFile().imageRecord(id)
+	if record == nil || record.Digests[img] == "" {
+		t.Fatalf("The digest has not been recorded: %v", record)
+	}
+
+	// The registry has to serve the manifest under the recorded digest.
+	url := "http://" + registry + "/v2/zypper-docker-push-test/manifests/" + record.Digests[img]
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v1+prettyjws")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not reach the registry: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("The registry does not know the digest %s: %s", record.Digests[img], resp.Status)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// layeredImage is an image as seen by the rebase command.
+type layeredImage struct {
+	name, id string
+
+	// The diff IDs of its layers, from the bottom to the top.
+	layers []string
+	labels map[string]string
+}
+
+// inspectLayers returns the given image along with its layers.
+func inspectLayers(img string) (*layeredImage, error) {
+	client := getDockerClient()
+
+	info, raw, err := client.ImageInspectWithRaw(img, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect image '%s': %v", img, err)
+	}
+	data := struct {
+		RootFS struct {
+			Layers []string
+		}
+	}{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("could not decode the layers of '%s': %v", img, err)
+	}
+	if len(data.RootFS.Layers) == 0 {
+		return nil, fmt.Errorf("the daemon does not report the layers of '%s'", img)
+	}
+	cfg, err := decodeImageConfig(info, raw)
+	if err != nil {
+		return nil, err
+	}
+	return &layeredImage{name: img, id: info.ID, layers: data.RootFS.Layers, labels: cfg.Labels}, nil
+}
+
+// basedOn returns whether the given image is built on top of base.
+func (img *layeredImage) basedOn(base *layeredImage) bool {
+	if len(base.layers) > len(img.layers) {
+		return false
+	}
+	for i, l := range base.layers {
+		if img.layers[i] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// findOldBase returns the image that app is based on, and that has to be
+// replaced by onto. If from is given, that's the one. Otherwise it's looked
+// for among the images that onto has been derived from by zypper-docker.
+func findOldBase(app, onto *layeredImage, from string) (*layeredImage, error) {
+	if app.basedOn(onto) {
+		return nil, fmt.Errorf("%s is already based on %s", app.name, onto.name)
+	}
+
+	if from != "" {
+		base, err := inspectLayers(from)
+		if err != nil {
+			return nil, err
+		}
+		if !app.basedOn(base) {
+			return nil, fmt.Errorf("%s is not based on %s", app.name, from)
+		}
+		return base, nil
+	}
+
+	cache := getCacheFile()
+	seen := map[string]bool{onto.id: true}
+	img := onto
+	for {
+		id := img.labels[labelPrefix+"source.id"]
+		if record := cache.imageRecord(img.id); id == "" && record != nil {
+			id = record.Source
+		}
+		if id == "" || seen[id] {
+			break
+		}
+		seen[id] = true
+
+		var err error
+		if img, err = inspectLayers(id); err != nil {
+			break
+		}
+		if app.basedOn(img) {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find the base of %s among the images %s has been derived from: use --from to give it",
+		app.name, onto.name)
+}
+
+// baseHistory returns the number of entries of the history of app that come
+// from base.
+func baseHistory(app, base *layeredImage) (int, error) {
+	client := getDockerClient()
+
+	appHistory, err := client.ImageHistory(app.id)
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch the history of %s: %v", app.name, err)
+	}
+	baseHistory, err := client.ImageHistory(base.id)
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch the history of %s: %v", base.name, err)
+	}
+
+	// The most recent entries come first.
+	offset := len(appHistory) - len(baseHistory)
+	if offset < 0 {
+		return 0, fmt.Errorf("the history of %s does not match the one of %s", app.name, base.name)
+	}
+	for i, h := range baseHistory {
+		if appHistory[offset+i].CreatedBy != h.CreatedBy {
+			return 0, fmt.Errorf("the history of %s does not match the one of %s", app.name, base.name)
+		}
+	}
+	return len(baseHistory), nil
+}
+
+// layerChanges returns the paths of the files added, modified or removed by
+// the given layer. Whiteouts of whole directories (opaque whiteouts) are
+// returned with a trailing slash.
+func layerChanges(layer string) ([]string, error) {
+	file, err := os.Open(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	changes := []string{}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return changes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			changes = append(changes, dir)
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			// Internal to the storage drivers, like the hard links of aufs.
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			changes = append(changes, dir+strings.TrimPrefix(base, archive.WhiteoutPrefix))
+		default:
+			changes = append(changes, name)
+		}
+	}
+}
+
+// shadowedFiles returns the files changed by the patched layers which are then
+// changed again, or removed, by the application layers.
+func shadowedFiles(patched, app []string) ([]string, error) {
+	files := make(map[string]bool)
+	for _, layer := range patched {
+		changes, err := layerChanges(layer)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range changes {
+			if !strings.HasSuffix(c, "/") {
+				files[c] = true
+			}
+		}
+	}
+
+	shadowed := make(map[string]bool)
+	for _, layer := range app {
+		changes, err := layerChanges(layer)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range changes {
+			// Removing a directory shadows everything inside of it.
+			dir := strings.TrimSuffix(c, "/") + "/"
+			for f := range files {
+				if f == c || strings.HasPrefix(f, dir) {
+					shadowed[f] = true
+				}
+			}
+		}
+	}
+
+	res := []string{}
+	for f := range shadowed {
+		res = append(res, f)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// rebaseLabels returns the labels of app once rebased from the old base to
+// onto: the ones inherited from the old base are replaced by the ones of onto.
+func rebaseLabels(app, old, onto map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range app {
+		if ov, ok := old[k]; !ok || ov != v {
+			labels[k] = v
+		}
+	}
+	for k, v := range onto {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// rebaseConfig returns the configuration of app, given as raw JSON, with its
+// first layers and history entries (the ones of the old base) replaced by the
+// ones of onto. The labels are updated as explained in `rebaseLabels`.
+func rebaseConfig(app, onto []byte, layers, history int, oldLabels map[string]string) ([]byte, error) {
+	type config struct {
+		RootFS  imageRootFS    `json:"rootfs"`
+		History []imageHistory `json:"history"`
+		Config  struct {
+			Labels map[string]string
+		} `json:"config"`
+	}
+	var a, o config
+	if err := json.Unmarshal(app, &a); err != nil {
+		return nil, fmt.Errorf("could not decode the configuration of the image: %v", err)
+	}
+	if err := json.Unmarshal(onto, &o); err != nil {
+		return nil, fmt.Errorf("could not decode the configuration of the new base: %v", err)
+	}
+	if len(a.RootFS.DiffIDs) < layers || len(a.History) < history {
+		return nil, fmt.Errorf("the image has less layers than its base")
+	}
+
+	// Unknown fields have to be kept.
+	cfg := make(map[string]json.RawMessage)
+	runCfg := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(app, &cfg); err != nil {
+		return nil, err
+	}
+	if raw, ok := cfg["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &runCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	rootfs := imageRootFS{
+		Type:    "layers",
+		DiffIDs: append(append([]string{}, o.RootFS.DiffIDs...), a.RootFS.DiffIDs[layers:]...),
+	}
+	values := map[string]interface{}{
+		"created": time.Now().UTC().Format(time.RFC3339Nano),
+		"rootfs":  rootfs,
+		"history": append(append([]imageHistory{}, o.History...), a.History[history:]...),
+	}
+	for key, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		cfg[key] = data
+	}
+
+	labels, err := json.Marshal(rebaseLabels(a.Config.Labels, oldLabels, o.Config.Labels))
+	if err != nil {
+		return nil, err
+	}
+	runCfg["Labels"] = labels
+	if cfg["config"], err = json.Marshal(runCfg); err != nil {
+		return nil, err
+	}
+	return json.Marshal(cfg)
+}
+
+// rebaseImage creates repo:tag from app, with the layers of its old base
+// replaced by the ones of onto. It returns the ID of the new image and the
+// files changed by onto since the old base that are shadowed by the layers
+// of the application.
+func rebaseImage(app, old, onto *layeredImage, repo, tag string) (string, []string, error) {
+	history, err := baseHistory(app, old)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "zypper-docker-rebase")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Fetch both images. The files of each one are kept in their own
+	// directory, since their names might clash.
+	am, err := saveImage(app.id, filepath.Join(dir, "app"))
+	if err != nil {
+		return "", nil, err
+	}
+	om, err := saveImage(onto.id, filepath.Join(dir, "onto"))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(am.Layers) != len(app.layers) || len(om.Layers) != len(onto.layers) {
+		return "", nil, fmt.Errorf("the saved images do not match the inspected ones")
+	}
+
+	// The layers of the new image.
+	layers, patched, upper := []string{}, []string{}, []string{}
+	for i, l := range om.Layers {
+		l = filepath.Join("onto", filepath.Clean(l))
+		layers = append(layers, l)
+		if !arrayIncludeString(old.layers, onto.layers[i]) {
+			patched = append(patched, filepath.Join(dir, l))
+		}
+	}
+	for _, l := range am.Layers[len(old.layers):] {
+		l = filepath.Join("app", filepath.Clean(l))
+		layers = append(layers, l)
+		upper = append(upper, filepath.Join(dir, l))
+	}
+	shadowed, err := shadowedFiles(patched, upper)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read the layers: %v", err)
+	}
+
+	// And its configuration.
+	appCfg, err := ioutil.ReadFile(filepath.Join(dir, "app", filepath.Clean(am.Config)))
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read the configuration of %s: %v", app.name, err)
+	}
+	ontoCfg, err := ioutil.ReadFile(filepath.Join(dir, "onto", filepath.Clean(om.Config)))
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read the configuration of %s: %v", onto.name, err)
+	}
+	data, err := rebaseConfig(appCfg, ontoCfg, len(old.layers), history, old.labels)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(data)
+	config := hex.EncodeToString(sum[:]) + ".json"
+	if err = ioutil.WriteFile(filepath.Join(dir, config), data, 0644); err != nil {
+		return "", nil, err
+	}
+
+	m := savedManifest{Config: config, RepoTags: []string{repo + ":" + tag}, Layers: layers}
+	if err = loadArchive(dir, m); err != nil {
+		return "", nil, fmt.Errorf("could not load the new image: %v", err)
+	}
+	return "sha256:" + hex.EncodeToString(sum[:]), shadowed, nil
+}
+
+// zypper-docker rebase [flags] <app-image> <new-image>
+func rebaseCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 2 {
+		logAndFatalf("Wrong invocation: expected 2 arguments, %d given.\n", len(ctx.Args()))
+		return
+	}
+	if ctx.String("onto") == "" {
+		logAndFatalf("Wrong invocation: the --onto flag is required.\n")
+		return
+	}
+
+	repo, tag, err := parseImageName(ctx.Args()[1])
+	if err != nil {
+		logAndFatalf("%v\n", err)
+		return
+	}
+	if err = preventImageOverwrite(repo, tag); err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+
+	app, err := inspectLayers(ctx.Args()[0])
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	onto, err := inspectLayers(ctx.String("onto"))
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+	old, err := findOldBase(app, onto, ctx.String("from"))
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+
+	id, shadowed, err := rebaseImage(app, old, onto, repo, tag)
+	if err != nil {
+		logAndFatalf("Could not rebase %s: %v.\n", app.name, err)
+		return
+	}
+	getCacheFile().recordRebase(app.id, id, repo+":"+tag)
+	logAndPrintf("%s:%s successfully created\n", repo, tag)
+
+	if len(shadowed) > 0 {
+		logAndPrintf("Warning: the application layers shadow these files updated by %s:\n", onto.name)
+		for _, f := range shadowed {
+			logAndPrintf("  %s\n", f)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/mssola/capture"
+)
+
+// rebaseClient returns a client knowing about an application image (app:1.0)
+// built on top of opensuse:13.2, and about the image that zypper-docker has
+// derived from the latter (opensuse:13.2-patched).
+func rebaseClient(t *testing.T) *mockClient {
+	old := `{"Id":"sha256:old","RootFS":{"Layers":["sha256:b1"]},"Config":{"Labels":{"vendor":"SUSE","version":"1"}}}`
+	onto := `{"Id":"sha256:onto","RootFS":{"Layers":["sha256:b1","sha256:p1"]},` +
+		`"Config":{"Labels":{"vendor":"SUSE","version":"2","com.suse.zypper-docker.source.id":"sha256:old"}}}`
+	app := `{"Id":"sha256:app","RootFS":{"Layers":["sha256:b1","sha256:a1","sha256:a2"]},` +
+		`"Config":{"Labels":{"vendor":"SUSE","version":"1","app":"1"}}}`
+
+	appConfig := `{"architecture":"amd64","config":{"Cmd":["/opt/app"],"Labels":{"vendor":"SUSE","version":"1","app":"1"}},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:b1","sha256:a1","sha256:a2"]},` +
+		`"history":[{"created_by":"base"},{"created_by":"a1"},{"created_by":"a2"}],"unknown":true}`
+	ontoConfig := `{"architecture":"amd64","config":{"Labels":{"vendor":"SUSE","version":"2","com.suse.zypper-docker.source.id":"sha256:old"}},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:b1","sha256:p1"]},` +
+		`"history":[{"created_by":"base"},{"created_by":"zypper"}]}`
+
+	base := newArchive(t, map[string]string{"etc/os-release": "openSUSE"})
+	return &mockClient{
+		rawInspects: map[string]string{
+			"opensuse:13.2":         old,
+			"sha256:old":            old,
+			"opensuse:13.2-patched": onto,
+			"app:1.0":               app,
+		},
+		histories: map[string][]types.ImageHistory{
+			"sha256:old":  {{CreatedBy: "base"}},
+			"sha256:onto": {{CreatedBy: "zypper"}, {CreatedBy: "base"}},
+			"sha256:app":  {{CreatedBy: "a2"}, {CreatedBy: "a1"}, {CreatedBy: "base"}},
+		},
+		savedImages: map[string][]byte{
+			"sha256:app": newArchive(t, map[string]string{
+				"manifest.json": `[{"Config":"app.json","RepoTags":["app:1.0"],"Layers":["b1/layer.tar","a1/layer.tar","a2/layer.tar"]}]`,
+				"app.json":      appConfig,
+				"b1/layer.tar":  string(base),
+				"a1/layer.tar":  string(newArchive(t, map[string]string{"usr/bin/": "", "usr/bin/bash": "bash", "opt/app": "app"})),
+				"a2/layer.tar":  string(newArchive(t, map[string]string{"etc/ssl/.wh..wh..opq": "", "etc/.wh.issue": ""})),
+			}),
+			"sha256:onto": newArchive(t, map[string]string{
+				"manifest.json": `[{"Config":"onto.json","RepoTags":["opensuse:13.2-patched"],"Layers":["b1/layer.tar","p1/layer.tar"]}]`,
+				"onto.json":     ontoConfig,
+				"b1/layer.tar":  string(base),
+				"p1/layer.tar": string(newArchive(t, map[string]string{
+					"usr/bin/":        "",
+					"usr/bin/bash":    "bash 2",
+					"usr/bin/zypper":  "zypper 2",
+					"etc/ssl/certs":   "certs 2",
+					"etc/.wh.motd":    "",
+					"etc/os-release2": "openSUSE",
+				})),
+			}),
+		},
+	}
+}
+
+func TestRebase(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	mc := rebaseClient(t)
+	safeClient.client = mc
+
+	setupTestExitStatus()
+	captured := capture.All(func() {
+		rebaseCmd(commandContext("rebase", "--onto", "opensuse:13.2-patched", "app:1.0", "new:1.0"))
+	})
+	if lastCode != 0 {
+		t.Fatalf("Unexpected failure: %s", captured.Stdout)
+	}
+	out := string(captured.Stdout)
+	if !strings.Contains(out, "new:1.0 successfully created") {
+		t.Fatalf("Wrong output: %s", out)
+	}
+	if !strings.Contains(out, "  /etc/ssl/certs\n  /usr/bin/bash\n") ||
+		strings.Contains(out, "zypper") || strings.Contains(out, "motd") {
+		t.Fatalf("Wrong list of shadowed files: %s", out)
+	}
+
+	files := readArchive(t, mc.loadedImage)
+	var manifests []savedManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifests); err != nil || len(manifests) != 1 {
+		t.Fatalf("Wrong manifest (%v): %s", err, files["manifest.json"])
+	}
+	m := manifests[0]
+	expected := []string{"onto/b1/layer.tar", "onto/p1/layer.tar", "app/a1/layer.tar", "app/a2/layer.tar"}
+	if compareStringSlices(m.RepoTags, []string{"new:1.0"}) != nil || compareStringSlices(m.Layers, expected) != nil {
+		t.Fatalf("Wrong manifest: %+v", m)
+	}
+	for _, l := range expected {
+		if _, ok := files[l]; !ok {
+			t.Fatalf("The layer %s has not been loaded", l)
+		}
+	}
+
+	config := struct {
+		RootFS  imageRootFS    `json:"rootfs"`
+		History []imageHistory `json:"history"`
+		Config  struct {
+			Cmd    []string
+			Labels map[string]string
+		} `json:"config"`
+		Unknown bool `json:"unknown"`
+	}{}
+	if err := json.Unmarshal([]byte(files[m.Config]), &config); err != nil || !config.Unknown {
+		t.Fatalf("Wrong configuration (%v): %s", err, files[m.Config])
+	}
+	if compareStringSlices(config.RootFS.DiffIDs, []string{"sha256:b1", "sha256:p1", "sha256:a1", "sha256:a2"}) != nil {
+		t.Fatalf("Wrong layers: %v", config.RootFS.DiffIDs)
+	}
+	history := []string{}
+	for _, h := range config.History {
+		history = append(history, h.CreatedBy)
+	}
+	if compareStringSlices(history, []string{"base", "zypper", "a1", "a2"}) != nil {
+		t.Fatalf("Wrong history: %v", history)
+	}
+	labels := config.Config.Labels
+	if len(labels) != 4 || labels["version"] != "2" || labels["app"] != "1" ||
+		labels["com.suse.zypper-docker.source.id"] != "sha256:old" || compareStringSlices(config.Config.Cmd, []string{"/opt/app"}) != nil {
+		t.Fatalf("Wrong configuration: %+v", config.Config)
+	}
+
+	record := getCacheFile().imageRecord("sha256:" + strings.TrimSuffix(m.Config, ".json"))
+	if record == nil || !record.Rebased || record.Source != "sha256:app" {
+		t.Fatalf("Wrong record: %+v", record)
+	}
+}
+
+func TestRebaseWithFrom(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	mc := rebaseClient(t)
+	safeClient.client = mc
+
+	// Without the label, the old base cannot be found.
+	mc.rawInspects["opensuse:13.2-patched"] = `{"Id":"sha256:onto","RootFS":{"Layers":["sha256:b1","sha256:p1"]}}`
+	setupTestExitStatus()
+	captured := capture.All(func() {
+		rebaseCmd(commandContext("rebase", "--onto", "opensuse:13.2-patched", "app:1.0", "new:1.0"))
+	})
+	if lastCode != 1 || !strings.Contains(string(captured.Stdout), "use --from to give it") {
+		t.Fatalf("Wrong failure (%d): %s", lastCode, captured.Stdout)
+	}
+
+	setupTestExitStatus()
+	captured = capture.All(func() {
+		rebaseCmd(commandContext("rebase", "--onto", "opensuse:13.2-patched", "--from", "opensuse:13.2", "app:1.0", "new:1.0"))
+	})
+	if lastCode != 0 {
+		t.Fatalf("Unexpected failure: %s", captured.Stdout)
+	}
+}
+
+func TestRebaseFailures(t *testing.T) {
+	tests := []struct {
+		onto, from string
+		args       []string
+		mutate     func(mc *mockClient)
+		err        string
+	}{
+		{"opensuse:13.2-patched", "", []string{"app:1.0"}, nil, "expected 2 arguments, 1 given"},
+		{"", "", []string{"app:1.0", "new:1.0"}, nil, "the --onto flag is required"},
+		{"opensuse:13.2-patched", "", []string{"app:1.0", "new:1.0"}, func(mc *mockClient) {
+			mc.rawInspects["app:1.0"] = `{"Id":"sha256:app","RootFS":{"Layers":["sha256:b1","sha256:p1","sha256:a1"]}}`
+		}, "app:1.0 is already based on opensuse:13.2-patched"},
+		{"opensuse:13.2-patched", "opensuse:13.2-patched", []string{"app:1.0", "new:1.0"}, nil,
+			"app:1.0 is not based on opensuse:13.2-patched"},
+		{"opensuse:13.2-patched", "", []string{"app:1.0", "new:1.0"}, func(mc *mockClient) {
+			mc.rawInspects["app:1.0"] = `{"Id":"sha256:app","RootFS":{}}`
+		}, "the daemon does not report the layers of 'app:1.0'"},
+		{"opensuse:13.2-patched", "", []string{"app:1.0", "new:1.0"}, func(mc *mockClient) {
+			mc.histories["sha256:app"][2].CreatedBy = "other"
+		}, "the history of app:1.0 does not match the one of sha256:old"},
+		{"opensuse:13.2-patched", "", []string{"app:1.0", "new:1.0"}, func(mc *mockClient) {
+			mc.loadFail = true
+		}, "could not load the new image"},
+	}
+
+	for _, test := range tests {
+		restore := setupTemporaryCache(t)
+		mc := rebaseClient(t)
+		if test.mutate != nil {
+			test.mutate(mc)
+		}
+		safeClient.client = mc
+
+		setupTestExitStatus()
+		captured := capture.All(func() {
+			rebaseCmd(commandContext("rebase", append([]string{"--onto", test.onto, "--from", test.from}, test.args...)...))
+		})
+		if lastCode != 1 || !strings.Contains(string(captured.Stdout), test.err) {
+			t.Fatalf("Expected '%s', got (%d): %s", test.err, lastCode, captured.Stdout)
+		}
+		restore()
+	}
+}
+
+func TestRebaseLabels(t *testing.T) {
+	labels := rebaseLabels(map[string]string{"a": "1", "b": "1"}, map[string]string{"a": "1", "b": "2"},
+		map[string]string{"c": "3"})
+	if len(labels) != 2 || labels["b"] != "1" || labels["c"] != "3" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+}
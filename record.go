@@ -0,0 +1,206 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// The prefixes of the lines that delimit the records printed by the zypper
+// commands of a transaction. See the `recordCommand` function.
+const (
+	recordBegin = "zypper-docker:begin:"
+	recordEnd   = "zypper-docker:end:"
+)
+
+// The names of the records printed by the zypper commands.
+const (
+	// The metadata of the repositories in use, as printed by
+	// `repositoriesCommand` when inspecting the source image.
+	repositoriesRecord = "repositories"
+
+	// The patches listed in XML mode right after resolving a transaction
+	// with --dry-run.
+	neededBeforeRecord = "needed-before"
+)
+
+// recordCommand returns the shell commands that run cmd and print its output
+// as the record with the given name.
+func recordCommand(name, cmd string) string {
+	return fmt.Sprintf("echo %s%s; %s; echo %s%s", recordBegin, name, cmd, recordEnd, name)
+}
+
+// recordedPatchesCommand returns the command that lists the patches in XML
+// mode while recording a transaction. It never asks questions, even if the
+// transaction itself is interactive.
+func recordedPatchesCommand() string {
+	return "zypper --non-interactive " + gpgFlags() + "--xmlout lp"
+}
+
+// recorder is a writer that forwards everything to another writer, except
+// for the records printed by the zypper commands of a transaction, which are
+// kept instead. Only the lines in which a record might begin are held back,
+// so the output of zypper is still shown as it comes.
+type recorder struct {
+	w       io.Writer
+	records map[string]string
+
+	// The current line, while it has not been forwarded.
+	line []byte
+
+	// Whether the rest of the current line has to be forwarded as it comes.
+	passing bool
+
+	// The name of the record being read, if any.
+	name string
+}
+
+// newRecorder returns a recorder that forwards everything else to w.
+func newRecorder(w io.Writer) *recorder {
+	return &recorder{w: w, records: make(map[string]string)}
+}
+
+// Write implements the io.Writer interface.
+func (r *recorder) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i++ {
+		if r.passing {
+			end := len(p)
+			if j := bytes.IndexByte(p[i:], '\n'); j >= 0 {
+				end, r.passing = i+j+1, false
+			}
+			if _, err := r.w.Write(p[i:end]); err != nil {
+				return i, err
+			}
+			i = end - 1
+			continue
+		}
+
+		r.line = append(r.line, p[i])
+		if p[i] == '\n' {
+			if err := r.endLine(); err != nil {
+				return i, err
+			}
+		} else if r.name == "" && !r.maybeMarker() {
+			if _, err := r.w.Write(r.line); err != nil {
+				return i, err
+			}
+			r.line, r.passing = r.line[:0], true
+		}
+	}
+	return len(p), nil
+}
+
+// maybeMarker returns true if the current line might be the beginning of a
+// record.
+func (r *recorder) maybeMarker() bool {
+	line := strings.TrimRight(string(r.line), "\r")
+	return strings.HasPrefix(line, recordBegin) || strings.HasPrefix(recordBegin, line)
+}
+
+// endLine handles the current line once it is complete.
+func (r *recorder) endLine() error {
+	line := strings.TrimRight(string(r.line), "\r\n")
+	held := r.line
+	r.line = nil
+
+	switch {
+	case r.name != "" && line == recordEnd+r.name:
+		r.name = ""
+	case r.name != "":
+		r.records[r.name] += line + "\n"
+	case strings.HasPrefix(line, recordBegin):
+		r.name = strings.TrimPrefix(line, recordBegin)
+		r.records[r.name] = ""
+	default:
+		_, err := r.w.Write(held)
+		return err
+	}
+	return nil
+}
+
+// flush forwards the line being held back, if any. It has to be called once
+// everything has been written.
+func (r *recorder) flush() {
+	if r.name == "" && len(r.line) > 0 {
+		if _, err := r.w.Write(r.line); err != nil {
+			log.Print(err)
+		}
+	}
+	r.line, r.name, r.passing = nil, "", false
+}
+
+// splitRecords returns the given output without the records printed in it,
+// and these records.
+func splitRecords(output string) (string, map[string]string) {
+	buf := bytes.NewBuffer([]byte{})
+	rec := newRecorder(buf)
+	if _, err := io.WriteString(rec, output); err != nil {
+		log.Print(err)
+	}
+	rec.flush()
+	return buf.String(), rec.records
+}
+
+// The line printed by zypper before the patches it's going to install, as in
+// "The following 2 NEW patches are going to be installed:".
+var newPatchesHeader = regexp.MustCompile(`^The following (\d+ )?NEW patch(es)? (is|are) going to be installed:$`)
+
+// patchScanner is a writer that forwards everything to another writer, while
+// keeping the names of the patches that zypper says it's going to install.
+type patchScanner struct {
+	w io.Writer
+
+	// The current line, until it's complete.
+	line []byte
+
+	// Whether the current line belongs to a list of new patches.
+	listing bool
+
+	// The names of the patches that zypper has announced.
+	patches []string
+}
+
+// newPatchScanner returns a patchScanner forwarding everything to w.
+func newPatchScanner(w io.Writer) *patchScanner {
+	return &patchScanner{w: w}
+}
+
+// Write implements the io.Writer interface.
+func (s *patchScanner) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	for _, b := range p[:n] {
+		if b != '\n' {
+			s.line = append(s.line, b)
+			continue
+		}
+
+		line := strings.TrimSpace(string(s.line))
+		s.line = s.line[:0]
+		switch {
+		case newPatchesHeader.MatchString(line):
+			s.listing = true
+		case line == "":
+			s.listing = false
+		case s.listing:
+			s.patches = append(s.patches, strings.Fields(line)...)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+// installOutput returns the output of a transaction in which zypper installed
+// the given patches.
+func installOutput(patches ...string) string {
+	header := "The following NEW patch is going to be installed:"
+	if len(patches) > 1 {
+		header = fmt.Sprintf("The following %d NEW patches are going to be installed:", len(patches))
+	}
+	return "Refreshing repositories\n\n" + header + "\n  " + strings.Join(patches, " ") + "\n\nInstalling patches\n"
+}
+
+func TestRecordCommand(t *testing.T) {
+	cmd := recordCommand("name", "zypper lp")
+	if cmd != "echo zypper-docker:begin:name; zypper lp; echo zypper-docker:end:name" {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	out := bytes.NewBuffer([]byte{})
+	rec := newRecorder(out)
+	input := "Refreshing repositories\n" +
+		recordBegin + repositoriesRecord + "\nabc\n" + recordEnd + repositoriesRecord + "\n" +
+		recordBegin + neededBeforeRecord + "\n<stream>\r\n</stream>\n" + recordEnd + neededBeforeRecord + "\n" +
+		"Installing patches\n"
+
+	// Write it in small pieces, so markers are split across writes.
+	for i := 0; i < len(input); i += 3 {
+		end := i + 3
+		if end > len(input) {
+			end = len(input)
+		}
+		if _, err := rec.Write([]byte(input[i:end])); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	_, _ = rec.Write([]byte("zypper-docker"))
+	rec.flush()
+
+	if out.String() != "Refreshing repositories\nInstalling patches\nzypper-docker" {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+	if rec.records[repositoriesRecord] != "abc\n" {
+		t.Fatalf("Wrong record: %q", rec.records[repositoriesRecord])
+	}
+	if rec.records[neededBeforeRecord] != "<stream>\n</stream>\n" {
+		t.Fatalf("Wrong record: %q", rec.records[neededBeforeRecord])
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	output, records := splitRecords(patchListOutput + recordBegin + repositoriesRecord + "\nabc\n" + recordEnd + repositoriesRecord + "\n")
+	if output != patchListOutput {
+		t.Fatalf("Wrong output: %q", output)
+	}
+	if len(records) != 1 || records[repositoriesRecord] != "abc\n" {
+		t.Fatalf("Wrong records: %v", records)
+	}
+}
+
+func TestPatchScanner(t *testing.T) {
+	out := bytes.NewBuffer([]byte{})
+	scanner := newPatchScanner(out)
+	input := installOutput("openSUSE-2016-100", "openSUSE-2016-101") +
+		"\nThe following package is going to be upgraded:\n  openssl\n\n" +
+		"The following NEW patch is going to be installed:\n  openSUSE-2016-102\n"
+
+	// Write it in small pieces, so lines are split across writes.
+	for i := 0; i < len(input); i += 5 {
+		end := i + 5
+		if end > len(input) {
+			end = len(input)
+		}
+		if _, err := scanner.Write([]byte(input[i:end])); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if out.String() != input {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+	if err := compareStringSlices(scanner.patches, []string{"openSUSE-2016-100", "openSUSE-2016-101", "openSUSE-2016-102"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppliedLabels(t *testing.T) {
+	listed, err := parsePatchList(patchListOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	p := &provenance{Command: "patch", Patches: listed}
+
+	labels := p.appliedLabels([]string{"openSUSE-2016-100", "unknown"})
+	if labels[labelPrefix+"patches"] != "openSUSE-2016-100,unknown" || labels[labelPrefix+"cves"] != "CVE-2016-0701" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+
+	// Only the patch command is labeled this way.
+	p.Command = "up"
+	if labels = p.appliedLabels([]string{"openSUSE-2016-100"}); labels != nil {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	p = nil
+	if labels = p.appliedLabels([]string{"openSUSE-2016-100"}); labels != nil {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+}
+
+func TestUpdateCommandRecordsNoPatches(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	mock := &mockClient{listReturnOneImage: true,
+		logOutput:         patchListOutput + recordBegin + repositoriesRecord + "\nabc\n" + recordEnd + repositoriesRecord + "\n",
+		transactionOutput: installOutput("openSUSE-2016-100")}
+	safeClient.client = mock
+
+	capture.All(func() {
+		_, _, _ = updatePatchImage("up", "opensuse:13.2", "new:1.0", commandContext("update"))
+	})
+	labels := mock.lastCommit.Config.Labels
+	if labels[labelPrefix+"repositories"] != repositoriesFingerprint("abc") {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	if _, ok := labels[labelPrefix+"patches"]; ok {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	if strings.Contains(mock.lastCmd[len(mock.lastCmd)-1], recordBegin) {
+		t.Fatalf("The transaction should not be recorded: %v", mock.lastCmd)
+	}
+}
+
+func TestBuildDockerfileImageRecordsLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-builder")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	listed, err := parsePatchList(patchListOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	prov := &provenance{Command: "patch", Patches: listed}
+	mc := &mockClient{buildOutput: installOutput("openSUSE-2016-100")}
+	safeClient.client = mc
+	var id string
+	captured := capture.All(func() {
+		id, err = buildDockerfileImage("opensuse:13.2", "new", "1.0", "zypper ref", "msg", "me", prov,
+			filepath.Join(dir, "Dockerfile"))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "built image ID" || len(mc.builtDockerfiles) != 2 {
+		t.Fatalf("Wrong builds: %s, %v", id, mc.builtDockerfiles)
+	}
+	if !strings.Contains(string(captured.Stdout), "openSUSE-2016-100") {
+		t.Fatalf("The output of zypper should be shown: %s", captured.Stdout)
+	}
+	relabel := mc.builtDockerfiles[1]
+	if !strings.HasPrefix(relabel, "FROM built image ID\nLABEL ") ||
+		!strings.Contains(relabel, `com.suse.zypper-docker.patches="openSUSE-2016-100"`) ||
+		!strings.Contains(relabel, `com.suse.zypper-docker.cves="CVE-2016-0701"`) {
+		t.Fatalf("Wrong Dockerfile:\n%s", relabel)
+	}
+}
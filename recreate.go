@@ -0,0 +1,377 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+// The time in seconds that containers are given to stop before being killed
+// when they are being recreated.
+const stopTimeout = 10
+
+// The suffix added to the name of a container while it's being replaced.
+const replacedSuffix = "-zypper-docker-old"
+
+// containerImageID returns the ID of the image in which the given container is
+// based on.
+func containerImageID(c types.Container) (string, error) {
+	if c.ImageID != "" {
+		return c.ImageID, nil
+	}
+	return getImageID(c.Image)
+}
+
+// imageContainerConfig returns the configuration of the given image.
+func imageContainerConfig(img string) (*container.Config, error) {
+	client := getDockerClient()
+
+	info, _, err := client.ImageInspectWithRaw(img, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect image '%s': %v", img, err)
+	}
+	if info.Config == nil {
+		return &container.Config{}, nil
+	}
+	return info.Config, nil
+}
+
+// recreatedConfig returns the configuration for the container replacing the
+// one described by info, which was based on an image with the configuration
+// given by oldImage. The new container will be based on the image img, with
+// the configuration given by newImage.
+func recreatedConfig(info types.ContainerJSON, img string, oldImage, newImage *container.Config) (*container.Config, *container.HostConfig, *network.NetworkingConfig) {
+	config := userConfig(info.ID, info.Config, oldImage, newImage)
+	config.Image = img
+
+	hostConfig := &container.HostConfig{}
+	if info.HostConfig != nil {
+		*hostConfig = *info.HostConfig
+	}
+
+	// Named and anonymous volumes are not part of the host config, so they
+	// have to be explicitly passed to the new container. Otherwise, the
+	// anonymous volumes would be lost.
+	binds := hostConfig.Binds
+	for _, m := range info.Mounts {
+		if m.Name == "" {
+			continue
+		}
+		bind := m.Name + ":" + m.Destination
+		if !m.RW {
+			bind += ":ro"
+		}
+		binds = append(binds, bind)
+	}
+	hostConfig.Binds = removeDuplicates(binds)
+
+	// Only the endpoint of the main network can be given when creating a
+	// container. The rest are connected afterwards by `connectNetworks`.
+	networking := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	mode := mainNetwork(hostConfig)
+	if info.NetworkSettings != nil {
+		if ep, ok := info.NetworkSettings.Networks[mode]; ok {
+			networking.EndpointsConfig[mode] = endpointConfig(ep)
+		}
+	}
+	return config, hostConfig, networking
+}
+
+// userConfig returns the configuration of newImage plus what the user set on
+// the container with the given id and configuration when creating it. The
+// settings that the container inherited from its image, whose configuration
+// is given by oldImage, are left out, so the ones of the new image are picked
+// up instead.
+func userConfig(id string, cur, oldImage, newImage *container.Config) *container.Config {
+	config := &container.Config{}
+	if newImage != nil {
+		*config = *newImage
+	}
+	if cur == nil {
+		return config
+	}
+	if oldImage == nil {
+		oldImage = &container.Config{}
+	}
+
+	// These belong to the container alone. The hostname defaults to the short
+	// ID of the container, which must not be passed on to the new one.
+	config.Hostname = ""
+	if cur.Hostname != "" && !strings.HasPrefix(id, cur.Hostname) {
+		config.Hostname = cur.Hostname
+	}
+	config.Domainname = cur.Domainname
+	config.AttachStdin, config.AttachStdout, config.AttachStderr = cur.AttachStdin, cur.AttachStdout, cur.AttachStderr
+	config.Tty, config.OpenStdin, config.StdinOnce = cur.Tty, cur.OpenStdin, cur.StdinOnce
+	config.PublishService = cur.PublishService
+	config.NetworkDisabled = cur.NetworkDisabled
+	config.MacAddress = cur.MacAddress
+
+	if cur.User != oldImage.User {
+		config.User = cur.User
+	}
+	if cur.WorkingDir != oldImage.WorkingDir {
+		config.WorkingDir = cur.WorkingDir
+	}
+	if cur.StopSignal != oldImage.StopSignal {
+		config.StopSignal = cur.StopSignal
+	}
+
+	// A command is only kept if it was given explicitly. The daemon drops the
+	// command of the image when the entrypoint is given, so in that case the
+	// command of the container is kept as well.
+	if !reflect.DeepEqual(cur.Entrypoint.Slice(), oldImage.Entrypoint.Slice()) {
+		config.Entrypoint, config.Cmd = cur.Entrypoint, cur.Cmd
+	} else if !reflect.DeepEqual(cur.Cmd.Slice(), oldImage.Cmd.Slice()) {
+		config.Cmd = cur.Cmd
+	}
+
+	config.Env = userEnv(cur.Env, oldImage.Env, config.Env)
+	labels := make(map[string]string)
+	for k, v := range cur.Labels {
+		if old, ok := oldImage.Labels[k]; !ok || old != v {
+			labels[k] = v
+		}
+	}
+	config.Labels = mergeLabels(config.Labels, labels)
+
+	ports := make(map[nat.Port]struct{})
+	for port := range config.ExposedPorts {
+		ports[port] = struct{}{}
+	}
+	for port := range cur.ExposedPorts {
+		if _, ok := oldImage.ExposedPorts[port]; !ok {
+			ports[port] = struct{}{}
+		}
+	}
+	volumes := make(map[string]struct{})
+	for volume := range config.Volumes {
+		volumes[volume] = struct{}{}
+	}
+	for volume := range cur.Volumes {
+		if _, ok := oldImage.Volumes[volume]; !ok {
+			volumes[volume] = struct{}{}
+		}
+	}
+	config.ExposedPorts, config.Volumes = ports, volumes
+	return config
+}
+
+// userEnv returns the given environment of an image plus the variables of
+// the environment of a container that were not inherited from its image,
+// whose environment is given by old. These take precedence.
+func userEnv(cur, old, env []string) []string {
+	res := append([]string{}, env...)
+	for _, v := range cur {
+		if arrayIncludeString(old, v) {
+			continue
+		}
+		key := strings.SplitN(v, "=", 2)[0]
+		replaced := false
+		for i, e := range res {
+			if strings.SplitN(e, "=", 2)[0] == key {
+				res[i], replaced = v, true
+			}
+		}
+		if !replaced {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// mainNetwork returns the name of the network that a container with the given
+// host configuration is connected to when being created.
+func mainNetwork(hostConfig *container.HostConfig) string {
+	if hostConfig == nil {
+		return "bridge"
+	}
+	mode := string(hostConfig.NetworkMode)
+	if mode == "" || mode == "default" {
+		return "bridge"
+	}
+	return mode
+}
+
+// endpointConfig returns the configuration of the given endpoint without any
+// of its operational data.
+func endpointConfig(ep *network.EndpointSettings) *network.EndpointSettings {
+	if ep == nil {
+		return &network.EndpointSettings{}
+	}
+	return &network.EndpointSettings{
+		IPAMConfig: ep.IPAMConfig,
+		Links:      ep.Links,
+		Aliases:    ep.Aliases,
+	}
+}
+
+// connectNetworks connects the container with the given id to all the
+// networks that the container described by info was connected to, except for
+// its main network.
+func connectNetworks(id string, info types.ContainerJSON) error {
+	if info.NetworkSettings == nil {
+		return nil
+	}
+
+	client := getDockerClient()
+	mode := mainNetwork(info.HostConfig)
+	for name, ep := range info.NetworkSettings.Networks {
+		if name == mode {
+			continue
+		}
+		if err := client.NetworkConnect(name, id, endpointConfig(ep)); err != nil {
+			return fmt.Errorf("could not connect to network %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// replacement is a container that has been replaced by a new one, but that
+// has not been removed yet. The replacement is either confirmed with the
+// `commit` method, or reverted with the `revert` one.
+type replacement struct {
+	old     types.ContainerJSON
+	name    string
+	running bool
+
+	// The ID of the new container.
+	ID string
+}
+
+// replaceContainer replaces the container with the given id with a new one
+// based on the given image. The new container keeps the name, the
+// configuration set by the user (see `userConfig`), the host configuration
+// (e.g. restart policy), the networks and the volumes of the old one. If the old container was running, then the
+// new one is started too.
+//
+// The old container is stopped and renamed, but it's only removed when the
+// returned replacement is committed. If anything goes wrong, the old
+// container is restored.
+func replaceContainer(id, img string) (*replacement, error) {
+	client := getDockerClient()
+
+	info, err := client.ContainerInspect(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect container %s: %v", id, err)
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+	running := info.State != nil && info.State.Running
+
+	oldImage, err := imageContainerConfig(info.Image)
+	if err != nil {
+		return nil, err
+	}
+	newImage, err := imageContainerConfig(img)
+	if err != nil {
+		return nil, err
+	}
+
+	if running {
+		if err = client.ContainerStop(info.ID, stopTimeout); err != nil {
+			return nil, fmt.Errorf("could not stop container %s: %v", name, err)
+		}
+	}
+	if err = client.ContainerRename(info.ID, name+replacedSuffix); err != nil {
+		restoreContainer(info, "", running)
+		return nil, fmt.Errorf("could not rename container %s: %v", name, err)
+	}
+
+	config, hostConfig, networking := recreatedConfig(info, img, oldImage, newImage)
+	resp, err := client.ContainerCreate(config, hostConfig, networking, name)
+	if err != nil {
+		restoreContainer(info, name, running)
+		return nil, fmt.Errorf("could not create the new container %s: %v", name, err)
+	}
+	for _, warning := range resp.Warnings {
+		log.Print(warning)
+	}
+
+	if err = connectNetworks(resp.ID, info); err == nil && running {
+		err = client.ContainerStart(resp.ID)
+	}
+	if err != nil {
+		removeContainer(resp.ID)
+		restoreContainer(info, name, running)
+		return nil, fmt.Errorf("could not start the new container %s: %v", name, err)
+	}
+	return &replacement{old: info, name: name, running: running, ID: resp.ID}, nil
+}
+
+// commit removes the old container, since it's no longer needed.
+func (r *replacement) commit() {
+	removeOldContainer(r.old.ID)
+}
+
+// revert removes the new container and puts the old one back into place.
+func (r *replacement) revert() {
+	// The volumes are shared with the old container, so they must be kept.
+	removeOldContainer(r.ID)
+	restoreContainer(r.old, r.name, r.running)
+}
+
+// recreateContainer replaces the container with the given id with a new one
+// based on the given image, as described in `replaceContainer`. The old
+// container is removed only after the new one has been successfully created
+// and started. It returns the ID of the new container.
+func recreateContainer(id, img string) (string, error) {
+	r, err := replaceContainer(id, img)
+	if err != nil {
+		return "", err
+	}
+	r.commit()
+	return r.ID, nil
+}
+
+// restoreContainer puts back into place the container described by info after
+// a failed attempt to recreate it. If name is not empty, the container is
+// renamed back to it.
+func restoreContainer(info types.ContainerJSON, name string, running bool) {
+	client := getDockerClient()
+
+	if name != "" {
+		if err := client.ContainerRename(info.ID, name); err != nil {
+			log.Printf("Could not rename container %s back to %s: %v", info.ID, name, err)
+		}
+	}
+	if running {
+		if err := client.ContainerStart(info.ID); err != nil {
+			log.Printf("Could not start container %s again: %v", info.ID, err)
+		}
+	}
+}
+
+// removeOldContainer removes a container that has been replaced. Contrary to
+// removeContainer, its volumes are kept since they are now used by the new
+// container.
+func removeOldContainer(id string) {
+	client := getDockerClient()
+
+	err := client.ContainerRemove(types.ContainerRemoveOptions{
+		ContainerID: id,
+		Force:       true,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/strslice"
+)
+
+func TestRecreatedConfig(t *testing.T) {
+	safeClient.client = &mockClient{}
+
+	info, _ := getDockerClient().ContainerInspect("1")
+	config, hostConfig, networking := recreatedConfig(info, "new:1.0.0", nil, nil)
+
+	if config.Image != "new:1.0.0" {
+		t.Fatalf("Wrong image: %s", config.Image)
+	}
+	if info.Config.Image != "opensuse:13.2" {
+		t.Fatal("The original config should not have been modified")
+	}
+	if hostConfig.RestartPolicy.Name != "always" {
+		t.Fatalf("Wrong restart policy: %v", hostConfig.RestartPolicy)
+	}
+	if err := compareStringSlices(hostConfig.Binds, []string{"/srv:/srv", "data:/data"}); err != nil {
+		t.Fatalf("Wrong binds: %v", err)
+	}
+	if len(networking.EndpointsConfig) != 1 {
+		t.Fatalf("Only the main network should be given: %v", networking.EndpointsConfig)
+	}
+	if ep := networking.EndpointsConfig["bridge"]; ep == nil || ep.IPAddress != "" {
+		t.Fatalf("Wrong endpoint: %v", ep)
+	}
+}
+
+func TestRecreatedConfigUserSettings(t *testing.T) {
+	oldImage := &container.Config{
+		Env:    []string{"PATH=/usr/bin", "LANG=C"},
+		Cmd:    strslice.New("/bin/sh"),
+		Labels: map[string]string{"a": "1"},
+	}
+	newImage := &container.Config{
+		Env:        []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C", "VERSION=2"},
+		Cmd:        strslice.New("/usr/bin/app"),
+		Labels:     map[string]string{"a": "3"},
+		WorkingDir: "/srv",
+	}
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: "4f3a2b1c0d9e8f7a6b5c"},
+		Config: &container.Config{
+			Hostname: "4f3a2b1c0d9e",
+			Tty:      true,
+			Env:      []string{"PATH=/usr/bin", "LANG=en_US", "DEBUG=1"},
+			Cmd:      strslice.New("/bin/sh"),
+			Labels:   map[string]string{"a": "1", "b": "2"},
+		},
+	}
+
+	config, _, _ := recreatedConfig(info, "new:1.0.0", oldImage, newImage)
+	if config.Hostname != "" || !config.Tty || config.WorkingDir != "/srv" {
+		t.Fatalf("Wrong config: %+v", config)
+	}
+	if err := compareStringSlices(config.Env, []string{"PATH=/usr/local/bin:/usr/bin", "LANG=en_US", "VERSION=2", "DEBUG=1"}); err != nil {
+		t.Fatalf("Wrong environment: %v", err)
+	}
+	if err := compareStringSlices(config.Cmd.Slice(), []string{"/usr/bin/app"}); err != nil {
+		t.Fatalf("Wrong command: %v", err)
+	}
+	if len(config.Labels) != 2 || config.Labels["a"] != "3" || config.Labels["b"] != "2" {
+		t.Fatalf("Wrong labels: %v", config.Labels)
+	}
+	if len(newImage.Labels) != 1 {
+		t.Fatalf("The config of the new image should not have been modified: %v", newImage.Labels)
+	}
+
+	// Explicit settings are kept, and the command goes along with the
+	// entrypoint.
+	info.Config.Hostname = "db"
+	info.Config.Entrypoint = strslice.New("/entrypoint.sh")
+	config, _, _ = recreatedConfig(info, "new:1.0.0", oldImage, newImage)
+	if config.Hostname != "db" {
+		t.Fatalf("Wrong hostname: %s", config.Hostname)
+	}
+	if err := compareStringSlices(config.Entrypoint.Slice(), []string{"/entrypoint.sh"}); err != nil {
+		t.Fatalf("Wrong entrypoint: %v", err)
+	}
+	if err := compareStringSlices(config.Cmd.Slice(), []string{"/bin/sh"}); err != nil {
+		t.Fatalf("Wrong command: %v", err)
+	}
+}
+
+func TestRecreateContainerSuccess(t *testing.T) {
+	mc := &mockClient{}
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	id, err := recreateContainer("1", "new:1.0.0")
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "zypper-docker-private-new:1.0.0" {
+		t.Fatalf("Wrong ID: %s", id)
+	}
+	if err := compareStringSlices(mc.renamed, []string{"1=name-1" + replacedSuffix}); err != nil {
+		t.Fatalf("Wrong renames: %v", err)
+	}
+	if err := compareStringSlices(mc.connected, []string{"backend=" + id}); err != nil {
+		t.Fatalf("Wrong networks: %v", err)
+	}
+	if err := compareStringSlices(mc.started, []string{id}); err != nil {
+		t.Fatalf("Wrong started containers: %v", err)
+	}
+	if !strings.Contains(buffer.String(), "Removed container 1") {
+		t.Fatalf("The old container should have been removed: %s", buffer.String())
+	}
+}
+
+func TestRecreateContainerFailures(t *testing.T) {
+	cases := []struct {
+		client  *mockClient
+		msg     string
+		renamed []string
+		started []string
+	}{
+		{&mockClient{inspectContFail: true}, "could not inspect container 1", nil, nil},
+		{&mockClient{inspectFail: true}, "could not inspect image", nil, nil},
+		{&mockClient{stopFail: true}, "could not stop container name-1", nil, nil},
+		{&mockClient{renameFail: true}, "could not rename container name-1", nil, []string{"1"}},
+		{&mockClient{createFail: true}, "could not create the new container name-1",
+			[]string{"1=name-1" + replacedSuffix, "1=name-1"}, []string{"1"}},
+		{&mockClient{connectFail: true}, "could not start the new container name-1: could not connect to network backend",
+			[]string{"1=name-1" + replacedSuffix, "1=name-1"}, []string{"1"}},
+	}
+
+	for _, test := range cases {
+		safeClient.client = test.client
+
+		log.SetOutput(bytes.NewBuffer([]byte{}))
+		_, err := recreateContainer("1", "new:1.0.0")
+
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Fatalf("Expected '%s', got: %v", test.msg, err)
+		}
+		if err := compareStringSlices(test.client.renamed, test.renamed); err != nil {
+			t.Fatalf("[%s] Wrong renames: %v", test.msg, err)
+		}
+		if err := compareStringSlices(test.client.started, test.started); err != nil {
+			t.Fatalf("[%s] Wrong started containers: %v", test.msg, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/engine-api/types"
+)
+
+// The time between two checks of the health of a container.
+var healthInterval = time.Second
+
+// containerHealth returns whether the container with the given id is running
+// and its health status. The status is an empty string if the container has
+// no healthcheck.
+func containerHealth(id string) (bool, string, error) {
+	client := getDockerClient()
+
+	// The health of the container is not available in the engine-api types.
+	_, raw, err := client.ContainerInspectWithRaw(id, false)
+	if err != nil {
+		return false, "", fmt.Errorf("could not inspect container %s: %v", id, err)
+	}
+
+	data := struct {
+		State struct {
+			Running bool
+			Health  *struct{ Status string }
+		}
+	}{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return false, "", fmt.Errorf("could not decode the state of container %s: %v", id, err)
+	}
+	if data.State.Health == nil {
+		return data.State.Running, "", nil
+	}
+	return data.State.Running, data.State.Health.Status, nil
+}
+
+// waitHealthy waits until the container with the given id is healthy. If the
+// container has no healthcheck, it's considered healthy as long as it's
+// running. It returns an error if the container stops, if it's reported as
+// unhealthy or if it's not healthy after the given timeout.
+func waitHealthy(id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		running, status, err := containerHealth(id)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return fmt.Errorf("the new container is not running")
+		}
+		switch status {
+		case "", "healthy":
+			return nil
+		case "unhealthy":
+			return fmt.Errorf("the new container is unhealthy")
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("the new container is not healthy after %v", timeout)
+		}
+
+		select {
+		case <-killChannel:
+			return fmt.Errorf("interrupted while waiting for the new container to be healthy")
+		case <-time.After(healthInterval):
+		}
+	}
+}
+
+// replacementImage returns how the image with the given ID should be
+// referenced by new containers. That is, one of its names if it still points
+// to it, or its ID otherwise.
+func replacementImage(id string, record *imageRecord) string {
+	if record != nil {
+		for _, name := range record.Names {
+			if nameID, err := getImageID(name); err == nil && nameID == id {
+				return name
+			}
+		}
+	}
+	return id
+}
+
+// containerName returns the name of the given container, or its ID if it has
+// no name.
+func containerName(c types.Container) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+// replaceWithImage replaces the given container with a new one based on the
+// given image. If the new container is not healthy within the given timeout,
+// then it's removed and the old container is restored.
+func replaceWithImage(c types.Container, img string, timeout time.Duration) (string, error) {
+	r, err := replaceContainer(c.ID, img)
+	if err != nil {
+		return "", err
+	}
+	if err = waitHealthy(r.ID, timeout); err != nil {
+		r.revert()
+		return "", fmt.Errorf("%v, the old container has been restored", err)
+	}
+	r.commit()
+	return r.ID, nil
+}
+
+// zypper-docker replace [flags] [<container-id>...]
+func replaceCmd(ctx *cli.Context) {
+	client := getDockerClient()
+
+	containers, err := client.ContainerList(types.ContainerListOptions{})
+	if err != nil {
+		logAndFatalf("Error while fetching running containers: %v\n", err)
+		return
+	}
+
+	// Without arguments, all the running containers are candidates.
+	explicit := len(ctx.Args()) > 0
+	targets := containers
+	if explicit {
+		targets = []types.Container{}
+		for _, id := range ctx.Args() {
+			c, err := lookupContainer(containers, id)
+			if err != nil {
+				logAndFatalf("%v.\n", err)
+				return
+			}
+			targets = append(targets, c)
+		}
+	}
+
+	cache := getCacheFile()
+	timeout := time.Duration(ctx.Int("timeout")) * time.Second
+	replaced, failed := 0, false
+
+	for _, c := range targets {
+		name := containerName(c)
+
+		imageID, err := containerImageID(c)
+		if err != nil {
+			log.Printf("Cannot analyze container %s [%s]: %s", c.ID, c.Image, err)
+			failed = failed || explicit
+			continue
+		}
+		newID := cache.replacementOf(imageID)
+		if newID == "" {
+			if explicit {
+				logAndPrintf("Container %s is not based on an image updated by zypper-docker\n", name)
+				failed = true
+			}
+			continue
+		}
+
+		img := replacementImage(newID, cache.imageRecord(newID))
+		id, err := replaceWithImage(c, img, timeout)
+		if err != nil {
+			logAndPrintf("Could not replace container %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		logAndPrintf("Container %s replaced by %s [%s]\n", name, id, img)
+		replaced++
+	}
+
+	if replaced == 0 && !failed {
+		fmt.Println("There are no outdated containers to replace.")
+	}
+	if failed {
+		exitWithCode(1)
+	}
+}
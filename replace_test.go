@@ -0,0 +1,123 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+func TestWaitHealthy(t *testing.T) {
+	tests := []struct {
+		client *mockClient
+		err    string
+	}{
+		{&mockClient{}, ""},
+		{&mockClient{health: "healthy"}, ""},
+		{&mockClient{health: "unhealthy"}, "the new container is unhealthy"},
+		{&mockClient{health: "starting"}, "the new container is not healthy after 0s"},
+		{&mockClient{exited: true}, "the new container is not running"},
+		{&mockClient{inspectContFail: true}, "could not inspect container 1: Container inspect failed"},
+	}
+
+	for _, test := range tests {
+		safeClient.client = test.client
+		err := waitHealthy("1", 0)
+		if test.err == "" {
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		} else if err == nil || err.Error() != test.err {
+			t.Fatalf("Expected error '%s', got: %v", test.err, err)
+		}
+	}
+}
+
+// runReplace runs the replace command with the given arguments and the given
+// client. It returns the captured stdout.
+func runReplace(t *testing.T, mc *mockClient, args ...string) string {
+	setupTestExitStatus()
+	safeClient.client = mc
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	captured := capture.All(func() { replaceCmd(testContext(args, false)) })
+	return string(captured.Stdout)
+}
+
+func TestReplaceCommand(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	stdout := runReplace(t, &mockClient{})
+	if lastCode != 0 || !strings.Contains(stdout, "There are no outdated containers to replace.") {
+		t.Fatalf("Wrong result (%d): %s", lastCode, stdout)
+	}
+
+	// opensuse:13.2 has the ID "2".
+	getCacheFile().recordUpdate("2", "5", "opensuse:patched")
+
+	mc := &mockClient{health: "healthy"}
+	stdout = runReplace(t, mc)
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, stdout)
+	}
+	if !strings.Contains(stdout, "Container suse replaced by zypper-docker-private-5 [5]") {
+		t.Fatalf("Wrong stdout: %s", stdout)
+	}
+	old := "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01"
+	if err := compareStringSlices(mc.removedContainers, []string{old}); err != nil {
+		t.Fatalf("Only the old container should have been removed: %v", err)
+	}
+
+	stdout = runReplace(t, &mockClient{}, "not_suse")
+	if lastCode != 1 || !strings.Contains(stdout, "Container not_suse is not based on an image updated by zypper-docker") {
+		t.Fatalf("Wrong result (%d): %s", lastCode, stdout)
+	}
+
+	stdout = runReplace(t, &mockClient{}, "whatever")
+	if lastCode != 1 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, stdout)
+	}
+}
+
+func TestReplaceCommandRollback(t *testing.T) {
+	defer setupTemporaryCache(t)()
+	getCacheFile().recordUpdate("2", "5", "opensuse:patched")
+
+	mc := &mockClient{health: "unhealthy"}
+	stdout := runReplace(t, mc, "suse")
+	if lastCode != 1 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, stdout)
+	}
+	if !strings.Contains(stdout, "Could not replace container suse: the new container is unhealthy, the old container has been restored") {
+		t.Fatalf("Wrong stdout: %s", stdout)
+	}
+	if err := compareStringSlices(mc.removedContainers, []string{"zypper-docker-private-5"}); err != nil {
+		t.Fatalf("Only the new container should have been removed: %v", err)
+	}
+
+	old := "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01"
+	expected := []string{old + "=name-" + old + replacedSuffix, old + "=name-" + old}
+	if err := compareStringSlices(mc.renamed, expected); err != nil {
+		t.Fatalf("The old container should have been renamed back: %v", err)
+	}
+	if err := compareStringSlices(mc.started, []string{"zypper-docker-private-5", old}); err != nil {
+		t.Fatalf("The old container should have been started again: %v", err)
+	}
+}
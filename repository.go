@@ -0,0 +1,170 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/engine-api/types"
+)
+
+// repositoryImage is an image of a repository together with all its local
+// tags in this repository.
+type repositoryImage struct {
+	ID   string
+	Tags []string
+}
+
+// repositoryImages returns the images of the given repository that have at
+// least one local tag, in the order given by the Docker daemon.
+func repositoryImages(repo string) ([]repositoryImage, error) {
+	client := getDockerClient()
+
+	images, err := client.ImageList(types.ImageListOptions{MatchName: repo, All: false})
+	if err != nil {
+		return nil, err
+	}
+
+	res := []repositoryImage{}
+	for _, img := range images {
+		tags := []string{}
+		for _, rt := range img.RepoTags {
+			// Images with a dangling name and images of other repositories
+			// sharing the same ID are ignored.
+			if r, t, err := parseImageName(rt); err == nil && r == repo {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) > 0 {
+			res = append(res, repositoryImage{ID: img.ID, Tags: sortedStrings(tags)})
+		}
+	}
+	return res, nil
+}
+
+// patchRepositoryImage patches the given image of the given repository once,
+// and tags the result for each of its tags as defined by the target template.
+// It returns the result of each tag.
+func patchRepositoryImage(zypperCmd, repo, target string, img repositoryImage, ctx *cli.Context) []applyResult {
+	results := make([]applyResult, len(img.Tags))
+	for i, tag := range img.Tags {
+		results[i] = applyResult{Source: repo + ":" + tag, Target: target, Status: "failed"}
+	}
+	fail := func(from int, err error) {
+		for i := from; i < len(results); i++ {
+			results[i].Error = err.Error()
+		}
+	}
+
+	// Images created by zypper-docker are not patched again, since they are
+	// most likely the result of a previous run.
+	if getCacheFile().imageRecord(img.ID) != nil {
+		for i := range results {
+			results[i].Target, results[i].Status = "", "skipped"
+			results[i].Error = "the image has been created by zypper-docker"
+		}
+		return results
+	}
+
+	first := results[0].Source
+	prov, err := inspectSource(first, zypperCmd, ctx, true)
+	if err != nil {
+		fail(0, err)
+		return results
+	}
+	cmd, err := patchCommand(zypperCmd, prov, ctx)
+	if err != nil {
+		fail(0, err)
+		return results
+	}
+	id, name, err := commitFromSource(first, target, cmd, prov, ctx)
+	if err != nil {
+		fail(0, err)
+		return results
+	}
+	results[0] = applyResult{Source: first, Target: name, ID: id, Status: "patched"}
+
+	names := map[string]bool{name: true}
+	for i := range results[1:] {
+		r := &results[i+1]
+		e := manifestEntry{Source: r.Source, Target: target}
+
+		// Names that had already been given to the new image are not pushed
+		// again.
+		n := len(names)
+		if err = tagForEntry(img.ID, id, e, prov, names, r); err == nil && ctx.Bool("push") && len(names) > n {
+			repo, tag, _ := parseImageName(r.Target)
+			err = pushAndRecord(id, repo, tag)
+		}
+		if err != nil {
+			r.Status, r.Error = "failed", err.Error()
+		}
+	}
+	return results
+}
+
+// updatePatchRepositoryCmd executes an update/patch command, depending on the
+// argument zypperCmd, on all the local tags of the repository given with the
+// `--repository` flag. Each image is patched only once, and the result is then
+// tagged as defined by the `--tag-template` flag for each of its tags.
+func updatePatchRepositoryCmd(zypperCmd string, ctx *cli.Context) {
+	if len(ctx.Args()) != 0 {
+		logAndFatalf("Wrong invocation: expected 0 arguments when using --repository, %d given.\n", len(ctx.Args()))
+		return
+	}
+	tmpl := ctx.String("tag-template")
+	if tmpl == "" {
+		logAndFatalf("Wrong invocation: the --tag-template flag has to be given with --repository.\n")
+		return
+	}
+	for _, f := range []string{"dry-run", "overwrite"} {
+		if ctx.Bool(f) {
+			logAndFatalf("Wrong invocation: the --%s flag cannot be combined with --repository.\n", f)
+			return
+		}
+	}
+
+	repo, _, err := parseImageName(ctx.String("repository"))
+	if err != nil {
+		logAndFatalf("Wrong invocation: invalid repository: %v.\n", err)
+		return
+	}
+	images, err := repositoryImages(repo)
+	if err != nil {
+		logAndFatalf("Cannot list the images of %s: %v.\n", repo, err)
+		return
+	}
+	if len(images) == 0 {
+		logAndFatalf("There are no local tags for the %s repository.\n", repo)
+		return
+	}
+	if len(images) > 1 && !isTemplate(tmpl) {
+		logAndFatalf("Wrong invocation: the --tag-template flag has to be a template when the %s repository has more than one image.\n", repo)
+		return
+	}
+
+	// The same template is applied to every tag of the repository.
+	target := fmt.Sprintf("%s:%s", repo, tmpl)
+	results := []applyResult{}
+	for _, img := range images {
+		results = append(results, patchRepositoryImage(zypperCmd, repo, target, img, ctx)...)
+	}
+
+	printResults(results)
+	if summarize(results).Failed > 0 {
+		exitWithCode(1)
+	}
+}
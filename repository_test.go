@@ -0,0 +1,128 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/mssola/capture"
+)
+
+func TestRepositoryImages(t *testing.T) {
+	safeClient.client = &mockClient{}
+
+	images, err := repositoryImages("opensuse")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(images) != 2 || images[0].ID != "1" || images[1].ID != "2" {
+		t.Fatalf("Wrong images: %+v", images)
+	}
+	if err = compareStringSlices(images[0].Tags, []string{"latest", "tag"}); err != nil {
+		t.Fatalf("Wrong tags: %v", err)
+	}
+
+	safeClient.client = &mockClient{listFail: true}
+	if _, err = repositoryImages("opensuse"); err == nil {
+		t.Fatal("It should have failed")
+	}
+}
+
+func TestPatchRepository(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	// The image with ID "2" has been created by zypper-docker.
+	cache := getCacheFile()
+	cache.recordUpdate("0", "2", "opensuse:13.2")
+
+	setupTestExitStatus()
+	mc := &mockClient{}
+	safeClient.client = mc
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	captured := capture.All(func() {
+		patchCmd(commandContext("patch", "--repository", "opensuse", "--tag-template", "{{.Tag}}-patched"))
+	})
+
+	if lastCode != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+	}
+	if n := len(mc.lastCmd); n != 1 {
+		t.Fatalf("The image should have been patched only once, %d commands run", n)
+	}
+	if err := compareStringSlices(mc.tags, []string{"fake image ID=opensuse:tag-patched"}); err != nil {
+		t.Fatalf("Wrong tags: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(captured.Stdout)), "\n")
+	expected := []string{
+		"opensuse:latest opensuse:latest-patched fake image I patched",
+		"opensuse:tag opensuse:tag-patched fake image I tagged",
+		"opensuse:13.2 skipped the image has been created by zypper-docker",
+	}
+	lines = lines[len(lines)-len(expected):]
+	for i, line := range expected {
+		if strings.Join(strings.Fields(lines[i]), " ") != line {
+			t.Fatalf("Expected '%s', got '%s'", line, lines[i])
+		}
+	}
+}
+
+func TestPatchRepositoryFailure(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	setupTestExitStatus()
+	safeClient.client = &mockClient{commitFail: true}
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	captured := capture.All(func() {
+		patchCmd(commandContext("patch", "--repository", "opensuse", "--tag-template", "{{.Tag}}-patched"))
+	})
+
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %d", lastCode)
+	}
+	if n := strings.Count(string(captured.Stdout), "failed"); n != 3 {
+		t.Fatalf("Every tag should have failed: %s", captured.Stdout)
+	}
+}
+
+func TestPatchRepositoryWrongInvocation(t *testing.T) {
+	tests := []struct {
+		ctx *cli.Context
+		msg string
+	}{
+		{commandContext("patch", "--repository", "opensuse", "--tag-template", "{{.Tag}}-patched", "opensuse:13.2"), "expected 0 arguments when using --repository, 1 given"},
+		{commandContext("patch", "--repository", "opensuse"), "the --tag-template flag has to be given with --repository"},
+		{commandContext("patch", "--repository", "opensuse", "--tag-template", "{{.Tag}}-patched", "--dry-run"), "the --dry-run flag cannot be combined with --repository"},
+		{commandContext("patch", "--repository", "unknown", "--tag-template", "{{.Tag}}-patched"), "There are no local tags for the unknown repository"},
+		{commandContext("patch", "--repository", "opensuse", "--tag-template", "patched"), "the --tag-template flag has to be a template when the opensuse repository has more than one image"},
+	}
+
+	safeClient.client = &mockClient{}
+	for _, test := range tests {
+		setupTestExitStatus()
+		buffer := bytes.NewBuffer([]byte{})
+		log.SetOutput(buffer)
+		capture.All(func() { patchCmd(test.ctx) })
+		if lastCode != 1 || !strings.Contains(buffer.String(), test.msg) {
+			t.Fatalf("Expected '%s', got (%d): %s", test.msg, lastCode, buffer.String())
+		}
+	}
+}
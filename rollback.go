@@ -0,0 +1,111 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/engine-api/types"
+)
+
+// zypper-docker rollback [flags] <image>
+func rollbackCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		logAndFatalf("Wrong invocation: expected 1 argument, %d given.\n", len(ctx.Args()))
+		return
+	}
+
+	img := ctx.Args().First()
+	repo, tag, err := parseImageName(img)
+	if err != nil {
+		logAndFatalf("%v\n", err)
+		return
+	}
+	id, err := getImageID(img)
+	if err != nil {
+		logAndFatalf("%v.\n", err)
+		return
+	}
+
+	cache := getCacheFile()
+	record := cache.imageRecord(id)
+	if record == nil || record.Source == "" {
+		logAndFatalf("The image %s has not been created by zypper-docker.\n", img)
+		return
+	}
+
+	client := getDockerClient()
+	if _, _, err = client.ImageInspectWithRaw(record.Source, false); err != nil {
+		logAndFatalf("The image %s was derived from can no longer be found: %v.\n", img, err)
+		return
+	}
+
+	// The list of containers has to be fetched before tagging the source
+	// image: afterwards, containers referencing the image by name would be
+	// resolved to the source image.
+	var containers []types.Container
+	if ctx.Bool("recreate") {
+		if containers, err = containersUsingImage(id); err != nil {
+			logAndFatalf("%v.\n", err)
+			return
+		}
+	}
+
+	if err = tagImage(record.Source, repo, tag, true); err != nil {
+		logAndFatalf("Could not tag the previous image as %s:%s: %v.\n", repo, tag, err)
+		return
+	}
+	cache.markBroken(id)
+	logAndPrintf("%s:%s now points to the image it was derived from\n", repo, tag)
+
+	failed := false
+	for _, c := range containers {
+		if newID, err := recreateContainer(c.ID, repo+":"+tag); err != nil {
+			logAndPrintf("Could not recreate container %s: %v\n", c.ID, err)
+			failed = true
+		} else {
+			logAndPrintf("Container %s recreated as %s\n", c.ID, newID)
+		}
+	}
+	if failed {
+		exitWithCode(1)
+	}
+}
+
+// containersUsingImage returns all the containers, running or not, based on
+// the image with the given ID.
+func containersUsingImage(id string) ([]types.Container, error) {
+	client := getDockerClient()
+
+	containers, err := client.ContainerList(types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("Error while fetching containers: %v", err)
+	}
+
+	res := []types.Container{}
+	for _, c := range containers {
+		imageID, err := containerImageID(c)
+		if err != nil {
+			log.Printf("Cannot analyze container %s [%s]: %s", c.ID, c.Image, err)
+			continue
+		}
+		if imageID == id {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
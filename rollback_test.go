@@ -0,0 +1,123 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+func TestRollbackCommand(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	cases := testCases{
+		{"Wrong number of arguments", &mockClient{}, 1, []string{}, true, "Wrong invocation: expected 1 argument, 0 given.", ""},
+		{"Wrong format of image name", &mockClient{}, 1, []string{"dollar$$"}, true, "Could not parse 'dollar$$': invalid reference format", ""},
+		{"Unknown image", &mockClient{}, 1, []string{"new:1.0.0"}, true, "Cannot find image new:1.0.0.", ""},
+		{"Not created by zypper-docker", &mockClient{}, 1, []string{"opensuse:13.2"}, true, "The image opensuse:13.2 has not been created by zypper-docker.", ""},
+	}
+	cases.run(t, rollbackCmd, "", "")
+}
+
+func TestRollbackCommandSuccess(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	cache := getCacheFile()
+	cache.recordUpdate("1", "2", "opensuse:13.2")
+
+	for _, recreate := range []bool{false, true} {
+		setupTestExitStatus()
+		mc := &mockClient{}
+		safeClient.client = mc
+
+		args := []string{"opensuse:13.2"}
+		if recreate {
+			args = append([]string{"--recreate"}, args...)
+		}
+		buffer := bytes.NewBuffer([]byte{})
+		log.SetOutput(buffer)
+		captured := capture.All(func() { rollbackCmd(testContextWithFlags(args, "recreate")) })
+
+		if lastCode != 0 {
+			t.Fatalf("Unexpected exit code %d: %s", lastCode, buffer.String())
+		}
+		if err := compareStringSlices(mc.tags, []string{"1=opensuse:13.2"}); err != nil {
+			t.Fatalf("The source image should have been tagged: %v", err)
+		}
+		if !strings.Contains(string(captured.Stdout), "opensuse:13.2 now points to the image it was derived from") {
+			t.Fatalf("Wrong stdout: %s", captured.Stdout)
+		}
+		if !getCacheFile().isImageBroken("2") {
+			t.Fatal("The image should have been marked as broken")
+		}
+
+		// Both the running and the stopped containers based on opensuse:13.2.
+		expected := 0
+		if recreate {
+			expected = 2
+		}
+		if n := strings.Count(string(captured.Stdout), "recreated as zypper-docker-private-opensuse:13.2"); n != expected {
+			t.Fatalf("Expected %d containers to be recreated, got %d: %s", expected, n, captured.Stdout)
+		}
+	}
+}
+
+func TestRollbackCommandRecreateFailure(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	cache := getCacheFile()
+	cache.recordUpdate("1", "2", "opensuse:13.2")
+
+	setupTestExitStatus()
+	safeClient.client = &mockClient{stopFail: true}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	captured := capture.All(func() {
+		rollbackCmd(testContextWithFlags([]string{"--recreate", "opensuse:13.2"}, "recreate"))
+	})
+
+	if lastCode != 1 {
+		t.Fatalf("Expected exit code 1, got %d", lastCode)
+	}
+	if !strings.Contains(string(captured.Stdout), "could not stop container") {
+		t.Fatalf("Wrong stdout: %s", captured.Stdout)
+	}
+}
+
+func TestPsCommandBroken(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	cache := getCacheFile()
+	cache.recordUpdate("1", "2", "opensuse:13.2")
+	cache.markBroken("2")
+
+	setupTestExitStatus()
+	safeClient.client = &mockClient{}
+
+	log.SetOutput(bytes.NewBuffer([]byte{}))
+	captured := capture.All(func() { psCmd(testContext([]string{}, false)) })
+
+	if !strings.Contains(string(captured.Stdout), "Running containers whose images have been rolled back") {
+		t.Fatalf("Wrong stdout: %s", captured.Stdout)
+	}
+	if strings.Contains(string(captured.Stdout), "Running containers whose images have been updated") {
+		t.Fatalf("Wrong stdout: %s", captured.Stdout)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/pkg/term"
+)
+
+// errSelectionAborted is returned when the user quits the selection of
+// patches without installing anything.
+var errSelectionAborted = errors.New("the selection of patches has been aborted")
+
+// selectPatchesInTerminal lets the user pick some of the given patches in the
+// current terminal, which is set in raw mode in the meantime. It fails if
+// either the standard input or output is not a terminal.
+func selectPatchesInTerminal(patches []patchInfo) ([]patchInfo, error) {
+	fd, isTerminal := term.GetFdInfo(os.Stdin)
+	if !isTerminal || !stdoutIsTerminal() {
+		return nil, errors.New("the --select flag needs a terminal")
+	}
+	state, err := term.SetRawTerminal(fd)
+	if err != nil {
+		return nil, fmt.Errorf("could not set the terminal in raw mode: %v", err)
+	}
+	defer func() {
+		if err := term.RestoreTerminal(fd, state); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	height, width := getTtySize()
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	return selectPatches(patches, os.Stdin, os.Stdout, height, width)
+}
+
+// selectPatches runs the selection of patches, reading the keys pressed by
+// the user from in and drawing the screen into out, which has the given size.
+// It returns the selected patches in the order in which they were given.
+func selectPatches(patches []patchInfo, in io.Reader, out io.Writer, height, width int) ([]patchInfo, error) {
+	s := newPatchSelector(patches, height, width)
+	r := bufio.NewReader(in)
+
+	for {
+		if _, err := io.WriteString(out, s.render()); err != nil {
+			return nil, err
+		}
+		k, err := readKey(r)
+		if err != nil {
+			return nil, err
+		}
+		if done, err := s.handle(k); err != nil {
+			return nil, err
+		} else if done {
+			return s.selection(), nil
+		}
+	}
+}
+
+// key is a key pressed by the user while selecting patches.
+type key int
+
+const (
+	keyOther key = iota
+	keyUp
+	keyDown
+	keyToggle
+	keyToggleAll
+	keyDetails
+	keyAccept
+	keyQuit
+)
+
+// readKey reads the next key pressed by the user. Arrow keys are sent by
+// terminals as escape sequences, which arrive all at once. Thus, an escape
+// character with nothing buffered after it is the escape key itself.
+func readKey(r *bufio.Reader) (key, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return keyOther, err
+	}
+
+	switch b {
+	case 'k':
+		return keyUp, nil
+	case 'j':
+		return keyDown, nil
+	case ' ', 'x':
+		return keyToggle, nil
+	case 'a':
+		return keyToggleAll, nil
+	case 'd', '\t':
+		return keyDetails, nil
+	case '\r', '\n':
+		return keyAccept, nil
+	case 'q', 3: // Ctrl-C is not a signal in raw mode.
+		return keyQuit, nil
+	case 0x1b:
+		if r.Buffered() < 2 {
+			return keyQuit, nil
+		}
+		seq := make([]byte, 2)
+		if _, err = io.ReadFull(r, seq); err != nil {
+			return keyOther, err
+		}
+		switch string(seq) {
+		case "[A", "OA":
+			return keyUp, nil
+		case "[B", "OB":
+			return keyDown, nil
+		}
+	}
+	return keyOther, nil
+}
+
+// patchSelector holds the state of the screen in which patches are selected.
+type patchSelector struct {
+	patches  []patchInfo
+	selected []bool
+
+	// The patch under the cursor and the first patch being shown.
+	cursor, offset int
+
+	// Whether the details of the patch under the cursor are being shown.
+	details bool
+
+	// A message to be shown to the user on the next render.
+	message string
+
+	height, width int
+}
+
+// newPatchSelector returns the state of a screen of the given size in which
+// no patch has been selected yet.
+func newPatchSelector(patches []patchInfo, height, width int) *patchSelector {
+	if height < 6 {
+		height = 24
+	}
+	if width < 20 {
+		width = 80
+	}
+	return &patchSelector{
+		patches:  patches,
+		selected: make([]bool, len(patches)),
+		height:   height,
+		width:    width,
+	}
+}
+
+// rows returns how many patches fit on the screen, leaving room for the
+// header and the footer.
+func (s *patchSelector) rows() int {
+	return s.height - 4
+}
+
+// handle updates the state with the given key. It returns true once the user
+// has accepted the selection, and errSelectionAborted if the user has quit.
+func (s *patchSelector) handle(k key) (bool, error) {
+	s.message = ""
+	if s.details {
+		// Any key goes back to the list.
+		s.details = false
+		return false, nil
+	}
+
+	switch k {
+	case keyUp:
+		if s.cursor > 0 {
+			s.cursor--
+		}
+	case keyDown:
+		if s.cursor < len(s.patches)-1 {
+			s.cursor++
+		}
+	case keyToggle:
+		s.selected[s.cursor] = !s.selected[s.cursor]
+	case keyToggleAll:
+		all := len(s.selection()) != len(s.patches)
+		for i := range s.selected {
+			s.selected[i] = all
+		}
+	case keyDetails:
+		s.details = true
+	case keyAccept:
+		if len(s.selection()) > 0 {
+			return true, nil
+		}
+		s.message = "Select at least one patch, or press q to quit."
+	case keyQuit:
+		return false, errSelectionAborted
+	}
+
+	if s.cursor < s.offset {
+		s.offset = s.cursor
+	} else if s.cursor >= s.offset+s.rows() {
+		s.offset = s.cursor - s.rows() + 1
+	}
+	return false, nil
+}
+
+// selection returns the selected patches.
+func (s *patchSelector) selection() []patchInfo {
+	patches := []patchInfo{}
+	for i, p := range s.patches {
+		if s.selected[i] {
+			patches = append(patches, p)
+		}
+	}
+	return patches
+}
+
+// render returns the whole screen for the current state. Lines end with
+// "\r\n", since the terminal is in raw mode.
+func (s *patchSelector) render() string {
+	var lines []string
+	if s.details {
+		lines = s.renderDetails()
+	} else {
+		lines = s.renderList()
+	}
+
+	str := "\x1b[H\x1b[2J"
+	for _, l := range lines {
+		str += l + "\r\n"
+	}
+	return str
+}
+
+// renderList returns the lines of the list of patches.
+func (s *patchSelector) renderList() []string {
+	lines := []string{
+		s.truncate(fmt.Sprintf("Select the patches to install (%d of %d selected)", len(s.selection()), len(s.patches))),
+		"",
+	}
+
+	for i := s.offset; i < len(s.patches) && i < s.offset+s.rows(); i++ {
+		p := s.patches[i]
+		tick := " "
+		if s.selected[i] {
+			tick = "x"
+		}
+		line := fmt.Sprintf("[%s] %-9s %-11s %-24s %s", tick, p.Severity, p.Category, p.Name, stripControl(p.Summary))
+		if cves := p.CVEs(); len(cves) > 0 {
+			line += " (" + strings.Join(cves, ", ") + ")"
+		}
+		line = s.truncate(line)
+		if i == s.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	footer := "up/down: move  space: select  a: select all  d: details  enter: install  q: quit"
+	if s.message != "" {
+		footer = s.message
+	}
+	return append(lines, "", s.truncate(footer))
+}
+
+// renderDetails returns the lines describing the patch under the cursor.
+func (s *patchSelector) renderDetails() []string {
+	p := s.patches[s.cursor]
+	lines := []string{
+		"Name:        " + p.Name + "-" + p.Edition,
+		"Severity:    " + p.Severity,
+		"Category:    " + p.Category,
+		fmt.Sprintf("Interactive: %v", p.Interactive),
+		"CVEs:        " + strings.Join(p.CVEs(), ", "),
+		"Summary:     " + stripControl(p.Summary),
+		"",
+	}
+	for _, l := range strings.Split(strings.TrimSpace(p.Description), "\n") {
+		lines = append(lines, stripControl(l))
+	}
+
+	// Keep room for the footer.
+	for i := range lines {
+		lines[i] = s.truncate(lines[i])
+	}
+	if max := s.height - 2; len(lines) > max {
+		lines = lines[:max]
+	}
+	return append(lines, "", "Press any key to go back to the list.")
+}
+
+// stripControl removes the control characters from the given text, except for
+// tabs. The summaries and the descriptions of the patches come from the
+// repositories, and they must not be able to mess with the terminal, which is
+// in raw mode, with escape sequences and the like.
+func stripControl(str string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\t') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, str)
+}
+
+// truncate cuts the given line so it fits into the width of the screen.
+func (s *patchSelector) truncate(line string) string {
+	if r := []rune(line); len(r) > s.width {
+		return string(r[:s.width])
+	}
+	return line
+}
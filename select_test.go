@@ -0,0 +1,154 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
+
+func TestReadKey(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("kj\x1b[A\x1bOB xad\t\r\nq\x03z"))
+	expected := []key{keyUp, keyDown, keyUp, keyDown, keyToggle, keyToggle, keyToggleAll,
+		keyDetails, keyDetails, keyAccept, keyAccept, keyQuit, keyQuit, keyOther}
+	for i, e := range expected {
+		if k, err := readKey(r); err != nil || k != e {
+			t.Fatalf("Expected key %d to be %v, got %v (%v)", i, e, k, err)
+		}
+	}
+
+	// A lonely escape is the escape key.
+	r = bufio.NewReader(strings.NewReader("\x1b"))
+	if k, _ := readKey(r); k != keyQuit {
+		t.Fatalf("Expected the escape key to quit, got %v", k)
+	}
+}
+
+func TestSelectPatches(t *testing.T) {
+	patches, err := parsePatchList(patchListOutput)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Accepting without a selection, moving down, selecting the second patch,
+	// looking at its details and going back before accepting.
+	out := bytes.NewBuffer([]byte{})
+	selected, err := selectPatches(patches, strings.NewReader("\rj dz\r"), out, 24, 200)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(selected) != 1 || selected[0].Name != "openSUSE-2016-101" {
+		t.Fatalf("Wrong selection: %+v", selected)
+	}
+
+	screen := out.String()
+	for _, str := range []string{
+		"[ ] important security    openSUSE-2016-100        Security update for openssl (CVE-2016-0701)",
+		"Select at least one patch, or press q to quit.",
+		"(1 of 2 selected)",
+		"Interactive: true",
+		"This update fixes a crash.",
+	} {
+		if !strings.Contains(screen, str) {
+			t.Fatalf("Expected '%s' in the screen: %q", str, screen)
+		}
+	}
+
+	// Selecting all of them.
+	selected, err = selectPatches(patches, strings.NewReader("a\r"), out, 24, 80)
+	if err != nil || len(selected) != 2 {
+		t.Fatalf("Wrong selection (%v): %+v", err, selected)
+	}
+
+	if _, err = selectPatches(patches, strings.NewReader(" jq"), out, 24, 80); err != errSelectionAborted {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestPatchSelectorScrolls(t *testing.T) {
+	patches := []patchInfo{{Name: "p0"}, {Name: "p1"}, {Name: "p2"}, {Name: "p3"}}
+	s := newPatchSelector(patches, 6, 80)
+	for i := 0; i < 3; i++ {
+		_, _ = s.handle(keyDown)
+	}
+	screen := s.render()
+	if s.offset != 2 || strings.Contains(screen, "p1") || !strings.Contains(screen, "p3") {
+		t.Fatalf("Wrong screen (offset %d): %q", s.offset, screen)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, _ = s.handle(keyUp)
+	}
+	if s.offset != 0 || s.cursor != 0 {
+		t.Fatalf("Wrong position: %d, %d", s.offset, s.cursor)
+	}
+}
+
+func TestPatchSelectorStripsControlCharacters(t *testing.T) {
+	patches := []patchInfo{{Name: "p0", Summary: "Fix\x1b[2J\tit\x7f", Description: "Line\x1b]0;title\x07\r\nother\x00"}}
+	s := newPatchSelector(patches, 20, 80)
+
+	list := strings.Join(s.renderList(), "\n")
+	if !strings.Contains(list, "Fix[2J\tit") || strings.Contains(list, "\x7f") {
+		t.Fatalf("Wrong list: %q", list)
+	}
+
+	details := strings.Join(s.renderDetails(), "\n")
+	if strings.ContainsAny(details, "\x1b\x07\x00\r\x7f") || !strings.Contains(details, "Line]0;title\nother") {
+		t.Fatalf("Wrong details: %q", details)
+	}
+}
+
+func TestPatchSelectFailures(t *testing.T) {
+	defer setupTemporaryCache(t)()
+
+	ctx := commandContext("patch", "--select")
+	currentContext = ctx
+	defer func() { currentContext = nil }()
+
+	tests := []struct {
+		output, err string
+	}{
+		{"", "could not fetch the patches needed by opensuse:13.2"},
+		{strings.Replace(patchListOutput, `status="needed"`, `status="applied"`, -1), "opensuse:13.2 does not need any patch"},
+		{patchListOutput, "the --select flag needs a terminal"},
+	}
+	for _, test := range tests {
+		mc := &mockClient{logOutput: test.output}
+		safeClient.client = mc
+
+		var err error
+		capture.All(func() { _, _, err = updatePatchImage("patch", "opensuse:13.2", "new:1.0", ctx) })
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected '%s', got: %v", test.err, err)
+		}
+		if mc.lastCommit.ContainerID != "" {
+			t.Fatal("Nothing should have been committed")
+		}
+	}
+
+	setupTestExitStatus()
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { updatePatchCmd("patch", commandContext("patch", "--select", "--dry-run", "opensuse:13.2")) })
+	if lastCode != 1 || !strings.Contains(buffer.String(), "cannot be used with --repository nor with --dry-run") {
+		t.Fatalf("Unexpected failure (%d): %s", lastCode, buffer.String())
+	}
+}
@@ -36,6 +36,8 @@ func listenSignals() {
 				syscall.SIGTERM:
 				log.Printf("Signal '%v' received: shutting down gracefully.", sig)
 				killChannel <- true
+			case syscall.SIGWINCH:
+				// Followed by the containers running with a TTY.
 			default:
 				log.Printf("Signal '%v' not handled. Doing nothing...", sig)
 			}
@@ -0,0 +1,56 @@
+require_relative "helper"
+
+describe "push operations" do
+  before :all do
+    @registry_container = unique_name("zypper_docker_registry")
+    @registry           = "localhost:5000"
+
+    pull_image("registry:2")
+    Cheetah.run(
+      "docker", "run",
+      "-d",
+      "-p", "5000:5000",
+      "--name", @registry_container,
+      "registry:2")
+
+    @pushed_image_repo = "#{@registry}/zypper-docker-pushed-image"
+    @pushed_image_tag  = unique_name("1.0")
+    @pushed_image      = "#{@pushed_image_repo}:#{@pushed_image_tag}"
+  end
+
+  after :all do
+    kill_and_remove_container(@registry_container)
+    if docker_image_exists?(@pushed_image_repo, @pushed_image_tag)
+      remove_docker_image(@pushed_image)
+    end
+  end
+
+  it "refuses to push images not created by zypper-docker" do
+    begin
+      Cheetah.run("zypper-docker", "push", Settings::VULNERABLE_IMAGE, stdout: :capture)
+      fail "it should have failed"
+    rescue Cheetah::ExecutionFailed => e
+      expect(e.stdout).to include("has not been created by zypper-docker")
+    end
+  end
+
+  it "pushes the new image to the registry" do
+    output = Cheetah.run(
+      "zypper-docker", "patch",
+      "--push",
+      Settings::VULNERABLE_IMAGE,
+      @pushed_image,
+      stdout: :capture)
+    expect(output).to include("#{@pushed_image} pushed with digest sha256:")
+    digest = output[/pushed with digest (sha256:[0-9a-f]+)/, 1]
+
+    # The registry serves the image under the reported digest. Note that the
+    # pull is performed by the daemon, so "localhost" refers to its host.
+    Cheetah.run("docker", "pull", "#{@pushed_image_repo}@#{digest}")
+  end
+
+  it "pushes an image created by zypper-docker again" do
+    output = Cheetah.run("zypper-docker", "push", @pushed_image, stdout: :capture)
+    expect(output).to include("#{@pushed_image} pushed with digest sha256:")
+  end
+end
@@ -0,0 +1,609 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// savedManifest is an entry of the manifest.json file of the archives produced
+// by `docker save`.
+type savedManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageRootFS contains the layers of an image as described by its
+// configuration.
+type imageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// imageHistory is an entry of the history of an image as described by its
+// configuration.
+type imageHistory struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// layerFilter keeps track of the changes done by the upper layers while
+// merging layers from the top to the bottom. A change of a lower layer is
+// dropped if an upper layer has overridden or removed it.
+type layerFilter struct {
+	// The paths written by the upper layers, and whether they are directories.
+	written map[string]bool
+
+	// The paths removed by the upper layers, and the directories whose
+	// contents from lower layers have been hidden (opaque directories).
+	removed map[string]bool
+	opaque  map[string]bool
+}
+
+// hidden returns true if the given path has been removed by an upper layer,
+// either directly or through one of its parent directories.
+func (f *layerFilter) hidden(p string) bool {
+	if f.removed[p] {
+		return true
+	}
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if f.removed[dir] || f.opaque[dir] {
+			return true
+		}
+		if isDir, ok := f.written[dir]; ok && !isDir {
+			return true
+		}
+	}
+	return false
+}
+
+// mergePlan describes which entries of the layers being merged end up in the
+// merged layer.
+type mergePlan struct {
+	// The layer from which each path of the merged layer is taken.
+	kept map[string]int
+
+	// For each layer, the paths whose contents are needed to turn its hard
+	// links into regular files, because their targets are not kept.
+	copies []map[string]bool
+}
+
+// planMerge returns the plan for merging the layers stored in the given paths,
+// which are ordered from the bottom to the top. Layers are walked from the top
+// to the bottom, and only the first occurrence of each path is kept.
+func planMerge(layers []string) (*mergePlan, error) {
+	plan := &mergePlan{kept: make(map[string]int), copies: make([]map[string]bool, len(layers))}
+	f := &layerFilter{
+		written: make(map[string]bool),
+		removed: make(map[string]bool),
+		opaque:  make(map[string]bool),
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		// Whiteouts only affect the layers below the one containing them.
+		removed, opaque := []string{}, []string{}
+		paths, links := make(map[string]bool), make(map[string]string)
+
+		file, err := os.Open(layers[i])
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(file)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				_ = file.Close()
+				return nil, fmt.Errorf("could not read layer %s: %v", layers[i], err)
+			}
+
+			p := path.Clean(hdr.Name)
+			paths[p] = true
+			if _, ok := f.written[p]; ok || f.hidden(p) || strings.HasPrefix(p, archive.WhiteoutLinkDir+"/") {
+				continue
+			}
+			dir, base := path.Split(p)
+			dir = path.Clean(dir)
+			switch {
+			case base == archive.WhiteoutOpaqueDir:
+				opaque = append(opaque, dir)
+			case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+				continue
+			case strings.HasPrefix(base, archive.WhiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix))
+				if _, ok := f.written[target]; ok {
+					continue
+				}
+				removed = append(removed, target)
+			}
+
+			if hdr.Typeflag == tar.TypeLink {
+				links[p] = path.Clean(hdr.Linkname)
+			}
+			plan.kept[p] = i
+			f.written[p] = hdr.Typeflag == tar.TypeDir
+		}
+		_ = file.Close()
+
+		for _, target := range links {
+			if l, ok := plan.kept[target]; paths[target] && (!ok || l != i) {
+				if plan.copies[i] == nil {
+					plan.copies[i] = make(map[string]bool)
+				}
+				plan.copies[i][target] = true
+			}
+		}
+		for _, p := range removed {
+			f.removed[p] = true
+		}
+		for _, p := range opaque {
+			f.opaque[p] = true
+		}
+	}
+	return plan, nil
+}
+
+// mergeLayers writes into w a single layer with the same contents as the
+// layers stored in the given paths, which are ordered from the bottom to the
+// top. Whiteouts are kept, since they might affect the layers below the
+// merged ones.
+//
+// The hard links of a layer are written after the rest of its entries, so
+// their targets come first. A hard link whose target is not kept, because an
+// upper layer has overridden or removed it, becomes a regular file with the
+// contents of its target.
+func mergeLayers(layers []string, w io.Writer) error {
+	plan, err := planMerge(layers)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "zypper-docker-merge")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tw := tar.NewWriter(w)
+	// Links whose target comes from another layer, which are written at the
+	// very end.
+	pending := []*tar.Header{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		links, err := mergeLayer(layers[i], i, plan, dir, tw)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, links...)
+	}
+	for _, hdr := range pending {
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// mergeLayer writes into tw the entries of the layer stored in the given path,
+// which is the i-th one, that are kept by the plan. The contents of the
+// targets of the links that have to be turned into regular files are kept in
+// dir meanwhile. It returns the links whose target is not in this layer.
+func mergeLayer(layer string, i int, plan *mergePlan, dir string, tw *tar.Writer) ([]*tar.Header, error) {
+	file, err := os.Open(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	links, pending := []*tar.Header{}, []*tar.Header{}
+	copies := make(map[string]string)
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read layer %s: %v", layer, err)
+		}
+
+		p := path.Clean(hdr.Name)
+		if plan.copies[i][p] {
+			copies[p] = filepath.Join(dir, strconv.Itoa(len(copies)))
+			if err = copyEntry(copies[p], tr); err != nil {
+				return nil, err
+			}
+		}
+		if l, ok := plan.kept[p]; !ok || l != i {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			target := path.Clean(hdr.Linkname)
+			if l, ok := plan.kept[target]; (ok && l == i) || plan.copies[i][target] {
+				links = append(links, hdr)
+			} else {
+				pending = append(pending, hdr)
+			}
+			continue
+		}
+
+		if copies[p] != "" {
+			err = writeFileEntry(tw, hdr, copies[p])
+		} else if err = tw.WriteHeader(hdr); err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hdr := range links {
+		target := path.Clean(hdr.Linkname)
+		if l, ok := plan.kept[target]; ok && l == i {
+			err = tw.WriteHeader(hdr)
+		} else {
+			link := *hdr
+			link.Typeflag, link.Linkname = tar.TypeReg, ""
+			err = writeFileEntry(tw, &link, copies[target])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// copyEntry writes the contents read from r into a new file at the given path.
+func copyEntry(name string, r io.Reader) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileEntry writes into tw the given header with the contents of the
+// file at the given path.
+func writeFileEntry(tw *tar.Writer, hdr *tar.Header, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Size = info.Size()
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// squashHistory returns the given history with the entries of the last n
+// layers merged into a single one.
+func squashHistory(history []imageHistory, n, layers int) ([]imageHistory, error) {
+	nonEmpty := 0
+	for _, h := range history {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != layers {
+		return nil, fmt.Errorf("the history of the image does not match its layers")
+	}
+
+	i := len(history)
+	for left := n; left > 0; {
+		i--
+		if !history[i].EmptyLayer {
+			left--
+		}
+	}
+	last := history[len(history)-1]
+	merged := imageHistory{
+		Created:   last.Created,
+		CreatedBy: fmt.Sprintf("zypper-docker squash of %d layers", n),
+		Author:    last.Author,
+		Comment:   last.Comment,
+	}
+	return append(history[:i:i], merged), nil
+}
+
+// extractArchive extracts the regular files and the directories of the given
+// archive into dir. Symbolic links are extracted as hard links to their
+// targets once everything else has been extracted, so there is never a
+// symbolic link inside of dir that could be followed outside of it.
+func extractArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	links := [][2]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("invalid path in the archive: %s", hdr.Name)
+		}
+		dst := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dst, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			var file *os.File
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if file, err = os.Create(dst); err == nil {
+				_, err = io.Copy(file, tr)
+				if cerr := file.Close(); err == nil {
+					err = cerr
+				}
+			}
+		case tar.TypeSymlink:
+			// Layers shared by many images might be linked.
+			target := filepath.Join(filepath.Dir(name), hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) || strings.HasPrefix(target, "..") {
+				return fmt.Errorf("invalid link in the archive: %s", hdr.Name)
+			}
+			links = append(links, [2]string{name, target})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Since there are no symbolic links inside of dir, the targets are
+	// resolved as they are written.
+	for _, l := range links {
+		dst, target := filepath.Join(dir, l[0]), filepath.Join(dir, l[1])
+		info, err := os.Lstat(target)
+		if err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("invalid link in the archive: %s", l[0])
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+			err = os.Link(target, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchive writes an archive into w with the given files, as stored in
+// dir. The files are given with their path relative to dir.
+func writeArchive(w io.Writer, dir string, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, name := range files {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Mode:     0644,
+				Size:     info.Size(),
+				ModTime:  info.ModTime(),
+				Typeflag: tar.TypeReg,
+			})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, file)
+		}
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// squashConfig returns the given configuration of an image with its last n
+// layers replaced by the one with the given diff ID.
+func squashConfig(data []byte, n int, diffID string) ([]byte, error) {
+	config := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	var rootfs imageRootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("could not read the layers of the image: %v", err)
+	}
+	layers := len(rootfs.DiffIDs)
+	rootfs.DiffIDs = append(rootfs.DiffIDs[:layers-n:layers-n], diffID)
+
+	var history []imageHistory
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("could not read the history of the image: %v", err)
+		}
+	}
+	if len(history) > 0 {
+		var err error
+		if history, err = squashHistory(history, n, layers); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	if config["history"], err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+// saveImage extracts the image with the given ID, as saved by the daemon, into
+// dir. It returns its manifest.
+func saveImage(id, dir string) (savedManifest, error) {
+	client := getDockerClient()
+
+	body, err := client.ImageSave([]string{id})
+	if err != nil {
+		return savedManifest{}, fmt.Errorf("could not save the image: %v", err)
+	}
+	err = extractArchive(body, dir)
+	_ = body.Close()
+	if err != nil {
+		return savedManifest{}, fmt.Errorf("could not extract the image: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return savedManifest{}, fmt.Errorf("could not read the manifest of the image: %v", err)
+	}
+	var manifests []savedManifest
+	if err = json.Unmarshal(data, &manifests); err != nil || len(manifests) != 1 {
+		return savedManifest{}, fmt.Errorf("unexpected manifest for the image")
+	}
+	return manifests[0], nil
+}
+
+// loadArchive loads into the daemon the image described by the given
+// manifest, whose files are stored in dir.
+func loadArchive(dir string, m savedManifest) error {
+	client := getDockerClient()
+
+	data, err := json.Marshal([]savedManifest{m})
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "manifest.json"), data, 0644); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		files := append([]string{"manifest.json", m.Config}, m.Layers...)
+		_ = pw.CloseWithError(writeArchive(pw, dir, files))
+	}()
+	resp, err := client.ImageLoad(pr)
+	_ = pr.Close()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.JSON {
+		return jsonmessage.DisplayJSONMessagesStream(resp.Body, ioutil.Discard, 0, false, nil)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// squashImage merges the last n layers of the image with the given ID, which
+// is known as repo:tag, into a single one. The configuration and the labels of
+// the image are kept. The resulting image takes the repo:tag name, and the
+// original one is removed. It returns the ID of the new image.
+func squashImage(id, repo, tag string, n int) (string, error) {
+	dir, err := ioutil.TempDir("", "zypper-docker-squash")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Fetch the image.
+	m, err := saveImage(id, dir)
+	if err != nil {
+		return "", err
+	}
+	if n > len(m.Layers) {
+		n = len(m.Layers)
+	}
+	base := m.Layers[:len(m.Layers)-n]
+
+	// Merge its last layers.
+	squashed, err := os.Create(filepath.Join(dir, "squashed.tar"))
+	if err != nil {
+		return "", err
+	}
+	layers := []string{}
+	for _, l := range m.Layers[len(base):] {
+		layers = append(layers, filepath.Join(dir, filepath.Clean(l)))
+	}
+	hash := sha256.New()
+	err = mergeLayers(layers, io.MultiWriter(squashed, hash))
+	if cerr := squashed.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not merge the layers: %v", err)
+	}
+
+	// Update its configuration.
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.Clean(m.Config)))
+	if err != nil {
+		return "", fmt.Errorf("could not read the configuration of the image: %v", err)
+	}
+	data, err = squashConfig(data, n, "sha256:"+hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	newID := "sha256:" + hex.EncodeToString(sum[:])
+	config := hex.EncodeToString(sum[:]) + ".json"
+	if err = ioutil.WriteFile(filepath.Join(dir, config), data, 0644); err != nil {
+		return "", err
+	}
+	m = savedManifest{
+		Config:   config,
+		RepoTags: []string{repo + ":" + tag},
+		Layers:   append(base[:len(base):len(base)], "squashed.tar"),
+	}
+
+	// And load it back.
+	if err = loadArchive(dir, m); err != nil {
+		return "", fmt.Errorf("could not load the squashed image: %v", err)
+	}
+
+	// The original image is no longer referenced.
+	if err = untagImage(id); err != nil {
+		log.Printf("Could not remove the image %s: %v", id, err)
+	}
+	return newID, nil
+}
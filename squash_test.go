@@ -0,0 +1,394 @@
+// Copyright (c) 2015 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newArchive returns an archive with the given files, indexed by their name.
+// Names ending with a slash are directories.
+func newArchive(t *testing.T, files map[string]string) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer([]byte{})
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Size, hdr.Typeflag = 0755, 0, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Could not write the archive: %v", err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatalf("Could not write the archive: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Could not write the archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// readArchive returns the files of the given archive, indexed by their name.
+func readArchive(t *testing.T, data []byte) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatalf("Could not read the archive: %v", err)
+		}
+		body, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(body)
+	}
+}
+
+func TestMergeLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-layers")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	layers := []map[string]string{
+		{"a/": "", "a/x": "x", "a/y": "y", "b/z": "z", "c/": "", "c/w": "w", "d": "d"},
+		{"a/.wh.x": "", "a/n": "n", "c/.wh..wh..opq": "", "c/v": "v", "d/": "", "d/e": "e"},
+		{"a/y": "y2", "a/.wh.n": "", "b/.wh.z": "", ".wh..wh.plnk/1": ""},
+	}
+	paths := []string{}
+	for i, l := range layers {
+		path := filepath.Join(dir, string('0'+rune(i))+".tar")
+		if err = ioutil.WriteFile(path, newArchive(t, l), 0644); err != nil {
+			t.Fatalf("Could not write layer: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err = mergeLayers(paths, buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	files := readArchive(t, buf.Bytes())
+
+	expected := map[string]string{
+		"a/": "", "a/y": "y2", "a/.wh.n": "", "b/.wh.z": "", "a/.wh.x": "",
+		"c/": "", "c/.wh..wh..opq": "", "c/v": "v", "d/": "", "d/e": "e",
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("Wrong files: %v", files)
+	}
+	for name, body := range expected {
+		if got, ok := files[name]; !ok || got != body {
+			t.Fatalf("Wrong contents for %s: %v", name, files)
+		}
+	}
+
+	if err = mergeLayers([]string{filepath.Join(dir, "unknown.tar")}, buf); err == nil {
+		t.Fatal("It should fail on missing layers")
+	}
+}
+
+func TestMergeLayersHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-layers")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Each entry is either a file with its contents, or a hard link to the
+	// path after the arrow. The entries are written in this order.
+	layers := [][][2]string{
+		{{"a", "old a"}, {"b", "-> a"}, {"x", "x"}, {"y", "-> x"}, {"t", "t"}},
+		{{"a", "new a"}, {".wh.x", ""}, {"l", "-> m"}, {"m", "m"}, {"u", "-> t"}},
+	}
+	paths := []string{}
+	for i, l := range layers {
+		buf := bytes.NewBuffer([]byte{})
+		tw := tar.NewWriter(buf)
+		for _, e := range l {
+			hdr := &tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1])), Typeflag: tar.TypeReg}
+			if strings.HasPrefix(e[1], "-> ") {
+				hdr.Size, hdr.Typeflag, hdr.Linkname = 0, tar.TypeLink, strings.TrimPrefix(e[1], "-> ")
+			}
+			if err = tw.WriteHeader(hdr); err == nil && hdr.Typeflag == tar.TypeReg {
+				_, err = tw.Write([]byte(e[1]))
+			}
+			if err != nil {
+				t.Fatalf("Could not write the archive: %v", err)
+			}
+		}
+		_ = tw.Close()
+		path := filepath.Join(dir, string('0'+rune(i))+".tar")
+		if err = ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Could not write layer: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err = mergeLayers(paths, buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Every link comes after its target, and the links whose target has been
+	// overridden or removed keep the contents the target had in their layer.
+	written := make(map[string]bool)
+	entries := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Could not read the archive: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			if !written[hdr.Linkname] {
+				t.Fatalf("The link %s comes before its target %s", hdr.Name, hdr.Linkname)
+			}
+			entries[hdr.Name] = "-> " + hdr.Linkname
+		} else {
+			body, _ := ioutil.ReadAll(tr)
+			entries[hdr.Name] = string(body)
+		}
+		written[hdr.Name] = true
+	}
+
+	expected := map[string]string{
+		"a": "new a", "b": "old a", ".wh.x": "", "y": "x", "t": "t",
+		"l": "-> m", "m": "m", "u": "-> t",
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Wrong entries: %v", entries)
+	}
+	for name, body := range expected {
+		if got, ok := entries[name]; !ok || got != body {
+			t.Fatalf("Wrong entry %s: %v", name, entries)
+		}
+	}
+}
+
+// symlinkArchive returns an archive with the given entries, written in this
+// order. Each entry is either a file with its contents, or a symbolic link to
+// the path after the arrow.
+func symlinkArchive(t *testing.T, entries [][2]string) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1])), Typeflag: tar.TypeReg}
+		if strings.HasPrefix(e[1], "-> ") {
+			hdr.Size, hdr.Typeflag, hdr.Linkname = 0, tar.TypeSymlink, strings.TrimPrefix(e[1], "-> ")
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Could not write the archive: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e[1])); err != nil {
+				t.Fatalf("Could not write the archive: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Could not write the archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	parent, err := ioutil.TempDir("", "zypper-docker-extract")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(parent) }()
+
+	// Shared layers are linked, even before their target is extracted.
+	dir := filepath.Join(parent, "ok")
+	data := symlinkArchive(t, [][2]string{
+		{"b/layer.tar", "-> ../a/layer.tar"}, {"a/layer.tar", "layer"},
+	})
+	if err = extractArchive(bytes.NewReader(data), dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "b", "layer.tar"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("The link should be a regular file: %v", err)
+	}
+	if body, _ := ioutil.ReadFile(filepath.Join(dir, "b", "layer.tar")); string(body) != "layer" {
+		t.Fatalf("Wrong contents: %s", body)
+	}
+
+	// Links cannot be followed to write outside of dir.
+	tests := [][][2]string{
+		{{"c", "-> ."}, {"a", "-> c/.."}, {"a/l", "-> .."}, {"a/l/escaped", "x"}},
+		{{"a", "-> c/.."}, {"a/escaped", "x"}},
+		{{"a", "-> ../escaped"}},
+		{{"../escaped", "x"}},
+	}
+	for i, test := range tests {
+		dir = filepath.Join(parent, "dirs", strconv.Itoa(i), "dir")
+		if err = extractArchive(bytes.NewReader(symlinkArchive(t, test)), dir); err == nil {
+			t.Fatalf("[%d] It should have failed", i)
+		}
+		if _, err = os.Lstat(filepath.Join(dir, "..", "escaped")); !os.IsNotExist(err) {
+			t.Fatalf("[%d] A file has been written outside of the directory: %v", i, err)
+		}
+		if _, err = os.Lstat(filepath.Join(dir, "..", "..", "escaped")); !os.IsNotExist(err) {
+			t.Fatalf("[%d] A file has been written outside of the directory: %v", i, err)
+		}
+	}
+}
+
+func TestSquashHistory(t *testing.T) {
+	history := []imageHistory{
+		{CreatedBy: "base"},
+		{CreatedBy: "env", EmptyLayer: true},
+		{CreatedBy: "zypper patch", Comment: "first"},
+		{CreatedBy: "label", EmptyLayer: true},
+		{CreatedBy: "zypper patch", Comment: "second", Author: "me"},
+	}
+
+	squashed, err := squashHistory(history, 2, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(squashed) != 3 || squashed[1].CreatedBy != "env" {
+		t.Fatalf("Wrong history: %+v", squashed)
+	}
+	last := squashed[2]
+	if last.CreatedBy != "zypper-docker squash of 2 layers" || last.Comment != "second" || last.Author != "me" || last.EmptyLayer {
+		t.Fatalf("Wrong entry: %+v", last)
+	}
+	if history[2].Comment != "first" {
+		t.Fatal("The original history should not have been modified")
+	}
+
+	if _, err = squashHistory(history, 2, 4); err == nil {
+		t.Fatal("It should fail when the history does not match the layers")
+	}
+}
+
+// savedImage returns an archive like the ones produced by `docker save` for
+// an image with three layers.
+func savedImage(t *testing.T) []byte {
+	config := `{"architecture":"amd64","config":{"Labels":{"com.suse.zypper-docker.command":"patch"}},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:1","sha256:2","sha256:3"]},` +
+		`"history":[{"created_by":"base"},{"created_by":"zypper","comment":"a"},{"created_by":"zypper","comment":"b"}]}`
+	return newArchive(t, map[string]string{
+		"manifest.json":  `[{"Config":"cfg.json","RepoTags":["opensuse:13.2"],"Layers":["1/layer.tar","2/layer.tar","3/layer.tar"]}]`,
+		"cfg.json":       config,
+		"1/":             "",
+		"1/layer.tar":    string(newArchive(t, map[string]string{"etc/os-release": "openSUSE"})),
+		"2/layer.tar":    string(newArchive(t, map[string]string{"usr/bin/bash": "bash 1"})),
+		"3/layer.tar":    string(newArchive(t, map[string]string{"usr/bin/bash": "bash 2"})),
+		"1/VERSION":      "1.0",
+		"3/json":         "{}",
+		"repositories":   "{}",
+		"unused/VERSION": "1.0",
+	})
+}
+
+func TestSquashImage(t *testing.T) {
+	mc := &mockClient{savedImage: savedImage(t)}
+	safeClient.client = mc
+
+	id, err := squashImage("fake image ID", "new", "1.0", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = compareStringSlices(mc.removedImages, []string{"fake image ID"}); err != nil {
+		t.Fatalf("The original image should have been removed: %v", err)
+	}
+
+	files := readArchive(t, mc.loadedImage)
+	var manifests []savedManifest
+	if err = json.Unmarshal([]byte(files["manifest.json"]), &manifests); err != nil || len(manifests) != 1 {
+		t.Fatalf("Wrong manifest (%v): %s", err, files["manifest.json"])
+	}
+	m := manifests[0]
+	if compareStringSlices(m.RepoTags, []string{"new:1.0"}) != nil ||
+		compareStringSlices(m.Layers, []string{"1/layer.tar", "squashed.tar"}) != nil {
+		t.Fatalf("Wrong manifest: %+v", m)
+	}
+	if layer := readArchive(t, []byte(files["squashed.tar"])); len(layer) != 1 || layer["usr/bin/bash"] != "bash 2" {
+		t.Fatalf("Wrong squashed layer: %v", layer)
+	}
+
+	config := files[m.Config]
+	sum := sha256.Sum256([]byte(config))
+	if id != "sha256:"+hex.EncodeToString(sum[:]) || m.Config != hex.EncodeToString(sum[:])+".json" {
+		t.Fatalf("Wrong ID %s for the configuration %s", id, m.Config)
+	}
+	data := struct {
+		Architecture string
+		Config       struct{ Labels map[string]string }
+		RootFS       imageRootFS    `json:"rootfs"`
+		History      []imageHistory `json:"history"`
+	}{}
+	if err = json.Unmarshal([]byte(config), &data); err != nil {
+		t.Fatalf("Could not decode the configuration: %v", err)
+	}
+	if data.Architecture != "amd64" || data.Config.Labels["com.suse.zypper-docker.command"] != "patch" {
+		t.Fatalf("The configuration has not been kept: %s", config)
+	}
+	layer := sha256.Sum256([]byte(files["squashed.tar"]))
+	if len(data.RootFS.DiffIDs) != 2 || data.RootFS.DiffIDs[0] != "sha256:1" ||
+		data.RootFS.DiffIDs[1] != "sha256:"+hex.EncodeToString(layer[:]) {
+		t.Fatalf("Wrong layers: %v", data.RootFS.DiffIDs)
+	}
+	if len(data.History) != 2 || data.History[1].Comment != "b" {
+		t.Fatalf("Wrong history: %+v", data.History)
+	}
+}
+
+func TestSquashImageFailures(t *testing.T) {
+	safeClient.client = &mockClient{}
+	if _, err := squashImage("fake image ID", "new", "1.0", 2); err == nil || !strings.Contains(err.Error(), "Save failed") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	mc := &mockClient{savedImage: savedImage(t), loadFail: true}
+	safeClient.client = mc
+	if _, err := squashImage("fake image ID", "new", "1.0", 2); err == nil || !strings.Contains(err.Error(), "Load failed") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(mc.removedImages) != 0 {
+		t.Fatalf("The original image should have been kept: %v", mc.removedImages)
+	}
+
+	safeClient.client = &mockClient{savedImage: newArchive(t, map[string]string{"../evil": ""})}
+	if _, err := squashImage("fake image ID", "new", "1.0", 2); err == nil || !strings.Contains(err.Error(), "invalid path") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -16,12 +16,22 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
 	"syscall"
 	"unsafe"
 
+	"github.com/docker/docker/pkg/term"
 	"github.com/docker/engine-api/types"
 )
 
+// Returns true if the standard output is a terminal. Otherwise containers are
+// created without a TTY, so their stdout and stderr can be told apart and no
+// progress bars end up in the output.
+func stdoutIsTerminal() bool {
+	return term.IsTerminal(os.Stdout.Fd())
+}
+
 // Resize the TTY of the container with the given id to the size of the current
 // TTY.
 func resizeTty(id string) {
@@ -42,6 +52,31 @@ func resizeTty(id string) {
 	}
 }
 
+// Resize the TTY of the container with the given id now and every time that
+// the current TTY is resized, until the returned function is called.
+func followTtySize(id string) func() {
+	resizeTty(id)
+
+	c := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		for {
+			select {
+			case <-c:
+				resizeTty(id)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
 // Get the size of the current TTY. On error, the returned values will be zero
 // and the error itself will be logged.
 func getTtySize() (int, int) {
@@ -38,3 +38,8 @@ func listUpdates(image string, ctx *cli.Context) {
 func updateCmd(ctx *cli.Context) {
 	updatePatchCmd("up", ctx)
 }
+
+// zypper-docker update-container [flags] <container> <new-image>
+func updateContainerCmd(ctx *cli.Context) {
+	updatePatchContainerCmd("up", ctx)
+}
@@ -25,12 +25,23 @@ func TestUpdateCommand(t *testing.T) {
 		{"List Command fails", &mockClient{listFail: true}, 1, []string{"ori", "opensuse:13.2"}, true, "Cannot proceed safely: List Failed.", ""},
 		{"Overwrite detected", &mockClient{}, 1, []string{"ori", "opensuse:13.2"}, true, "Cannot overwrite an existing image. Please use a different repository/tag.", ""},
 		{"Start fail on commit", &mockClient{startFail: true}, 1, []string{"ori", "new:1.0.0"}, true, "Could not commit to the new image: Start failed.", ""},
-		{"Cannot update cache", &mockClient{}, 1, []string{"ori", "new:1.0.0"}, false, "Cannot add image details to zypper-docker cache", ""},
+		{"Cannot update cache", &mockClient{}, 0, []string{"ori", "new:1.0.0"}, false, "Cannot add image details to zypper-docker cache", ""},
 		{"Update success", &mockClient{listReturnOneImage: true}, 0, []string{"opensuse:13.2", "new:1.0.0"}, true, "new:1.0.0 successfully created", ""},
 	}
 	cases.run(t, updateCmd, "zypper -n up", "")
 }
 
+// UPDATE CONTAINER
+
+func TestUpdateContainerCommand(t *testing.T) {
+	cases := testCases{
+		{"Wrong number of arguments", &mockClient{}, 1, []string{}, true, "Wrong invocation: expected 2 arguments, 0 given.", ""},
+		{"Cannot inspect", &mockClient{inspectFail: true}, 1, []string{"suse", "new:1.0.0"}, true, "could not inspect image '2': inspect fail", ""},
+		{"Update success", &mockClient{listReturnOneImage: true}, 0, []string{"suse", "new:1.0.0"}, true, "new:1.0.0 successfully created", ""},
+	}
+	cases.run(t, updateContainerCmd, "zypper -n up", "")
+}
+
 // LIST UPDATES
 
 func TestListUpdatesCommand(t *testing.T) {
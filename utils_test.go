@@ -20,7 +20,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -60,6 +63,76 @@ func testContext(args []string, force bool) *cli.Context {
 	return c
 }
 
+// testContextWithFlags returns a context in which the given boolean flags have
+// been defined (and set to false unless given in args).
+func testContextWithFlags(args []string, boolFlags ...string) *cli.Context {
+	set := flag.NewFlagSet("test", 0)
+	c := cli.NewContext(nil, set, nil)
+	for _, name := range boolFlags {
+		set.Bool(name, false, "doc")
+	}
+	err := set.Parse(args)
+	if err != nil {
+		log.Fatal("Cannot parse cli options", err)
+	}
+	return c
+}
+
+// commandContext returns the context of the given zypper-docker command as if
+// it had been called with the given arguments. The flags are the ones the
+// command defines in newApp, so the arguments cannot contain a flag that the
+// real command does not accept.
+func commandContext(name string, args ...string) *cli.Context {
+	return globalCommandContext(nil, name, args...)
+}
+
+// globalCommandContext works like commandContext, but the given global
+// arguments are parsed as the global flags of zypper-docker.
+func globalCommandContext(global []string, name string, args ...string) *cli.Context {
+	app := newApp()
+	gset := flag.NewFlagSet(app.Name, flag.ContinueOnError)
+	for _, f := range app.Flags {
+		f.Apply(gset)
+	}
+	if err := gset.Parse(global); err != nil {
+		log.Fatal("Cannot parse cli options", err)
+	}
+
+	cmd := app.Command(name)
+	if cmd == nil {
+		log.Fatalf("Unknown command %s", name)
+	}
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, f := range cmd.Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		log.Fatal("Cannot parse cli options", err)
+	}
+	ctx := cli.NewContext(app, set, cli.NewContext(app, gset, nil))
+	ctx.Command = *cmd
+	return ctx
+}
+
+// setupTemporaryCache makes the cache file live inside of a temporary
+// directory. It returns a function that restores everything as it was.
+func setupTemporaryCache(t *testing.T) func() {
+	home := os.Getenv("HOME")
+	dir, err := ioutil.TempDir("", "zypper-docker-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, ".cache"), 0755); err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	_ = os.Setenv("HOME", dir)
+
+	return func() {
+		_ = os.Setenv("HOME", home)
+		_ = os.RemoveAll(dir)
+	}
+}
+
 func compareStringSlices(actual, expected []string) error {
 	if len(actual) != len(expected) {
 		return fmt.Errorf("different size, actual is %d while expected is %d",
@@ -16,15 +16,53 @@
 // in a safe way.
 package main
 
-import "os"
+import (
+	"os"
+	"sync"
+
+	"github.com/docker/docker/pkg/reexec"
+)
 
 var exitWithCode func(code int)
 var killChannel chan bool
 
+// exitHooks are run before exiting, so temporary resources are not left
+// behind when zypper-docker is interrupted.
+var exitHooks struct {
+	sync.Mutex
+	hooks []func()
+}
+
+// onExit registers the given function to be run before exiting.
+func onExit(f func()) {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+
+	exitHooks.hooks = append(exitHooks.hooks, f)
+}
+
+// runExitHooks runs the functions registered with `onExit`.
+func runExitHooks() {
+	exitHooks.Lock()
+	hooks := exitHooks.hooks
+	exitHooks.hooks = nil
+	exitHooks.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
 func main() {
+	// The sandbox of the OCI backend is run by re-executing zypper-docker.
+	if reexec.Init() {
+		return
+	}
 	listenSignals()
+	onExit(removeLiveContainers)
 
 	exitWithCode = func(code int) {
+		runExitHooks()
 		os.Exit(code)
 	}
 